@@ -4,32 +4,110 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
-	"github.com/vgjm/linebot/internal/dynamodriver"
-	"github.com/vgjm/linebot/internal/envs"
+	"github.com/vgjm/linebot/internal/adminapi"
+	"github.com/vgjm/linebot/internal/config"
 	"github.com/vgjm/linebot/internal/linebot"
+	"github.com/vgjm/linebot/internal/metricstore"
+	"github.com/vgjm/linebot/internal/storagedriver"
+	"github.com/vgjm/linebot/pkg/health"
+	"github.com/vgjm/linebot/pkg/metrics"
+	"github.com/vgjm/linebot/pkg/tracing"
 )
 
+// shutdownTimeout bounds Shutdown on SIGTERM, Lambda kills the function 500ms
+// after sending it.
+const shutdownTimeout = 400 * time.Millisecond
+
 func main() {
 	ctx := context.Background()
 
-	storageDriver, err := dynamodriver.New(ctx, dynamodriver.Config{})
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tracerProvider, err := tracing.Setup(ctx, cfg.Tracing.Exporter, "linebot")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v\n", err)
+	}
+
+	if cfg.Storage.Driver != config.StorageDynamoDB {
+		log.Fatalf("Storage driver %q is not supported on lambda\n", cfg.Storage.Driver)
+	}
+	storageDriver, err := storagedriver.OpenDynamoDB(ctx, cfg.Storage)
 	if err != nil {
 		log.Fatalf("Failed to create dynamodb client: %v\n", err)
 	}
+	store, err := storagedriver.Encrypt(ctx, metricstore.New(storageDriver), cfg.Storage.Encryption)
+	if err != nil {
+		log.Fatalf("Failed to set up storage encryption: %v\n", err)
+	}
+	store = storagedriver.Cache(store, cfg.Storage.Cache)
 	lb, err := linebot.New(ctx, &linebot.LineBotConfig{
-		Storage:       storageDriver,
-		ChannelSecret: envs.LineChannelSecret,
-		ChannelToken:  envs.LineChannelToken,
+		Storage:            store,
+		ChannelSecret:      cfg.Line.ChannelSecret,
+		ChannelToken:       cfg.Line.ChannelToken,
+		GeminiApiKey:       cfg.Gemini.ApiKey,
+		GeminiModel:        cfg.Gemini.Model,
+		HistorySize:        cfg.Bot.HistorySize,
+		HistoryTTL:         cfg.Bot.HistoryTTL,
+		RateLimit:          cfg.Bot.RateLimit,
+		PublicURL:          cfg.Bot.PublicURL,
+		Timezone:           cfg.Bot.Timezone,
+		GroupOwners:        cfg.Bot.GroupOwners,
+		Operators:          cfg.Bot.Operators,
+		LeaveBlockedGroups: cfg.Bot.LeaveBlockedGroups,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer lb.Close()
 
 	http.HandleFunc("/", lb.Callback)
+	http.HandleFunc(linebot.ExportPath, lb.Export)
+	health.New(&health.Config{
+		Checks: map[string]health.Check{
+			"storage": func(ctx context.Context) error { return storagedriver.Ping(ctx, store) },
+			"llm":     lb.PingLLM,
+		},
+	}).Register(http.DefaultServeMux)
+	if cfg.Admin.Token != "" {
+		adminapi.New(&adminapi.Config{
+			Storage:    store,
+			Token:      cfg.Admin.Token,
+			Operators:  cfg.Bot.Operators,
+			LeaveGroup: lb.LeaveBlockedGroup,
+		}).Register(http.DefaultServeMux)
+	}
 
-	lambda.Start(httpadapter.New(http.DefaultServeMux).ProxyWithContext)
+	// Nothing scrapes a Lambda function, so the metrics of each invocation are
+	// logged for CloudWatch to pick up instead. Spans are exported before the
+	// function is frozen.
+	emf := metrics.NewEMF(os.Stdout)
+	proxy := httpadapter.New(http.DefaultServeMux).ProxyWithContext
+	handler := func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		defer func() {
+			if err := emf.Flush(); err != nil {
+				log.Printf("Failed to write metrics: %v\n", err)
+			}
+			if err := tracerProvider.ForceFlush(ctx); err != nil {
+				log.Printf("Failed to export traces: %v\n", err)
+			}
+		}()
+		return proxy(ctx, req)
+	}
+	// lambda.Start never returns. Events still being handled when an invocation
+	// timed out are drained, or their chats apologized to, on SIGTERM instead.
+	lambda.StartWithOptions(handler, lambda.WithEnableSIGTERM(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := lb.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down: %v\n", err)
+		}
+	}))
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vgjm/linebot/internal/backup"
+	"github.com/vgjm/linebot/internal/config"
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/internal/storagedriver"
+)
+
+// openStorage opens the configured storage with encryption, so that archives
+// hold plaintext and can be restored under other keys.
+func openStorage(ctx context.Context, cfg *config.Config) (storage.Storage, func(), error) {
+	driver, err := storagedriver.Open(ctx, cfg.Storage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create storage driver: %w", err)
+	}
+	closeDriver := func() {
+		if closer, ok := driver.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	s, err := storagedriver.Encrypt(ctx, driver, cfg.Storage.Encryption)
+	if err != nil {
+		closeDriver()
+		return nil, nil, fmt.Errorf("failed to set up storage encryption: %w", err)
+	}
+	return s, closeDriver, nil
+}
+
+func runBackup(ctx context.Context, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("o", "-", "archive file to write, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s, closeStorage, err := openStorage(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	w := os.Stdout
+	if *output != "-" {
+		// The archive holds decrypted instructions and history.
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	stats, err := backup.Backup(ctx, s, w)
+	fmt.Fprintf(os.Stderr, "backed up %v\n", stats)
+	if err != nil || w == os.Stdout {
+		return err
+	}
+	return w.Sync()
+}
+
+func runRestore(ctx context.Context, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := fs.String("i", "-", "archive file to read, - for stdin")
+	overwrite := fs.Bool("overwrite", false, "replace existing items instead of skipping them")
+	dryRun := fs.Bool("dry-run", false, "read the archive and report what would be restored without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s, closeStorage, err := openStorage(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	r := os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	stats, err := backup.Restore(ctx, s, r, backup.RestoreOptions{
+		Overwrite:  *overwrite,
+		HistoryTTL: cfg.Bot.HistoryTTL,
+		DryRun:     *dryRun,
+	})
+	verb := "restored"
+	if *dryRun {
+		verb = "would restore"
+	}
+	fmt.Fprintf(os.Stderr, "%s %v\nskipped existing %v\n", verb, stats.Restored, stats.Skipped)
+	return err
+}
@@ -0,0 +1,56 @@
+// Command linebotctl runs maintenance tasks against the configured storage.
+//
+//	linebotctl [config flags] <command> [command flags]
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/vgjm/linebot/internal/config"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, cfg *config.Config, args []string) error
+}
+
+var commands = map[string]command{
+	"backup":    {"write settings, personas, roles, blocks, history and audit log to an NDJSON archive", runBackup},
+	"restore":   {"load an archive written by backup", runRestore},
+	"migrate":   {"upgrade stored items to the current schema version", runMigrate},
+	"reencrypt": {"re-encrypt stored data under the current master key", runReencrypt},
+}
+
+func main() {
+	ctx := context.Background()
+
+	cfg, args, err := config.LoadStorage(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(ctx, cfg, args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [config flags] <command> [command flags]\n\ncommands:\n", os.Args[0])
+	for _, name := range slices.Sorted(maps.Keys(commands)) {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
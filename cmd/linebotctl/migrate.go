@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/vgjm/linebot/internal/config"
+	"github.com/vgjm/linebot/internal/dynamodriver"
+	"github.com/vgjm/linebot/internal/storagedriver"
+)
+
+func runMigrate(ctx context.Context, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report items that would be upgraded without writing them")
+	table := fs.String("table", "", "comma separated table names to migrate, all when empty")
+	resume := fs.String("resume", "", "resume token printed by an interrupted run")
+	pageSize := fs.Int("page-size", 100, "items read per scan page")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if cfg.Storage.Driver != config.StorageDynamoDB {
+		// SQL drivers apply their migrations on start, the others have no schema.
+		return fmt.Errorf("storage driver %q has no item migrations", cfg.Storage.Driver)
+	}
+	driver, err := storagedriver.OpenDynamoDB(ctx, cfg.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to create dynamodb client: %w", err)
+	}
+
+	opts := dynamodriver.MigrationOptions{
+		DryRun:      *dryRun,
+		ResumeToken: *resume,
+		PageSize:    int32(*pageSize),
+		OnItem: func(table string, key map[string]string, from, to int) {
+			verb := "upgrade"
+			if *dryRun {
+				verb = "would upgrade"
+			}
+			fmt.Printf("%s %s %v: v%d -> v%d\n", verb, table, key, from, to)
+		},
+		OnPage: func(p dynamodriver.MigrationProgress) {
+			fmt.Printf("%s: scanned %d, upgraded %d", p.Table, p.Scanned, p.Upgraded)
+			if p.ResumeToken != "" {
+				fmt.Printf(", resume with -resume %s", p.ResumeToken)
+			}
+			fmt.Println()
+		},
+	}
+	if *table != "" {
+		opts.Tables = strings.Split(*table, ",")
+	}
+	return driver.MigrateItems(ctx, opts)
+}
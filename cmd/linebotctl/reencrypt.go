@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/vgjm/linebot/internal/config"
+	"github.com/vgjm/linebot/internal/encstore"
+	"github.com/vgjm/linebot/internal/storagedriver"
+)
+
+func runReencrypt(ctx context.Context, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "check that every value can be decrypted without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	keys, err := storagedriver.OpenKeyProvider(ctx, cfg.Storage.Encryption)
+	if err != nil {
+		return fmt.Errorf("failed to open key provider: %w", err)
+	}
+	if keys == nil {
+		return errors.New("storage.encryption.provider is not set")
+	}
+	driver, err := storagedriver.Open(ctx, cfg.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to create storage driver: %w", err)
+	}
+	if closer, ok := driver.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	stats, err := encstore.New(driver, keys).Reencrypt(ctx, *dryRun)
+	fmt.Printf("scanned %d, re-encrypted %d, conflicts %d\n", stats.Scanned, stats.Reencrypted, stats.Conflicts)
+	if err != nil {
+		return err
+	}
+	if stats.Conflicts > 0 {
+		return errors.New("some settings changed during the run, run it again")
+	}
+	return nil
+}
@@ -2,33 +2,109 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/vgjm/linebot/internal/dynamodriver"
-	"github.com/vgjm/linebot/internal/envs"
+	"github.com/vgjm/linebot/internal/adminapi"
+	"github.com/vgjm/linebot/internal/config"
+	"github.com/vgjm/linebot/internal/dashboard"
 	"github.com/vgjm/linebot/internal/linebot"
+	"github.com/vgjm/linebot/internal/metricstore"
+	"github.com/vgjm/linebot/internal/storagedriver"
+	"github.com/vgjm/linebot/pkg/health"
+	"github.com/vgjm/linebot/pkg/metrics"
+	"github.com/vgjm/linebot/pkg/tracing"
 )
 
 func main() {
 	ctx := context.Background()
 
-	storageDriver, err := dynamodriver.New(ctx, dynamodriver.Config{})
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
 	if err != nil {
-		log.Fatalf("Failed to create dynamodb client: %v\n", err)
+		log.Fatalf("Failed to load config: %v\n", err)
 	}
+
+	tracerProvider, err := tracing.Setup(ctx, cfg.Tracing.Exporter, "linebot")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v\n", err)
+	}
+	defer tracerProvider.Shutdown(context.Background())
+
+	storageDriver, err := storagedriver.Open(ctx, cfg.Storage)
+	if err != nil {
+		log.Fatalf("Failed to create storage driver: %v\n", err)
+	}
+	if closer, ok := storageDriver.(io.Closer); ok {
+		defer closer.Close()
+	}
+	store, err := storagedriver.Encrypt(ctx, metricstore.New(storageDriver), cfg.Storage.Encryption)
+	if err != nil {
+		log.Fatalf("Failed to set up storage encryption: %v\n", err)
+	}
+	store = storagedriver.Cache(store, cfg.Storage.Cache)
 	lb, err := linebot.New(ctx, &linebot.LineBotConfig{
-		Storage:       storageDriver,
-		ChannelSecret: envs.LineChannelSecret,
-		ChannelToken:  envs.LineChannelToken,
+		Storage:            store,
+		ChannelSecret:      cfg.Line.ChannelSecret,
+		ChannelToken:       cfg.Line.ChannelToken,
+		GeminiApiKey:       cfg.Gemini.ApiKey,
+		GeminiModel:        cfg.Gemini.Model,
+		HistorySize:        cfg.Bot.HistorySize,
+		HistoryTTL:         cfg.Bot.HistoryTTL,
+		RateLimit:          cfg.Bot.RateLimit,
+		PublicURL:          cfg.Bot.PublicURL,
+		Timezone:           cfg.Bot.Timezone,
+		GroupOwners:        cfg.Bot.GroupOwners,
+		Operators:          cfg.Bot.Operators,
+		LeaveBlockedGroups: cfg.Bot.LeaveBlockedGroups,
 	})
 	if err != nil {
 		log.Fatalf("Failed to create line bot client: %v\n", err)
 	}
-	defer lb.Close()
 
 	http.HandleFunc("/", lb.Callback)
+	http.HandleFunc(linebot.ExportPath, lb.Export)
+	health.New(&health.Config{
+		Checks: map[string]health.Check{
+			"storage": func(ctx context.Context) error { return storagedriver.Ping(ctx, store) },
+			"llm":     lb.PingLLM,
+		},
+	}).Register(http.DefaultServeMux)
+	http.Handle("GET /metrics", metrics.Handler())
+	if cfg.Admin.Token != "" {
+		adminapi.New(&adminapi.Config{
+			Storage:    store,
+			Token:      cfg.Admin.Token,
+			Operators:  cfg.Bot.Operators,
+			LeaveGroup: lb.LeaveBlockedGroup,
+		}).Register(http.DefaultServeMux)
+		dashboard.Register(http.DefaultServeMux)
+	}
 
-	http.ListenAndServe(":5000", nil)
+	server := &http.Server{Addr: cfg.Server.Addr}
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to serve: %v\n", err)
+		}
+	}()
 
+	stopCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-stopCtx.Done()
+	log.Printf("Shutting down, waiting up to %s for requests in progress\n", cfg.Server.ShutdownTimeout)
+
+	// Webhook requests return once their events are answered, but events
+	// outlive requests that time out, so the bot waits for them on its own.
+	shutdownCtx, cancel := context.WithTimeout(ctx, cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to finish requests in progress: %v\n", err)
+	}
+	if err := lb.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down the line bot: %v\n", err)
+	}
 }
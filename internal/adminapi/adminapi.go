@@ -0,0 +1,255 @@
+// Package adminapi serves a REST API under /admin/ to manage the settings,
+// personas, quotas and blocks of the bot and read its usage, authenticated
+// with a bearer token.
+package adminapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+const (
+	// Prefix is the path every admin endpoint lives under.
+	Prefix = "/admin/"
+	// Actor is the audit log actor of changes made through the API.
+	Actor = "admin-api"
+
+	defaultPageSize = 50
+	maxPageSize     = 200
+	maxBodySize     = 64 << 10
+)
+
+//go:embed schemas/*.json
+var schemas embed.FS
+
+// API serves the admin endpoints. Bot settings changed through it, such as
+// quotas, reach running bots once their cache of them expires.
+type API struct {
+	storage    storage.Storage
+	tokenHash  [sha256.Size]byte
+	operators  []string
+	leaveGroup func(groupId string)
+	mux        *http.ServeMux
+}
+
+type Config struct {
+	Storage storage.Storage
+	// Token is the bearer token clients send in the Authorization header.
+	Token string
+	// Operators cannot be blocked.
+	Operators []string
+	// LeaveGroup, if set, is called with every group blocked.
+	LeaveGroup func(groupId string)
+}
+
+func New(cfg *Config) *API {
+	a := &API{
+		storage:    cfg.Storage,
+		tokenHash:  sha256.Sum256([]byte(cfg.Token)),
+		operators:  cfg.Operators,
+		leaveGroup: cfg.LeaveGroup,
+		mux:        http.NewServeMux(),
+	}
+	a.routes()
+	return a
+}
+
+// Register serves the API on mux under Prefix.
+func (a *API) Register(mux *http.ServeMux) {
+	mux.Handle(Prefix, a)
+}
+
+func (a *API) routes() {
+	a.mux.HandleFunc("GET /admin/schemas/{name}", a.getSchema)
+
+	a.mux.HandleFunc("GET /admin/users", a.listUserSettings)
+	a.mux.HandleFunc("GET /admin/users/{userId}", a.getUserSetting)
+	a.mux.HandleFunc("PUT /admin/users/{userId}", a.putUserSetting)
+	a.mux.HandleFunc("DELETE /admin/users/{userId}", a.deleteUserSetting)
+
+	a.mux.HandleFunc("GET /admin/groups/{groupId}/settings", a.listGroupUserSettings)
+	a.mux.HandleFunc("GET /admin/groups/{groupId}/settings/{userId}", a.getGroupUserSetting)
+	a.mux.HandleFunc("PUT /admin/groups/{groupId}/settings/{userId}", a.putGroupUserSetting)
+	a.mux.HandleFunc("DELETE /admin/groups/{groupId}/settings/{userId}", a.deleteGroupUserSetting)
+
+	a.mux.HandleFunc("GET /admin/personas", a.listPersonas)
+	a.mux.HandleFunc("GET /admin/personas/{scope}/{name}", a.getPersona)
+	a.mux.HandleFunc("PUT /admin/personas/{scope}/{name}", a.putPersona)
+	a.mux.HandleFunc("DELETE /admin/personas/{scope}/{name}", a.deletePersona)
+
+	a.mux.HandleFunc("GET /admin/quotas", a.listQuotas)
+	a.mux.HandleFunc("PUT /admin/quotas/{scope}", a.putQuota)
+	a.mux.HandleFunc("DELETE /admin/quotas/{scope}", a.deleteQuota)
+
+	a.mux.HandleFunc("GET /admin/blocks", a.listBlocks)
+	a.mux.HandleFunc("GET /admin/blocks/{id}", a.getBlock)
+	a.mux.HandleFunc("PUT /admin/blocks/{id}", a.putBlock)
+	a.mux.HandleFunc("DELETE /admin/blocks/{id}", a.deleteBlock)
+
+	a.mux.HandleFunc("GET /admin/audit", a.listAudit)
+
+	a.mux.HandleFunc("GET /admin/stats", a.getStats)
+}
+
+// ServeHTTP checks the bearer token before routing the request.
+func (a *API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	sum := sha256.Sum256([]byte(token))
+	if !ok || subtle.ConstantTimeCompare(sum[:], a.tokenHash[:]) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	a.mux.ServeHTTP(w, req)
+}
+
+func (a *API) getSchema(w http.ResponseWriter, req *http.Request) {
+	data, err := schemas.ReadFile("schemas/" + strings.TrimSuffix(req.PathValue("name"), ".json") + ".json")
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no such schema")
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(data)
+}
+
+// record appends a change made through the API to the audit log. The change
+// is already made by then, so a failure is only logged.
+func (a *API) record(ctx context.Context, scope, action, oldValue, newValue string) {
+	entry := storage.AuditEntry{
+		Scope:    scope,
+		Time:     time.Now().UTC(),
+		Actor:    Actor,
+		Action:   action,
+		OldHash:  storage.HashValue(oldValue),
+		NewValue: newValue,
+	}
+	if err := a.storage.AppendAudit(ctx, entry); err != nil {
+		slog.Error("Failed to append audit entry", "scope", scope, "actor", Actor, "action", action, "error", err)
+	}
+}
+
+// page is the body of every list response. NextCursor is passed as the cursor
+// query parameter to get the next page, and is empty on the last one.
+type page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// pageSize reads the limit query parameter.
+func pageSize(req *http.Request) (int, error) {
+	value := req.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	return limit, nil
+}
+
+// pageCursor reads the cursor and limit query parameters: the key after which
+// the page starts, and its size.
+func pageCursor(req *http.Request) (string, int, error) {
+	limit, err := pageSize(req)
+	if err != nil {
+		return "", 0, err
+	}
+	after, err := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("cursor"))
+	if err != nil {
+		return "", 0, errors.New("invalid cursor")
+	}
+	return string(after), limit, nil
+}
+
+// listed builds a page from items listed by storage after the cursor, which
+// asked for one more item than limit to tell whether another page follows.
+func listed[T any](items []T, limit int, key func(T) string) page[T] {
+	p := page[T]{Items: items[:min(limit, len(items))]}
+	if len(items) > limit {
+		p.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(key(p.Items[len(p.Items)-1])))
+	}
+	if p.Items == nil {
+		p.Items = []T{}
+	}
+	return p
+}
+
+// paginate returns the page of items after the cursor of req, ordering them
+// by key. The storage scans are unordered, so every page reads every item.
+func paginate[T any](req *http.Request, items []T, key func(T) string) (page[T], error) {
+	after, limit, err := pageCursor(req)
+	if err != nil {
+		return page[T]{}, err
+	}
+	slices.SortFunc(items, func(a, b T) int { return strings.Compare(key(a), key(b)) })
+	start := 0
+	if after != "" {
+		start = len(items)
+		if i := slices.IndexFunc(items, func(item T) bool { return key(item) > after }); i >= 0 {
+			start = i
+		}
+	}
+	return listed(items[start:], limit, key), nil
+}
+
+// decode reads a JSON body, rejecting unknown fields.
+func decode(w http.ResponseWriter, req *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid body: %w", err)
+	}
+	return nil
+}
+
+// versionParam reads the version query parameter DELETE requests carry, the
+// version the client read the resource at.
+func versionParam(req *http.Request) (int64, error) {
+	version, err := strconv.ParseInt(req.URL.Query().Get("version"), 10, 64)
+	if err != nil || version < 1 {
+		return 0, errors.New("the version query parameter is required")
+	}
+	return version, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write admin API response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeStorageError maps storage errors to status codes.
+func writeStorageError(w http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		writeError(w, http.StatusNotFound, "not found")
+	case errors.Is(err, storage.ErrConflict):
+		writeError(w, http.StatusConflict, "version mismatch, read the resource again")
+	default:
+		slog.Error("Admin API request failed", "method", req.Method, "path", req.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
@@ -0,0 +1,271 @@
+package adminapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+const testToken = "0123456789abcdef0123456789abcdef"
+
+func newServer(t *testing.T, s storage.Storage) *httptest.Server {
+	return newServerWith(t, &Config{Storage: s})
+}
+
+func newServerWith(t *testing.T, cfg *Config) *httptest.Server {
+	cfg.Token = testToken
+	mux := http.NewServeMux()
+	New(cfg).Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func do(t *testing.T, server *httptest.Server, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v\n", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v\n", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v\n", err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func userId(i int) string {
+	return fmt.Sprintf("U%032x", i)
+}
+
+func TestAuthentication(t *testing.T) {
+	server := newServer(t, memstore.New())
+	for name, header := range map[string]string{
+		"no token":    "",
+		"wrong token": "Bearer " + strings.Repeat("x", len(testToken)),
+		"basic auth":  "Basic " + testToken,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/admin/users", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("failed to send request: %v\n", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got status %d with %s, expect 401", resp.StatusCode, name)
+		}
+	}
+	if status, _ := do(t, server, http.MethodGet, "/admin/users", ""); status != http.StatusOK {
+		t.Fatalf("got status %d with the token, expect 200", status)
+	}
+}
+
+func TestUserSettingLifecycle(t *testing.T) {
+	store := memstore.New()
+	server := newServer(t, store)
+	path := "/admin/users/" + userId(1)
+
+	status, body := do(t, server, http.MethodPut, path, `{"system_instruction":"be brief","timezone":"Asia/Tokyo","version":0}`)
+	if status != http.StatusOK || !strings.Contains(body, `"version":1`) {
+		t.Fatalf("got %d %s, expect the created setting", status, body)
+	}
+	if status, _ := do(t, server, http.MethodPut, path, `{"system_instruction":"stale","version":0}`); status != http.StatusConflict {
+		t.Fatalf("got status %d for a stale version, expect 409", status)
+	}
+	if status, _ := do(t, server, http.MethodPut, path, `{"system_instruction":"x","timezone":"Mars/Olympus_Mons","version":1}`); status != http.StatusBadRequest {
+		t.Fatalf("got status %d for an unknown time zone, expect 400", status)
+	}
+	if status, _ := do(t, server, http.MethodPut, path, `{"instruction":"typo","version":1}`); status != http.StatusBadRequest {
+		t.Fatalf("got status %d for an unknown field, expect 400", status)
+	}
+
+	status, body = do(t, server, http.MethodGet, path, "")
+	var setting storage.UserSetting
+	if err := json.Unmarshal([]byte(body), &setting); status != http.StatusOK || err != nil {
+		t.Fatalf("got %d %s, expect the setting", status, body)
+	}
+	if setting.SystemInstruction != "be brief" || setting.Timezone != "Asia/Tokyo" || setting.Version != 1 {
+		t.Fatalf("got different setting: %+v\n", setting)
+	}
+
+	if status, _ := do(t, server, http.MethodDelete, path, ""); status != http.StatusBadRequest {
+		t.Fatalf("got status %d for a delete without version, expect 400", status)
+	}
+	if status, _ := do(t, server, http.MethodDelete, path+"?version=1", ""); status != http.StatusNoContent {
+		t.Fatalf("got status %d for a delete, expect 204", status)
+	}
+	if status, _ := do(t, server, http.MethodGet, path, ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d for a deleted setting, expect 404", status)
+	}
+
+	entries, err := store.ListAudit(context.TODO(), storage.UserScope(userId(1)), time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v\n", err)
+	}
+	if len(entries) != 2 || entries[0].Action != "unset instruction" || entries[1].Actor != Actor {
+		t.Fatalf("expect the two changes in the audit log, got: %+v\n", entries)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	store := memstore.New()
+	for i := range 3 {
+		if err := store.UpsertUserSetting(context.TODO(), storage.UserSetting{UserId: userId(i)}); err != nil {
+			t.Fatalf("failed to update user setting: %v\n", err)
+		}
+	}
+	server := newServer(t, store)
+
+	var seen []string
+	cursor := ""
+	for range 3 {
+		status, body := do(t, server, http.MethodGet, "/admin/users?limit=2&cursor="+cursor, "")
+		var p page[storage.UserSetting]
+		if err := json.Unmarshal([]byte(body), &p); status != http.StatusOK || err != nil {
+			t.Fatalf("got %d %s, expect a page", status, body)
+		}
+		for _, setting := range p.Items {
+			seen = append(seen, setting.UserId)
+		}
+		if cursor = p.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if strings.Join(seen, ",") != strings.Join([]string{userId(0), userId(1), userId(2)}, ",") {
+		t.Fatalf("got users %v, expect every user once in order", seen)
+	}
+	if status, _ := do(t, server, http.MethodGet, "/admin/users?limit=1000", ""); status != http.StatusBadRequest {
+		t.Fatalf("got status %d for a page too large, expect 400", status)
+	}
+}
+
+func TestGroupSettingsPagination(t *testing.T) {
+	store := memstore.New()
+	groupId, otherId := fmt.Sprintf("C%032x", 1), fmt.Sprintf("C%032x", 2)
+	for i := range 3 {
+		for _, id := range []string{groupId, otherId} {
+			if err := store.UpsertGroupUserSetting(context.TODO(), storage.GroupUserSetting{GroupId: id, UserId: userId(i)}); err != nil {
+				t.Fatalf("failed to update group user setting: %v\n", err)
+			}
+		}
+	}
+	server := newServer(t, store)
+
+	var seen []string
+	cursor := ""
+	for range 3 {
+		status, body := do(t, server, http.MethodGet, "/admin/groups/"+groupId+"/settings?limit=2&cursor="+cursor, "")
+		var p page[storage.GroupUserSetting]
+		if err := json.Unmarshal([]byte(body), &p); status != http.StatusOK || err != nil {
+			t.Fatalf("got %d %s, expect a page", status, body)
+		}
+		for _, setting := range p.Items {
+			if setting.GroupId != groupId {
+				t.Fatalf("got a setting of another group: %+v\n", setting)
+			}
+			seen = append(seen, setting.UserId)
+		}
+		if cursor = p.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if strings.Join(seen, ",") != strings.Join([]string{userId(0), userId(1), userId(2)}, ",") {
+		t.Fatalf("got users %v, expect every member once in order", seen)
+	}
+}
+
+func TestQuotasAndBlocks(t *testing.T) {
+	store := memstore.New()
+	var left []string
+	server := newServerWith(t, &Config{
+		Storage:    store,
+		Operators:  []string{userId(1)},
+		LeaveGroup: func(groupId string) { left = append(left, groupId) },
+	})
+	groupId := fmt.Sprintf("C%032x", 1)
+
+	if status, body := do(t, server, http.MethodPut, "/admin/quotas/"+groupId, `{"limit":5}`); status != http.StatusOK {
+		t.Fatalf("got %d %s, expect the quota to be set", status, body)
+	}
+	if status, body := do(t, server, http.MethodGet, "/admin/quotas", ""); status != http.StatusOK || !strings.Contains(body, `{"scope":"`+groupId+`","limit":5}`) {
+		t.Fatalf("got %d %s, expect the quota to be listed", status, body)
+	}
+	if status, _ := do(t, server, http.MethodPut, "/admin/quotas/everyone", `{"limit":5}`); status != http.StatusBadRequest {
+		t.Fatalf("got status %d for an unknown scope, expect 400", status)
+	}
+
+	if status, body := do(t, server, http.MethodPut, "/admin/blocks/"+groupId, `{"reason":"spam","expires_at":"2999-01-01T00:00:00Z"}`); status != http.StatusOK {
+		t.Fatalf("got %d %s, expect the group to be blocked", status, body)
+	}
+	block, err := store.GetBlock(context.TODO(), groupId)
+	if err != nil || block.Reason != "spam" || block.CreatedBy != Actor || block.ExpiresAt.Year() != 2999 {
+		t.Fatalf("got block %+v, %v, expect the stored block", block, err)
+	}
+	if len(left) != 1 || left[0] != groupId {
+		t.Fatalf("got left groups %v, expect the blocked group to be left", left)
+	}
+	if status, _ := do(t, server, http.MethodPut, "/admin/blocks/"+userId(1), `{"reason":"oops"}`); status != http.StatusForbidden {
+		t.Fatalf("got status %d for blocking an operator, expect 403", status)
+	}
+	if status, _ := do(t, server, http.MethodPut, "/admin/blocks/everyone", `{}`); status != http.StatusBadRequest {
+		t.Fatalf("got status %d for an invalid id, expect 400", status)
+	}
+	if status, _ := do(t, server, http.MethodDelete, "/admin/blocks/"+groupId, ""); status != http.StatusNoContent {
+		t.Fatalf("got status %d for an unblock, expect 204", status)
+	}
+	if status, _ := do(t, server, http.MethodDelete, "/admin/blocks/"+groupId, ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d for a missing block, expect 404", status)
+	}
+}
+
+func TestStats(t *testing.T) {
+	store := memstore.New()
+	now := time.Now()
+	groupId := fmt.Sprintf("C%032x", 1)
+	for key, value := range map[string]int64{
+		storage.StatsKey(storage.StatMessages, now):                                   10,
+		storage.StatsKey(storage.StatErrors, now):                                     1,
+		storage.StatsKey(storage.StatMessages, now.AddDate(0, 0, -1)):                 5,
+		storage.StatsKey(storage.StatMessages, now.AddDate(0, 0, -storage.StatsDays)): 99,
+		storage.StatsKey(storage.StatGroupPrefix+groupId, now):                        4,
+		storage.StatsKey(storage.StatInputTokensPrefix+"gemini-2.5-flash", now):       300,
+		storage.StatsKey(storage.StatOutputTokensPrefix+"gemini-2.5-flash", now):      20,
+	} {
+		if _, err := store.IncrCounter(context.TODO(), key, value, time.Hour); err != nil {
+			t.Fatalf("failed to increment counter: %v\n", err)
+		}
+	}
+	server := newServer(t, store)
+
+	status, body := do(t, server, http.MethodGet, "/admin/stats", "")
+	var s stats
+	if err := json.Unmarshal([]byte(body), &s); status != http.StatusOK || err != nil {
+		t.Fatalf("got %d %s, expect stats", status, body)
+	}
+	if len(s.Days) != storage.StatsDays || s.Days[0].Messages != 10 || s.Days[0].Errors != 1 || s.Days[1].Messages != 5 {
+		t.Fatalf("got different days: %+v\n", s.Days)
+	}
+	if tokens := s.Days[0].Tokens["gemini-2.5-flash"]; tokens == nil || tokens.Input != 300 || tokens.Output != 20 {
+		t.Fatalf("got different tokens: %+v\n", s.Days[0].Tokens)
+	}
+	if len(s.Groups) != 1 || s.Groups[0] != (groupStats{GroupId: groupId, Messages: 4}) {
+		t.Fatalf("got different groups: %+v\n", s.Groups)
+	}
+}
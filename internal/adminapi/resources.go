@@ -0,0 +1,529 @@
+package adminapi
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// personaName matches the names /persona accepts.
+var personaName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// maxInstructionLength bounds instructions and personas set through the API.
+const maxInstructionLength = 10000
+
+// settingBody is the body of PUT requests on user and group settings.
+// Timezone only applies to user settings.
+type settingBody struct {
+	SystemInstruction string `json:"system_instruction"`
+	Persona           string `json:"persona"`
+	Timezone          string `json:"timezone"`
+	Version           int64  `json:"version"`
+}
+
+func (b settingBody) validate() error {
+	if len(b.SystemInstruction) > maxInstructionLength {
+		return errors.New("system_instruction is too long")
+	}
+	if b.Persona != "" && !personaName.MatchString(b.Persona) {
+		return errors.New("persona is not a valid persona name")
+	}
+	if b.Timezone != "" {
+		if _, err := time.LoadLocation(b.Timezone); err != nil || b.Timezone == "Local" {
+			return errors.New("timezone is not a known IANA time zone")
+		}
+	}
+	if b.Version < 0 {
+		return errors.New("version must not be negative")
+	}
+	return nil
+}
+
+func (a *API) listUserSettings(w http.ResponseWriter, req *http.Request) {
+	var settings []storage.UserSetting
+	if err := a.storage.ScanUserSettings(req.Context(), func(setting storage.UserSetting) error {
+		settings = append(settings, setting)
+		return nil
+	}); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	p, err := paginate(req, settings, func(s storage.UserSetting) string { return s.UserId })
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (a *API) getUserSetting(w http.ResponseWriter, req *http.Request) {
+	setting, err := a.storage.GetUserSetting(req.Context(), req.PathValue("userId"))
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, setting)
+}
+
+func (a *API) putUserSetting(w http.ResponseWriter, req *http.Request) {
+	ctx, userId := req.Context(), req.PathValue("userId")
+	var body settingBody
+	if err := decode(w, req, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !storage.IsUserId(userId) {
+		writeError(w, http.StatusBadRequest, "not a user id")
+		return
+	}
+	old, err := a.storage.GetUserSetting(ctx, userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		old, err = &storage.UserSetting{UserId: userId}, nil
+	}
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	setting := storage.UserSetting{
+		UserId:            userId,
+		SystemInstruction: body.SystemInstruction,
+		Persona:           body.Persona,
+		Timezone:          body.Timezone,
+		Version:           body.Version,
+	}
+	if err := a.storage.UpsertUserSetting(ctx, setting); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, storage.UserScope(userId), "set instruction", old.SystemInstruction, setting.SystemInstruction)
+	setting.Version++
+	writeJSON(w, http.StatusOK, setting)
+}
+
+func (a *API) deleteUserSetting(w http.ResponseWriter, req *http.Request) {
+	ctx, userId := req.Context(), req.PathValue("userId")
+	version, err := versionParam(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	setting, err := a.storage.GetUserSetting(ctx, userId)
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	old := setting.SystemInstruction
+	setting.Version = version
+	if err := a.storage.DeleteUserSetting(ctx, *setting); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, storage.UserScope(userId), "unset instruction", old, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) listGroupUserSettings(w http.ResponseWriter, req *http.Request) {
+	after, limit, err := pageCursor(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	settings, err := a.storage.ListGroupUserSettings(req.Context(), req.PathValue("groupId"), after, limit+1)
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, listed(settings, limit, func(s storage.GroupUserSetting) string { return s.UserId }))
+}
+
+func (a *API) getGroupUserSetting(w http.ResponseWriter, req *http.Request) {
+	setting, err := a.storage.GetGroupUserSetting(req.Context(), req.PathValue("groupId"), req.PathValue("userId"))
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, setting)
+}
+
+// groupSettingAction names a change of the group default, stored under the
+// user id "default", or of a member's instruction.
+func groupSettingAction(verb, userId string) string {
+	if userId == "default" {
+		return verb + " default instruction"
+	}
+	return verb + " instruction of " + userId
+}
+
+func (a *API) putGroupUserSetting(w http.ResponseWriter, req *http.Request) {
+	ctx, groupId, userId := req.Context(), req.PathValue("groupId"), req.PathValue("userId")
+	var body settingBody
+	if err := decode(w, req, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Timezone != "" {
+		writeError(w, http.StatusBadRequest, "timezone is a user setting")
+		return
+	}
+	if !storage.IsGroupId(groupId) || (userId != "default" && !storage.IsUserId(userId)) {
+		writeError(w, http.StatusBadRequest, "not a group id, or neither a user id nor default")
+		return
+	}
+	old, err := a.storage.GetGroupUserSetting(ctx, groupId, userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		old, err = &storage.GroupUserSetting{GroupId: groupId, UserId: userId}, nil
+	}
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	setting := storage.GroupUserSetting{
+		GroupId:           groupId,
+		UserId:            userId,
+		SystemInstruction: body.SystemInstruction,
+		Persona:           body.Persona,
+		Version:           body.Version,
+	}
+	if err := a.storage.UpsertGroupUserSetting(ctx, setting); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, storage.GroupScope(groupId), groupSettingAction("set", userId), old.SystemInstruction, setting.SystemInstruction)
+	setting.Version++
+	writeJSON(w, http.StatusOK, setting)
+}
+
+func (a *API) deleteGroupUserSetting(w http.ResponseWriter, req *http.Request) {
+	ctx, groupId, userId := req.Context(), req.PathValue("groupId"), req.PathValue("userId")
+	version, err := versionParam(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	setting, err := a.storage.GetGroupUserSetting(ctx, groupId, userId)
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	old := setting.SystemInstruction
+	setting.Version = version
+	if err := a.storage.DeleteGroupUserSetting(ctx, *setting); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, storage.GroupScope(groupId), groupSettingAction("unset", userId), old, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listPersonas lists the personas of the scope query parameter, or of every
+// scope when it is empty.
+func (a *API) listPersonas(w http.ResponseWriter, req *http.Request) {
+	var personas []storage.Persona
+	var err error
+	if scope := req.URL.Query().Get("scope"); scope != "" {
+		personas, err = a.storage.ListPersonas(req.Context(), scope)
+	} else {
+		err = a.storage.ScanPersonas(req.Context(), func(persona storage.Persona) error {
+			personas = append(personas, persona)
+			return nil
+		})
+	}
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	p, err := paginate(req, personas, func(p storage.Persona) string { return p.Scope + "\x00" + p.Name })
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (a *API) getPersona(w http.ResponseWriter, req *http.Request) {
+	persona, err := a.storage.GetPersona(req.Context(), req.PathValue("scope"), req.PathValue("name"))
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, persona)
+}
+
+// validScope reports whether scope is a UserScope or GroupScope.
+func validScope(scope string) bool {
+	if userId, ok := strings.CutPrefix(scope, storage.UserScope("")); ok {
+		return storage.IsUserId(userId)
+	}
+	if groupId, ok := strings.CutPrefix(scope, storage.GroupScope("")); ok {
+		return storage.IsGroupId(groupId)
+	}
+	return false
+}
+
+func (a *API) putPersona(w http.ResponseWriter, req *http.Request) {
+	ctx, scope, name := req.Context(), req.PathValue("scope"), req.PathValue("name")
+	var body struct {
+		SystemInstruction string `json:"system_instruction"`
+		Version           int64  `json:"version"`
+	}
+	if err := decode(w, req, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch {
+	case !validScope(scope):
+		writeError(w, http.StatusBadRequest, "scope must be user:<user id> or group:<group id>")
+		return
+	case !personaName.MatchString(name):
+		writeError(w, http.StatusBadRequest, "name has up to 32 lowercase letters, digits, - or _")
+		return
+	case body.SystemInstruction == "" || len(body.SystemInstruction) > maxInstructionLength:
+		writeError(w, http.StatusBadRequest, "system_instruction is required and must not be too long")
+		return
+	}
+	var old string
+	if persona, err := a.storage.GetPersona(ctx, scope, name); err == nil {
+		old = persona.SystemInstruction
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		writeStorageError(w, req, err)
+		return
+	}
+	persona := storage.Persona{Scope: scope, Name: name, SystemInstruction: body.SystemInstruction, Version: body.Version}
+	if err := a.storage.UpsertPersona(ctx, persona); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, scope, "save persona "+name, old, persona.SystemInstruction)
+	persona.Version++
+	writeJSON(w, http.StatusOK, persona)
+}
+
+func (a *API) deletePersona(w http.ResponseWriter, req *http.Request) {
+	ctx, scope, name := req.Context(), req.PathValue("scope"), req.PathValue("name")
+	version, err := versionParam(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	persona, err := a.storage.GetPersona(ctx, scope, name)
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	old := persona.SystemInstruction
+	persona.Version = version
+	if err := a.storage.DeletePersona(ctx, *persona); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, scope, "delete persona "+name, old, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// quota is a rate limit override, in messages per minute with 0 unlimited.
+type quota struct {
+	// Scope is a user id, a group id or storage.QuotaDefault.
+	Scope string `json:"scope"`
+	Limit int    `json:"limit"`
+}
+
+func (a *API) listQuotas(w http.ResponseWriter, req *http.Request) {
+	var quotas []quota
+	if err := a.storage.ScanBotSettings(req.Context(), func(setting storage.BotSetting) error {
+		scope, ok := strings.CutPrefix(setting.Key, storage.QuotaPrefix)
+		if !ok {
+			return nil
+		}
+		limit, err := strconv.Atoi(setting.Value)
+		if err != nil {
+			return nil
+		}
+		quotas = append(quotas, quota{Scope: scope, Limit: limit})
+		return nil
+	}); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	p, err := paginate(req, quotas, func(q quota) string { return q.Scope })
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (a *API) putQuota(w http.ResponseWriter, req *http.Request) {
+	ctx, scope := req.Context(), req.PathValue("scope")
+	var body struct {
+		Limit *int `json:"limit"`
+	}
+	if err := decode(w, req, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if scope != storage.QuotaDefault && !storage.IsUserId(scope) && !storage.IsGroupId(scope) {
+		writeError(w, http.StatusBadRequest, "scope must be default, a user id or a group id")
+		return
+	}
+	if body.Limit == nil || *body.Limit < 0 {
+		writeError(w, http.StatusBadRequest, "limit is required and must not be negative")
+		return
+	}
+	setting, err := a.storage.GetBotSetting(ctx, storage.QuotaPrefix+scope)
+	if errors.Is(err, storage.ErrNotFound) {
+		setting, err = &storage.BotSetting{Key: storage.QuotaPrefix + scope}, nil
+	}
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	old := setting.Value
+	setting.Value = strconv.Itoa(*body.Limit)
+	if err := a.storage.UpsertBotSetting(ctx, *setting); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, storage.BotScope, "quota "+scope, old, setting.Value)
+	writeJSON(w, http.StatusOK, quota{Scope: scope, Limit: *body.Limit})
+}
+
+func (a *API) deleteQuota(w http.ResponseWriter, req *http.Request) {
+	ctx, scope := req.Context(), req.PathValue("scope")
+	setting, err := a.storage.GetBotSetting(ctx, storage.QuotaPrefix+scope)
+	if err == nil {
+		err = a.storage.DeleteBotSetting(ctx, *setting)
+	}
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, storage.BotScope, "reset quota "+scope, setting.Value, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listBlocks lists the blocks in force.
+func (a *API) listBlocks(w http.ResponseWriter, req *http.Request) {
+	var blocks []storage.Block
+	now := time.Now()
+	if err := a.storage.ScanBlocks(req.Context(), func(block storage.Block) error {
+		if !block.Expired(now) {
+			blocks = append(blocks, block)
+		}
+		return nil
+	}); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	p, err := paginate(req, blocks, func(b storage.Block) string { return b.Id })
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (a *API) getBlock(w http.ResponseWriter, req *http.Request) {
+	block, err := a.storage.GetBlock(req.Context(), req.PathValue("id"))
+	if err == nil && block.Expired(time.Now()) {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, block)
+}
+
+// putBlock blocks a user or group, replacing any earlier block, like /op block
+// does.
+func (a *API) putBlock(w http.ResponseWriter, req *http.Request) {
+	ctx, id := req.Context(), req.PathValue("id")
+	var body struct {
+		Reason    string    `json:"reason"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := decode(w, req, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !body.ExpiresAt.IsZero() && !body.ExpiresAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "expires_at is in the past")
+		return
+	}
+	block, err := storage.PutBlock(ctx, a.storage, a.operators, id, body.Reason, Actor, body.ExpiresAt)
+	switch {
+	case errors.Is(err, storage.ErrInvalidBlockId):
+		writeError(w, http.StatusBadRequest, "not a user or group id")
+		return
+	case errors.Is(err, storage.ErrBlockOperator):
+		writeError(w, http.StatusForbidden, "operators cannot be blocked")
+		return
+	case err != nil:
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, storage.BotScope, "block "+id, "", block.Reason)
+	if storage.IsGroupId(id) && a.leaveGroup != nil {
+		a.leaveGroup(id)
+	}
+	writeJSON(w, http.StatusOK, block)
+}
+
+func (a *API) deleteBlock(w http.ResponseWriter, req *http.Request) {
+	ctx, id := req.Context(), req.PathValue("id")
+	if err := storage.RemoveBlock(ctx, a.storage, id); err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	a.record(ctx, storage.BotScope, "unblock "+id, "", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listAudit lists the audit log of the scope query parameter, the newest
+// first. Its cursor is the time of the last entry of the previous page.
+func (a *API) listAudit(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	scope := query.Get("scope")
+	if scope == "" {
+		writeError(w, http.StatusBadRequest, "the scope query parameter is required")
+		return
+	}
+	limit, err := pageSize(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var before time.Time
+	if cursor := query.Get("cursor"); cursor != "" {
+		if before, err = time.Parse(time.RFC3339Nano, cursor); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+	entries, err := a.storage.ListAudit(req.Context(), scope, before, limit)
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	p := page[storage.AuditEntry]{Items: entries}
+	if p.Items == nil {
+		p.Items = []storage.AuditEntry{}
+	}
+	if len(entries) == limit {
+		p.NextCursor = entries[len(entries)-1].Time.Format(time.RFC3339Nano)
+	}
+	writeJSON(w, http.StatusOK, p)
+}
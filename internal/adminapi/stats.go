@@ -0,0 +1,93 @@
+package adminapi
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// stats is the body of GET /admin/stats, the usage of the last
+// storage.StatsDays days.
+type stats struct {
+	// Days are ordered from today back.
+	Days []dayStats `json:"days"`
+	// Groups are the groups that sent messages, the busiest first.
+	Groups []groupStats `json:"groups"`
+}
+
+type dayStats struct {
+	Date     string `json:"date"`
+	Messages int64  `json:"messages"`
+	Errors   int64  `json:"errors"`
+	// Tokens are the tokens used with each model.
+	Tokens map[string]*tokenStats `json:"tokens"`
+}
+
+type tokenStats struct {
+	Input  int64 `json:"input"`
+	Output int64 `json:"output"`
+}
+
+type groupStats struct {
+	GroupId  string `json:"group_id"`
+	Messages int64  `json:"messages"`
+}
+
+// getStats sums up the daily counters the bot keeps. Days are UTC days.
+func (a *API) getStats(w http.ResponseWriter, req *http.Request) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	var s stats
+	days := make(map[string]*dayStats)
+	for i := range storage.StatsDays {
+		date := today.AddDate(0, 0, -i).Format(time.DateOnly)
+		s.Days = append(s.Days, dayStats{Date: date, Tokens: make(map[string]*tokenStats)})
+	}
+	for i := range s.Days {
+		days[s.Days[i].Date] = &s.Days[i]
+	}
+	groups := make(map[string]int64)
+	err := a.storage.ScanCounters(req.Context(), storage.StatsPrefix, func(key string, value int64) error {
+		name, day, ok := storage.ParseStatsKey(key)
+		d := days[day.Format(time.DateOnly)]
+		if !ok || d == nil {
+			return nil
+		}
+		if groupId, ok := strings.CutPrefix(name, storage.StatGroupPrefix); ok {
+			groups[groupId] += value
+		} else if model, ok := strings.CutPrefix(name, storage.StatInputTokensPrefix); ok {
+			d.tokens(model).Input += value
+		} else if model, ok := strings.CutPrefix(name, storage.StatOutputTokensPrefix); ok {
+			d.tokens(model).Output += value
+		} else if name == storage.StatMessages {
+			d.Messages += value
+		} else if name == storage.StatErrors {
+			d.Errors += value
+		}
+		return nil
+	})
+	if err != nil {
+		writeStorageError(w, req, err)
+		return
+	}
+	s.Groups = []groupStats{}
+	for groupId, messages := range groups {
+		s.Groups = append(s.Groups, groupStats{GroupId: groupId, Messages: messages})
+	}
+	slices.SortFunc(s.Groups, func(a, b groupStats) int {
+		return cmp.Or(cmp.Compare(b.Messages, a.Messages), strings.Compare(a.GroupId, b.GroupId))
+	})
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (d *dayStats) tokens(model string) *tokenStats {
+	t, ok := d.Tokens[model]
+	if !ok {
+		t = &tokenStats{}
+		d.Tokens[model] = t
+	}
+	return t
+}
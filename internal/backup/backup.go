@@ -0,0 +1,385 @@
+// Package backup streams the data behind a storage.Storage to and from a
+// portable NDJSON archive, so that it can be restored into any driver.
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// FormatVersion is written in the header of every archive. Restore rejects
+// archives written by a newer release.
+const FormatVersion = 1
+
+// Record kinds. Every line of an archive is one record, the first one being
+// the header.
+const (
+	KindHeader           = "header"
+	KindUserSetting      = "user_setting"
+	KindGroupUserSetting = "group_user_setting"
+	KindPersona          = "persona"
+	KindGroupRole        = "group_role"
+	KindBotSetting       = "bot_setting"
+	KindBlock            = "block"
+	KindHistory          = "history"
+	KindAudit            = "audit"
+)
+
+type record struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+type header struct {
+	Format    int       `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type history struct {
+	Key      string                   `json:"key"`
+	Messages []storage.HistoryMessage `json:"messages"`
+}
+
+type auditLog struct {
+	Scope   string               `json:"scope"`
+	Entries []storage.AuditEntry `json:"entries"`
+}
+
+// Stats counts records by kind.
+type Stats map[string]int
+
+func (s Stats) String() string {
+	return fmt.Sprintf("user settings %d, group user settings %d, personas %d, group roles %d, bot settings %d, blocks %d, histories %d, audit logs %d",
+		s[KindUserSetting], s[KindGroupUserSetting], s[KindPersona], s[KindGroupRole], s[KindBotSetting], s[KindBlock], s[KindHistory], s[KindAudit])
+}
+
+// Backup writes every setting, persona, group role, block, conversation
+// history and audit log of s to w. Versions are left out, items start over at
+// version 1 when restored.
+// Rate-limit counters and webhook markers are only useful for minutes and are
+// skipped.
+func Backup(ctx context.Context, s storage.Storage, w io.Writer) (Stats, error) {
+	stats := make(Stats)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	write := func(kind string, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(record{Kind: kind, Data: data}); err != nil {
+			return err
+		}
+		if kind != KindHeader {
+			stats[kind]++
+		}
+		return nil
+	}
+
+	if err := write(KindHeader, header{Format: FormatVersion, CreatedAt: time.Now().UTC()}); err != nil {
+		return stats, err
+	}
+	err := s.ScanUserSettings(ctx, func(setting storage.UserSetting) error {
+		setting.Version = 0
+		return write(KindUserSetting, setting)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to back up user settings: %w", err)
+	}
+	err = s.ScanGroupUserSettings(ctx, func(setting storage.GroupUserSetting) error {
+		setting.Version = 0
+		return write(KindGroupUserSetting, setting)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to back up group user settings: %w", err)
+	}
+	err = s.ScanPersonas(ctx, func(persona storage.Persona) error {
+		persona.Version = 0
+		return write(KindPersona, persona)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to back up personas: %w", err)
+	}
+	err = s.ScanGroupRoles(ctx, func(role storage.GroupRole) error {
+		role.Version = 0
+		return write(KindGroupRole, role)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to back up group roles: %w", err)
+	}
+	err = s.ScanBotSettings(ctx, func(setting storage.BotSetting) error {
+		setting.Version = 0
+		return write(KindBotSetting, setting)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to back up bot settings: %w", err)
+	}
+	err = s.ScanBlocks(ctx, func(block storage.Block) error {
+		block.Version = 0
+		return write(KindBlock, block)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to back up blocks: %w", err)
+	}
+	err = s.ScanHistory(ctx, "", func(key string, messages []storage.HistoryMessage) error {
+		return write(KindHistory, history{Key: key, Messages: messages})
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to back up history: %w", err)
+	}
+	err = s.ScanAudit(ctx, func(scope string, entries []storage.AuditEntry) error {
+		return write(KindAudit, auditLog{Scope: scope, Entries: entries})
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to back up audit log: %w", err)
+	}
+	return stats, bw.Flush()
+}
+
+type RestoreOptions struct {
+	// Overwrite replaces items that already exist instead of skipping them.
+	Overwrite bool
+	// HistoryTTL is the expiry of restored histories.
+	HistoryTTL time.Duration
+	// DryRun only reads and checks the archive.
+	DryRun bool
+}
+
+// RestoreStats counts restored and skipped records by kind.
+type RestoreStats struct {
+	Restored Stats
+	Skipped  Stats
+}
+
+// Restore loads an archive written by Backup into s.
+func Restore(ctx context.Context, s storage.Storage, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+	stats := RestoreStats{Restored: make(Stats), Skipped: make(Stats)}
+	scanner := bufio.NewScanner(r)
+	// A history line holds a whole conversation.
+	scanner.Buffer(nil, 64<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return stats, fmt.Errorf("line %d: %w", line, err)
+		}
+		if line == 1 {
+			if err := checkHeader(rec); err != nil {
+				return stats, err
+			}
+			continue
+		}
+		restored, err := restoreRecord(ctx, s, rec, opts)
+		if err != nil {
+			return stats, fmt.Errorf("line %d: %w", line, err)
+		}
+		if restored {
+			stats.Restored[rec.Kind]++
+		} else {
+			stats.Skipped[rec.Kind]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	if line == 0 {
+		return stats, errors.New("empty archive")
+	}
+	return stats, nil
+}
+
+func checkHeader(rec record) error {
+	if rec.Kind != KindHeader {
+		return errors.New("not a backup archive: missing header")
+	}
+	var h header
+	if err := json.Unmarshal(rec.Data, &h); err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+	if h.Format > FormatVersion {
+		return fmt.Errorf("archive format %d is newer than the supported %d", h.Format, FormatVersion)
+	}
+	return nil
+}
+
+// restoreRecord reports whether the record was written, as opposed to skipped
+// because the item exists.
+func restoreRecord(ctx context.Context, s storage.Storage, rec record, opts RestoreOptions) (bool, error) {
+	switch rec.Kind {
+	case KindUserSetting:
+		var setting storage.UserSetting
+		if err := json.Unmarshal(rec.Data, &setting); err != nil {
+			return false, err
+		}
+		current, err := s.GetUserSetting(ctx, setting.UserId)
+		if ok, err := shouldWrite(err, opts); !ok || err != nil {
+			return false, err
+		}
+		setting.Version = 0
+		if current != nil {
+			setting.Version = current.Version
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		return true, s.UpsertUserSetting(ctx, setting)
+	case KindGroupUserSetting:
+		var setting storage.GroupUserSetting
+		if err := json.Unmarshal(rec.Data, &setting); err != nil {
+			return false, err
+		}
+		current, err := s.GetGroupUserSetting(ctx, setting.GroupId, setting.UserId)
+		if ok, err := shouldWrite(err, opts); !ok || err != nil {
+			return false, err
+		}
+		setting.Version = 0
+		if current != nil {
+			setting.Version = current.Version
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		return true, s.UpsertGroupUserSetting(ctx, setting)
+	case KindPersona:
+		var persona storage.Persona
+		if err := json.Unmarshal(rec.Data, &persona); err != nil {
+			return false, err
+		}
+		current, err := s.GetPersona(ctx, persona.Scope, persona.Name)
+		if ok, err := shouldWrite(err, opts); !ok || err != nil {
+			return false, err
+		}
+		persona.Version = 0
+		if current != nil {
+			persona.Version = current.Version
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		return true, s.UpsertPersona(ctx, persona)
+	case KindGroupRole:
+		var role storage.GroupRole
+		if err := json.Unmarshal(rec.Data, &role); err != nil {
+			return false, err
+		}
+		current, err := s.GetGroupRole(ctx, role.GroupId, role.UserId)
+		if ok, err := shouldWrite(err, opts); !ok || err != nil {
+			return false, err
+		}
+		role.Version = 0
+		if current != nil {
+			role.Version = current.Version
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		return true, s.UpsertGroupRole(ctx, role)
+	case KindBotSetting:
+		var setting storage.BotSetting
+		if err := json.Unmarshal(rec.Data, &setting); err != nil {
+			return false, err
+		}
+		current, err := s.GetBotSetting(ctx, setting.Key)
+		if ok, err := shouldWrite(err, opts); !ok || err != nil {
+			return false, err
+		}
+		setting.Version = 0
+		if current != nil {
+			setting.Version = current.Version
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		return true, s.UpsertBotSetting(ctx, setting)
+	case KindBlock:
+		var block storage.Block
+		if err := json.Unmarshal(rec.Data, &block); err != nil {
+			return false, err
+		}
+		current, err := s.GetBlock(ctx, block.Id)
+		if ok, err := shouldWrite(err, opts); !ok || err != nil {
+			return false, err
+		}
+		block.Version = 0
+		if current != nil {
+			block.Version = current.Version
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		return true, s.UpsertBlock(ctx, block)
+	case KindHistory:
+		var h history
+		if err := json.Unmarshal(rec.Data, &h); err != nil {
+			return false, err
+		}
+		current, err := s.GetHistory(ctx, h.Key)
+		if err != nil {
+			return false, err
+		}
+		if len(current) > 0 && !opts.Overwrite {
+			return false, nil
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		if err := s.DeleteHistory(ctx, h.Key); err != nil {
+			return false, err
+		}
+		for _, m := range h.Messages {
+			if err := s.AppendHistory(ctx, h.Key, m, len(h.Messages), opts.HistoryTTL); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case KindAudit:
+		// The log of a scope is restored whole, as entries cannot be told apart.
+		var log auditLog
+		if err := json.Unmarshal(rec.Data, &log); err != nil {
+			return false, err
+		}
+		current, err := s.ListAudit(ctx, log.Scope, time.Time{}, 1)
+		if err != nil {
+			return false, err
+		}
+		if len(current) > 0 && !opts.Overwrite {
+			return false, nil
+		}
+		if opts.DryRun {
+			return true, nil
+		}
+		if err := s.DeleteAudit(ctx, log.Scope); err != nil {
+			return false, err
+		}
+		for _, entry := range log.Entries {
+			entry.Scope = log.Scope
+			if err := s.AppendAudit(ctx, entry); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown record kind %q", rec.Kind)
+	}
+}
+
+// shouldWrite decides from the result of reading the target whether an item is
+// written: missing ones always are, existing ones only with Overwrite.
+func shouldWrite(getErr error, opts RestoreOptions) (bool, error) {
+	switch {
+	case errors.Is(getErr, storage.ErrNotFound):
+		return true, nil
+	case getErr != nil:
+		return false, getErr
+	default:
+		return opts.Overwrite, nil
+	}
+}
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.TODO()
+	source := memstore.New()
+	if err := source.UpsertUserSetting(ctx, storage.UserSetting{UserId: "user", SystemInstruction: "user instruction"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	if err := source.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: "group", UserId: "user", SystemInstruction: "group instruction"}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	if err := source.UpsertPersona(ctx, storage.Persona{Scope: storage.UserScope("user"), Name: "poet", SystemInstruction: "answer in verse"}); err != nil {
+		t.Fatalf("failed to update persona: %v\n", err)
+	}
+	if err := source.UpsertGroupRole(ctx, storage.GroupRole{GroupId: "group", UserId: "user", Role: storage.RoleOwner}); err != nil {
+		t.Fatalf("failed to update group role: %v\n", err)
+	}
+	if err := source.UpsertBotSetting(ctx, storage.BotSetting{Key: "model:default", Value: "gemini-2.5-pro"}); err != nil {
+		t.Fatalf("failed to update bot setting: %v\n", err)
+	}
+	if err := source.UpsertBlock(ctx, storage.Block{Id: "spammer", Reason: "spam"}); err != nil {
+		t.Fatalf("failed to update block: %v\n", err)
+	}
+	for _, text := range []string{"one", "two"} {
+		if err := source.AppendHistory(ctx, "history:user:user", storage.HistoryMessage{Role: storage.HistoryRoleUser, Text: text}, 10, time.Minute); err != nil {
+			t.Fatalf("failed to append history: %v\n", err)
+		}
+	}
+
+	for _, value := range []string{"first", "second"} {
+		if err := source.AppendAudit(ctx, storage.AuditEntry{Scope: storage.UserScope("user"), Time: time.Now().UTC(), Actor: "user", Action: "set instruction", NewValue: value}); err != nil {
+			t.Fatalf("failed to append audit entry: %v\n", err)
+		}
+	}
+
+	var archive bytes.Buffer
+	stats, err := Backup(ctx, source, &archive)
+	if err != nil {
+		t.Fatalf("failed to back up: %v\n", err)
+	}
+	if stats[KindUserSetting] != 1 || stats[KindGroupUserSetting] != 1 || stats[KindPersona] != 1 || stats[KindGroupRole] != 1 ||
+		stats[KindBotSetting] != 1 || stats[KindBlock] != 1 || stats[KindHistory] != 1 || stats[KindAudit] != 1 {
+		t.Fatalf("got backup stats %v, expect one record of each kind", stats)
+	}
+
+	target := memstore.New()
+	// The target already has a newer setting, which is kept unless overwritten.
+	if err := target.UpsertUserSetting(ctx, storage.UserSetting{UserId: "user", SystemInstruction: "newer"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	restored, err := Restore(ctx, target, bytes.NewReader(archive.Bytes()), RestoreOptions{HistoryTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("failed to restore: %v\n", err)
+	}
+	if restored.Restored[KindGroupUserSetting] != 1 || restored.Restored[KindHistory] != 1 || restored.Skipped[KindUserSetting] != 1 {
+		t.Fatalf("got restore stats %+v, expect the existing user setting to be skipped", restored)
+	}
+	setting, err := target.GetUserSetting(ctx, "user")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "newer" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, "newer")
+	}
+	guSetting, err := target.GetGroupUserSetting(ctx, "group", "user")
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if guSetting.SystemInstruction != "group instruction" || guSetting.Version != 1 {
+		t.Fatalf("got different group user setting: %+v\n", guSetting)
+	}
+	persona, err := target.GetPersona(ctx, storage.UserScope("user"), "poet")
+	if err != nil {
+		t.Fatalf("failed to get persona: %v\n", err)
+	}
+	if persona.SystemInstruction != "answer in verse" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", persona.SystemInstruction, "answer in verse")
+	}
+	role, err := target.GetGroupRole(ctx, "group", "user")
+	if err != nil {
+		t.Fatalf("failed to get group role: %v\n", err)
+	}
+	if role.Role != storage.RoleOwner {
+		t.Fatalf("got different role, got: %v, expect: %v\n", role.Role, storage.RoleOwner)
+	}
+	if _, err := target.GetBotSetting(ctx, "model:default"); err != nil {
+		t.Fatalf("failed to get bot setting: %v\n", err)
+	}
+	if block, err := target.GetBlock(ctx, "spammer"); err != nil || block.Reason != "spam" {
+		t.Fatalf("got block %+v, %v, expect the restored block", block, err)
+	}
+	history, err := target.GetHistory(ctx, "history:user:user")
+	if err != nil {
+		t.Fatalf("failed to get history: %v\n", err)
+	}
+	if len(history) != 2 || history[0].Text != "one" || history[1].Text != "two" {
+		t.Fatalf("expect the history in order, got: %+v\n", history)
+	}
+
+	audit, err := target.ListAudit(ctx, storage.UserScope("user"), time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v\n", err)
+	}
+	if len(audit) != 2 || audit[0].NewValue != "second" || audit[1].NewValue != "first" || audit[0].Actor != "user" {
+		t.Fatalf("expect the audit log in order, got: %+v\n", audit)
+	}
+
+	restored, err = Restore(ctx, target, bytes.NewReader(archive.Bytes()), RestoreOptions{Overwrite: true, HistoryTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("failed to restore: %v\n", err)
+	}
+	if len(restored.Skipped) != 0 {
+		t.Fatalf("got restore stats %+v, expect nothing skipped with overwrite", restored)
+	}
+	setting, err = target.GetUserSetting(ctx, "user")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "user instruction" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, "user instruction")
+	}
+	history, err = target.GetHistory(ctx, "history:user:user")
+	if err != nil {
+		t.Fatalf("failed to get history: %v\n", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expect an overwritten history not to be appended to, got: %+v\n", history)
+	}
+	audit, err = target.ListAudit(ctx, storage.UserScope("user"), time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v\n", err)
+	}
+	if len(audit) != 2 {
+		t.Fatalf("expect an overwritten audit log not to be appended to, got: %+v\n", audit)
+	}
+}
+
+func TestRestoreRejectsInvalidArchives(t *testing.T) {
+	for name, archive := range map[string]string{
+		"empty":          "",
+		"missing header": `{"kind":"user_setting","data":{"user_id":"user"}}` + "\n",
+		"newer format":   `{"kind":"header","data":{"format":99}}` + "\n",
+		"unknown kind":   `{"kind":"header","data":{"format":1}}` + "\n" + `{"kind":"unknown","data":{}}` + "\n",
+		"invalid json":   `{"kind":"header","data":{"format":1}}` + "\n{\n",
+	} {
+		if _, err := Restore(context.TODO(), memstore.New(), strings.NewReader(archive), RestoreOptions{}); err == nil {
+			t.Fatalf("expect an error for an archive with %s", name)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package cachestore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+var _ storage.Storage = (*CacheStore)(nil)
+
+// maxEntries bounds each cache; once reached, expired entries are swept and,
+// if that is not enough, the cache starts over.
+const maxEntries = 10000
+
+type groupUserKey struct {
+	groupId string
+	userId  string
+}
+
+// CacheStore is a read-through cache for settings in front of another
+// storage.Storage. Writes go to the backing store and invalidate the cached
+// entry, even when rejected, so a conflict caused by a stale cached version is
+// resolved by reading again. Ephemeral data is passed through untouched.
+//
+// Each process has its own cache, so a write made by another instance is only
+// seen once the cached entry expires.
+type CacheStore struct {
+	storage.Storage
+	userSettings      *ttlCache[string, storage.UserSetting]
+	groupUserSettings *ttlCache[groupUserKey, storage.GroupUserSetting]
+	hits              atomic.Uint64
+	misses            atomic.Uint64
+}
+
+type Config struct {
+	// TTL is how long a found setting is cached.
+	TTL time.Duration
+	// NegativeTTL is how long a missing setting is cached.
+	NegativeTTL time.Duration
+}
+
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+func (s Stats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+func New(backing storage.Storage, cConfig Config) *CacheStore {
+	return &CacheStore{
+		Storage:           backing,
+		userSettings:      newTTLCache[string, storage.UserSetting](cConfig.TTL, cConfig.NegativeTTL),
+		groupUserSettings: newTTLCache[groupUserKey, storage.GroupUserSetting](cConfig.TTL, cConfig.NegativeTTL),
+	}
+}
+
+func (c *CacheStore) Stats() Stats {
+	return Stats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+func (c *CacheStore) record(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+func (c *CacheStore) UpsertGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	key := groupUserKey{setting.GroupId, setting.UserId}
+	defer c.groupUserSettings.delete(key)
+	return c.Storage.UpsertGroupUserSetting(ctx, setting)
+}
+
+func (c *CacheStore) GetGroupUserSetting(ctx context.Context, groupId, userId string) (*storage.GroupUserSetting, error) {
+	key := groupUserKey{groupId, userId}
+	if setting, missing, ok := c.groupUserSettings.get(key); ok {
+		c.record(true)
+		if missing {
+			return nil, storage.ErrNotFound
+		}
+		return &setting, nil
+	}
+	c.record(false)
+	epoch := c.groupUserSettings.epoch()
+	setting, err := c.Storage.GetGroupUserSetting(ctx, groupId, userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.groupUserSettings.set(key, storage.GroupUserSetting{}, true, epoch)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.groupUserSettings.set(key, *setting, false, epoch)
+	return setting, nil
+}
+
+func (c *CacheStore) DeleteGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	key := groupUserKey{setting.GroupId, setting.UserId}
+	defer c.groupUserSettings.delete(key)
+	return c.Storage.DeleteGroupUserSetting(ctx, setting)
+}
+
+func (c *CacheStore) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	defer c.userSettings.delete(setting.UserId)
+	return c.Storage.UpsertUserSetting(ctx, setting)
+}
+
+func (c *CacheStore) GetUserSetting(ctx context.Context, userId string) (*storage.UserSetting, error) {
+	if setting, missing, ok := c.userSettings.get(userId); ok {
+		c.record(true)
+		if missing {
+			return nil, storage.ErrNotFound
+		}
+		return &setting, nil
+	}
+	c.record(false)
+	epoch := c.userSettings.epoch()
+	setting, err := c.Storage.GetUserSetting(ctx, userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.userSettings.set(userId, storage.UserSetting{}, true, epoch)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.userSettings.set(userId, *setting, false, epoch)
+	return setting, nil
+}
+
+func (c *CacheStore) DeleteUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	defer c.userSettings.delete(setting.UserId)
+	return c.Storage.DeleteUserSetting(ctx, setting)
+}
+
+type entry[V any] struct {
+	value     V
+	missing   bool
+	expiresAt time.Time
+}
+
+type ttlCache[K comparable, V any] struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[K]entry[V]
+	// invalidations counts deletes so a read that raced with a write does not
+	// put the value it read before the write back into the cache.
+	invalidations uint64
+}
+
+func newTTLCache[K comparable, V any](ttl, negativeTTL time.Duration) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[K]entry[V]),
+	}
+}
+
+// get reports whether key is cached and, if so, whether it stands for a
+// missing row.
+func (c *ttlCache[K, V]) get(key K) (value V, missing, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !time.Now().Before(e.expiresAt) {
+		var zero V
+		return zero, false, false
+	}
+	return e.value, e.missing, true
+}
+
+func (c *ttlCache[K, V]) epoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.invalidations
+}
+
+// set caches value with the negative TTL when it stands for a missing row,
+// unless an invalidation happened since epoch was taken.
+func (c *ttlCache[K, V]) set(key K, value V, missing bool, epoch uint64) {
+	ttl := c.ttl
+	if missing {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.invalidations != epoch {
+		return
+	}
+	now := time.Now()
+	if len(c.entries) >= maxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = entry[V]{value: value, missing: missing, expiresAt: now.Add(ttl)}
+}
+
+func (c *ttlCache[K, V]) delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	delete(c.entries, key)
+}
@@ -0,0 +1,118 @@
+package cachestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/internal/storage/storagetest"
+)
+
+func TestCacheStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return New(memstore.New(), Config{TTL: time.Minute, NegativeTTL: time.Minute})
+	})
+}
+
+func TestCacheStoreHitsAndInvalidation(t *testing.T) {
+	ctx := context.TODO()
+	backing := memstore.New()
+	cache := New(backing, Config{TTL: time.Minute, NegativeTTL: time.Minute})
+
+	if err := cache.UpsertUserSetting(ctx, storage.UserSetting{UserId: "test", SystemInstruction: "first"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	for range 3 {
+		if _, err := cache.GetUserSetting(ctx, "test"); err != nil {
+			t.Fatalf("failed to get user setting: %v\n", err)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("got stats %+v, expect 2 hits and 1 miss", stats)
+	}
+
+	// A write that bypasses the cache is not seen until the entry expires...
+	if err := backing.UpsertUserSetting(ctx, storage.UserSetting{UserId: "test", SystemInstruction: "bypassed", Version: 1}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	setting, err := cache.GetUserSetting(ctx, "test")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "first" {
+		t.Fatalf("expect the cached instruction, got: %v\n", setting.SystemInstruction)
+	}
+
+	// ...and writing back its stale version conflicts, which invalidates it...
+	setting.SystemInstruction = "second"
+	if err := cache.UpsertUserSetting(ctx, *setting); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect a conflict for the stale cached version, got: %v\n", err)
+	}
+	setting, err = cache.GetUserSetting(ctx, "test")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "bypassed" {
+		t.Fatalf("expect the conflict to invalidate the entry, got: %v\n", setting.SystemInstruction)
+	}
+
+	// ...as does a successful write through the cache.
+	setting.SystemInstruction = "second"
+	if err := cache.UpsertUserSetting(ctx, *setting); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	setting, err = cache.GetUserSetting(ctx, "test")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "second" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, "second")
+	}
+}
+
+func TestCacheStoreNegativeTTL(t *testing.T) {
+	ctx := context.TODO()
+	backing := memstore.New()
+	cache := New(backing, Config{TTL: time.Minute, NegativeTTL: 50 * time.Millisecond})
+
+	if _, err := cache.GetGroupUserSetting(ctx, "group", "user"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect a missing group user setting, got: %v\n", err)
+	}
+	if err := backing.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: "group", UserId: "user", SystemInstruction: "set"}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	if _, err := cache.GetGroupUserSetting(ctx, "group", "user"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect the missing row to be cached, got: %v\n", err)
+	}
+
+	// An instruction cleared on purpose is a found setting, cached with the full TTL.
+	if err := backing.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: "group", UserId: "cleared"}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	if _, err := cache.GetGroupUserSetting(ctx, "group", "cleared"); err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := backing.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: "group", UserId: "cleared", SystemInstruction: "bypassed", Version: 1}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	cleared, err := cache.GetGroupUserSetting(ctx, "group", "cleared")
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if cleared.SystemInstruction != "" {
+		t.Fatalf("expect the empty instruction to stay cached, got: %v\n", cleared.SystemInstruction)
+	}
+
+	setting, err := cache.GetGroupUserSetting(ctx, "group", "user")
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "set" {
+		t.Fatalf("expect the negative entry to expire, got: %v\n", setting.SystemInstruction)
+	}
+}
@@ -0,0 +1,462 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	// The Docker and Lambda images ship without a time zone database.
+	_ "time/tzdata"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFileEnv  = "LINEBOT_CONFIG"
+	configFileFlag = "config"
+	fileEnvSuffix  = "_FILE"
+)
+
+type Config struct {
+	Line    LineConfig    `yaml:"line" toml:"line"`
+	Gemini  GeminiConfig  `yaml:"gemini" toml:"gemini"`
+	Bot     BotConfig     `yaml:"bot" toml:"bot"`
+	Storage StorageConfig `yaml:"storage" toml:"storage"`
+	Server  ServerConfig  `yaml:"server" toml:"server"`
+	Admin   AdminConfig   `yaml:"admin" toml:"admin"`
+	Tracing TracingConfig `yaml:"tracing" toml:"tracing"`
+}
+
+type LineConfig struct {
+	ChannelSecret string `yaml:"channel_secret" toml:"channel_secret"`
+	ChannelToken  string `yaml:"channel_token" toml:"channel_token"`
+}
+
+type GeminiConfig struct {
+	ApiKey string `yaml:"api_key" toml:"api_key"`
+	Model  string `yaml:"model" toml:"model"`
+}
+
+type BotConfig struct {
+	HistorySize int           `yaml:"history_size" toml:"history_size"`
+	HistoryTTL  time.Duration `yaml:"history_ttl" toml:"history_ttl"`
+	RateLimit   int           `yaml:"rate_limit" toml:"rate_limit"`
+	PublicURL   string        `yaml:"public_url" toml:"public_url"`
+	// Timezone is the IANA time zone of instruction templates for users who
+	// did not set their own.
+	Timezone string `yaml:"timezone" toml:"timezone"`
+	// GroupOwners are user ids that own every group the bot is in.
+	GroupOwners []string `yaml:"group_owners" toml:"group_owners"`
+	// Operators are user ids allowed to run /op commands.
+	Operators []string `yaml:"operators" toml:"operators"`
+	// LeaveBlockedGroups makes the bot leave a group blocked by an operator.
+	LeaveBlockedGroups bool `yaml:"leave_blocked_groups" toml:"leave_blocked_groups"`
+}
+
+const (
+	StorageDynamoDB = "dynamodb"
+	StorageSQLite   = "sqlite"
+	StorageMemory   = "memory"
+	StoragePostgres = "postgres"
+	StorageRedis    = "redis"
+)
+
+type StorageConfig struct {
+	Driver     string           `yaml:"driver" toml:"driver"`
+	DynamoDB   DynamoDBConfig   `yaml:"dynamodb" toml:"dynamodb"`
+	SQLite     SQLiteConfig     `yaml:"sqlite" toml:"sqlite"`
+	Postgres   PostgresConfig   `yaml:"postgres" toml:"postgres"`
+	Redis      RedisConfig      `yaml:"redis" toml:"redis"`
+	Cache      CacheConfig      `yaml:"cache" toml:"cache"`
+	Encryption EncryptionConfig `yaml:"encryption" toml:"encryption"`
+}
+
+const (
+	BillingProvisioned = "provisioned"
+	BillingOnDemand    = "on-demand"
+)
+
+type DynamoDBConfig struct {
+	EndPoint          string `yaml:"endpoint" toml:"endpoint"`
+	TablePrefix       string `yaml:"table_prefix" toml:"table_prefix"`
+	BillingMode       string `yaml:"billing_mode" toml:"billing_mode"`
+	ReadCapacity      int    `yaml:"read_capacity" toml:"read_capacity"`
+	WriteCapacity     int    `yaml:"write_capacity" toml:"write_capacity"`
+	SkipTableCreation bool   `yaml:"skip_table_creation" toml:"skip_table_creation"`
+	// EnableTTL is on by default: without it the ephemeral table keeps every
+	// webhook marker, counter and history item forever.
+	EnableTTL bool `yaml:"enable_ttl" toml:"enable_ttl"`
+}
+
+type SQLiteConfig struct {
+	Path string `yaml:"path" toml:"path"`
+}
+
+type PostgresConfig struct {
+	DSN             string        `yaml:"dsn" toml:"dsn"`
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr" toml:"addr"`
+	Password string `yaml:"password" toml:"password"`
+	DB       int    `yaml:"db" toml:"db"`
+	Prefix   string `yaml:"prefix" toml:"prefix"`
+}
+
+type CacheConfig struct {
+	TTL         time.Duration `yaml:"ttl" toml:"ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl" toml:"negative_ttl"`
+}
+
+const (
+	EncryptionLocal = "local"
+	EncryptionKMS   = "kms"
+)
+
+type EncryptionConfig struct {
+	// Provider is empty when encryption is disabled.
+	Provider string `yaml:"provider" toml:"provider"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	KMSKeyId string `yaml:"kms_key_id" toml:"kms_key_id"`
+}
+
+type ServerConfig struct {
+	Addr string `yaml:"addr" toml:"addr"`
+	// ShutdownTimeout is how long the server waits for requests and answers
+	// in progress once it is asked to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+const (
+	TracingOTLP   = "otlp"
+	TracingStdout = "stdout"
+)
+
+type TracingConfig struct {
+	// Exporter is empty when tracing is disabled.
+	Exporter string `yaml:"exporter" toml:"exporter"`
+}
+
+type AdminConfig struct {
+	// Token authenticates requests to the admin API, which is disabled when
+	// it is empty.
+	Token string `yaml:"token" toml:"token"`
+}
+
+// minAdminTokenLength keeps the admin token out of reach of guessing.
+const minAdminTokenLength = 32
+
+// option binds a config field to its environment variable and command-line flag.
+// Secret options may also be read from the file named by the <env>_FILE variable.
+type option struct {
+	key      string
+	env      string
+	flag     string
+	usage    string
+	secret   bool
+	required bool
+	dst      any
+}
+
+func Default() *Config {
+	return &Config{
+		Bot: BotConfig{
+			HistoryTTL: time.Hour,
+			Timezone:   "UTC",
+		},
+		Storage: StorageConfig{
+			Driver: StorageDynamoDB,
+			DynamoDB: DynamoDBConfig{
+				BillingMode:   BillingProvisioned,
+				ReadCapacity:  5,
+				WriteCapacity: 5,
+				EnableTTL:     true,
+			},
+			SQLite: SQLiteConfig{
+				Path: "linebot.db",
+			},
+			Postgres: PostgresConfig{
+				MaxOpenConns:    10,
+				MaxIdleConns:    5,
+				ConnMaxLifetime: 30 * time.Minute,
+			},
+			Redis: RedisConfig{
+				Addr:   "localhost:6379",
+				Prefix: "linebot:",
+			},
+			Cache: CacheConfig{
+				TTL:         30 * time.Second,
+				NegativeTTL: 10 * time.Second,
+			},
+		},
+		Server: ServerConfig{
+			Addr:            ":5000",
+			ShutdownTimeout: 20 * time.Second,
+		},
+	}
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{key: "line.channel_secret", env: "LINE_CHANNEL_SECRET", flag: "line-channel-secret", usage: "LINE channel secret", secret: true, required: true, dst: &c.Line.ChannelSecret},
+		{key: "line.channel_token", env: "LINE_CHANNEL_TOKEN", flag: "line-channel-token", usage: "LINE channel access token", secret: true, required: true, dst: &c.Line.ChannelToken},
+		{key: "gemini.api_key", env: "GEMINI_API_KEY", flag: "gemini-api-key", usage: "Gemini API key", secret: true, required: true, dst: &c.Gemini.ApiKey},
+		{key: "gemini.model", env: "GEMINI_MODEL", flag: "gemini-model", usage: "preferred Gemini model, tried before the defaults", dst: &c.Gemini.Model},
+		{key: "bot.history_size", env: "BOT_HISTORY_SIZE", flag: "history-size", usage: "messages of conversation history sent to the model, 0 disables history", dst: &c.Bot.HistorySize},
+		{key: "bot.history_ttl", env: "BOT_HISTORY_TTL", flag: "history-ttl", usage: "how long an idle conversation history is kept", dst: &c.Bot.HistoryTTL},
+		{key: "bot.rate_limit", env: "BOT_RATE_LIMIT", flag: "rate-limit", usage: "messages a user may send per minute, 0 disables the limit", dst: &c.Bot.RateLimit},
+		{key: "bot.public_url", env: "BOT_PUBLIC_URL", flag: "public-url", usage: "base URL the bot is reachable at, enables download links for /mydata export", dst: &c.Bot.PublicURL},
+		{key: "bot.timezone", env: "BOT_TIMEZONE", flag: "timezone", usage: "default IANA time zone of instruction templates, e.g. Asia/Tokyo", dst: &c.Bot.Timezone},
+		{key: "bot.group_owners", env: "BOT_GROUP_OWNERS", flag: "group-owners", usage: "comma-separated user ids that own every group", dst: &c.Bot.GroupOwners},
+		{key: "bot.operators", env: "BOT_OPERATORS", flag: "operators", usage: "comma-separated user ids allowed to run /op commands", dst: &c.Bot.Operators},
+		{key: "bot.leave_blocked_groups", env: "BOT_LEAVE_BLOCKED_GROUPS", flag: "leave-blocked-groups", usage: "leave groups blocked by an operator", dst: &c.Bot.LeaveBlockedGroups},
+		{key: "storage.driver", env: "STORAGE_DRIVER", flag: "storage-driver", usage: "storage backend: dynamodb, sqlite, postgres, redis or memory", dst: &c.Storage.Driver},
+		{key: "storage.dynamodb.endpoint", env: "DYNAMODB_ENDPOINT", flag: "dynamodb-endpoint", usage: "custom DynamoDB endpoint, e.g. http://localhost:8000", dst: &c.Storage.DynamoDB.EndPoint},
+		{key: "storage.dynamodb.table_prefix", env: "DYNAMODB_TABLE_PREFIX", flag: "dynamodb-table-prefix", usage: "prefix of every DynamoDB table name, e.g. dev-", dst: &c.Storage.DynamoDB.TablePrefix},
+		{key: "storage.dynamodb.billing_mode", env: "DYNAMODB_BILLING_MODE", flag: "dynamodb-billing-mode", usage: "billing mode of created tables: provisioned or on-demand", dst: &c.Storage.DynamoDB.BillingMode},
+		{key: "storage.dynamodb.read_capacity", env: "DYNAMODB_READ_CAPACITY", flag: "dynamodb-read-capacity", usage: "read capacity units of provisioned tables", dst: &c.Storage.DynamoDB.ReadCapacity},
+		{key: "storage.dynamodb.write_capacity", env: "DYNAMODB_WRITE_CAPACITY", flag: "dynamodb-write-capacity", usage: "write capacity units of provisioned tables", dst: &c.Storage.DynamoDB.WriteCapacity},
+		{key: "storage.dynamodb.skip_table_creation", env: "DYNAMODB_SKIP_TABLE_CREATION", flag: "dynamodb-skip-table-creation", usage: "do not create missing tables, e.g. when they are managed by IaC", dst: &c.Storage.DynamoDB.SkipTableCreation},
+		{key: "storage.dynamodb.enable_ttl", env: "DYNAMODB_ENABLE_TTL", flag: "dynamodb-enable-ttl", usage: "enable DynamoDB TTL on the ephemeral table, on by default", dst: &c.Storage.DynamoDB.EnableTTL},
+		{key: "storage.sqlite.path", env: "SQLITE_PATH", flag: "sqlite-path", usage: "path of the SQLite database file", dst: &c.Storage.SQLite.Path},
+		{key: "storage.postgres.dsn", env: "POSTGRES_DSN", flag: "postgres-dsn", usage: "PostgreSQL connection string", secret: true, dst: &c.Storage.Postgres.DSN},
+		{key: "storage.postgres.max_open_conns", env: "POSTGRES_MAX_OPEN_CONNS", flag: "postgres-max-open-conns", usage: "maximum open PostgreSQL connections", dst: &c.Storage.Postgres.MaxOpenConns},
+		{key: "storage.postgres.max_idle_conns", env: "POSTGRES_MAX_IDLE_CONNS", flag: "postgres-max-idle-conns", usage: "maximum idle PostgreSQL connections", dst: &c.Storage.Postgres.MaxIdleConns},
+		{key: "storage.postgres.conn_max_lifetime", env: "POSTGRES_CONN_MAX_LIFETIME", flag: "postgres-conn-max-lifetime", usage: "maximum lifetime of a PostgreSQL connection, e.g. 30m", dst: &c.Storage.Postgres.ConnMaxLifetime},
+		{key: "storage.redis.addr", env: "REDIS_ADDR", flag: "redis-addr", usage: "Redis address", dst: &c.Storage.Redis.Addr},
+		{key: "storage.redis.password", env: "REDIS_PASSWORD", flag: "redis-password", usage: "Redis password", secret: true, dst: &c.Storage.Redis.Password},
+		{key: "storage.redis.db", env: "REDIS_DB", flag: "redis-db", usage: "Redis database number", dst: &c.Storage.Redis.DB},
+		{key: "storage.redis.prefix", env: "REDIS_PREFIX", flag: "redis-prefix", usage: "prefix of every Redis key", dst: &c.Storage.Redis.Prefix},
+		{key: "storage.cache.ttl", env: "STORAGE_CACHE_TTL", flag: "cache-ttl", usage: "how long settings are cached in memory, 0 disables caching", dst: &c.Storage.Cache.TTL},
+		{key: "storage.cache.negative_ttl", env: "STORAGE_CACHE_NEGATIVE_TTL", flag: "cache-negative-ttl", usage: "how long missing settings are cached in memory", dst: &c.Storage.Cache.NegativeTTL},
+		{key: "storage.encryption.provider", env: "STORAGE_ENCRYPTION_PROVIDER", flag: "encryption-provider", usage: "key provider encrypting instructions and history: local or kms, empty disables encryption", dst: &c.Storage.Encryption.Provider},
+		{key: "storage.encryption.key_file", env: "STORAGE_ENCRYPTION_KEY_FILE", flag: "encryption-key-file", usage: "master key file of the local key provider", dst: &c.Storage.Encryption.KeyFile},
+		{key: "storage.encryption.kms_key_id", env: "STORAGE_ENCRYPTION_KMS_KEY_ID", flag: "encryption-kms-key-id", usage: "KMS key id, ARN or alias of the kms key provider", dst: &c.Storage.Encryption.KMSKeyId},
+		{key: "server.addr", env: "SERVER_ADDR", flag: "addr", usage: "address the HTTP server listens on", dst: &c.Server.Addr},
+		{key: "server.shutdown_timeout", env: "SERVER_SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", usage: "how long to wait for answers in progress when stopping", dst: &c.Server.ShutdownTimeout},
+		{key: "tracing.exporter", env: "TRACING_EXPORTER", flag: "tracing-exporter", usage: "where to export traces: otlp or stdout, empty disables tracing", dst: &c.Tracing.Exporter},
+		{key: "admin.token", env: "ADMIN_TOKEN", flag: "admin-token", usage: "bearer token of the admin API under /admin/, disabled when empty", secret: true, dst: &c.Admin.Token},
+	}
+}
+
+// Load builds the config from defaults, the YAML or TOML file named by -config or LINEBOT_CONFIG,
+// environment variables and command-line flags, each overriding the previous one,
+// and validates the result.
+func Load(name string, args []string) (*Config, error) {
+	cfg, rest, err := load(name, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", rest)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadStorage is Load for tools that only talk to storage: it validates the
+// storage section only and returns the arguments left after the flags.
+func LoadStorage(name string, args []string) (*Config, []string, error) {
+	cfg, rest, err := load(name, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.Storage.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, rest, nil
+}
+
+func load(name string, args []string) (*Config, []string, error) {
+	cfg := Default()
+	opts := cfg.options()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String(configFileFlag, os.Getenv(configFileEnv), "path to a YAML config file, or TOML with a .toml extension")
+	flags := make(map[string]string)
+	for _, o := range opts {
+		fs.Func(o.flag, o.usage, func(v string) error {
+			flags[o.flag] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, o := range opts {
+		v, ok, err := lookupEnv(o)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		if err := setValue(o.dst, v); err != nil {
+			return nil, nil, fmt.Errorf("invalid value for %s: %w", o.env, err)
+		}
+	}
+
+	for _, o := range opts {
+		v, ok := flags[o.flag]
+		if !ok {
+			continue
+		}
+		if err := setValue(o.dst, v); err != nil {
+			return nil, nil, fmt.Errorf("invalid value for -%s: %w", o.flag, err)
+		}
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// loadFile reads a config file, as TOML when its extension is .toml and as
+// YAML otherwise.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	unmarshal := yaml.Unmarshal
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		unmarshal = toml.Unmarshal
+	}
+	if err := unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func lookupEnv(o option) (string, bool, error) {
+	if v, ok := os.LookupEnv(o.env); ok {
+		return v, true, nil
+	}
+	if !o.secret {
+		return "", false, nil
+	}
+	path, ok := os.LookupEnv(o.env + fileEnvSuffix)
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", o.env+fileEnvSuffix, err)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+func setValue(dst any, v string) error {
+	switch d := dst.(type) {
+	case *string:
+		*d = v
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*d = b
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*d = n
+	case *time.Duration:
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = dur
+	case *[]string:
+		*d = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*d = append(*d, s)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported option type %T", dst)
+	}
+	return nil
+}
+
+// Validate reports every missing or invalid field at once.
+func (c *Config) Validate() error {
+	var errs []error
+	for _, o := range c.options() {
+		if !o.required {
+			continue
+		}
+		if s, ok := o.dst.(*string); ok && *s == "" {
+			hint := o.env
+			if o.secret {
+				hint += ", " + o.env + fileEnvSuffix
+			}
+			errs = append(errs, fmt.Errorf("%s is required (set it in the config file, %s or -%s)", o.key, hint, o.flag))
+		}
+	}
+	if _, err := time.LoadLocation(c.Bot.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("bot.timezone %q is not a known time zone", c.Bot.Timezone))
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout must not be negative"))
+	}
+	switch c.Tracing.Exporter {
+	case "", TracingOTLP, TracingStdout:
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter %q is not supported, use %s or %s", c.Tracing.Exporter, TracingOTLP, TracingStdout))
+	}
+	if c.Admin.Token != "" && len(c.Admin.Token) < minAdminTokenLength {
+		errs = append(errs, fmt.Errorf("admin.token must be at least %d characters long", minAdminTokenLength))
+	}
+	errs = append(errs, c.Storage.Validate())
+	return errors.Join(errs...)
+}
+
+func (c StorageConfig) Validate() error {
+	var errs []error
+	switch c.Driver {
+	case StorageDynamoDB, StorageSQLite, StorageRedis, StorageMemory:
+	case StoragePostgres:
+		if c.Postgres.DSN == "" {
+			errs = append(errs, errors.New("storage.postgres.dsn is required when storage.driver is postgres (set it in the config file, POSTGRES_DSN, POSTGRES_DSN_FILE or -postgres-dsn)"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.driver %q is not supported", c.Driver))
+	}
+	switch c.DynamoDB.BillingMode {
+	case BillingProvisioned, BillingOnDemand:
+	default:
+		errs = append(errs, fmt.Errorf("storage.dynamodb.billing_mode %q is not supported, use %s or %s", c.DynamoDB.BillingMode, BillingProvisioned, BillingOnDemand))
+	}
+	switch c.Encryption.Provider {
+	case "":
+	case EncryptionLocal:
+		if c.Encryption.KeyFile == "" {
+			errs = append(errs, errors.New("storage.encryption.key_file is required when storage.encryption.provider is local (set it in the config file, STORAGE_ENCRYPTION_KEY_FILE or -encryption-key-file)"))
+		}
+	case EncryptionKMS:
+		if c.Encryption.KMSKeyId == "" {
+			errs = append(errs, errors.New("storage.encryption.kms_key_id is required when storage.encryption.provider is kms (set it in the config file, STORAGE_ENCRYPTION_KMS_KEY_ID or -encryption-kms-key-id)"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.encryption.provider %q is not supported, use %s or %s", c.Encryption.Provider, EncryptionLocal, EncryptionKMS))
+	}
+	return errors.Join(errs...)
+}
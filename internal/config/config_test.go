@@ -0,0 +1,176 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setRequired(t *testing.T) {
+	t.Setenv("LINE_CHANNEL_SECRET", "secret")
+	t.Setenv("LINE_CHANNEL_TOKEN", "token")
+	t.Setenv("GEMINI_API_KEY", "key")
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v\n", name, err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	setRequired(t)
+	path := writeFile(t, "config.yaml", `
+gemini:
+  model: from-file
+storage:
+  dynamodb:
+    endpoint: http://file:8000
+server:
+  addr: ":7000"
+`)
+	t.Setenv("GEMINI_MODEL", "from-env")
+	t.Setenv("SERVER_ADDR", ":6000")
+
+	cfg, err := Load("test", []string{"-config", path, "-addr", ":8080"})
+	if err != nil {
+		t.Fatalf("failed to load config: %v\n", err)
+	}
+	if cfg.Storage.DynamoDB.EndPoint != "http://file:8000" {
+		t.Fatalf("got endpoint %q, expect value from file", cfg.Storage.DynamoDB.EndPoint)
+	}
+	if cfg.Gemini.Model != "from-env" {
+		t.Fatalf("got model %q, expect env to override file", cfg.Gemini.Model)
+	}
+	if cfg.Server.Addr != ":8080" {
+		t.Fatalf("got addr %q, expect flag to override env", cfg.Server.Addr)
+	}
+}
+
+func TestLoadSecretFile(t *testing.T) {
+	setRequired(t)
+	os.Unsetenv("LINE_CHANNEL_SECRET")
+	t.Setenv("LINE_CHANNEL_SECRET_FILE", writeFile(t, "secret", "from-file\n"))
+
+	cfg, err := Load("test", nil)
+	if err != nil {
+		t.Fatalf("failed to load config: %v\n", err)
+	}
+	if cfg.Line.ChannelSecret != "from-file" {
+		t.Fatalf("got channel secret %q, expect %q", cfg.Line.ChannelSecret, "from-file")
+	}
+}
+
+func TestLoadPrecedenceTOML(t *testing.T) {
+	setRequired(t)
+	path := writeFile(t, "config.toml", `
+[gemini]
+model = "from-file"
+
+[bot]
+history_ttl = "2h"
+group_owners = ["U1", "U2"]
+
+[storage.dynamodb]
+endpoint = "http://file:8000"
+
+[server]
+addr = ":7000"
+`)
+	t.Setenv("GEMINI_MODEL", "from-env")
+	t.Setenv("SERVER_ADDR", ":6000")
+
+	cfg, err := Load("test", []string{"-config", path, "-addr", ":8080"})
+	if err != nil {
+		t.Fatalf("failed to load config: %v\n", err)
+	}
+	if cfg.Storage.DynamoDB.EndPoint != "http://file:8000" {
+		t.Fatalf("got endpoint %q, expect value from file", cfg.Storage.DynamoDB.EndPoint)
+	}
+	if cfg.Bot.HistoryTTL != 2*time.Hour || len(cfg.Bot.GroupOwners) != 2 {
+		t.Fatalf("got history ttl %v and group owners %q, expect typed values from file", cfg.Bot.HistoryTTL, cfg.Bot.GroupOwners)
+	}
+	if cfg.Gemini.Model != "from-env" {
+		t.Fatalf("got model %q, expect env to override file", cfg.Gemini.Model)
+	}
+	if cfg.Server.Addr != ":8080" {
+		t.Fatalf("got addr %q, expect flag to override env", cfg.Server.Addr)
+	}
+}
+
+func TestLoadMissingRequired(t *testing.T) {
+	t.Setenv("LINE_CHANNEL_SECRET", "")
+	t.Setenv("LINE_CHANNEL_TOKEN", "token")
+	t.Setenv("GEMINI_API_KEY", "")
+
+	_, err := Load("test", nil)
+	if err == nil {
+		t.Fatal("expect an error for missing required fields")
+	}
+	for _, key := range []string{"line.channel_secret", "gemini.api_key"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Fatalf("error %q does not mention %s", err, key)
+		}
+	}
+	if strings.Contains(err.Error(), "line.channel_token") {
+		t.Fatalf("error %q mentions a field that is set", err)
+	}
+}
+
+func TestLoadTypedValues(t *testing.T) {
+	setRequired(t)
+	t.Setenv("STORAGE_DRIVER", "postgres")
+	t.Setenv("POSTGRES_DSN", "postgres://localhost/linebot")
+	t.Setenv("POSTGRES_MAX_OPEN_CONNS", "20")
+	t.Setenv("DYNAMODB_SKIP_TABLE_CREATION", "true")
+	t.Setenv("BOT_GROUP_OWNERS", "U1, U2,")
+
+	cfg, err := Load("test", []string{"-postgres-conn-max-lifetime", "1m"})
+	if err != nil {
+		t.Fatalf("failed to load config: %v\n", err)
+	}
+	if cfg.Storage.Postgres.MaxOpenConns != 20 {
+		t.Fatalf("got max open conns %d, expect 20", cfg.Storage.Postgres.MaxOpenConns)
+	}
+	if cfg.Storage.Postgres.ConnMaxLifetime != time.Minute {
+		t.Fatalf("got conn max lifetime %v, expect 1m", cfg.Storage.Postgres.ConnMaxLifetime)
+	}
+	if !cfg.Storage.DynamoDB.SkipTableCreation {
+		t.Fatal("expect skip table creation to be parsed as true")
+	}
+	if !cfg.Storage.DynamoDB.EnableTTL {
+		t.Fatal("expect TTL to be enabled by default")
+	}
+	if len(cfg.Bot.GroupOwners) != 2 || cfg.Bot.GroupOwners[0] != "U1" || cfg.Bot.GroupOwners[1] != "U2" {
+		t.Fatalf("got group owners %q, expect [U1 U2]", cfg.Bot.GroupOwners)
+	}
+
+	t.Setenv("POSTGRES_MAX_OPEN_CONNS", "many")
+	if _, err := Load("test", nil); err == nil {
+		t.Fatal("expect an error for a malformed integer")
+	}
+	t.Setenv("POSTGRES_MAX_OPEN_CONNS", "20")
+
+	if _, err := Load("test", []string{"-dynamodb-billing-mode", "free"}); err == nil {
+		t.Fatal("expect an error for an unknown billing mode")
+	}
+	if _, err := Load("test", []string{"-timezone", "Mars/Olympus_Mons"}); err == nil {
+		t.Fatal("expect an error for an unknown time zone")
+	}
+	if _, err := Load("test", []string{"-encryption-provider", "local"}); err == nil {
+		t.Fatal("expect an error for the local key provider without a key file")
+	}
+	if _, err := Load("test", []string{"-admin-token", "short"}); err == nil {
+		t.Fatal("expect an error for a short admin token")
+	}
+	if _, err := Load("test", []string{"-shutdown-timeout", "-1s"}); err == nil {
+		t.Fatal("expect an error for a negative shutdown timeout")
+	}
+	if _, err := Load("test", []string{"-tracing-exporter", "jaeger"}); err == nil {
+		t.Fatal("expect an error for an unknown trace exporter")
+	}
+}
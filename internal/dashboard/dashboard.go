@@ -0,0 +1,38 @@
+// Package dashboard serves a single-page dashboard for operators under
+// /dashboard/. The page is static: it asks for the admin token and reads and
+// changes everything through the admin API, so it needs no session of its own.
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// Prefix is the path the dashboard is served under.
+const Prefix = "/dashboard/"
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard under Prefix.
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix(Prefix, http.FileServerFS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The page only talks to this server and never runs inline code, so
+		// an injected value cannot run a script with the admin token.
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		fileServer.ServeHTTP(w, req)
+	})
+}
+
+// Register serves the dashboard on mux under Prefix.
+func Register(mux *http.ServeMux) {
+	mux.Handle(Prefix, Handler())
+}
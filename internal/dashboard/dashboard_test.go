@@ -0,0 +1,47 @@
+package dashboard
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for path, contentType := range map[string]string{
+		"/dashboard/":              "text/html",
+		"/dashboard/dashboard.js":  "text/javascript",
+		"/dashboard/dashboard.css": "text/css",
+	} {
+		resp, err := server.Client().Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v\n", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(body) == 0 {
+			t.Fatalf("got status %d for %s, expect 200", resp.StatusCode, path)
+		}
+		if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, contentType) {
+			t.Fatalf("got content type %q for %s, expect %s", got, path, contentType)
+		}
+		if resp.Header.Get("Content-Security-Policy") == "" {
+			t.Fatalf("expect a content security policy for %s", path)
+		}
+	}
+
+	resp, err := server.Client().Get(server.URL + "/dashboard")
+	if err != nil {
+		t.Fatalf("failed to get /dashboard: %v\n", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/dashboard/" {
+		t.Fatalf("got status %d at %s, expect a redirect to /dashboard/", resp.StatusCode, resp.Request.URL.Path)
+	}
+}
@@ -0,0 +1,310 @@
+"use strict";
+
+// The admin token is kept for the browser tab only.
+const tokenKey = "linebot.adminToken";
+const number = new Intl.NumberFormat();
+
+const $ = (id) => document.getElementById(id);
+
+class ApiError extends Error {
+  constructor(status, message) {
+    super(message);
+    this.status = status;
+  }
+}
+
+async function api(method, path, body) {
+  const init = { method, headers: { Authorization: "Bearer " + sessionStorage.getItem(tokenKey) } };
+  if (body !== undefined) {
+    init.headers["Content-Type"] = "application/json";
+    init.body = JSON.stringify(body);
+  }
+  const resp = await fetch("/admin/" + path, init);
+  if (resp.status === 401) {
+    signOut("The admin token was not accepted.");
+    throw new ApiError(401, "unauthorized");
+  }
+  if (resp.status === 204) {
+    return null;
+  }
+  const data = await resp.json().catch(() => ({}));
+  if (!resp.ok) {
+    throw new ApiError(resp.status, data.error || resp.statusText);
+  }
+  return data;
+}
+
+// listAll follows next_cursor through every page of a list.
+async function listAll(path) {
+  const items = [];
+  let cursor = "";
+  do {
+    const page = await api("GET", path + "?limit=200" + (cursor ? "&cursor=" + encodeURIComponent(cursor) : ""));
+    items.push(...page.items);
+    cursor = page.next_cursor;
+  } while (cursor);
+  return items;
+}
+
+function setStatus(id, message, isError) {
+  $(id).textContent = message;
+  $(id).classList.toggle("error", Boolean(isError));
+}
+
+// cell adds a cell to row. Values are always set as text, never as HTML.
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function button(label, onClick) {
+  const b = document.createElement("button");
+  b.type = "button";
+  b.textContent = label;
+  b.addEventListener("click", onClick);
+  return b;
+}
+
+function emptyRow(tbody, columns, text) {
+  const td = cell(tbody.insertRow(), text, "empty");
+  td.colSpan = columns;
+}
+
+function percent(part, whole) {
+  return whole ? ((100 * part) / whole).toFixed(1) + "%" : "-";
+}
+
+// formatTime shows a time in the browser's time zone, Go's zero time as never.
+function formatTime(value) {
+  const t = new Date(value);
+  return t.getUTCFullYear() <= 1 ? "never" : t.toLocaleString();
+}
+
+async function loadStats() {
+  const stats = await api("GET", "stats");
+  let messages = 0;
+  let errors = 0;
+  const models = new Map();
+  for (const day of stats.days) {
+    messages += day.messages;
+    errors += day.errors;
+    for (const [model, t] of Object.entries(day.tokens)) {
+      const sum = models.get(model) || { input: 0, output: 0 };
+      sum.input += t.input;
+      sum.output += t.output;
+      models.set(model, sum);
+    }
+  }
+  let tokens = 0;
+  for (const sum of models.values()) {
+    tokens += sum.input + sum.output;
+  }
+  $("total-messages").textContent = number.format(messages);
+  $("total-errors").textContent = number.format(errors);
+  $("error-rate").textContent = percent(errors, messages);
+  $("active-groups").textContent = number.format(stats.groups.length);
+  $("total-tokens").textContent = number.format(tokens);
+
+  const busiest = Math.max(1, ...stats.days.map((day) => day.messages));
+  const volume = $("volume").tBodies[0];
+  volume.replaceChildren();
+  for (const day of stats.days) {
+    const row = volume.insertRow();
+    cell(row, day.date);
+    cell(row, number.format(day.messages), "num");
+    const bar = document.createElement("div");
+    bar.className = "bar";
+    bar.style.width = (100 * day.messages) / busiest + "%";
+    cell(row, "", "bar-cell").append(bar);
+    cell(row, number.format(day.errors), "num");
+    cell(row, percent(day.errors, day.messages), "num");
+  }
+
+  const spend = $("tokens").tBodies[0];
+  spend.replaceChildren();
+  const sorted = [...models].sort((a, b) => b[1].input + b[1].output - (a[1].input + a[1].output));
+  for (const [model, sum] of sorted) {
+    const row = spend.insertRow();
+    cell(row, model);
+    cell(row, number.format(sum.input), "num");
+    cell(row, number.format(sum.output), "num");
+    cell(row, number.format(sum.input + sum.output), "num");
+  }
+  if (sorted.length === 0) {
+    emptyRow(spend, 4, "No tokens used in the last 7 days.");
+  }
+
+  const groups = $("groups").tBodies[0];
+  groups.replaceChildren();
+  for (const group of stats.groups) {
+    const row = groups.insertRow();
+    cell(row, group.group_id, "id");
+    cell(row, number.format(group.messages), "num");
+    row.insertCell().append(
+      button("Edit instruction", () => {
+        $("group-id").value = group.group_id;
+        loadGroup();
+        $("group-id").scrollIntoView();
+      }),
+    );
+  }
+  if (stats.groups.length === 0) {
+    emptyRow(groups, 3, "No group sent a message in the last 7 days.");
+  }
+}
+
+// groupSetting is the default setting of the group in the editor, as read.
+let groupSetting = null;
+
+function groupPath() {
+  return "groups/" + encodeURIComponent(groupSetting.group_id) + "/settings/default";
+}
+
+async function loadGroup() {
+  const groupId = $("group-id").value.trim();
+  try {
+    groupSetting = await api("GET", "groups/" + encodeURIComponent(groupId) + "/settings/default");
+    setStatus("group-status", "Version " + groupSetting.version + ".");
+  } catch (e) {
+    if (e.status !== 404) {
+      setStatus("group-status", e.message, true);
+      return;
+    }
+    groupSetting = { group_id: groupId, system_instruction: "", persona: "", version: 0 };
+    setStatus("group-status", "This group has no default instruction yet.");
+  }
+  $("group-instruction").value = groupSetting.system_instruction;
+  $("group-editor").hidden = false;
+}
+
+async function saveGroup() {
+  try {
+    groupSetting = await api("PUT", groupPath(), {
+      system_instruction: $("group-instruction").value,
+      persona: groupSetting.persona,
+      version: groupSetting.version,
+    });
+    setStatus("group-status", "Saved, version " + groupSetting.version + ".");
+  } catch (e) {
+    setStatus("group-status", e.status === 409 ? "Someone changed this instruction in the meantime, load it again before saving." : e.message, true);
+  }
+}
+
+async function deleteGroup() {
+  if (groupSetting.version === 0 || !confirm("Delete the default instruction of " + groupSetting.group_id + "?")) {
+    return;
+  }
+  try {
+    await api("DELETE", groupPath() + "?version=" + groupSetting.version);
+    groupSetting = { group_id: groupSetting.group_id, system_instruction: "", persona: "", version: 0 };
+    $("group-instruction").value = "";
+    setStatus("group-status", "Deleted.");
+  } catch (e) {
+    setStatus("group-status", e.status === 409 ? "Someone changed this instruction in the meantime, load it again." : e.message, true);
+  }
+}
+
+async function loadBlocks() {
+  const blocks = await listAll("blocks");
+  const tbody = $("blocks").tBodies[0];
+  tbody.replaceChildren();
+  for (const block of blocks) {
+    const row = tbody.insertRow();
+    cell(row, block.id, "id");
+    cell(row, block.reason);
+    cell(row, block.created_by);
+    cell(row, formatTime(block.created_at));
+    cell(row, formatTime(block.expires_at));
+    row.insertCell().append(button("Unblock", () => unblock(block.id)));
+  }
+  if (blocks.length === 0) {
+    emptyRow(tbody, 6, "Nobody is blocked.");
+  }
+}
+
+async function addBlock() {
+  const body = { reason: $("block-reason").value.trim() };
+  if ($("block-expires").value) {
+    body.expires_at = new Date($("block-expires").value).toISOString();
+  }
+  const id = $("block-id").value.trim();
+  try {
+    await api("PUT", "blocks/" + encodeURIComponent(id), body);
+    $("block-add").reset();
+    setStatus("block-status", id + " blocked.");
+    await loadBlocks();
+  } catch (e) {
+    setStatus("block-status", e.message, true);
+  }
+}
+
+async function unblock(id) {
+  if (!confirm("Unblock " + id + "?")) {
+    return;
+  }
+  try {
+    await api("DELETE", "blocks/" + encodeURIComponent(id));
+    setStatus("block-status", id + " unblocked.");
+    await loadBlocks();
+  } catch (e) {
+    setStatus("block-status", e.message, true);
+  }
+}
+
+async function refresh() {
+  setStatus("app-status", "Loading...");
+  try {
+    await Promise.all([loadStats(), loadBlocks()]);
+    setStatus("app-status", "Updated at " + new Date().toLocaleTimeString());
+  } catch (e) {
+    if (e.status !== 401) {
+      setStatus("app-status", e.message, true);
+    }
+  }
+}
+
+function showApp() {
+  $("login").hidden = true;
+  $("app").hidden = false;
+  $("refresh").hidden = false;
+  $("sign-out").hidden = false;
+  refresh();
+}
+
+function signOut(message) {
+  sessionStorage.removeItem(tokenKey);
+  $("login").hidden = false;
+  $("app").hidden = true;
+  $("refresh").hidden = true;
+  $("sign-out").hidden = true;
+  setStatus("app-status", "");
+  setStatus("login-status", message || "", Boolean(message));
+}
+
+// onSubmit handles a form without reloading the page.
+function onSubmit(id, fn) {
+  $(id).addEventListener("submit", (event) => {
+    event.preventDefault();
+    fn();
+  });
+}
+
+onSubmit("login", () => {
+  sessionStorage.setItem(tokenKey, $("token").value);
+  $("token").value = "";
+  showApp();
+});
+onSubmit("group-load", loadGroup);
+onSubmit("group-editor", saveGroup);
+onSubmit("block-add", addBlock);
+$("group-delete").addEventListener("click", deleteGroup);
+$("refresh").addEventListener("click", refresh);
+$("sign-out").addEventListener("click", () => signOut());
+
+if (sessionStorage.getItem(tokenKey)) {
+  showApp();
+}
@@ -0,0 +1,232 @@
+package dynamodriver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// auditSeqAttribute is the sort key of audit entries: their time in a form
+// that sorts as a string, and a random suffix telling apart entries written
+// at the same time.
+const auditSeqAttribute = "Seq"
+
+const auditSeqLayout = "20060102T150405.000000000"
+
+func (d *DynamoDriver) AppendAudit(ctx context.Context, entry storage.AuditEntry) error {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	item[auditSeqAttribute] = &types.AttributeValueMemberS{
+		Value: entry.Time.UTC().Format(auditSeqLayout) + "#" + hex.EncodeToString(suffix),
+	}
+	if _, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tables.audit),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("couldn't put item to table %v. Error: %w", d.tables.audit, err)
+	}
+	return nil
+}
+
+func (d *DynamoDriver) ListAudit(ctx context.Context, scope string, before time.Time, limit int) ([]storage.AuditEntry, error) {
+	cond := expression.Key("Scope").Equal(expression.Value(scope))
+	if !before.IsZero() {
+		// "#" sorts before the random suffix, so entries at before are left out.
+		cond = cond.And(expression.Key(auditSeqAttribute).LessThan(expression.Value(before.UTC().Format(auditSeqLayout) + "#")))
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(cond).Build()
+	if err != nil {
+		return nil, err
+	}
+	out, err := d.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.tables.audit),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't query table %v. Error: %w", d.tables.audit, err)
+	}
+	entries := make([]storage.AuditEntry, 0, len(out.Items))
+	for _, item := range out.Items {
+		var entry storage.AuditEntry
+		if err := attributevalue.UnmarshalMap(item, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ScanAudit reads the whole table before calling fn, since a scan returns the
+// entries of a scope in no particular order.
+func (d *DynamoDriver) ScanAudit(ctx context.Context, fn func(scope string, entries []storage.AuditEntry) error) error {
+	type seqEntry struct {
+		seq   string
+		entry storage.AuditEntry
+	}
+	audit := make(map[string][]seqEntry)
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName: aws.String(d.tables.audit),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't scan table %v. Error: %w", d.tables.audit, err)
+		}
+		for _, item := range page.Items {
+			var entry storage.AuditEntry
+			if err := attributevalue.UnmarshalMap(item, &entry); err != nil {
+				return err
+			}
+			var seq string
+			if err := attributevalue.Unmarshal(item[auditSeqAttribute], &seq); err != nil {
+				return err
+			}
+			audit[entry.Scope] = append(audit[entry.Scope], seqEntry{seq, entry})
+		}
+	}
+	for scope, seqEntries := range audit {
+		slices.SortFunc(seqEntries, func(a, b seqEntry) int { return strings.Compare(a.seq, b.seq) })
+		entries := make([]storage.AuditEntry, len(seqEntries))
+		for i, e := range seqEntries {
+			entries[i] = e.entry
+		}
+		if err := fn(scope, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDriver) DeleteAudit(ctx context.Context, scope string) error {
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("Scope").Equal(expression.Value(scope))).
+		WithProjection(expression.NamesList(expression.Name("Scope"), expression.Name(auditSeqAttribute))).
+		Build()
+	if err != nil {
+		return err
+	}
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.tables.audit),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't query table %v. Error: %w", d.tables.audit, err)
+		}
+		for _, key := range page.Items {
+			if _, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(d.tables.audit),
+				Key:       key,
+			}); err != nil {
+				return fmt.Errorf("couldn't delete item from table %v. Error: %w", d.tables.audit, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDriver) RedactAudit(ctx context.Context, actor string) error {
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Name("Actor").Equal(expression.Value(actor))).
+		WithProjection(expression.NamesList(expression.Name("Scope"), expression.Name(auditSeqAttribute))).
+		Build()
+	if err != nil {
+		return err
+	}
+	update, err := expression.NewBuilder().
+		WithUpdate(expression.Remove(expression.Name("Actor")).Remove(expression.Name("OldHash")).Remove(expression.Name("NewValue"))).
+		Build()
+	if err != nil {
+		return err
+	}
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName:                 aws.String(d.tables.audit),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't scan table %v. Error: %w", d.tables.audit, err)
+		}
+		for _, key := range page.Items {
+			if _, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:                aws.String(d.tables.audit),
+				Key:                      key,
+				UpdateExpression:         update.Update(),
+				ExpressionAttributeNames: update.Names(),
+			}); err != nil {
+				return fmt.Errorf("couldn't update item in table %v. Error: %w", d.tables.audit, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RewriteAudit updates one entry at a time, leaving those redacted meanwhile.
+func (d *DynamoDriver) RewriteAudit(ctx context.Context, fn func(storage.AuditEntry) (string, error)) error {
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName: aws.String(d.tables.audit),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't scan table %v. Error: %w", d.tables.audit, err)
+		}
+		for _, item := range page.Items {
+			var entry storage.AuditEntry
+			if err := attributevalue.UnmarshalMap(item, &entry); err != nil {
+				return err
+			}
+			value, err := fn(entry)
+			if err != nil {
+				return err
+			}
+			expr, err := expression.NewBuilder().
+				WithUpdate(expression.Set(expression.Name("NewValue"), expression.Value(value))).
+				WithCondition(expression.Name("Actor").Equal(expression.Value(entry.Actor)).
+					And(expression.Name("NewValue").Equal(expression.Value(entry.NewValue)))).
+				Build()
+			if err != nil {
+				return err
+			}
+			_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:                 aws.String(d.tables.audit),
+				Key:                       map[string]types.AttributeValue{"Scope": item["Scope"], auditSeqAttribute: item[auditSeqAttribute]},
+				UpdateExpression:          expr.Update(),
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			})
+			if err != nil && !isConditionalCheckFailed(err) {
+				return fmt.Errorf("couldn't update item in table %v. Error: %w", d.tables.audit, err)
+			}
+		}
+	}
+	return nil
+}
@@ -16,12 +16,43 @@ import (
 	"github.com/vgjm/linebot/internal/storage"
 )
 
+const defaultCapacityUnits = 5
+
+// userIdIndex is a global secondary index of the group user setting table for
+// looking a user up across groups.
+const userIdIndex = "UserIdIndex"
+
 type DynamoDriver struct {
 	client *dynamodb.Client
+	config Config
+	tables tableNames
+}
+
+type tableNames struct {
+	userSetting      string
+	groupUserSetting string
+	ephemeral        string
+	persona          string
+	groupRole        string
+	botSetting       string
+	block            string
+	audit            string
 }
 
 type Config struct {
 	EndPoint string
+	// TablePrefix is prepended to every table name, so several environments
+	// can share one account.
+	TablePrefix string
+	// OnDemand creates tables with PAY_PER_REQUEST billing instead of
+	// provisioned ReadCapacity/WriteCapacity (5 each when unset).
+	OnDemand      bool
+	ReadCapacity  int64
+	WriteCapacity int64
+	// SkipTableCreation leaves table management to infrastructure as code.
+	SkipTableCreation bool
+	// EnableTTL turns on DynamoDB TTL for the ephemeral table.
+	EnableTTL bool
 }
 
 func New(ctx context.Context, dConfig Config) (*DynamoDriver, error) {
@@ -36,7 +67,20 @@ func New(ctx context.Context, dConfig Config) (*DynamoDriver, error) {
 
 	client := dynamodb.NewFromConfig(cfg)
 
-	driver := &DynamoDriver{client}
+	driver := &DynamoDriver{
+		client: client,
+		config: dConfig,
+		tables: tableNames{
+			userSetting:      dConfig.TablePrefix + storage.UserSettingTableName,
+			groupUserSetting: dConfig.TablePrefix + storage.GroupUserSettingTableName,
+			ephemeral:        dConfig.TablePrefix + storage.EphemeralTableName,
+			persona:          dConfig.TablePrefix + storage.PersonaTableName,
+			groupRole:        dConfig.TablePrefix + storage.GroupRoleTableName,
+			botSetting:       dConfig.TablePrefix + storage.BotSettingTableName,
+			block:            dConfig.TablePrefix + storage.BlockTableName,
+			audit:            dConfig.TablePrefix + storage.AuditTableName,
+		},
+	}
 
 	if err := driver.init(ctx); err != nil {
 		return nil, err
@@ -46,12 +90,98 @@ func New(ctx context.Context, dConfig Config) (*DynamoDriver, error) {
 }
 
 func (d *DynamoDriver) init(ctx context.Context) error {
-	if err := d.createGroupUserSettingTableIfNotExist(ctx); err != nil {
-		return err
+	if !d.config.SkipTableCreation {
+		if err := d.createGroupUserSettingTableIfNotExist(ctx); err != nil {
+			return err
+		}
+		if err := d.createUserSettingTableIfNotExist(ctx); err != nil {
+			return err
+		}
+		if err := d.createEphemeralTableIfNotExist(ctx); err != nil {
+			return err
+		}
+		if err := d.createPersonaTableIfNotExist(ctx); err != nil {
+			return err
+		}
+		if err := d.createGroupRoleTableIfNotExist(ctx); err != nil {
+			return err
+		}
+		if err := d.createBotSettingTableIfNotExist(ctx); err != nil {
+			return err
+		}
+		if err := d.createBlockTableIfNotExist(ctx); err != nil {
+			return err
+		}
+		if err := d.createAuditTableIfNotExist(ctx); err != nil {
+			return err
+		}
+		if err := d.addUserIdIndexIfNotExist(ctx); err != nil {
+			return err
+		}
+	}
+	if d.config.EnableTTL {
+		if err := d.enableTTL(ctx, d.tables.ephemeral, "ExpiresAt"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withBilling applies the configured billing mode to a table definition and
+// its indexes.
+func (d *DynamoDriver) withBilling(input *dynamodb.CreateTableInput) *dynamodb.CreateTableInput {
+	if d.config.OnDemand {
+		input.BillingMode = types.BillingModePayPerRequest
+		return input
+	}
+	input.BillingMode = types.BillingModeProvisioned
+	input.ProvisionedThroughput = d.provisionedThroughput()
+	for i := range input.GlobalSecondaryIndexes {
+		input.GlobalSecondaryIndexes[i].ProvisionedThroughput = d.provisionedThroughput()
+	}
+	return input
+}
+
+// provisionedThroughput returns nil for on-demand tables.
+func (d *DynamoDriver) provisionedThroughput() *types.ProvisionedThroughput {
+	if d.config.OnDemand {
+		return nil
+	}
+	read, write := d.config.ReadCapacity, d.config.WriteCapacity
+	if read <= 0 {
+		read = defaultCapacityUnits
+	}
+	if write <= 0 {
+		write = defaultCapacityUnits
+	}
+	return &types.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(read),
+		WriteCapacityUnits: aws.Int64(write),
+	}
+}
+
+func (d *DynamoDriver) enableTTL(ctx context.Context, tablename, attribute string) error {
+	response, err := d.client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(tablename),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't describe ttl of table %v. Error: %w", tablename, err)
 	}
-	if err := d.createUserSettingTableIfNotExist(ctx); err != nil {
-		return err
+	if desc := response.TimeToLiveDescription; desc != nil &&
+		(desc.TimeToLiveStatus == types.TimeToLiveStatusEnabled || desc.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		return nil
 	}
+	_, err = d.client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tablename),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't enable ttl of table %v. Error: %w", tablename, err)
+	}
+	slog.Info("ttl enabled.", "table", tablename, "attribute", attribute)
 	return nil
 }
 
@@ -95,7 +225,7 @@ func (d *DynamoDriver) createTableAndWait(ctx context.Context, input *dynamodb.C
 }
 
 func (d *DynamoDriver) createUserSettingTableIfNotExist(ctx context.Context) error {
-	return d.createTableAndWait(ctx, &dynamodb.CreateTableInput{
+	return d.createTableAndWait(ctx, d.withBilling(&dynamodb.CreateTableInput{
 		AttributeDefinitions: []types.AttributeDefinition{{
 			AttributeName: aws.String("UserId"),
 			AttributeType: types.ScalarAttributeTypeS,
@@ -104,16 +234,118 @@ func (d *DynamoDriver) createUserSettingTableIfNotExist(ctx context.Context) err
 			AttributeName: aws.String("UserId"),
 			KeyType:       types.KeyTypeHash,
 		}},
-		TableName: aws.String(storage.UserSettingTableName),
-		ProvisionedThroughput: &types.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(5),
-			WriteCapacityUnits: aws.Int64(5),
-		},
-	})
+		TableName: aws.String(d.tables.userSetting),
+	}))
 }
 
 func (d *DynamoDriver) createGroupUserSettingTableIfNotExist(ctx context.Context) error {
-	return d.createTableAndWait(ctx, &dynamodb.CreateTableInput{
+	return d.createTableAndWait(ctx, d.withBilling(&dynamodb.CreateTableInput{
+		AttributeDefinitions: groupUserSettingAttributes(),
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("GroupId"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("UserId"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{{
+			IndexName:  aws.String(userIdIndex),
+			KeySchema:  userIdIndexKeySchema(),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}},
+		TableName: aws.String(d.tables.groupUserSetting),
+	}))
+}
+
+func groupUserSettingAttributes() []types.AttributeDefinition {
+	return []types.AttributeDefinition{{
+		AttributeName: aws.String("GroupId"),
+		AttributeType: types.ScalarAttributeTypeS,
+	}, {
+		AttributeName: aws.String("UserId"),
+		AttributeType: types.ScalarAttributeTypeS,
+	}}
+}
+
+func userIdIndexKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{{
+		AttributeName: aws.String("UserId"),
+		KeyType:       types.KeyTypeHash,
+	}, {
+		AttributeName: aws.String("GroupId"),
+		KeyType:       types.KeyTypeRange,
+	}}
+}
+
+// addUserIdIndexIfNotExist adds the index to tables created before it existed.
+// DynamoDB backfills it in the background; lookups across groups fail until
+// it is active.
+func (d *DynamoDriver) addUserIdIndexIfNotExist(ctx context.Context) error {
+	tablename := d.tables.groupUserSetting
+	response, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tablename)})
+	if err != nil {
+		return fmt.Errorf("couldn't describe table %v. Error: %w", tablename, err)
+	}
+	for _, index := range response.Table.GlobalSecondaryIndexes {
+		if aws.ToString(index.IndexName) == userIdIndex {
+			return nil
+		}
+	}
+	_, err = d.client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName:            aws.String(tablename),
+		AttributeDefinitions: groupUserSettingAttributes(),
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+			Create: &types.CreateGlobalSecondaryIndexAction{
+				IndexName:             aws.String(userIdIndex),
+				KeySchema:             userIdIndexKeySchema(),
+				Projection:            &types.Projection{ProjectionType: types.ProjectionTypeAll},
+				ProvisionedThroughput: d.provisionedThroughput(),
+			},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't add index %v to table %v. Error: %w", userIdIndex, tablename, err)
+	}
+	slog.Info("index is being created.", "table", tablename, "index", userIdIndex)
+	return nil
+}
+
+func (d *DynamoDriver) createEphemeralTableIfNotExist(ctx context.Context) error {
+	return d.createTableAndWait(ctx, d.withBilling(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("Id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("Id"),
+			KeyType:       types.KeyTypeHash,
+		}},
+		TableName: aws.String(d.tables.ephemeral),
+	}))
+}
+
+func (d *DynamoDriver) createPersonaTableIfNotExist(ctx context.Context) error {
+	return d.createTableAndWait(ctx, d.withBilling(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("Scope"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String("Name"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("Scope"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("Name"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName: aws.String(d.tables.persona),
+	}))
+}
+
+func (d *DynamoDriver) createGroupRoleTableIfNotExist(ctx context.Context) error {
+	return d.createTableAndWait(ctx, d.withBilling(&dynamodb.CreateTableInput{
 		AttributeDefinitions: []types.AttributeDefinition{{
 			AttributeName: aws.String("GroupId"),
 			AttributeType: types.ScalarAttributeTypeS,
@@ -128,100 +360,408 @@ func (d *DynamoDriver) createGroupUserSettingTableIfNotExist(ctx context.Context
 			AttributeName: aws.String("UserId"),
 			KeyType:       types.KeyTypeRange,
 		}},
-		TableName: aws.String(storage.GroupUserSettingTableName),
-		ProvisionedThroughput: &types.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(5),
-			WriteCapacityUnits: aws.Int64(5),
-		},
-	})
+		TableName: aws.String(d.tables.groupRole),
+	}))
+}
+
+func (d *DynamoDriver) createBotSettingTableIfNotExist(ctx context.Context) error {
+	return d.createTableAndWait(ctx, d.withBilling(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("Key"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("Key"),
+			KeyType:       types.KeyTypeHash,
+		}},
+		TableName: aws.String(d.tables.botSetting),
+	}))
+}
+
+func (d *DynamoDriver) createBlockTableIfNotExist(ctx context.Context) error {
+	return d.createTableAndWait(ctx, d.withBilling(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("Id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("Id"),
+			KeyType:       types.KeyTypeHash,
+		}},
+		TableName: aws.String(d.tables.block),
+	}))
+}
+
+func (d *DynamoDriver) createAuditTableIfNotExist(ctx context.Context) error {
+	return d.createTableAndWait(ctx, d.withBilling(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("Scope"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String(auditSeqAttribute),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("Scope"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String(auditSeqAttribute),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName: aws.String(d.tables.audit),
+	}))
 }
 
 func (d *DynamoDriver) UpsertGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
-	var response *dynamodb.UpdateItemOutput
-	var attribute map[string]string
-	update := expression.Set(expression.Name(storage.SystemInstruction), expression.Value(setting.SystemInstruction))
-	expr, err := expression.NewBuilder().WithUpdate(update).Build()
-	if err != nil {
-		return err
-	} else {
-		response, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-			TableName:                 aws.String(storage.GroupUserSettingTableName),
-			Key:                       setting.GetKey(),
-			ExpressionAttributeNames:  expr.Names(),
-			ExpressionAttributeValues: expr.Values(),
-			UpdateExpression:          expr.Update(),
-			ReturnValues:              types.ReturnValueUpdatedNew,
-		})
-		if err != nil {
+	update := expression.Set(expression.Name(storage.SystemInstruction), expression.Value(setting.SystemInstruction)).
+		Set(expression.Name(storage.SettingPersona), expression.Value(setting.Persona)).
+		Set(expression.Name(storage.SettingPersonaOnly), expression.Value(setting.PersonaOnly))
+	return d.updateItem(ctx, d.groupUserSettingSchema(), setting.GetKey(), update, setting.Version)
+}
+
+func (d *DynamoDriver) GetGroupUserSetting(ctx context.Context, groupId, userId string) (*storage.GroupUserSetting, error) {
+	guSetting := storage.GroupUserSetting{GroupId: groupId, UserId: userId}
+	item, err := d.getItem(ctx, d.groupUserSettingSchema(), guSetting.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, storage.ErrNotFound
+	}
+	if err := attributevalue.UnmarshalMap(item, &guSetting); err != nil {
+		return nil, err
+	}
+	return &guSetting, nil
+}
+
+func (d *DynamoDriver) DeleteGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	return d.deleteItem(ctx, d.groupUserSettingSchema(), setting.GetKey(), setting.Version)
+}
+
+func (d *DynamoDriver) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	update := expression.Set(expression.Name(storage.SystemInstruction), expression.Value(setting.SystemInstruction)).
+		Set(expression.Name(storage.SettingPersona), expression.Value(setting.Persona)).
+		Set(expression.Name(storage.SettingTimezone), expression.Value(setting.Timezone))
+	return d.updateItem(ctx, d.userSettingSchema(), setting.GetKey(), update, setting.Version)
+}
+
+func (d *DynamoDriver) GetUserSetting(ctx context.Context, userId string) (*storage.UserSetting, error) {
+	uSetting := storage.UserSetting{UserId: userId}
+	item, err := d.getItem(ctx, d.userSettingSchema(), uSetting.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, storage.ErrNotFound
+	}
+	if err := attributevalue.UnmarshalMap(item, &uSetting); err != nil {
+		return nil, err
+	}
+	return &uSetting, nil
+}
+
+func (d *DynamoDriver) DeleteUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	return d.deleteItem(ctx, d.userSettingSchema(), setting.GetKey(), setting.Version)
+}
+
+func (d *DynamoDriver) ScanGroupUserSettings(ctx context.Context, fn func(storage.GroupUserSetting) error) error {
+	return d.scanItems(ctx, d.groupUserSettingSchema(), func(item map[string]types.AttributeValue) error {
+		var setting storage.GroupUserSetting
+		if err := attributevalue.UnmarshalMap(item, &setting); err != nil {
 			return err
-		} else {
-			err = attributevalue.UnmarshalMap(response.Attributes, &attribute)
-			if err != nil {
-				return err
+		}
+		return fn(setting)
+	})
+}
+
+func (d *DynamoDriver) ScanUserSettings(ctx context.Context, fn func(storage.UserSetting) error) error {
+	return d.scanItems(ctx, d.userSettingSchema(), func(item map[string]types.AttributeValue) error {
+		var setting storage.UserSetting
+		if err := attributevalue.UnmarshalMap(item, &setting); err != nil {
+			return err
+		}
+		return fn(setting)
+	})
+}
+
+func (d *DynamoDriver) ListGroupUserSettings(ctx context.Context, groupId, after string, limit int) ([]storage.GroupUserSetting, error) {
+	schema := d.groupUserSettingSchema()
+	keyCond := expression.Key("GroupId").Equal(expression.Value(groupId))
+	if after != "" {
+		keyCond = keyCond.And(expression.Key("UserId").GreaterThan(expression.Value(after)))
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return nil, err
+	}
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(schema.name),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+		Limit:                     aws.Int32(int32(limit)),
+	})
+	var settings []storage.GroupUserSetting
+	for paginator.HasMorePages() && len(settings) < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't query table %v. Error: %w", schema.name, err)
+		}
+		for _, item := range page.Items[:min(len(page.Items), limit-len(settings))] {
+			if _, _, err := d.upgradeItem(ctx, schema, item, false); err != nil {
+				return nil, err
+			}
+			var setting storage.GroupUserSetting
+			if err := attributevalue.UnmarshalMap(item, &setting); err != nil {
+				return nil, err
 			}
+			settings = append(settings, setting)
 		}
 	}
-	return nil
+	return settings, nil
 }
 
-func (d *DynamoDriver) GetGroupUserSetting(ctx context.Context, groupId, userId string) (*storage.GroupUserSetting, error) {
-	guSetting := storage.GroupUserSetting{GroupId: groupId, UserId: userId}
-	response, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
-		Key:       guSetting.GetKey(),
-		TableName: aws.String(storage.GroupUserSettingTableName),
-	})
+func (d *DynamoDriver) ListGroupUserSettingsByUser(ctx context.Context, userId string) ([]storage.GroupUserSetting, error) {
+	schema := d.groupUserSettingSchema()
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("UserId").Equal(expression.Value(userId))).
+		Build()
 	if err != nil {
 		return nil, err
-	} else {
-		err = attributevalue.UnmarshalMap(response.Item, &guSetting)
+	}
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(schema.name),
+		IndexName:                 aws.String(userIdIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var settings []storage.GroupUserSetting
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("couldn't query index %v of table %v. Error: %w", userIdIndex, schema.name, err)
+		}
+		for _, item := range page.Items {
+			if _, _, err := d.upgradeItem(ctx, schema, item, false); err != nil {
+				return nil, err
+			}
+			var setting storage.GroupUserSetting
+			if err := attributevalue.UnmarshalMap(item, &setting); err != nil {
+				return nil, err
+			}
+			settings = append(settings, setting)
 		}
 	}
-	return &guSetting, nil
+	return settings, nil
 }
 
-func (d *DynamoDriver) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) error {
-	var response *dynamodb.UpdateItemOutput
-	var attribute map[string]string
-	update := expression.Set(expression.Name(storage.SystemInstruction), expression.Value(setting.SystemInstruction))
-	expr, err := expression.NewBuilder().WithUpdate(update).Build()
-	if err != nil {
-		return err
-	} else {
-		response, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-			TableName:                 aws.String(storage.UserSettingTableName),
-			Key:                       setting.GetKey(),
-			ExpressionAttributeNames:  expr.Names(),
-			ExpressionAttributeValues: expr.Values(),
-			UpdateExpression:          expr.Update(),
-			ReturnValues:              types.ReturnValueUpdatedNew,
-		})
+func (d *DynamoDriver) UpsertPersona(ctx context.Context, persona storage.Persona) error {
+	update := expression.Set(expression.Name(storage.SystemInstruction), expression.Value(persona.SystemInstruction))
+	return d.updateItem(ctx, d.personaSchema(), persona.GetKey(), update, persona.Version)
+}
+
+func (d *DynamoDriver) GetPersona(ctx context.Context, scope, name string) (*storage.Persona, error) {
+	persona := storage.Persona{Scope: scope, Name: name}
+	item, err := d.getItem(ctx, d.personaSchema(), persona.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, storage.ErrNotFound
+	}
+	if err := attributevalue.UnmarshalMap(item, &persona); err != nil {
+		return nil, err
+	}
+	return &persona, nil
+}
+
+func (d *DynamoDriver) DeletePersona(ctx context.Context, persona storage.Persona) error {
+	return d.deleteItem(ctx, d.personaSchema(), persona.GetKey(), persona.Version)
+}
+
+func (d *DynamoDriver) ListPersonas(ctx context.Context, scope string) ([]storage.Persona, error) {
+	schema := d.personaSchema()
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("Scope").Equal(expression.Value(scope))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(schema.name),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+	})
+	var personas []storage.Persona
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return err
-		} else {
-			err = attributevalue.UnmarshalMap(response.Attributes, &attribute)
-			if err != nil {
-				return err
+			return nil, fmt.Errorf("couldn't query table %v. Error: %w", schema.name, err)
+		}
+		for _, item := range page.Items {
+			if _, _, err := d.upgradeItem(ctx, schema, item, false); err != nil {
+				return nil, err
+			}
+			var persona storage.Persona
+			if err := attributevalue.UnmarshalMap(item, &persona); err != nil {
+				return nil, err
 			}
+			personas = append(personas, persona)
 		}
 	}
-	return nil
+	return personas, nil
 }
 
-func (d *DynamoDriver) GetUserSetting(ctx context.Context, userId string) (*storage.UserSetting, error) {
-	uSetting := storage.UserSetting{UserId: userId}
-	response, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
-		Key:       uSetting.GetKey(),
-		TableName: aws.String(storage.UserSettingTableName),
+func (d *DynamoDriver) ScanPersonas(ctx context.Context, fn func(storage.Persona) error) error {
+	return d.scanItems(ctx, d.personaSchema(), func(item map[string]types.AttributeValue) error {
+		var persona storage.Persona
+		if err := attributevalue.UnmarshalMap(item, &persona); err != nil {
+			return err
+		}
+		return fn(persona)
 	})
+}
+
+func (d *DynamoDriver) UpsertGroupRole(ctx context.Context, role storage.GroupRole) error {
+	update := expression.Set(expression.Name(storage.GroupRoleRole), expression.Value(role.Role))
+	return d.updateItem(ctx, d.groupRoleSchema(), role.GetKey(), update, role.Version)
+}
+
+func (d *DynamoDriver) GetGroupRole(ctx context.Context, groupId, userId string) (*storage.GroupRole, error) {
+	role := storage.GroupRole{GroupId: groupId, UserId: userId}
+	item, err := d.getItem(ctx, d.groupRoleSchema(), role.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, storage.ErrNotFound
+	}
+	if err := attributevalue.UnmarshalMap(item, &role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (d *DynamoDriver) DeleteGroupRole(ctx context.Context, role storage.GroupRole) error {
+	return d.deleteItem(ctx, d.groupRoleSchema(), role.GetKey(), role.Version)
+}
+
+func (d *DynamoDriver) ListGroupRoles(ctx context.Context, groupId string) ([]storage.GroupRole, error) {
+	schema := d.groupRoleSchema()
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("GroupId").Equal(expression.Value(groupId))).
+		Build()
 	if err != nil {
 		return nil, err
-	} else {
-		err = attributevalue.UnmarshalMap(response.Item, &uSetting)
+	}
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(schema.name),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+	})
+	var roles []storage.GroupRole
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("couldn't query table %v. Error: %w", schema.name, err)
+		}
+		for _, item := range page.Items {
+			if _, _, err := d.upgradeItem(ctx, schema, item, false); err != nil {
+				return nil, err
+			}
+			var role storage.GroupRole
+			if err := attributevalue.UnmarshalMap(item, &role); err != nil {
+				return nil, err
+			}
+			roles = append(roles, role)
 		}
 	}
-	return &uSetting, nil
+	return roles, nil
+}
+
+func (d *DynamoDriver) ScanGroupRoles(ctx context.Context, fn func(storage.GroupRole) error) error {
+	return d.scanItems(ctx, d.groupRoleSchema(), func(item map[string]types.AttributeValue) error {
+		var role storage.GroupRole
+		if err := attributevalue.UnmarshalMap(item, &role); err != nil {
+			return err
+		}
+		return fn(role)
+	})
+}
+
+func (d *DynamoDriver) UpsertBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	update := expression.Set(expression.Name(storage.BotSettingValue), expression.Value(setting.Value))
+	return d.updateItem(ctx, d.botSettingSchema(), setting.GetKey(), update, setting.Version)
+}
+
+func (d *DynamoDriver) GetBotSetting(ctx context.Context, key string) (*storage.BotSetting, error) {
+	setting := storage.BotSetting{Key: key}
+	item, err := d.getItem(ctx, d.botSettingSchema(), setting.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, storage.ErrNotFound
+	}
+	if err := attributevalue.UnmarshalMap(item, &setting); err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+func (d *DynamoDriver) DeleteBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	return d.deleteItem(ctx, d.botSettingSchema(), setting.GetKey(), setting.Version)
+}
+
+func (d *DynamoDriver) ScanBotSettings(ctx context.Context, fn func(storage.BotSetting) error) error {
+	return d.scanItems(ctx, d.botSettingSchema(), func(item map[string]types.AttributeValue) error {
+		var setting storage.BotSetting
+		if err := attributevalue.UnmarshalMap(item, &setting); err != nil {
+			return err
+		}
+		return fn(setting)
+	})
+}
+
+func (d *DynamoDriver) UpsertBlock(ctx context.Context, block storage.Block) error {
+	update := expression.Set(expression.Name(storage.BlockReason), expression.Value(block.Reason)).
+		Set(expression.Name(storage.BlockCreatedBy), expression.Value(block.CreatedBy)).
+		Set(expression.Name(storage.BlockCreatedAt), expression.Value(block.CreatedAt)).
+		Set(expression.Name(storage.BlockExpiresAt), expression.Value(block.ExpiresAt))
+	return d.updateItem(ctx, d.blockSchema(), block.GetKey(), update, block.Version)
+}
+
+func (d *DynamoDriver) GetBlock(ctx context.Context, id string) (*storage.Block, error) {
+	block := storage.Block{Id: id}
+	item, err := d.getItem(ctx, d.blockSchema(), block.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, storage.ErrNotFound
+	}
+	if err := attributevalue.UnmarshalMap(item, &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+func (d *DynamoDriver) DeleteBlock(ctx context.Context, block storage.Block) error {
+	return d.deleteItem(ctx, d.blockSchema(), block.GetKey(), block.Version)
+}
+
+func (d *DynamoDriver) ScanBlocks(ctx context.Context, fn func(storage.Block) error) error {
+	return d.scanItems(ctx, d.blockSchema(), func(item map[string]types.AttributeValue) error {
+		var block storage.Block
+		if err := attributevalue.UnmarshalMap(item, &block); err != nil {
+			return err
+		}
+		return fn(block)
+	})
 }
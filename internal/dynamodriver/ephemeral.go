@@ -0,0 +1,269 @@
+package dynamodriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// DynamoDB TTL deletes expired items lazily, up to days later, so every read
+// still checks ExpiresAt itself.
+
+const maxCounterAttempts = 3
+
+// expiresAt rounds up to whole seconds, the resolution of DynamoDB TTL, so an
+// item never expires earlier than asked.
+func expiresAt(now time.Time, ttl time.Duration) int64 {
+	return now.Add(ttl + time.Second - 1).Unix()
+}
+
+func expired(item storage.EphemeralItem, now time.Time) bool {
+	return item.ExpiresAt <= now.Unix()
+}
+
+func (d *DynamoDriver) getEphemeralItem(ctx context.Context, key string) (*storage.EphemeralItem, error) {
+	item := storage.EphemeralItem{Id: key}
+	response, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		Key:       item.GetKey(),
+		TableName: aws.String(d.tables.ephemeral),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Item == nil {
+		return nil, nil
+	}
+	if err := attributevalue.UnmarshalMap(response.Item, &item); err != nil {
+		return nil, err
+	}
+	if expired(item, time.Now()) {
+		return nil, nil
+	}
+	return &item, nil
+}
+
+func (d *DynamoDriver) putEphemeralItem(ctx context.Context, item storage.EphemeralItem, cond *expression.ConditionBuilder) error {
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(d.tables.ephemeral),
+		Item:      av,
+	}
+	if cond != nil {
+		expr, err := expression.NewBuilder().WithCondition(*cond).Build()
+		if err != nil {
+			return err
+		}
+		input.ConditionExpression = expr.Condition()
+		input.ExpressionAttributeNames = expr.Names()
+		input.ExpressionAttributeValues = expr.Values()
+	}
+	_, err = d.client.PutItem(ctx, input)
+	return err
+}
+
+// scanEphemeral reads the whole ephemeral table, so it is only meant for rare
+// maintenance like privacy requests.
+func (d *DynamoDriver) scanEphemeral(ctx context.Context, prefix string, cond expression.ConditionBuilder, fn func(storage.EphemeralItem) error) error {
+	now := time.Now()
+	filter := expression.BeginsWith(expression.Name("Id"), prefix).
+		And(expression.Name("ExpiresAt").GreaterThan(expression.Value(now.Unix()))).
+		And(cond)
+	expr, err := expression.NewBuilder().WithFilter(filter).Build()
+	if err != nil {
+		return err
+	}
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName:                 aws.String(d.tables.ephemeral),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't scan table %v. Error: %w", d.tables.ephemeral, err)
+		}
+		for _, av := range page.Items {
+			var item storage.EphemeralItem
+			if err := attributevalue.UnmarshalMap(av, &item); err != nil {
+				return err
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDriver) deleteEphemeralItem(ctx context.Context, key string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tables.ephemeral),
+		Key:       storage.EphemeralItem{Id: key}.GetKey(),
+	})
+	return err
+}
+
+func (d *DynamoDriver) AppendHistory(ctx context.Context, key string, message storage.HistoryMessage, maxLen int, ttl time.Duration) error {
+	item, err := d.getEphemeralItem(ctx, key)
+	if err != nil {
+		return err
+	}
+	var history []storage.HistoryMessage
+	if item != nil {
+		history = item.Messages
+	}
+	return d.putEphemeralItem(ctx, storage.EphemeralItem{
+		Id:        key,
+		ExpiresAt: expiresAt(time.Now(), ttl),
+		Messages:  storage.AppendHistory(history, message, maxLen),
+	}, nil)
+}
+
+func (d *DynamoDriver) GetHistory(ctx context.Context, key string) ([]storage.HistoryMessage, error) {
+	item, err := d.getEphemeralItem(ctx, key)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return item.Messages, nil
+}
+
+func (d *DynamoDriver) ScanHistory(ctx context.Context, prefix string, fn func(key string, history []storage.HistoryMessage) error) error {
+	return d.scanEphemeral(ctx, prefix, expression.AttributeExists(expression.Name("Messages")), func(item storage.EphemeralItem) error {
+		return fn(item.Id, item.Messages)
+	})
+}
+
+// RewriteHistory writes the history back only if its messages and expiry are
+// still those read.
+func (d *DynamoDriver) RewriteHistory(ctx context.Context, key string, fn func([]storage.HistoryMessage) ([]storage.HistoryMessage, error)) error {
+	item, err := d.getEphemeralItem(ctx, key)
+	if err != nil || item == nil || item.Messages == nil {
+		return err
+	}
+	history, err := fn(slices.Clone(item.Messages))
+	if err != nil {
+		return err
+	}
+	cond := expression.Name("Messages").Equal(expression.Value(item.Messages)).
+		And(expression.Name("ExpiresAt").Equal(expression.Value(item.ExpiresAt)))
+	err = d.putEphemeralItem(ctx, storage.EphemeralItem{
+		Id:        key,
+		ExpiresAt: item.ExpiresAt,
+		Messages:  history,
+	}, &cond)
+	if isConditionalCheckFailed(err) {
+		return storage.ErrConflict
+	}
+	return err
+}
+
+func (d *DynamoDriver) DeleteHistory(ctx context.Context, key string) error {
+	return d.deleteEphemeralItem(ctx, key)
+}
+
+func (d *DynamoDriver) IncrCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	var err error
+	for range maxCounterAttempts {
+		var value int64
+		value, err = d.incrLiveCounter(ctx, key, delta, ttl)
+		if !isConditionalCheckFailed(err) {
+			return value, err
+		}
+		// The counter exists but its window has passed; start a new one unless
+		// another writer already did.
+		now := time.Now()
+		cond := expression.Name("ExpiresAt").LessThanEqual(expression.Value(now.Unix()))
+		err = d.putEphemeralItem(ctx, storage.EphemeralItem{
+			Id:        key,
+			ExpiresAt: expiresAt(now, ttl),
+			Value:     delta,
+		}, &cond)
+		if !isConditionalCheckFailed(err) {
+			return delta, err
+		}
+	}
+	return 0, err
+}
+
+func (d *DynamoDriver) incrLiveCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	update := expression.Add(expression.Name("Value"), expression.Value(delta)).
+		Set(expression.Name("ExpiresAt"), expression.IfNotExists(expression.Name("ExpiresAt"), expression.Value(expiresAt(now, ttl))))
+	cond := expression.AttributeNotExists(expression.Name("Id")).
+		Or(expression.Name("ExpiresAt").GreaterThan(expression.Value(now.Unix())))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return 0, err
+	}
+	response, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(d.tables.ephemeral),
+		Key:                       storage.EphemeralItem{Id: key}.GetKey(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var item storage.EphemeralItem
+	if err := attributevalue.UnmarshalMap(response.Attributes, &item); err != nil {
+		return 0, err
+	}
+	return item.Value, nil
+}
+
+func (d *DynamoDriver) GetCounter(ctx context.Context, key string) (int64, error) {
+	item, err := d.getEphemeralItem(ctx, key)
+	if err != nil || item == nil {
+		return 0, err
+	}
+	return item.Value, nil
+}
+
+func (d *DynamoDriver) ScanCounters(ctx context.Context, prefix string, fn func(key string, value int64) error) error {
+	return d.scanEphemeral(ctx, prefix, expression.AttributeNotExists(expression.Name("Messages")), func(item storage.EphemeralItem) error {
+		return fn(item.Id, item.Value)
+	})
+}
+
+func (d *DynamoDriver) DeleteCounter(ctx context.Context, key string) error {
+	return d.deleteEphemeralItem(ctx, key)
+}
+
+func (d *DynamoDriver) MarkProcessed(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	cond := expression.AttributeNotExists(expression.Name("Id")).
+		Or(expression.Name("ExpiresAt").LessThanEqual(expression.Value(now.Unix())))
+	err := d.putEphemeralItem(ctx, storage.EphemeralItem{
+		Id:        key,
+		ExpiresAt: expiresAt(now, ttl),
+	}, &cond)
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *DynamoDriver) UnmarkProcessed(ctx context.Context, key string) error {
+	return d.deleteEphemeralItem(ctx, key)
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var condErr *types.ConditionalCheckFailedException
+	return errors.As(err, &condErr)
+}
@@ -0,0 +1,472 @@
+package dynamodriver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// Settings items carry a SchemaVersion attribute. Items older than the
+// current version are upgraded lazily when read, or in bulk with MigrateItems.
+// Writes only ever touch items at the current version, so a partial update
+// never stamps an old item as current without running its migrations.
+
+const schemaVersionAttribute = "SchemaVersion"
+
+// itemMigration upgrades an item in place from version i to i+1, where i is
+// its index in a table's migrations. Append new migrations, never edit one.
+type itemMigration func(item map[string]types.AttributeValue) error
+
+var userSettingMigrations = []itemMigration{
+	// 1: items written before schema versions existed, nothing to change.
+	func(item map[string]types.AttributeValue) error { return nil },
+}
+
+var groupUserSettingMigrations = []itemMigration{
+	// 1: items written before schema versions existed, nothing to change.
+	func(item map[string]types.AttributeValue) error { return nil },
+}
+
+// personaMigrations is empty: persona items carry a schema version from the
+// start.
+var personaMigrations []itemMigration
+
+// groupRoleMigrations, botSettingMigrations and blockMigrations are empty for
+// the same reason.
+var (
+	groupRoleMigrations  []itemMigration
+	botSettingMigrations []itemMigration
+	blockMigrations      []itemMigration
+)
+
+type tableSchema struct {
+	base       string
+	name       string
+	keys       []string
+	migrations []itemMigration
+}
+
+func (t tableSchema) currentVersion() int {
+	return len(t.migrations)
+}
+
+func (d *DynamoDriver) userSettingSchema() tableSchema {
+	return tableSchema{
+		base:       storage.UserSettingTableName,
+		name:       d.tables.userSetting,
+		keys:       []string{"UserId"},
+		migrations: userSettingMigrations,
+	}
+}
+
+func (d *DynamoDriver) groupUserSettingSchema() tableSchema {
+	return tableSchema{
+		base:       storage.GroupUserSettingTableName,
+		name:       d.tables.groupUserSetting,
+		keys:       []string{"GroupId", "UserId"},
+		migrations: groupUserSettingMigrations,
+	}
+}
+
+func (d *DynamoDriver) personaSchema() tableSchema {
+	return tableSchema{
+		base:       storage.PersonaTableName,
+		name:       d.tables.persona,
+		keys:       []string{"Scope", "Name"},
+		migrations: personaMigrations,
+	}
+}
+
+func (d *DynamoDriver) groupRoleSchema() tableSchema {
+	return tableSchema{
+		base:       storage.GroupRoleTableName,
+		name:       d.tables.groupRole,
+		keys:       []string{"GroupId", "UserId"},
+		migrations: groupRoleMigrations,
+	}
+}
+
+func (d *DynamoDriver) botSettingSchema() tableSchema {
+	return tableSchema{
+		base:       storage.BotSettingTableName,
+		name:       d.tables.botSetting,
+		keys:       []string{"Key"},
+		migrations: botSettingMigrations,
+	}
+}
+
+func (d *DynamoDriver) blockSchema() tableSchema {
+	return tableSchema{
+		base:       storage.BlockTableName,
+		name:       d.tables.block,
+		keys:       []string{"Id"},
+		migrations: blockMigrations,
+	}
+}
+
+func (d *DynamoDriver) migratedSchemas() []tableSchema {
+	return []tableSchema{
+		d.userSettingSchema(), d.groupUserSettingSchema(), d.personaSchema(),
+		d.groupRoleSchema(), d.botSettingSchema(), d.blockSchema(),
+	}
+}
+
+func itemVersion(item map[string]types.AttributeValue) (int, error) {
+	av, ok := item[schemaVersionAttribute]
+	if !ok {
+		return 0, nil
+	}
+	var version int
+	if err := attributevalue.Unmarshal(av, &version); err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", schemaVersionAttribute, err)
+	}
+	return version, nil
+}
+
+// upgradeItem runs the pending migrations on item in memory and, when write is
+// set, stores it unless another writer changed it in the meantime.
+func (d *DynamoDriver) upgradeItem(ctx context.Context, schema tableSchema, item map[string]types.AttributeValue, write bool) (from int, upgraded bool, err error) {
+	from, err = itemVersion(item)
+	if err != nil {
+		return 0, false, err
+	}
+	current := schema.currentVersion()
+	if from >= current {
+		return from, false, nil
+	}
+	for v := from; v < current; v++ {
+		if err := schema.migrations[v](item); err != nil {
+			return from, false, fmt.Errorf("migration %d of table %v failed: %w", v+1, schema.name, err)
+		}
+	}
+	item[schemaVersionAttribute] = &types.AttributeValueMemberN{Value: strconv.Itoa(current)}
+	if !write {
+		return from, true, nil
+	}
+
+	cond := expression.AttributeExists(expression.Name(schema.keys[0]))
+	if from == 0 {
+		cond = cond.And(expression.AttributeNotExists(expression.Name(schemaVersionAttribute)))
+	} else {
+		cond = cond.And(expression.Name(schemaVersionAttribute).Equal(expression.Value(from)))
+	}
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return from, false, err
+	}
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(schema.name),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConditionalCheckFailed(err) {
+		// Someone else upgraded, rewrote or deleted the item first.
+		return from, false, nil
+	}
+	return from, err == nil, err
+}
+
+// getItem reads an item and upgrades it when it is behind the current schema.
+// A missing item is returned as nil.
+func (d *DynamoDriver) getItem(ctx context.Context, schema tableSchema, key map[string]types.AttributeValue) (map[string]types.AttributeValue, error) {
+	response, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		Key:       key,
+		TableName: aws.String(schema.name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Item == nil {
+		return nil, nil
+	}
+	if _, _, err := d.upgradeItem(ctx, schema, response.Item, true); err != nil {
+		slog.Warn("failed to upgrade item", "table", schema.name, "error", err)
+	}
+	return response.Item, nil
+}
+
+// updateItem applies update to a new or current-version item, upgrading an
+// old item first. The write only happens while the item's Version still equals
+// version, and bumps it by one; otherwise it returns storage.ErrConflict.
+func (d *DynamoDriver) updateItem(ctx context.Context, schema tableSchema, key map[string]types.AttributeValue, update expression.UpdateBuilder, version int64) error {
+	current := schema.currentVersion()
+	update = update.
+		Set(expression.Name(schemaVersionAttribute), expression.Value(current)).
+		Set(expression.Name(storage.SettingVersion), expression.Value(version+1))
+	cond := expression.AttributeNotExists(expression.Name(schema.keys[0])).
+		Or(expression.Name(schemaVersionAttribute).Equal(expression.Value(current))).
+		And(versionCondition(version))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(schema.name),
+		Key:                       key,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	}
+	_, err = d.client.UpdateItem(ctx, input)
+	if !isConditionalCheckFailed(err) {
+		return err
+	}
+
+	// Either the item is behind the current schema or someone else wrote it.
+	item, err := d.getItem(ctx, schema, key)
+	if err != nil {
+		return err
+	}
+	if stored, err := settingVersion(item); err != nil {
+		return err
+	} else if stored != version {
+		return storage.ErrConflict
+	}
+	if v, err := itemVersion(item); err != nil {
+		return err
+	} else if v > current {
+		return fmt.Errorf("item in table %v has schema version %d which this build does not support", schema.name, v)
+	}
+	_, err = d.client.UpdateItem(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return storage.ErrConflict
+	}
+	return err
+}
+
+// scanItems calls fn for every item of a table, upgraded in memory to the
+// current schema.
+func (d *DynamoDriver) scanItems(ctx context.Context, schema tableSchema, fn func(map[string]types.AttributeValue) error) error {
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName: aws.String(schema.name),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't scan table %v. Error: %w", schema.name, err)
+		}
+		for _, item := range page.Items {
+			if _, _, err := d.upgradeItem(ctx, schema, item, false); err != nil {
+				return err
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteItem removes an item while its Version still equals version.
+func (d *DynamoDriver) deleteItem(ctx context.Context, schema tableSchema, key map[string]types.AttributeValue, version int64) error {
+	cond := expression.AttributeExists(expression.Name(schema.keys[0])).And(versionCondition(version))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(schema.name),
+		Key:                       key,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if !isConditionalCheckFailed(err) {
+		return err
+	}
+	item, err := d.getItem(ctx, schema, key)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return storage.ErrNotFound
+	}
+	return storage.ErrConflict
+}
+
+// versionCondition matches items at version, where items written before
+// settings were versioned have no Version at all.
+func versionCondition(version int64) expression.ConditionBuilder {
+	if version == 0 {
+		return expression.AttributeNotExists(expression.Name(storage.SettingVersion))
+	}
+	return expression.Name(storage.SettingVersion).Equal(expression.Value(version))
+}
+
+func settingVersion(item map[string]types.AttributeValue) (int64, error) {
+	var stored struct {
+		Version int64 `dynamodbav:"Version"`
+	}
+	if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+		return 0, err
+	}
+	return stored.Version, nil
+}
+
+type MigrationOptions struct {
+	// Tables limits the migration to these base table names, all when empty.
+	Tables []string
+	// DryRun runs the migrations in memory without writing anything.
+	DryRun bool
+	// ResumeToken continues an interrupted run from the page it reported.
+	ResumeToken string
+	PageSize    int32
+	// OnItem is called for every item behind the current schema version.
+	OnItem func(table string, key map[string]string, from, to int)
+	// OnPage is called after every scanned page.
+	OnPage func(MigrationProgress)
+}
+
+type MigrationProgress struct {
+	Table    string
+	Scanned  int
+	Upgraded int
+	// ResumeToken restarts the run after this page; empty once every table is done.
+	ResumeToken string
+}
+
+type resumeToken struct {
+	Table string            `json:"table"`
+	Key   map[string]string `json:"key"`
+}
+
+func encodeResumeToken(table string, key map[string]types.AttributeValue) (string, error) {
+	if key == nil {
+		return "", nil
+	}
+	token := resumeToken{Table: table}
+	if err := attributevalue.UnmarshalMap(key, &token.Key); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeResumeToken(s string) (*resumeToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resume token: %w", err)
+	}
+	var token resumeToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("invalid resume token: %w", err)
+	}
+	return &token, nil
+}
+
+// MigrateItems scans the settings tables and upgrades every item behind the
+// current schema version.
+func (d *DynamoDriver) MigrateItems(ctx context.Context, opts MigrationOptions) error {
+	var resume *resumeToken
+	if opts.ResumeToken != "" {
+		var err error
+		if resume, err = decodeResumeToken(opts.ResumeToken); err != nil {
+			return err
+		}
+	}
+
+	schemas := d.migratedSchemas()
+	if len(opts.Tables) > 0 {
+		schemas = slices.DeleteFunc(schemas, func(s tableSchema) bool {
+			return !slices.Contains(opts.Tables, s.base)
+		})
+	}
+	if resume != nil {
+		i := slices.IndexFunc(schemas, func(s tableSchema) bool { return s.base == resume.Table })
+		if i < 0 {
+			return fmt.Errorf("resume token refers to table %v which is not being migrated", resume.Table)
+		}
+		schemas = schemas[i:]
+	}
+
+	for i, schema := range schemas {
+		var startKey map[string]types.AttributeValue
+		if resume != nil && resume.Table == schema.base && len(resume.Key) > 0 {
+			var err error
+			if startKey, err = attributevalue.MarshalMap(resume.Key); err != nil {
+				return err
+			}
+		}
+		var next string
+		if i+1 < len(schemas) {
+			next = schemas[i+1].base
+		}
+		if err := d.migrateTable(ctx, schema, startKey, next, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDriver) migrateTable(ctx context.Context, schema tableSchema, startKey map[string]types.AttributeValue, nextTable string, opts MigrationOptions) error {
+	input := &dynamodb.ScanInput{
+		TableName:         aws.String(schema.name),
+		ExclusiveStartKey: startKey,
+	}
+	if opts.PageSize > 0 {
+		input.Limit = aws.Int32(opts.PageSize)
+	}
+	paginator := dynamodb.NewScanPaginator(d.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't scan table %v. Error: %w", schema.name, err)
+		}
+
+		progress := MigrationProgress{Table: schema.base, Scanned: len(page.Items)}
+		for _, item := range page.Items {
+			key := make(map[string]string, len(schema.keys))
+			for _, k := range schema.keys {
+				var v string
+				if err := attributevalue.Unmarshal(item[k], &v); err != nil {
+					return err
+				}
+				key[k] = v
+			}
+			from, upgraded, err := d.upgradeItem(ctx, schema, item, !opts.DryRun)
+			if err != nil {
+				return err
+			}
+			if from < schema.currentVersion() && opts.OnItem != nil {
+				opts.OnItem(schema.base, key, from, schema.currentVersion())
+			}
+			if upgraded {
+				progress.Upgraded++
+			}
+		}
+
+		progress.ResumeToken, err = encodeResumeToken(schema.base, page.LastEvaluatedKey)
+		if err != nil {
+			return err
+		}
+		if progress.ResumeToken == "" && nextTable != "" {
+			// This table is done; resuming starts the next one from the top.
+			data, err := json.Marshal(resumeToken{Table: nextTable})
+			if err != nil {
+				return err
+			}
+			progress.ResumeToken = base64.RawURLEncoding.EncodeToString(data)
+		}
+		if opts.OnPage != nil {
+			opts.OnPage(progress)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package dynamodriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestUpgradeItemInMemory(t *testing.T) {
+	d := &DynamoDriver{}
+	schema := d.userSettingSchema()
+	item := map[string]types.AttributeValue{
+		"UserId": &types.AttributeValueMemberS{Value: "test"},
+	}
+
+	from, upgraded, err := d.upgradeItem(context.TODO(), schema, item, false)
+	if err != nil {
+		t.Fatalf("failed to upgrade item: %v\n", err)
+	}
+	if from != 0 || !upgraded {
+		t.Fatalf("expect a legacy item to be upgraded, got from: %v, upgraded: %v\n", from, upgraded)
+	}
+	version, err := itemVersion(item)
+	if err != nil {
+		t.Fatalf("failed to read schema version: %v\n", err)
+	}
+	if version != schema.currentVersion() {
+		t.Fatalf("got schema version %v, expect: %v\n", version, schema.currentVersion())
+	}
+
+	if _, upgraded, err := d.upgradeItem(context.TODO(), schema, item, false); err != nil || upgraded {
+		t.Fatalf("expect a current item to be left alone, got upgraded: %v, error: %v\n", upgraded, err)
+	}
+}
+
+func TestResumeToken(t *testing.T) {
+	key := map[string]types.AttributeValue{
+		"GroupId": &types.AttributeValueMemberS{Value: "group"},
+		"UserId":  &types.AttributeValueMemberS{Value: "user"},
+	}
+	encoded, err := encodeResumeToken("LineBotGroupUserSetting", key)
+	if err != nil {
+		t.Fatalf("failed to encode resume token: %v\n", err)
+	}
+	token, err := decodeResumeToken(encoded)
+	if err != nil {
+		t.Fatalf("failed to decode resume token: %v\n", err)
+	}
+	if token.Table != "LineBotGroupUserSetting" || token.Key["GroupId"] != "group" || token.Key["UserId"] != "user" {
+		t.Fatalf("got different resume token: %+v\n", token)
+	}
+
+	if _, err := decodeResumeToken("not a token"); err == nil {
+		t.Fatal("expect an error for a malformed token")
+	}
+}
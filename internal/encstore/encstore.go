@@ -0,0 +1,440 @@
+// Package encstore encrypts personal data before it reaches a storage.Storage.
+package encstore
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+var _ storage.Storage = (*EncStore)(nil)
+
+const (
+	// envelopePrefix marks an encrypted value; anything else is read as
+	// plaintext written before encryption was enabled.
+	envelopePrefix = "enc:v1:"
+	// maxDataKeyUses bounds how many values are sealed with one data key,
+	// well below the limit for random AES-GCM nonces.
+	maxDataKeyUses = 1 << 20
+	// maxOpenedKeys bounds the unwrapped data keys kept in memory.
+	maxOpenedKeys = 1000
+)
+
+// EncStore encrypts system instructions, personas, history messages and the
+// new values of audit entries with envelope encryption: each value is sealed
+// with AES-256-GCM under a data key, and the data key is stored next to it,
+// wrapped by a KeyProvider. The item key is bound to the ciphertext so values
+// cannot be swapped between users. Counters
+// and processed markers hold no personal data and are passed through.
+type EncStore struct {
+	storage.Storage
+	keys KeyProvider
+
+	mu      sync.Mutex
+	current *dataKey
+	uses    int
+	// opened caches unwrapped data keys by their wrapped form, so reads do
+	// not call the key provider every time.
+	opened map[string]cipher.AEAD
+}
+
+type dataKey struct {
+	wrapped []byte
+	aead    cipher.AEAD
+}
+
+func New(backing storage.Storage, keys KeyProvider) *EncStore {
+	return &EncStore{
+		Storage: backing,
+		keys:    keys,
+		opened:  make(map[string]cipher.AEAD),
+	}
+}
+
+// RotateDataKey makes the next write generate a new data key, wrapped by the
+// provider's current master key.
+func (e *EncStore) RotateDataKey() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.current = nil
+}
+
+func (e *EncStore) dataKey(ctx context.Context) (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.current == nil || e.uses >= maxDataKeyUses {
+		plaintext, wrapped, err := e.keys.GenerateDataKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		e.current = &dataKey{wrapped: wrapped, aead: aead}
+		e.uses = 0
+		e.remember(wrapped, aead)
+	}
+	e.uses++
+	return e.current, nil
+}
+
+func (e *EncStore) openDataKey(ctx context.Context, wrapped []byte) (cipher.AEAD, error) {
+	e.mu.Lock()
+	aead, ok := e.opened[string(wrapped)]
+	e.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	plaintext, err := e.keys.DecryptDataKey(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newAEAD(plaintext); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.remember(wrapped, aead)
+	return aead, nil
+}
+
+// remember must be called with mu held.
+func (e *EncStore) remember(wrapped []byte, aead cipher.AEAD) {
+	if len(e.opened) >= maxOpenedKeys {
+		clear(e.opened)
+	}
+	e.opened[string(wrapped)] = aead
+}
+
+// encrypt seals plaintext as envelopePrefix + base64(len(wrapped key) |
+// wrapped key | nonce | ciphertext), with aad as additional data.
+func (e *EncStore) encrypt(ctx context.Context, plaintext, aad string) (string, error) {
+	key, err := e.dataKey(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get data key: %w", err)
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(key.wrapped)))
+	buf = append(buf, key.wrapped...)
+	buf = append(buf, nonce...)
+	buf = key.aead.Seal(buf, nonce, []byte(plaintext), []byte(aad))
+	return envelopePrefix + base64.RawStdEncoding.EncodeToString(buf), nil
+}
+
+func (e *EncStore) decrypt(ctx context.Context, value, aad string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, envelopePrefix)
+	if !ok {
+		return value, nil
+	}
+	buf, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(buf) < 2 {
+		return "", errors.New("malformed encrypted value")
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return "", errors.New("malformed encrypted value")
+	}
+	aead, err := e.openDataKey(ctx, buf[2:2+n])
+	if err != nil {
+		return "", fmt.Errorf("failed to open data key: %w", err)
+	}
+	rest := buf[2+n:]
+	if len(rest) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+func userAAD(userId string) string {
+	return "user:" + userId
+}
+
+func groupUserAAD(groupId, userId string) string {
+	return "group:" + groupId + ":user:" + userId
+}
+
+func personaAAD(scope, name string) string {
+	return "persona:" + scope + ":" + name
+}
+
+func historyAAD(key string) string {
+	return "history:" + key
+}
+
+func auditAAD(scope string) string {
+	return "audit:" + scope
+}
+
+func (e *EncStore) UpsertGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	var err error
+	setting.SystemInstruction, err = e.encrypt(ctx, setting.SystemInstruction, groupUserAAD(setting.GroupId, setting.UserId))
+	if err != nil {
+		return err
+	}
+	return e.Storage.UpsertGroupUserSetting(ctx, setting)
+}
+
+func (e *EncStore) GetGroupUserSetting(ctx context.Context, groupId, userId string) (*storage.GroupUserSetting, error) {
+	setting, err := e.Storage.GetGroupUserSetting(ctx, groupId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.decryptGroupUserSetting(ctx, setting); err != nil {
+		return nil, err
+	}
+	return setting, nil
+}
+
+func (e *EncStore) ScanGroupUserSettings(ctx context.Context, fn func(storage.GroupUserSetting) error) error {
+	return e.Storage.ScanGroupUserSettings(ctx, func(setting storage.GroupUserSetting) error {
+		if err := e.decryptGroupUserSetting(ctx, &setting); err != nil {
+			return err
+		}
+		return fn(setting)
+	})
+}
+
+func (e *EncStore) decryptGroupUserSetting(ctx context.Context, setting *storage.GroupUserSetting) error {
+	var err error
+	setting.SystemInstruction, err = e.decrypt(ctx, setting.SystemInstruction, groupUserAAD(setting.GroupId, setting.UserId))
+	if err != nil {
+		return fmt.Errorf("group %v user %v: %w", setting.GroupId, setting.UserId, err)
+	}
+	return nil
+}
+
+func (e *EncStore) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	var err error
+	setting.SystemInstruction, err = e.encrypt(ctx, setting.SystemInstruction, userAAD(setting.UserId))
+	if err != nil {
+		return err
+	}
+	return e.Storage.UpsertUserSetting(ctx, setting)
+}
+
+func (e *EncStore) GetUserSetting(ctx context.Context, userId string) (*storage.UserSetting, error) {
+	setting, err := e.Storage.GetUserSetting(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.decryptUserSetting(ctx, setting); err != nil {
+		return nil, err
+	}
+	return setting, nil
+}
+
+func (e *EncStore) ScanUserSettings(ctx context.Context, fn func(storage.UserSetting) error) error {
+	return e.Storage.ScanUserSettings(ctx, func(setting storage.UserSetting) error {
+		if err := e.decryptUserSetting(ctx, &setting); err != nil {
+			return err
+		}
+		return fn(setting)
+	})
+}
+
+func (e *EncStore) decryptUserSetting(ctx context.Context, setting *storage.UserSetting) error {
+	var err error
+	setting.SystemInstruction, err = e.decrypt(ctx, setting.SystemInstruction, userAAD(setting.UserId))
+	if err != nil {
+		return fmt.Errorf("user %v: %w", setting.UserId, err)
+	}
+	return nil
+}
+
+func (e *EncStore) AppendHistory(ctx context.Context, key string, message storage.HistoryMessage, maxLen int, ttl time.Duration) error {
+	var err error
+	message.Text, err = e.encrypt(ctx, message.Text, historyAAD(key))
+	if err != nil {
+		return err
+	}
+	return e.Storage.AppendHistory(ctx, key, message, maxLen, ttl)
+}
+
+func (e *EncStore) GetHistory(ctx context.Context, key string) ([]storage.HistoryMessage, error) {
+	history, err := e.Storage.GetHistory(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := range history {
+		if history[i].Text, err = e.decrypt(ctx, history[i].Text, historyAAD(key)); err != nil {
+			return nil, fmt.Errorf("history %v: %w", key, err)
+		}
+	}
+	return history, nil
+}
+
+func (e *EncStore) ListGroupUserSettings(ctx context.Context, groupId, after string, limit int) ([]storage.GroupUserSetting, error) {
+	settings, err := e.Storage.ListGroupUserSettings(ctx, groupId, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range settings {
+		if err := e.decryptGroupUserSetting(ctx, &settings[i]); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+func (e *EncStore) ListGroupUserSettingsByUser(ctx context.Context, userId string) ([]storage.GroupUserSetting, error) {
+	settings, err := e.Storage.ListGroupUserSettingsByUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range settings {
+		if err := e.decryptGroupUserSetting(ctx, &settings[i]); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+func (e *EncStore) ScanHistory(ctx context.Context, prefix string, fn func(key string, history []storage.HistoryMessage) error) error {
+	return e.Storage.ScanHistory(ctx, prefix, func(key string, history []storage.HistoryMessage) error {
+		for i := range history {
+			var err error
+			if history[i].Text, err = e.decrypt(ctx, history[i].Text, historyAAD(key)); err != nil {
+				return fmt.Errorf("history %v: %w", key, err)
+			}
+		}
+		return fn(key, history)
+	})
+}
+
+func (e *EncStore) RewriteHistory(ctx context.Context, key string, fn func([]storage.HistoryMessage) ([]storage.HistoryMessage, error)) error {
+	return e.Storage.RewriteHistory(ctx, key, func(history []storage.HistoryMessage) ([]storage.HistoryMessage, error) {
+		for i := range history {
+			var err error
+			if history[i].Text, err = e.decrypt(ctx, history[i].Text, historyAAD(key)); err != nil {
+				return nil, fmt.Errorf("history %v: %w", key, err)
+			}
+		}
+		history, err := fn(history)
+		if err != nil {
+			return nil, err
+		}
+		for i := range history {
+			if history[i].Text, err = e.encrypt(ctx, history[i].Text, historyAAD(key)); err != nil {
+				return nil, err
+			}
+		}
+		return history, nil
+	})
+}
+
+func (e *EncStore) UpsertPersona(ctx context.Context, persona storage.Persona) error {
+	var err error
+	persona.SystemInstruction, err = e.encrypt(ctx, persona.SystemInstruction, personaAAD(persona.Scope, persona.Name))
+	if err != nil {
+		return err
+	}
+	return e.Storage.UpsertPersona(ctx, persona)
+}
+
+func (e *EncStore) GetPersona(ctx context.Context, scope, name string) (*storage.Persona, error) {
+	persona, err := e.Storage.GetPersona(ctx, scope, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.decryptPersona(ctx, persona); err != nil {
+		return nil, err
+	}
+	return persona, nil
+}
+
+func (e *EncStore) ListPersonas(ctx context.Context, scope string) ([]storage.Persona, error) {
+	personas, err := e.Storage.ListPersonas(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	for i := range personas {
+		if err := e.decryptPersona(ctx, &personas[i]); err != nil {
+			return nil, err
+		}
+	}
+	return personas, nil
+}
+
+func (e *EncStore) ScanPersonas(ctx context.Context, fn func(storage.Persona) error) error {
+	return e.Storage.ScanPersonas(ctx, func(persona storage.Persona) error {
+		if err := e.decryptPersona(ctx, &persona); err != nil {
+			return err
+		}
+		return fn(persona)
+	})
+}
+
+func (e *EncStore) decryptPersona(ctx context.Context, persona *storage.Persona) error {
+	var err error
+	persona.SystemInstruction, err = e.decrypt(ctx, persona.SystemInstruction, personaAAD(persona.Scope, persona.Name))
+	if err != nil {
+		return fmt.Errorf("persona %v in %v: %w", persona.Name, persona.Scope, err)
+	}
+	return nil
+}
+
+func (e *EncStore) AppendAudit(ctx context.Context, entry storage.AuditEntry) error {
+	var err error
+	entry.NewValue, err = e.encrypt(ctx, entry.NewValue, auditAAD(entry.Scope))
+	if err != nil {
+		return err
+	}
+	return e.Storage.AppendAudit(ctx, entry)
+}
+
+func (e *EncStore) ListAudit(ctx context.Context, scope string, before time.Time, limit int) ([]storage.AuditEntry, error) {
+	entries, err := e.Storage.ListAudit(ctx, scope, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].NewValue, err = e.decrypt(ctx, entries[i].NewValue, auditAAD(scope))
+		if err != nil {
+			return nil, fmt.Errorf("audit entry of %v at %v: %w", scope, entries[i].Time, err)
+		}
+	}
+	return entries, nil
+}
+
+func (e *EncStore) ScanAudit(ctx context.Context, fn func(scope string, entries []storage.AuditEntry) error) error {
+	return e.Storage.ScanAudit(ctx, func(scope string, entries []storage.AuditEntry) error {
+		for i := range entries {
+			var err error
+			if entries[i].NewValue, err = e.decrypt(ctx, entries[i].NewValue, auditAAD(scope)); err != nil {
+				return fmt.Errorf("audit entry of %v at %v: %w", scope, entries[i].Time, err)
+			}
+		}
+		return fn(scope, entries)
+	})
+}
+
+func (e *EncStore) RewriteAudit(ctx context.Context, fn func(storage.AuditEntry) (string, error)) error {
+	return e.Storage.RewriteAudit(ctx, func(entry storage.AuditEntry) (string, error) {
+		var err error
+		if entry.NewValue, err = e.decrypt(ctx, entry.NewValue, auditAAD(entry.Scope)); err != nil {
+			return "", fmt.Errorf("audit entry of %v at %v: %w", entry.Scope, entry.Time, err)
+		}
+		value, err := fn(entry)
+		if err != nil {
+			return "", err
+		}
+		return e.encrypt(ctx, value, auditAAD(entry.Scope))
+	})
+}
@@ -0,0 +1,217 @@
+package encstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/internal/storage/storagetest"
+)
+
+func newKeyLine(t *testing.T, id string) string {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to generate key: %v\n", err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func writeKeyFile(t *testing.T, path string, lines ...string) *LocalKeyProvider {
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v\n", err)
+	}
+	keys, err := NewLocalKeyProvider(path)
+	if err != nil {
+		t.Fatalf("failed to load key file: %v\n", err)
+	}
+	return keys
+}
+
+func TestEncStore(t *testing.T) {
+	keys := writeKeyFile(t, filepath.Join(t.TempDir(), "keys"), newKeyLine(t, "test"))
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return New(memstore.New(), keys)
+	})
+}
+
+func TestEncStoreEncryptsAtRest(t *testing.T) {
+	ctx := context.TODO()
+	backing := memstore.New()
+	keys := writeKeyFile(t, filepath.Join(t.TempDir(), "keys"), newKeyLine(t, "test"))
+	enc := New(backing, keys)
+
+	if err := enc.UpsertUserSetting(ctx, storage.UserSetting{UserId: "user", SystemInstruction: "secret instruction"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	if err := enc.AppendHistory(ctx, "history", storage.HistoryMessage{Role: storage.HistoryRoleUser, Text: "secret message"}, 10, time.Minute); err != nil {
+		t.Fatalf("failed to append history: %v\n", err)
+	}
+
+	stored, err := backing.GetUserSetting(ctx, "user")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if !strings.HasPrefix(stored.SystemInstruction, envelopePrefix) || strings.Contains(stored.SystemInstruction, "secret") {
+		t.Fatalf("expect the instruction to be encrypted, got: %v\n", stored.SystemInstruction)
+	}
+	history, err := backing.GetHistory(ctx, "history")
+	if err != nil {
+		t.Fatalf("failed to get history: %v\n", err)
+	}
+	if len(history) != 1 || strings.Contains(history[0].Text, "secret") {
+		t.Fatalf("expect the history to be encrypted, got: %+v\n", history)
+	}
+
+	// A ciphertext is bound to its item and cannot be moved to another user.
+	if err := backing.UpsertUserSetting(ctx, storage.UserSetting{UserId: "other", SystemInstruction: stored.SystemInstruction}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	if _, err := enc.GetUserSetting(ctx, "other"); err == nil {
+		t.Fatal("expect a ciphertext copied to another user to be rejected")
+	}
+
+	// Settings stored before encryption was enabled are still readable.
+	if err := backing.UpsertUserSetting(ctx, storage.UserSetting{UserId: "legacy", SystemInstruction: "plaintext"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	setting, err := enc.GetUserSetting(ctx, "legacy")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "plaintext" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, "plaintext")
+	}
+}
+
+func TestEncStoreRotation(t *testing.T) {
+	ctx := context.TODO()
+	backing := memstore.New()
+	path := filepath.Join(t.TempDir(), "keys")
+	oldKey, newKey := newKeyLine(t, "old"), newKeyLine(t, "new")
+
+	enc := New(backing, writeKeyFile(t, path, oldKey))
+	if err := enc.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: "group", UserId: "user", SystemInstruction: "group instruction"}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	if err := backing.UpsertUserSetting(ctx, storage.UserSetting{UserId: "legacy", SystemInstruction: "plaintext"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	if err := enc.AppendHistory(ctx, "history", storage.HistoryMessage{Role: storage.HistoryRoleUser, Text: "secret message"}, 10, time.Minute); err != nil {
+		t.Fatalf("failed to append history: %v\n", err)
+	}
+	if err := enc.AppendAudit(ctx, storage.AuditEntry{Scope: storage.UserScope("user"), Time: time.Now(), Actor: "user", Action: "set instruction", NewValue: "secret value"}); err != nil {
+		t.Fatalf("failed to append audit entry: %v\n", err)
+	}
+
+	// Add the new master key on top, re-encrypt, then retire the old one.
+	enc = New(backing, writeKeyFile(t, path, newKey, oldKey))
+	stats, err := enc.Reencrypt(ctx, false)
+	if err != nil {
+		t.Fatalf("failed to re-encrypt: %v\n", err)
+	}
+	if stats.Scanned != 4 || stats.Reencrypted != 4 || stats.Conflicts != 0 {
+		t.Fatalf("got stats %+v, expect 2 settings, a history and an audit entry re-encrypted", stats)
+	}
+
+	enc = New(backing, writeKeyFile(t, path, newKey))
+	guSetting, err := enc.GetGroupUserSetting(ctx, "group", "user")
+	if err != nil {
+		t.Fatalf("failed to get group user setting after rotation: %v\n", err)
+	}
+	if guSetting.SystemInstruction != "group instruction" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", guSetting.SystemInstruction, "group instruction")
+	}
+	stored, err := backing.GetUserSetting(ctx, "legacy")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if !strings.HasPrefix(stored.SystemInstruction, envelopePrefix) {
+		t.Fatalf("expect the plaintext setting to be encrypted, got: %v\n", stored.SystemInstruction)
+	}
+	history, err := enc.GetHistory(ctx, "history")
+	if err != nil {
+		t.Fatalf("failed to get history after rotation: %v\n", err)
+	}
+	if len(history) != 1 || history[0].Text != "secret message" {
+		t.Fatalf("got different history, got: %+v\n", history)
+	}
+	entries, err := enc.ListAudit(ctx, storage.UserScope("user"), time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries after rotation: %v\n", err)
+	}
+	if len(entries) != 1 || entries[0].NewValue != "secret value" {
+		t.Fatalf("got different audit entries, got: %+v\n", entries)
+	}
+}
+
+func TestLocalKeyProviderErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"empty":     "# no keys\n",
+		"short":     "test:" + base64.StdEncoding.EncodeToString([]byte("short")) + "\n",
+		"no id":     "bm90IGEga2V5\n",
+		"duplicate": newKeyLine(t, "a") + "\n" + newKeyLine(t, "a") + "\n",
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "-"))
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write key file: %v\n", err)
+		}
+		if _, err := NewLocalKeyProvider(path); err == nil {
+			t.Fatalf("expect an error for a key file with %s", name)
+		}
+	}
+}
+
+// fakeKMS wraps data keys by reversing them, enough to check the API calls.
+type fakeKMS struct {
+	keyId string
+}
+
+func (f *fakeKMS) GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	if *params.KeyId != f.keyId {
+		return nil, errors.New("unknown key")
+	}
+	plaintext := make([]byte, dataKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{Plaintext: plaintext, CiphertextBlob: reversed(plaintext)}, nil
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: reversed(params.CiphertextBlob)}, nil
+}
+
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func TestKMSProvider(t *testing.T) {
+	ctx := context.TODO()
+	enc := New(memstore.New(), NewKMSProvider(&fakeKMS{keyId: "alias/linebot"}, "alias/linebot"))
+	if err := enc.UpsertUserSetting(ctx, storage.UserSetting{UserId: "user", SystemInstruction: "instruction"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	// A new store has no cached data keys and has to ask KMS.
+	enc = New(enc.Storage, NewKMSProvider(&fakeKMS{keyId: "alias/linebot"}, "alias/linebot"))
+	setting, err := enc.GetUserSetting(ctx, "user")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "instruction" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, "instruction")
+	}
+}
@@ -0,0 +1,161 @@
+package encstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const dataKeySize = 32
+
+// KeyProvider generates and unwraps data keys. The master key wrapping them
+// never leaves the provider, like with AWS KMS.
+type KeyProvider interface {
+	// GenerateDataKey returns a new 256-bit data key, in plaintext and wrapped
+	// by the current master key.
+	GenerateDataKey(ctx context.Context) (plaintext, wrapped []byte, err error)
+	// DecryptDataKey unwraps a key returned by GenerateDataKey, including one
+	// wrapped by a master key that has since been rotated.
+	DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyProvider wraps data keys with master keys read from a file, meant for
+// tests and single-node deployments.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewLocalKeyProvider reads a key file with one "<id>:<base64 256-bit key>" per
+// line; blank lines and lines starting with # are ignored. The first key wraps
+// new data keys and the others are kept to unwrap old ones, so a master key is
+// rotated by adding a new first line, re-encrypting, then removing the old line.
+func NewLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	p := &LocalKeyProvider{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(text, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("key file line %d: expect <id>:<base64 key>", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("key file line %d: expect a base64 encoded %d-byte key", line, dataKeySize)
+		}
+		if _, ok := p.keys[id]; ok {
+			return nil, fmt.Errorf("key file line %d: duplicate key id %q", line, id)
+		}
+		if p.keys[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		if p.current == "" {
+			p.current = id
+		}
+	}
+	if p.current == "" {
+		return nil, errors.New("key file has no keys")
+	}
+	return p, nil
+}
+
+// GenerateDataKey wraps the key as len(id) | id | nonce | sealed key.
+func (p *LocalKeyProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	plaintext := make([]byte, dataKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, err
+	}
+	aead := p.keys[p.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	wrapped := append([]byte{byte(len(p.current))}, p.current...)
+	wrapped = append(wrapped, nonce...)
+	wrapped = aead.Seal(wrapped, nonce, plaintext, []byte(p.current))
+	return plaintext, wrapped, nil
+}
+
+func (p *LocalKeyProvider) DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 1 || len(wrapped) < 1+int(wrapped[0]) {
+		return nil, errors.New("malformed wrapped data key")
+	}
+	id := string(wrapped[1 : 1+wrapped[0]])
+	aead, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", id)
+	}
+	rest := wrapped[1+len(id):]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("malformed wrapped data key")
+	}
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(id))
+}
+
+// KMSClient is the part of the AWS KMS API used by KMSProvider; *kms.Client
+// implements it, as does any KMS-compatible service client.
+type KMSClient interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// KMSProvider wraps data keys with a KMS key. Rotating the key material in
+// KMS keeps old data keys readable; switching to another key id does too, as
+// long as the old key stays enabled until items are re-encrypted.
+type KMSProvider struct {
+	client KMSClient
+	keyId  string
+}
+
+func NewKMSProvider(client KMSClient, keyId string) *KMSProvider {
+	return &KMSProvider{client: client, keyId: keyId}
+}
+
+func (p *KMSProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	output, err := p.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(p.keyId),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	return output.Plaintext, output.CiphertextBlob, nil
+}
+
+func (p *KMSProvider) DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	// No KeyId: KMS finds the key in the blob, so keys rotated out still work.
+	output, err := p.client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	return output.Plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,95 @@
+package encstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+type ReencryptStats struct {
+	Scanned     int
+	Reencrypted int
+	// Conflicts counts settings and histories changed while being
+	// re-encrypted. They were rewritten by someone else, who may still use an
+	// old data key.
+	Conflicts int
+}
+
+// Reencrypt rewrites every setting, persona, conversation history and audit
+// entry under a new data key wrapped by the current master key, including
+// those stored before encryption was enabled. Once it reports no conflicts and
+// every running instance was restarted with the new master key, retired master
+// keys are no longer needed. With dryRun, values are only decrypted.
+func (e *EncStore) Reencrypt(ctx context.Context, dryRun bool) (ReencryptStats, error) {
+	var stats ReencryptStats
+	e.RotateDataKey()
+
+	err := e.ScanUserSettings(ctx, func(setting storage.UserSetting) error {
+		stats.Scanned++
+		if dryRun {
+			return nil
+		}
+		return stats.record(e.UpsertUserSetting(ctx, setting))
+	})
+	if err != nil {
+		return stats, err
+	}
+	err = e.ScanGroupUserSettings(ctx, func(setting storage.GroupUserSetting) error {
+		stats.Scanned++
+		if dryRun {
+			return nil
+		}
+		return stats.record(e.UpsertGroupUserSetting(ctx, setting))
+	})
+	if err != nil {
+		return stats, err
+	}
+	err = e.ScanPersonas(ctx, func(persona storage.Persona) error {
+		stats.Scanned++
+		if dryRun {
+			return nil
+		}
+		return stats.record(e.UpsertPersona(ctx, persona))
+	})
+	if err != nil {
+		return stats, err
+	}
+	err = e.ScanHistory(ctx, "", func(key string, history []storage.HistoryMessage) error {
+		stats.Scanned++
+		if dryRun {
+			return nil
+		}
+		return stats.record(e.RewriteHistory(ctx, key, func(history []storage.HistoryMessage) ([]storage.HistoryMessage, error) {
+			return history, nil
+		}))
+	})
+	if err != nil {
+		return stats, err
+	}
+	if dryRun {
+		err = e.ScanAudit(ctx, func(scope string, entries []storage.AuditEntry) error {
+			stats.Scanned += len(entries)
+			return nil
+		})
+		return stats, err
+	}
+	err = e.RewriteAudit(ctx, func(entry storage.AuditEntry) (string, error) {
+		stats.Scanned++
+		stats.Reencrypted++
+		return entry.NewValue, nil
+	})
+	return stats, err
+}
+
+func (s *ReencryptStats) record(err error) error {
+	switch {
+	case err == nil:
+		s.Reencrypted++
+	case errors.Is(err, storage.ErrConflict):
+		s.Conflicts++
+	default:
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package linebot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// historyLimit is how many changes /history settings shows.
+const historyLimit = 10
+
+// recordChange appends a change to the audit log. The change is already made
+// by then, so a failure is only logged.
+func (lb *LineBot) recordChange(ctx context.Context, scope, actor, action, oldValue, newValue string) {
+	entry := storage.AuditEntry{
+		Scope:    scope,
+		Time:     time.Now().UTC(),
+		Actor:    actor,
+		Action:   action,
+		OldHash:  storage.HashValue(oldValue),
+		NewValue: newValue,
+	}
+	if err := lb.storage.AppendAudit(ctx, entry); err != nil {
+		slog.Error("Failed to append audit entry", "scope", scope, "actor", actor, "action", action, "error", err)
+	}
+}
+
+// handleHistory handles /history settings, which lists the latest changes of
+// settings in the chat.
+func (lb *LineBot) handleHistory(ctx context.Context, meta TextMessageMeta) bool {
+	tokens := strings.Fields(strings.TrimPrefix(meta.Text, "/"))
+	if len(tokens) != 2 || tokens[0] != "history" || tokens[1] != "settings" {
+		return false
+	}
+	entries, err := lb.storage.ListAudit(ctx, chatScope(meta), time.Time{}, historyLimit)
+	if err != nil {
+		slog.Error("Failed to list audit entries", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+		lb.reply("Something went wrong when fetching the history", meta)
+		return true
+	}
+	if len(entries) == 0 {
+		lb.reply("no setting was changed yet", meta)
+		return true
+	}
+	names := make(map[string]string)
+	var b strings.Builder
+	b.WriteString("latest changes:")
+	for _, entry := range entries {
+		name, ok := names[entry.Actor]
+		if !ok {
+			name = entry.Actor
+			if meta.Type == GroupSource {
+				name = lb.memberName(meta.GroupId, entry.Actor)
+			}
+			names[entry.Actor] = name
+		}
+		fmt.Fprintf(&b, "\n- %s %s: %s", entry.Time.In(lb.location).Format("2006-01-02 15:04"), name, entry.Action)
+		if entry.NewValue != "" {
+			fmt.Fprintf(&b, " %s", preview(entry.NewValue, 60))
+		}
+		if entry.OldHash != "" {
+			fmt.Fprintf(&b, " (was #%s)", entry.OldHash[:8])
+		}
+	}
+	lb.reply(preview(b.String(), maxTextLength), meta)
+	return true
+}
@@ -0,0 +1,152 @@
+package linebot
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// blockedSource reports whether an event comes from a blocked group or user.
+// Blocked groups are left when LeaveBlockedGroups is set.
+func (lb *LineBot) blockedSource(ctx context.Context, source webhook.SourceInterface) bool {
+	switch s := source.(type) {
+	case webhook.GroupSource:
+		if lb.blocked(ctx, s.GroupId) {
+			slog.Info("Ignore event from blocked group", "group_id", s.GroupId)
+			lb.LeaveBlockedGroup(s.GroupId)
+			return true
+		}
+		if lb.blocked(ctx, s.UserId) {
+			slog.Info("Ignore event from blocked user", "user_id", s.UserId, "group_id", s.GroupId)
+			return true
+		}
+	case webhook.UserSource:
+		if lb.blocked(ctx, s.UserId) {
+			slog.Info("Ignore event from blocked user", "user_id", s.UserId)
+			return true
+		}
+	}
+	return false
+}
+
+// blocksTTL is how long blocks are cached. A block added on another instance
+// or through the admin API applies after at most this long.
+const blocksTTL = 30 * time.Second
+
+// blocksCache holds every block in force, there are only a few.
+type blocksCache struct {
+	mu       sync.Mutex
+	blocks   map[string]storage.Block
+	loadedAt time.Time
+}
+
+// blocked reports whether id is blocked. Expired blocks are deleted as the
+// blocks are loaded. When storage fails the last blocks read are used, or none.
+func (lb *LineBot) blocked(ctx context.Context, id string) bool {
+	if id == "" {
+		return false
+	}
+	c := &lb.blocks
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.loadedAt) > blocksTTL {
+		blocks := make(map[string]storage.Block)
+		now := time.Now()
+		err := lb.storage.ScanBlocks(ctx, func(block storage.Block) error {
+			if !block.Expired(now) {
+				blocks[block.Id] = block
+				return nil
+			}
+			if err := lb.storage.DeleteBlock(ctx, block); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				slog.Warn("Failed to delete expired block", "id", block.Id, "error", err)
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("Failed to scan blocks", "error", err)
+		} else {
+			c.blocks, c.loadedAt = blocks, now
+		}
+	}
+	block, ok := c.blocks[id]
+	return ok && !block.Expired(time.Now())
+}
+
+// reloadBlocks makes the next lookup read the blocks again.
+func (lb *LineBot) reloadBlocks() {
+	lb.blocks.mu.Lock()
+	lb.blocks.loadedAt = time.Time{}
+	lb.blocks.mu.Unlock()
+}
+
+// LeaveBlockedGroup leaves a blocked group when LeaveBlockedGroups is set.
+func (lb *LineBot) LeaveBlockedGroup(groupId string) {
+	if !lb.leaveBlocked {
+		return
+	}
+	if _, err := lb.messagingAPI.LeaveGroup(groupId); err != nil {
+		slog.Error("Failed to leave blocked group", "group_id", groupId, "error", err)
+		return
+	}
+	slog.Info("Left blocked group", "group_id", groupId)
+}
+
+// Block stops the bot from answering a user or group, see storage.PutBlock,
+// and leaves a blocked group.
+func (lb *LineBot) Block(ctx context.Context, id, reason, createdBy string, expiresAt time.Time) error {
+	if _, err := storage.PutBlock(ctx, lb.storage, lb.operators, id, reason, createdBy, expiresAt); err != nil {
+		return err
+	}
+	lb.reloadBlocks()
+	if storage.IsGroupId(id) {
+		lb.LeaveBlockedGroup(id)
+	}
+	return nil
+}
+
+// Unblock lifts the block of id. It returns storage.ErrNotFound when id is not
+// blocked.
+func (lb *LineBot) Unblock(ctx context.Context, id string) error {
+	defer lb.reloadBlocks()
+	return storage.RemoveBlock(ctx, lb.storage, id)
+}
+
+// Blocks returns the blocks in force, the most recent first.
+func (lb *LineBot) Blocks(ctx context.Context) ([]storage.Block, error) {
+	var blocks []storage.Block
+	now := time.Now()
+	if err := lb.storage.ScanBlocks(ctx, func(block storage.Block) error {
+		if !block.Expired(now) {
+			blocks = append(blocks, block)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(blocks, func(a, b storage.Block) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return blocks, nil
+}
+
+// parseBlockDuration parses a Go duration, or a number of days like 7d.
+func parseBlockDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.New("invalid number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = errors.New("duration is not positive")
+	}
+	return d, err
+}
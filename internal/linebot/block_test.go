@@ -0,0 +1,75 @@
+package linebot
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+func TestParseBlockDuration(t *testing.T) {
+	for _, c := range []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "12h", want: 12 * time.Hour},
+		{s: "90m", want: 90 * time.Minute},
+		{s: "7d", want: 7 * 24 * time.Hour},
+		{s: "1d", want: 24 * time.Hour},
+		{s: "0d", wantErr: true},
+		{s: "-1d", wantErr: true},
+		{s: "xd", wantErr: true},
+		{s: "0s", wantErr: true},
+		{s: "-1h", wantErr: true},
+		{s: "forever", wantErr: true},
+		{s: "", wantErr: true},
+	} {
+		got, err := parseBlockDuration(c.s)
+		if (err != nil) != c.wantErr || (!c.wantErr && got != c.want) {
+			t.Fatalf("parseBlockDuration(%q) = %v, %v, expected %v, error %v\n", c.s, got, err, c.want, c.wantErr)
+		}
+	}
+}
+
+func TestBlockedCache(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	lb := &LineBot{storage: store}
+	user, expired := fmt.Sprintf("U%032x", 1), fmt.Sprintf("U%032x", 2)
+	if err := store.UpsertBlock(ctx, storage.Block{Id: expired, ExpiresAt: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatalf("Failed to store block: %v\n", err)
+	}
+
+	if lb.blocked(ctx, user) || lb.blocked(ctx, expired) {
+		t.Fatal("Expected nobody to be blocked")
+	}
+	if _, err := store.GetBlock(ctx, expired); err != storage.ErrNotFound {
+		t.Fatalf("Expected the expired block to be deleted, got %v\n", err)
+	}
+
+	// Blocks made by the bot apply at once, others once the cache expires.
+	if err := lb.Block(ctx, user, "spam", "Uoperator", time.Time{}); err != nil {
+		t.Fatalf("Failed to block: %v\n", err)
+	}
+	if !lb.blocked(ctx, user) {
+		t.Fatal("Expected the user to be blocked")
+	}
+	block, err := store.GetBlock(ctx, user)
+	if err != nil {
+		t.Fatalf("Failed to get block: %v\n", err)
+	}
+	if err := store.DeleteBlock(ctx, *block); err != nil {
+		t.Fatalf("Failed to delete block: %v\n", err)
+	}
+	if !lb.blocked(ctx, user) {
+		t.Fatal("Expected the cached block to apply")
+	}
+	lb.blocks.loadedAt = time.Now().Add(-blocksTTL)
+	if lb.blocked(ctx, user) {
+		t.Fatal("Expected the block to be lifted once the cache expires")
+	}
+}
@@ -6,41 +6,85 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
 	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
-	"github.com/vgjm/linebot/internal/envs"
 	"github.com/vgjm/linebot/internal/storage"
 	"github.com/vgjm/linebot/pkg/gemini"
 	"github.com/vgjm/linebot/pkg/llm"
+	"github.com/vgjm/linebot/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const webhookDedupTTL = 24 * time.Hour
+
+var tracer = otel.Tracer("github.com/vgjm/linebot/internal/linebot")
+
 type LineBot struct {
 	ctx           context.Context
 	channelSecret string
 	messagingAPI  *messaging_api.MessagingApiAPI
 	llmProvider   llm.LLM
 	storage       storage.Storage
+	historySize   int
+	historyTTL    time.Duration
+	rateLimit     int
+	publicURL     string
+	location      *time.Location
+	groupOwners   []string
+	operators     []string
+	leaveBlocked  bool
+	botSettings   botSettingsCache
+	blocks        blocksCache
+	inflight      inflight
 }
 
 type LineBotConfig struct {
 	Storage       storage.Storage
 	ChannelSecret string
 	ChannelToken  string
+	GeminiApiKey  string
+	GeminiModel   string
+	HistorySize   int
+	HistoryTTL    time.Duration
+	RateLimit     int
+	// PublicURL is where this server is reachable from the internet. It
+	// enables download links for /mydata export.
+	PublicURL string
+	// Timezone is the IANA time zone of instruction templates for users who
+	// did not set their own, UTC when empty.
+	Timezone string
+	// GroupOwners own every group, on top of the owner stored for each.
+	GroupOwners []string
+	// Operators may run /op commands in a 1:1 chat.
+	Operators []string
+	// LeaveBlockedGroups makes the bot leave a group once it is blocked.
+	LeaveBlockedGroups bool
 }
 
 func New(ctx context.Context, cfg *LineBotConfig) (*LineBot, error) {
 	slog.Info("Starting the linebot...")
 
-	messagingAPI, err := messaging_api.NewMessagingApiAPI(cfg.ChannelToken)
+	messagingAPI, err := messaging_api.NewMessagingApiAPI(cfg.ChannelToken,
+		messaging_api.WithHTTPClient(&http.Client{Transport: lineTransport{next: http.DefaultTransport}}))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create line bot client: %w", err)
 	}
 
-	llmProvider, err := gemini.New(ctx, envs.GeminiApiKey, envs.GeminiModel)
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load time zone: %w", err)
+	}
+
+	llmProvider, err := gemini.New(ctx, cfg.GeminiApiKey, cfg.GeminiModel)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize llm client: %w", err)
 	}
@@ -51,44 +95,90 @@ func New(ctx context.Context, cfg *LineBotConfig) (*LineBot, error) {
 		messagingAPI:  messagingAPI,
 		llmProvider:   llmProvider,
 		storage:       cfg.Storage,
+		historySize:   cfg.HistorySize,
+		historyTTL:    cfg.HistoryTTL,
+		rateLimit:     cfg.RateLimit,
+		publicURL:     cfg.PublicURL,
+		location:      location,
+		groupOwners:   cfg.GroupOwners,
+		operators:     cfg.Operators,
+		leaveBlocked:  cfg.LeaveBlockedGroups,
 	}, nil
 }
 
-func (lb *LineBot) Close() error {
-	return lb.llmProvider.Close()
+// PingLLM checks that the LLM provider can be reached.
+func (lb *LineBot) PingLLM(ctx context.Context) error {
+	return lb.llmProvider.Ping(ctx)
 }
 
 func (lb *LineBot) Callback(w http.ResponseWriter, req *http.Request) {
-	ctx, cancel := context.WithTimeout(req.Context(), time.Minute) // Max to 1min
+	ctx, span := tracer.Start(req.Context(), "linebot.Callback", trace.WithSpanKind(trace.SpanKindServer))
+	start, status := time.Now(), http.StatusOK
+	defer func() {
+		metrics.CallbackRequests.WithLabelValues(strconv.Itoa(status)).Inc()
+		metrics.CallbackDuration.WithLabelValues().Observe(time.Since(start).Seconds())
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		span.End()
+	}()
+	ctx, cancel := context.WithTimeout(ctx, time.Minute) // Max to 1min
 	defer cancel()
 
 	cb, err := webhook.ParseRequest(lb.channelSecret, req)
 	if err != nil {
 		if errors.Is(err, webhook.ErrInvalidSignature) {
 			slog.Warn("Received a request with invalid signature", "error", err)
-			w.WriteHeader(400)
+			status = http.StatusBadRequest
 		} else {
 			slog.Warn("Failed to parse the request", "error", err)
-			w.WriteHeader(500)
+			status = http.StatusInternalServerError
 		}
+		span.SetStatus(codes.Error, err.Error())
+		w.WriteHeader(status)
 		return
 	}
 
+	span.SetAttributes(attribute.Int("linebot.events", len(cb.Events)))
 	var wg sync.WaitGroup
 	wg.Add(len(cb.Events))
+	lb.inflight.events.Add(len(cb.Events))
 	for _, event := range cb.Events {
 		go func() {
 			defer wg.Done()
+			defer lb.inflight.events.Done()
+			ctx, span := tracer.Start(ctx, "linebot.event", trace.WithAttributes(attribute.String("linebot.event.type", event.GetType())))
+			defer span.End()
+			eventStart := time.Now()
+			metrics.Events.WithLabelValues(event.GetType()).Inc()
+			defer func() {
+				metrics.EventDuration.WithLabelValues(event.GetType()).Observe(time.Since(eventStart).Seconds())
+			}()
 			switch e := event.(type) {
 			case webhook.MessageEvent:
+				span.SetAttributes(
+					attribute.String("linebot.event.id", e.WebhookEventId),
+					attribute.String("linebot.event.source", e.Source.GetType()),
+				)
+				if !lb.firstDelivery(ctx, e.WebhookEventId) {
+					slog.Info("Ignore redelivered event", "webhook_event_id", e.WebhookEventId)
+					span.SetAttributes(attribute.Bool("linebot.event.redelivered", true))
+					return
+				}
+				if lb.blockedSource(ctx, e.Source) {
+					span.SetAttributes(attribute.Bool("linebot.event.blocked", true))
+					return
+				}
+				handled := true
 				switch s := e.Source.(type) {
 				case webhook.UserSource:
-					lb.handleUserEvent(ctx, e, s)
+					handled = lb.handleUserEvent(ctx, e, s)
 				case webhook.GroupSource:
-					lb.handleGroupEvent(ctx, e, s)
+					handled = lb.handleGroupEvent(ctx, e, s)
 				default:
 					slog.Error("Unknown event source", "event_source", e.Source.GetType())
 				}
+				if !handled {
+					lb.forgetDelivery(ctx, e.WebhookEventId)
+				}
 			default:
 				slog.Error("Unknown event type", "event_type", event.GetType())
 			}
@@ -110,14 +200,39 @@ func (lb *LineBot) Callback(w http.ResponseWriter, req *http.Request) {
 		slog.Error("Request timeout")
 	}
 
-	w.WriteHeader(200)
+	w.WriteHeader(status)
+}
+
+// firstDelivery reports whether the event has not been handled yet. LINE may
+// redeliver an event when our reply was slow; storage errors fail open.
+func (lb *LineBot) firstDelivery(ctx context.Context, webhookEventId string) bool {
+	first, err := lb.storage.MarkProcessed(ctx, "webhook:"+webhookEventId, webhookDedupTTL)
+	if err != nil {
+		slog.Error("Failed to mark event as processed", "webhook_event_id", webhookEventId, "error", err)
+		return true
+	}
+	return first
+}
+
+// forgetDelivery unmarks an event that could not be answered, so that a
+// redelivery by LINE is handled again.
+func (lb *LineBot) forgetDelivery(ctx context.Context, webhookEventId string) {
+	// The request may have timed out, which is a reason to be here.
+	ctx = context.WithoutCancel(ctx)
+	if err := lb.storage.UnmarkProcessed(ctx, "webhook:"+webhookEventId); err != nil {
+		slog.Error("Failed to unmark event as processed", "webhook_event_id", webhookEventId, "error", err)
+		return
+	}
+	slog.Warn("Event left unanswered, a redelivery will be handled", "webhook_event_id", webhookEventId)
 }
 
-func (lb *LineBot) handleUserEvent(ctx context.Context, e webhook.MessageEvent, s webhook.UserSource) {
+// handleUserEvent and handleGroupEvent report whether the event is done with,
+// false when a message expecting an answer got none.
+func (lb *LineBot) handleUserEvent(ctx context.Context, e webhook.MessageEvent, s webhook.UserSource) bool {
 	slog.Info("Handling user event", "user_id", s.UserId)
 	switch m := e.Message.(type) {
 	case webhook.TextMessageContent:
-		lb.handleTextMessage(ctx, TextMessageMeta{
+		return lb.handleTextMessage(ctx, TextMessageMeta{
 			Type:       UserSource,
 			UserId:     s.UserId,
 			Text:       m.Text,
@@ -127,22 +242,24 @@ func (lb *LineBot) handleUserEvent(ctx context.Context, e webhook.MessageEvent,
 	default:
 		slog.Error("Unknown message type", "message_type", e.Message.GetType())
 	}
+	return true
 }
 
-func (lb *LineBot) handleGroupEvent(ctx context.Context, e webhook.MessageEvent, s webhook.GroupSource) {
+func (lb *LineBot) handleGroupEvent(ctx context.Context, e webhook.MessageEvent, s webhook.GroupSource) bool {
 	slog.Info("Handling group event", "group_id", s.GroupId, "user_id", s.UserId)
 	switch m := e.Message.(type) {
 	case webhook.TextMessageContent:
 		text := strings.TrimSpace(m.Text)
 		slog.Info("Received text message", "original_text", m.Text)
 		if strings.HasPrefix(text, "/") {
-			lb.handleTextMessage(ctx, TextMessageMeta{
+			return lb.handleTextMessage(ctx, TextMessageMeta{
 				Type:       GroupSource,
 				UserId:     s.UserId,
 				GroupId:    s.GroupId,
 				Text:       strings.Replace(text, "/", "", 1),
 				ReplyToken: e.ReplyToken,
 				QuoteToken: m.QuoteToken,
+				Mentions:   mentionedUsers(m.Mention),
 			})
 		} else {
 			slog.Info("Ignore regular group chat")
@@ -150,4 +267,20 @@ func (lb *LineBot) handleGroupEvent(ctx context.Context, e webhook.MessageEvent,
 	default:
 		slog.Error("Unknown message type", "message_type", e.Message.GetType())
 	}
+	return true
+}
+
+// mentionedUsers returns the ids of the users mentioned in a message, leaving
+// out @All and users whose id LINE withholds.
+func mentionedUsers(mention *webhook.Mention) []string {
+	if mention == nil {
+		return nil
+	}
+	var userIds []string
+	for _, m := range mention.Mentionees {
+		if u, ok := m.(webhook.UserMentionee); ok && u.UserId != "" {
+			userIds = append(userIds, u.UserId)
+		}
+	}
+	return userIds
 }
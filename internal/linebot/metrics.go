@@ -0,0 +1,32 @@
+package linebot
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/vgjm/linebot/pkg/metrics"
+)
+
+// lineIdPattern matches the user, group and room ids in LINE API paths, which
+// are left out of metric labels.
+var lineIdPattern = regexp.MustCompile(`/[UCR][0-9a-f]{32}(/|$)`)
+
+// lineTransport counts and times the requests to the LINE API.
+type lineTransport struct {
+	next http.RoundTripper
+}
+
+func (t lineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.Method + " " + lineIdPattern.ReplaceAllString(req.URL.Path, "/{id}$1")
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	metrics.LineAPIDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	code := metrics.OutcomeError
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metrics.LineAPIRequests.WithLabelValues(endpoint, code).Inc()
+	return resp, err
+}
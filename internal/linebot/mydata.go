@@ -0,0 +1,415 @@
+package linebot
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+const (
+	// ExportPath is where the signed links of /mydata export point to.
+	ExportPath = "/mydata/export"
+	// exportLinkTTL is how long a signed export link can be downloaded.
+	exportLinkTTL = 10 * time.Minute
+	// maxTextLength and maxMessages are the LINE limits of a text message and
+	// of the messages sent in one reply or push.
+	maxTextLength = 5000
+	maxMessages   = 5
+	// deleteAttempts bounds the retries of a setting changed while deleting.
+	deleteAttempts = 3
+)
+
+// UserData is everything stored about one user, as returned by /mydata export.
+type UserData struct {
+	UserId        string                     `json:"user_id"`
+	ExportedAt    time.Time                  `json:"exported_at"`
+	UserSetting   *storage.UserSetting       `json:"user_setting"`
+	GroupSettings []storage.GroupUserSetting `json:"group_settings"`
+	// Personas are those saved in 1:1 chats; group personas belong to groups.
+	Personas []storage.Persona `json:"personas"`
+	// GroupRoles are the groups the user owns or is an admin of.
+	GroupRoles []storage.GroupRole `json:"group_roles"`
+	// Histories and Usage are keyed by their storage key.
+	Histories map[string][]storage.HistoryMessage `json:"histories"`
+	Usage     map[string]int64                    `json:"usage"`
+	// Audit holds the changes of the user's settings and those they made in
+	// groups.
+	Audit []storage.AuditEntry `json:"audit"`
+}
+
+// userHistoryPrefix prefixes the keys of every history of a user, in a 1:1
+// chat and in groups.
+func userHistoryPrefix(userId string) string {
+	return "history:user:" + userId
+}
+
+func rateLimitPrefix(userId string) string {
+	return "ratelimit:" + userId + ":"
+}
+
+// scanUserHistory calls fn for the histories of userId only, not for those of
+// users whose id merely starts with it.
+func (lb *LineBot) scanUserHistory(ctx context.Context, userId string, fn func(key string, history []storage.HistoryMessage) error) error {
+	prefix := userHistoryPrefix(userId)
+	return lb.storage.ScanHistory(ctx, prefix, func(key string, history []storage.HistoryMessage) error {
+		if key != prefix && !strings.HasPrefix(key, prefix+":") {
+			return nil
+		}
+		return fn(key, history)
+	})
+}
+
+// userGroupRoles scans the roles of every group, which are keyed by group, for
+// those of userId.
+func (lb *LineBot) userGroupRoles(ctx context.Context, userId string) ([]storage.GroupRole, error) {
+	var roles []storage.GroupRole
+	err := lb.storage.ScanGroupRoles(ctx, func(role storage.GroupRole) error {
+		if role.UserId == userId {
+			roles = append(roles, role)
+		}
+		return nil
+	})
+	return roles, err
+}
+
+// userAudit scans the audit log of every scope for the entries of userId's
+// settings and those userId made elsewhere.
+func (lb *LineBot) userAudit(ctx context.Context, userId string) ([]storage.AuditEntry, error) {
+	var audit []storage.AuditEntry
+	err := lb.storage.ScanAudit(ctx, func(scope string, entries []storage.AuditEntry) error {
+		for _, entry := range entries {
+			if scope == storage.UserScope(userId) || entry.Actor == userId {
+				audit = append(audit, entry)
+			}
+		}
+		return nil
+	})
+	return audit, err
+}
+
+// ExportUserData collects every setting, history, usage counter and audit
+// entry stored for userId.
+func (lb *LineBot) ExportUserData(ctx context.Context, userId string) (*UserData, error) {
+	data := &UserData{
+		UserId:     userId,
+		ExportedAt: time.Now().UTC(),
+		Histories:  make(map[string][]storage.HistoryMessage),
+		Usage:      make(map[string]int64),
+	}
+	setting, err := lb.storage.GetUserSetting(ctx, userId)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("failed to get user setting: %w", err)
+	}
+	data.UserSetting = setting
+	if data.GroupSettings, err = lb.storage.ListGroupUserSettingsByUser(ctx, userId); err != nil {
+		return nil, fmt.Errorf("failed to list group user settings: %w", err)
+	}
+	if data.Personas, err = lb.storage.ListPersonas(ctx, storage.UserScope(userId)); err != nil {
+		return nil, fmt.Errorf("failed to list personas: %w", err)
+	}
+	if data.GroupRoles, err = lb.userGroupRoles(ctx, userId); err != nil {
+		return nil, fmt.Errorf("failed to scan group roles: %w", err)
+	}
+	err = lb.scanUserHistory(ctx, userId, func(key string, history []storage.HistoryMessage) error {
+		data.Histories[key] = history
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan history: %w", err)
+	}
+	err = lb.storage.ScanCounters(ctx, rateLimitPrefix(userId), func(key string, value int64) error {
+		data.Usage[key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan usage: %w", err)
+	}
+	if data.Audit, err = lb.userAudit(ctx, userId); err != nil {
+		return nil, fmt.Errorf("failed to scan audit log: %w", err)
+	}
+	return data, nil
+}
+
+// DeleteUserData removes everything ExportUserData returns. Group defaults are
+// kept: they belong to the group, not to the user who set them. So are the
+// entries of changes the user made in groups, with the user and values
+// blanked. A group whose owner deleted their data is owned by the next member
+// to change a setting.
+func (lb *LineBot) DeleteUserData(ctx context.Context, userId string) error {
+	err := retryConflict(func() error {
+		setting, err := lb.storage.GetUserSetting(ctx, userId)
+		if err != nil {
+			return err
+		}
+		return lb.storage.DeleteUserSetting(ctx, *setting)
+	})
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to delete user setting: %w", err)
+	}
+
+	settings, err := lb.storage.ListGroupUserSettingsByUser(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("failed to list group user settings: %w", err)
+	}
+	for _, setting := range settings {
+		err := retryConflict(func() error {
+			if err := lb.storage.DeleteGroupUserSetting(ctx, setting); !errors.Is(err, storage.ErrConflict) {
+				return err
+			}
+			current, err := lb.storage.GetGroupUserSetting(ctx, setting.GroupId, setting.UserId)
+			if err != nil {
+				return err
+			}
+			setting = *current
+			return storage.ErrConflict
+		})
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("failed to delete group %v user setting: %w", setting.GroupId, err)
+		}
+	}
+
+	personas, err := lb.storage.ListPersonas(ctx, storage.UserScope(userId))
+	if err != nil {
+		return fmt.Errorf("failed to list personas: %w", err)
+	}
+	for _, persona := range personas {
+		err := retryConflict(func() error {
+			if err := lb.storage.DeletePersona(ctx, persona); !errors.Is(err, storage.ErrConflict) {
+				return err
+			}
+			current, err := lb.storage.GetPersona(ctx, persona.Scope, persona.Name)
+			if err != nil {
+				return err
+			}
+			persona = *current
+			return storage.ErrConflict
+		})
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("failed to delete persona %v: %w", persona.Name, err)
+		}
+	}
+
+	roles, err := lb.userGroupRoles(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("failed to scan group roles: %w", err)
+	}
+	for _, role := range roles {
+		err := retryConflict(func() error {
+			if err := lb.storage.DeleteGroupRole(ctx, role); !errors.Is(err, storage.ErrConflict) {
+				return err
+			}
+			current, err := lb.storage.GetGroupRole(ctx, role.GroupId, role.UserId)
+			if err != nil {
+				return err
+			}
+			role = *current
+			return storage.ErrConflict
+		})
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("failed to delete group %v role: %w", role.GroupId, err)
+		}
+	}
+
+	var keys []string
+	err = lb.scanUserHistory(ctx, userId, func(key string, history []storage.HistoryMessage) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan history: %w", err)
+	}
+	for _, key := range keys {
+		if err := lb.storage.DeleteHistory(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete history %v: %w", key, err)
+		}
+	}
+
+	keys = nil
+	err = lb.storage.ScanCounters(ctx, rateLimitPrefix(userId), func(key string, value int64) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan usage: %w", err)
+	}
+	for _, key := range keys {
+		if err := lb.storage.DeleteCounter(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete usage %v: %w", key, err)
+		}
+	}
+
+	if err := lb.storage.DeleteAudit(ctx, storage.UserScope(userId)); err != nil {
+		return fmt.Errorf("failed to delete audit log: %w", err)
+	}
+	if err := lb.storage.RedactAudit(ctx, userId); err != nil {
+		return fmt.Errorf("failed to redact audit log: %w", err)
+	}
+	return nil
+}
+
+// retryConflict runs fn again while it returns storage.ErrConflict, up to
+// deleteAttempts times.
+func retryConflict(fn func() error) error {
+	var err error
+	for range deleteAttempts {
+		if err = fn(); !errors.Is(err, storage.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// handleMyData handles /mydata, with or without the slash in a 1:1 chat.
+func (lb *LineBot) handleMyData(ctx context.Context, meta TextMessageMeta) bool {
+	tokens := strings.Fields(meta.Text)
+	if len(tokens) < 2 || strings.TrimPrefix(tokens[0], "/") != "mydata" {
+		return false
+	}
+	switch {
+	case tokens[1] == "export":
+		lb.exportMyData(ctx, meta)
+	case tokens[1] == "delete" && len(tokens) == 2:
+		lb.reply("This deletes your instructions in every chat and group, your personas, your group roles, your conversation history, your settings history and usage. Send \"/mydata delete confirm\" to go ahead", meta)
+	case tokens[1] == "delete" && tokens[2] == "confirm":
+		if err := lb.DeleteUserData(ctx, meta.UserId); err != nil {
+			slog.Error("Failed to delete user data", "user_id", meta.UserId, "error", err)
+			lb.reply("Something went wrong when deleting your data, please try again", meta)
+			return true
+		}
+		slog.Info("Deleted user data", "user_id", meta.UserId)
+		lb.reply("Your data has been deleted", meta)
+	default:
+		return false
+	}
+	return true
+}
+
+// exportMyData only answers in a 1:1 chat, so that nobody else in a group can
+// see the data or the link.
+func (lb *LineBot) exportMyData(ctx context.Context, meta TextMessageMeta) {
+	if meta.Type != UserSource {
+		lb.reply("Please send \"/mydata export\" to me in a 1:1 chat", meta)
+		return
+	}
+	if lb.publicURL != "" {
+		link := lb.exportLink(meta.UserId, time.Now().Add(exportLinkTTL))
+		lb.reply(fmt.Sprintf("Download your data within %v: %s", exportLinkTTL, link), meta)
+		return
+	}
+
+	data, err := lb.ExportUserData(ctx, meta.UserId)
+	if err != nil {
+		slog.Error("Failed to export user data", "user_id", meta.UserId, "error", err)
+		lb.reply("Something went wrong when exporting your data", meta)
+		return
+	}
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode user data", "user_id", meta.UserId, "error", err)
+		lb.reply("Something went wrong when exporting your data", meta)
+		return
+	}
+	if err := lb.sendChunks(meta, string(encoded)); err != nil {
+		slog.Error("Failed to send user data", "user_id", meta.UserId, "error", err)
+	}
+}
+
+// sendChunks replies with the first messages of text and pushes the rest.
+func (lb *LineBot) sendChunks(meta TextMessageMeta, text string) error {
+	var messages []messaging_api.MessageInterface
+	for _, chunk := range splitText(text, maxTextLength) {
+		messages = append(messages, messaging_api.TextMessage{Text: chunk})
+	}
+	first := messages[:min(len(messages), maxMessages)]
+	if _, err := lb.messagingAPI.ReplyMessage(&messaging_api.ReplyMessageRequest{
+		ReplyToken: meta.ReplyToken,
+		Messages:   first,
+	}); err != nil {
+		return err
+	}
+	lb.answered(meta.ReplyToken)
+	for rest := messages[len(first):]; len(rest) > 0; rest = rest[min(len(rest), maxMessages):] {
+		if _, err := lb.messagingAPI.PushMessage(&messaging_api.PushMessageRequest{
+			To:       meta.UserId,
+			Messages: rest[:min(len(rest), maxMessages)],
+		}, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitText splits text into chunks of at most size runes.
+func splitText(text string, size int) []string {
+	var chunks []string
+	runes := []rune(text)
+	for len(runes) > size {
+		chunks = append(chunks, string(runes[:size]))
+		runes = runes[size:]
+	}
+	return append(chunks, string(runes))
+}
+
+// exportSignature signs a user id and expiry with a key derived from the
+// channel secret, so that links cannot be forged for another user.
+func (lb *LineBot) exportSignature(userId string, expires int64) string {
+	key := hmac.New(sha256.New, []byte(lb.channelSecret))
+	key.Write([]byte("mydata export"))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(userId + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (lb *LineBot) exportLink(userId string, expires time.Time) string {
+	query := url.Values{
+		"u":   {userId},
+		"exp": {strconv.FormatInt(expires.Unix(), 10)},
+		"sig": {lb.exportSignature(userId, expires.Unix())},
+	}
+	return strings.TrimSuffix(lb.publicURL, "/") + ExportPath + "?" + query.Encode()
+}
+
+// Export serves the JSON behind a signed link of /mydata export. The data is
+// read when the link is opened, not when it was created.
+func (lb *LineBot) Export(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	userId := query.Get("u")
+	expires, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || userId == "" ||
+		!hmac.Equal([]byte(query.Get("sig")), []byte(lb.exportSignature(userId, expires))) {
+		http.Error(w, "invalid link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "link expired, send /mydata export again", http.StatusGone)
+		return
+	}
+
+	data, err := lb.ExportUserData(req.Context(), userId)
+	if err != nil {
+		slog.Error("Failed to export user data", "user_id", userId, "error", err)
+		http.Error(w, "failed to export data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="mydata.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(data); err != nil {
+		slog.Error("Failed to write user data", "user_id", userId, "error", err)
+	}
+}
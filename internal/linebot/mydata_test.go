@@ -0,0 +1,54 @@
+package linebot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+func TestUserDataAudit(t *testing.T) {
+	ctx := context.Background()
+	lb := &LineBot{storage: memstore.New()}
+	user := TextMessageMeta{Type: UserSource, UserId: "Uuser"}
+	group := TextMessageMeta{Type: GroupSource, GroupId: "Cgroup", UserId: "Uuser"}
+	other := TextMessageMeta{Type: GroupSource, GroupId: "Cgroup", UserId: "Uother"}
+
+	if err := lb.SetInstruction(ctx, user, "private instruction", false); err != nil {
+		t.Fatalf("Failed to set the instruction: %v\n", err)
+	}
+	if err := lb.SetInstruction(ctx, group, "group instruction", false); err != nil {
+		t.Fatalf("Failed to set the group instruction: %v\n", err)
+	}
+	if err := lb.SetInstruction(ctx, other, "other instruction", false); err != nil {
+		t.Fatalf("Failed to set the other instruction: %v\n", err)
+	}
+
+	data, err := lb.ExportUserData(ctx, "Uuser")
+	if err != nil {
+		t.Fatalf("Failed to export user data: %v\n", err)
+	}
+	if len(data.Audit) != 2 {
+		t.Fatalf("Expected the entries of the 1:1 chat and the group, got %+v\n", data.Audit)
+	}
+
+	if err := lb.DeleteUserData(ctx, "Uuser"); err != nil {
+		t.Fatalf("Failed to delete user data: %v\n", err)
+	}
+	if entries, err := lb.storage.ListAudit(ctx, storage.UserScope("Uuser"), time.Time{}, 10); err != nil || len(entries) != 0 {
+		t.Fatalf("Expected the 1:1 chat entries to be deleted, got %+v, %v\n", entries, err)
+	}
+	entries, err := lb.storage.ListAudit(ctx, storage.GroupScope("Cgroup"), time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("Failed to list the group entries: %v\n", err)
+	}
+	if len(entries) != 2 || entries[0].Actor != "Uother" || entries[0].NewValue != "other instruction" ||
+		entries[1].Actor != "" || entries[1].NewValue != "" {
+		t.Fatalf("Expected only the entry of the user to be redacted, got %+v\n", entries)
+	}
+	if data, err := lb.ExportUserData(ctx, "Uuser"); err != nil || len(data.Audit) != 0 {
+		t.Fatalf("Expected nothing left to export, got %+v, %v\n", data, err)
+	}
+}
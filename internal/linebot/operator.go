@@ -0,0 +1,357 @@
+package linebot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+const (
+	// botSettingsTTL is how long bot settings are cached. A change made on
+	// another instance applies after at most this long.
+	botSettingsTTL = 30 * time.Second
+	statsTTL       = (storage.StatsDays + 1) * 24 * time.Hour
+)
+
+const opUsage = `operator commands:
+/op stats
+/op block <user or group id> [for <duration>] [reason]
+/op unblock <user or group id>
+/op blocks
+/op broadcast <text>
+/op model default <model|reset>
+/op quota [<default|user id|group id> <messages per minute|reset>]`
+
+// botSettingsCache holds every bot setting, there are only a handful.
+type botSettingsCache struct {
+	mu       sync.Mutex
+	values   map[string]string
+	loadedAt time.Time
+}
+
+// botSetting returns the value of a bot setting, "" when it is not set. When
+// storage fails the last values read are used.
+func (lb *LineBot) botSetting(ctx context.Context, key string) string {
+	c := &lb.botSettings
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.loadedAt) > botSettingsTTL {
+		values := make(map[string]string)
+		err := lb.storage.ScanBotSettings(ctx, func(setting storage.BotSetting) error {
+			values[setting.Key] = setting.Value
+			return nil
+		})
+		if err != nil {
+			slog.Error("Failed to scan bot settings", "error", err)
+		} else {
+			c.values, c.loadedAt = values, time.Now()
+		}
+	}
+	return c.values[key]
+}
+
+// setBotSetting stores a bot setting, or deletes it when value is empty.
+func (lb *LineBot) setBotSetting(ctx context.Context, key, value string) error {
+	setting, err := lb.storage.GetBotSetting(ctx, key)
+	switch {
+	case errors.Is(err, storage.ErrNotFound) && value == "":
+		return nil
+	case errors.Is(err, storage.ErrNotFound):
+		setting, err = &storage.BotSetting{Key: key}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		err = lb.storage.DeleteBotSetting(ctx, *setting)
+	} else {
+		setting.Value = value
+		err = lb.storage.UpsertBotSetting(ctx, *setting)
+	}
+	lb.botSettings.mu.Lock()
+	lb.botSettings.loadedAt = time.Time{}
+	lb.botSettings.mu.Unlock()
+	return err
+}
+
+// quota returns the messages per minute set by operators for scope, a user or
+// group id or storage.QuotaDefault, and whether one is set.
+func (lb *LineBot) quota(ctx context.Context, scope string) (int, bool) {
+	value := lb.botSetting(ctx, storage.QuotaPrefix+scope)
+	if value == "" {
+		return 0, false
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Error("Invalid quota", "scope", scope, "quota", value, "error", err)
+		return 0, false
+	}
+	return limit, true
+}
+
+// countStat adds delta to today's counter of name for /op stats and the
+// dashboard.
+func (lb *LineBot) countStat(ctx context.Context, name string, delta int64) {
+	if _, err := lb.storage.IncrCounter(ctx, storage.StatsKey(name, time.Now()), delta, statsTTL); err != nil {
+		slog.Error("Failed to count stat", "stat", name, "error", err)
+	}
+}
+
+// audit writes an operator action to the log and to the audit log of
+// storage.BotScope, with the error of a failed one. args are key-value pairs.
+func (lb *LineBot) audit(ctx context.Context, meta TextMessageMeta, action string, err error, args ...any) {
+	logArgs := append([]any{"audit", true, "operator", meta.UserId, "action", action}, args...)
+	if err != nil {
+		slog.Error("Operator action failed", append(logArgs, "error", err)...)
+		args = append(args, "error", err)
+	} else {
+		slog.Info("Operator action", logArgs...)
+	}
+	var pairs []string
+	for i := 0; i+1 < len(args); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", args[i], args[i+1]))
+	}
+	lb.recordChange(ctx, storage.BotScope, meta.UserId, "op "+action, "", strings.Join(pairs, " "))
+}
+
+// handleOperator handles /op in 1:1 chats with operators. Anyone else gets the
+// text answered like any other.
+func (lb *LineBot) handleOperator(ctx context.Context, meta TextMessageMeta) bool {
+	tokens := strings.Fields(meta.Text)
+	if meta.Type != UserSource || len(tokens) == 0 || strings.TrimPrefix(tokens[0], "/") != "op" ||
+		!slices.Contains(lb.operators, meta.UserId) {
+		return false
+	}
+	if len(tokens) < 2 {
+		lb.reply(opUsage, meta)
+		return true
+	}
+	args := tokens[2:]
+	switch tokens[1] {
+	case "stats":
+		reply, err := lb.opStats(ctx)
+		lb.audit(ctx, meta, "stats", err)
+		if err != nil {
+			reply = "Something went wrong when collecting stats"
+		}
+		lb.reply(reply, meta)
+	case "block":
+		if len(args) == 0 {
+			lb.reply("Usage: /op block <user or group id> [for <duration, e.g. 12h or 7d>] [reason]", meta)
+			return true
+		}
+		lb.opBlock(ctx, meta, args[0], args[1:])
+	case "unblock":
+		if len(args) == 0 {
+			lb.reply("Usage: /op unblock <user or group id>", meta)
+			return true
+		}
+		err := lb.Unblock(ctx, args[0])
+		lb.audit(ctx, meta, "unblock", err, "id", args[0])
+		reply := args[0] + " unblocked"
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			reply = args[0] + " is not blocked"
+		case err != nil:
+			reply = "Something went wrong when unblocking " + args[0]
+		}
+		lb.reply(reply, meta)
+	case "blocks":
+		reply, err := lb.opBlocks(ctx)
+		lb.audit(ctx, meta, "blocks", err)
+		if err != nil {
+			reply = "Something went wrong when listing blocks"
+		}
+		lb.reply(reply, meta)
+	case "broadcast":
+		// Keep the text as typed, line breaks included.
+		_, text, _ := strings.Cut(meta.Text, "broadcast")
+		text = strings.TrimSpace(text)
+		if text == "" || utf8.RuneCountInString(text) > maxTextLength {
+			lb.reply(fmt.Sprintf("Usage: /op broadcast <text of up to %d characters>", maxTextLength), meta)
+			return true
+		}
+		_, err := lb.messagingAPI.Broadcast(&messaging_api.BroadcastRequest{
+			Messages: []messaging_api.MessageInterface{messaging_api.TextMessage{Text: text}},
+		}, "")
+		lb.audit(ctx, meta, "broadcast", err, "text", text)
+		reply := "broadcast sent"
+		if err != nil {
+			reply = "Something went wrong when broadcasting"
+		}
+		lb.reply(reply, meta)
+	case "model":
+		if len(args) != 2 || args[0] != "default" {
+			current := lb.botSetting(ctx, storage.ModelDefaultKey)
+			lb.audit(ctx, meta, "model", nil)
+			if current == "" {
+				current = "not set, the configured model is used"
+			}
+			lb.reply("default model: "+current+"\nUsage: /op model default <model|reset>", meta)
+			return true
+		}
+		model := args[1]
+		if model == "reset" {
+			model = ""
+		}
+		err := lb.setBotSetting(ctx, storage.ModelDefaultKey, model)
+		lb.audit(ctx, meta, "model default", err, "model", model)
+		reply := "default model set to " + model
+		switch {
+		case err != nil:
+			reply = "Something went wrong when setting the model"
+		case model == "":
+			reply = "default model reset, the configured model is used"
+		}
+		lb.reply(reply, meta)
+	case "quota":
+		lb.opQuota(ctx, meta, args)
+	default:
+		lb.reply(opUsage, meta)
+	}
+	return true
+}
+
+func (lb *LineBot) opStats(ctx context.Context) (string, error) {
+	var b strings.Builder
+	now := time.Now()
+	for _, name := range []string{storage.StatMessages, storage.StatErrors} {
+		var today, week int64
+		for i := range storage.StatsDays {
+			count, err := lb.storage.GetCounter(ctx, storage.StatsKey(name, now.AddDate(0, 0, -i)))
+			if err != nil {
+				return "", err
+			}
+			if i == 0 {
+				today = count
+			}
+			week += count
+		}
+		fmt.Fprintf(&b, "%s today: %d, last %d days: %d\n", name, today, storage.StatsDays, week)
+	}
+
+	var users, personas int
+	groups := make(map[string]struct{})
+	if err := lb.storage.ScanUserSettings(ctx, func(storage.UserSetting) error {
+		users++
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	if err := lb.storage.ScanGroupUserSettings(ctx, func(setting storage.GroupUserSetting) error {
+		groups[setting.GroupId] = struct{}{}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	if err := lb.storage.ScanPersonas(ctx, func(storage.Persona) error {
+		personas++
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	blocks, err := lb.Blocks(ctx)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&b, "users with settings: %d\ngroups with settings: %d\npersonas: %d\nblocks: %d", users, len(groups), personas, len(blocks))
+	return b.String(), nil
+}
+
+func (lb *LineBot) opBlock(ctx context.Context, meta TextMessageMeta, id string, args []string) {
+	var expiresAt time.Time
+	if len(args) >= 2 && args[0] == "for" {
+		d, err := parseBlockDuration(args[1])
+		if err != nil {
+			lb.reply("The duration is like 30m, 12h or 7d", meta)
+			return
+		}
+		expiresAt, args = time.Now().Add(d), args[2:]
+	}
+	reason := strings.Join(args, " ")
+	err := lb.Block(ctx, id, reason, meta.UserId, expiresAt)
+	lb.audit(ctx, meta, "block", err, "id", id, "reason", reason, "expires_at", expiresAt)
+	reply := id + " blocked"
+	if !expiresAt.IsZero() {
+		reply += " until " + expiresAt.In(lb.location).Format(time.DateTime)
+	}
+	switch {
+	case errors.Is(err, storage.ErrInvalidBlockId):
+		reply = "Usage: /op block <user or group id> [for <duration, e.g. 12h or 7d>] [reason]"
+	case errors.Is(err, storage.ErrBlockOperator):
+		reply = "operators cannot be blocked"
+	case err != nil:
+		reply = "Something went wrong when blocking " + id
+	}
+	lb.reply(reply, meta)
+}
+
+func (lb *LineBot) opBlocks(ctx context.Context) (string, error) {
+	blocks, err := lb.Blocks(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(blocks) == 0 {
+		return "nothing is blocked", nil
+	}
+	var b strings.Builder
+	b.WriteString("blocks:")
+	for _, block := range blocks {
+		fmt.Fprintf(&b, "\n- %s since %s", block.Id, block.CreatedAt.In(lb.location).Format(time.DateOnly))
+		if !block.ExpiresAt.IsZero() {
+			fmt.Fprintf(&b, " until %s", block.ExpiresAt.In(lb.location).Format(time.DateTime))
+		}
+		if block.Reason != "" {
+			fmt.Fprintf(&b, ": %s", block.Reason)
+		}
+	}
+	return preview(b.String(), maxTextLength), nil
+}
+
+func (lb *LineBot) opQuota(ctx context.Context, meta TextMessageMeta, args []string) {
+	if len(args) != 2 {
+		var b strings.Builder
+		fmt.Fprintf(&b, "configured rate limit: %d messages per minute, 0 is unlimited", lb.rateLimit)
+		err := lb.storage.ScanBotSettings(ctx, func(setting storage.BotSetting) error {
+			if scope, ok := strings.CutPrefix(setting.Key, storage.QuotaPrefix); ok {
+				fmt.Fprintf(&b, "\n- %s: %s", scope, setting.Value)
+			}
+			return nil
+		})
+		lb.audit(ctx, meta, "quotas", err)
+		b.WriteString("\nUsage: /op quota <default|user id|group id> <messages per minute|reset>")
+		lb.reply(b.String(), meta)
+		return
+	}
+	scope, value := args[0], args[1]
+	if scope != storage.QuotaDefault && !storage.IsUserId(scope) && !storage.IsGroupId(scope) {
+		lb.reply("The scope is default, a user id or a group id", meta)
+		return
+	}
+	if value == "reset" {
+		value = ""
+	} else if n, err := strconv.Atoi(value); err != nil || n < 0 {
+		lb.reply("The quota is a number of messages per minute, 0 is unlimited", meta)
+		return
+	}
+	err := lb.setBotSetting(ctx, storage.QuotaPrefix+scope, value)
+	lb.audit(ctx, meta, "quota", err, "scope", scope, "quota", value)
+	reply := fmt.Sprintf("quota of %s set to %s messages per minute", scope, value)
+	switch {
+	case err != nil:
+		reply = "Something went wrong when setting the quota"
+	case value == "":
+		reply = "quota of " + scope + " reset"
+	}
+	lb.reply(reply, meta)
+}
@@ -0,0 +1,51 @@
+package linebot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+func TestOperatorAudit(t *testing.T) {
+	ctx := context.TODO()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	messagingAPI, err := messaging_api.NewMessagingApiAPI("token", messaging_api.WithEndpoint(server.URL))
+	if err != nil {
+		t.Fatalf("Failed to create messaging API: %v\n", err)
+	}
+	operator := fmt.Sprintf("U%032x", 1)
+	lb := &LineBot{storage: memstore.New(), messagingAPI: messagingAPI, operators: []string{operator}, location: time.UTC}
+
+	for _, text := range []string{"/op block " + operator + " spam", "/op blocks"} {
+		if !lb.handleOperator(ctx, TextMessageMeta{Type: UserSource, UserId: operator, Text: text, ReplyToken: "token"}) {
+			t.Fatalf("Expected %q to be handled\n", text)
+		}
+	}
+
+	entries, err := lb.storage.ListAudit(ctx, storage.BotScope, time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("Failed to list audit entries: %v\n", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the failed block and the listing to be audited, got: %+v\n", entries)
+	}
+	blocks, block := entries[0], entries[1]
+	if block.Action != "op block" || block.Actor != operator || !strings.Contains(block.NewValue, "id="+operator) ||
+		!strings.Contains(block.NewValue, "error="+storage.ErrBlockOperator.Error()) {
+		t.Fatalf("Expected the failed block with its error, got: %+v\n", block)
+	}
+	if blocks.Action != "op blocks" || strings.Contains(blocks.NewValue, "error=") {
+		t.Fatalf("Expected the listing of blocks, got: %+v\n", blocks)
+	}
+}
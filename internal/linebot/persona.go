@@ -0,0 +1,268 @@
+package linebot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// builtinPersonas are available in every chat. A persona saved under the same
+// name takes precedence.
+var builtinPersonas = map[string]string{
+	"translator":  "You are a translator. If the message is in English, translate it into Japanese, otherwise into English. Reply with the translation only.",
+	"proofreader": "You are a proofreader. Correct the spelling, grammar and punctuation of the message while keeping its meaning and tone. Reply with the corrected text, then briefly list the main changes.",
+	"summarizer":  "You are a summarizer. Summarize the message in a few short bullet points, in the language it is written in.",
+}
+
+var personaName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// chatScope is where personas are saved and settings changes are audited: per
+// user in a 1:1 chat, shared by the members of a group.
+func chatScope(meta TextMessageMeta) string {
+	if meta.Type == GroupSource {
+		return storage.GroupScope(meta.GroupId)
+	}
+	return storage.UserScope(meta.UserId)
+}
+
+// resolvePersona returns the instruction of the persona called name in scope,
+// falling back to the built-in catalog.
+func (lb *LineBot) resolvePersona(ctx context.Context, scope, name string) (string, error) {
+	persona, err := lb.storage.GetPersona(ctx, scope, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		if instruct, ok := builtinPersonas[name]; ok {
+			return instruct, nil
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return persona.SystemInstruction, nil
+}
+
+// SavePersona creates or replaces a persona in the scope of meta.
+func (lb *LineBot) SavePersona(ctx context.Context, meta TextMessageMeta, name, instruct string) error {
+	persona, err := lb.storage.GetPersona(ctx, chatScope(meta), name)
+	if errors.Is(err, storage.ErrNotFound) {
+		persona, err = &storage.Persona{Scope: chatScope(meta), Name: name}, nil
+	}
+	if err != nil {
+		return err
+	}
+	old := persona.SystemInstruction
+	persona.SystemInstruction = instruct
+	if err := lb.storage.UpsertPersona(ctx, *persona); err != nil {
+		return err
+	}
+	lb.recordChange(ctx, chatScope(meta), meta.UserId, "save persona "+name, old, instruct)
+	return nil
+}
+
+// DeletePersona removes a saved persona. Settings using it fall back to the
+// built-in persona of the same name, if any, or to their own instruction.
+func (lb *LineBot) DeletePersona(ctx context.Context, meta TextMessageMeta, name string) error {
+	persona, err := lb.storage.GetPersona(ctx, chatScope(meta), name)
+	if err != nil {
+		return err
+	}
+	if err := lb.storage.DeletePersona(ctx, *persona); err != nil {
+		return err
+	}
+	lb.recordChange(ctx, chatScope(meta), meta.UserId, "delete persona "+name, persona.SystemInstruction, "")
+	return nil
+}
+
+// UsePersona makes the caller's setting use the persona called name, or none
+// when name is empty. In a group, turning the persona off goes back to the
+// group default when the caller never set an instruction of their own, even
+// an empty one. It returns storage.ErrNotFound for an unknown persona.
+func (lb *LineBot) UsePersona(ctx context.Context, meta TextMessageMeta, name string) error {
+	if name != "" {
+		if _, err := lb.resolvePersona(ctx, chatScope(meta), name); err != nil {
+			return err
+		}
+	}
+	switch meta.Type {
+	case UserSource:
+		setting, err := lb.storage.GetUserSetting(ctx, meta.UserId)
+		if errors.Is(err, storage.ErrNotFound) {
+			setting, err = &storage.UserSetting{UserId: meta.UserId}, nil
+		}
+		if err != nil {
+			return err
+		}
+		old := setting.Persona
+		setting.Persona = name
+		if err := lb.storage.UpsertUserSetting(ctx, *setting); err != nil {
+			return err
+		}
+		lb.recordChange(ctx, chatScope(meta), meta.UserId, "use persona", old, name)
+	case GroupSource:
+		setting, err := lb.storage.GetGroupUserSetting(ctx, meta.GroupId, meta.UserId)
+		if errors.Is(err, storage.ErrNotFound) {
+			setting, err = &storage.GroupUserSetting{GroupId: meta.GroupId, UserId: meta.UserId, PersonaOnly: true}, nil
+		}
+		if err != nil {
+			return err
+		}
+		old := setting.Persona
+		setting.Persona = name
+		// A setting kept only for the persona would hide the group default,
+		// so it is deleted once the persona is turned off.
+		switch {
+		case name == "" && setting.PersonaOnly && setting.Version == 0:
+			return nil
+		case name == "" && setting.PersonaOnly:
+			err = lb.storage.DeleteGroupUserSetting(ctx, *setting)
+		default:
+			err = lb.storage.UpsertGroupUserSetting(ctx, *setting)
+		}
+		if err != nil {
+			return err
+		}
+		lb.recordChange(ctx, chatScope(meta), meta.UserId, "use persona", old, name)
+	}
+	return nil
+}
+
+// handlePersona handles /persona, with or without the slash in a 1:1 chat.
+func (lb *LineBot) handlePersona(ctx context.Context, meta TextMessageMeta) bool {
+	tokens := strings.Fields(meta.Text)
+	if len(tokens) < 2 || strings.TrimPrefix(tokens[0], "/") != "persona" {
+		return false
+	}
+	var name string
+	if len(tokens) >= 3 {
+		name = strings.ToLower(tokens[2])
+	}
+	switch tokens[1] {
+	case "save", "delete":
+		// Group personas are shared by every member.
+		if !lb.allowGroupWide(ctx, meta) {
+			return true
+		}
+	}
+	switch tokens[1] {
+	case "save":
+		// Keep the instruction as typed, line breaks included.
+		_, rest, _ := strings.Cut(meta.Text, "save")
+		rest = strings.TrimSpace(rest)
+		instruct := strings.TrimSpace(rest[strings.IndexFunc(rest+" ", unicode.IsSpace):])
+		if !personaName.MatchString(name) || instruct == "" {
+			lb.reply("Usage: /persona save <name> <instruction>, where the name has up to 32 lowercase letters, digits, - or _", meta)
+			return true
+		}
+		if err := lb.SavePersona(ctx, meta, name, instruct); err != nil {
+			slog.Error("Failed to save persona", "user_id", meta.UserId, "group_id", meta.GroupId, "persona", name, "error", err)
+			lb.replyPersonaError(err, meta)
+			return true
+		}
+		lb.reply(fmt.Sprintf("persona %s saved, send \"/persona use %s\" to use it", name, name), meta)
+	case "use":
+		if name == "" {
+			lb.reply("Usage: /persona use <name>", meta)
+			return true
+		}
+		err := lb.UsePersona(ctx, meta, name)
+		if errors.Is(err, storage.ErrNotFound) {
+			lb.reply(fmt.Sprintf("no persona is called %s, send \"/persona list\" to see them", name), meta)
+			return true
+		}
+		if err != nil {
+			slog.Error("Failed to use persona", "user_id", meta.UserId, "group_id", meta.GroupId, "persona", name, "error", err)
+			lb.replyPersonaError(err, meta)
+			return true
+		}
+		lb.reply(fmt.Sprintf("now using persona %s, send \"/persona off\" to go back to your instruction", name), meta)
+	case "off":
+		if err := lb.UsePersona(ctx, meta, ""); err != nil {
+			slog.Error("Failed to stop using persona", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+			lb.replyPersonaError(err, meta)
+			return true
+		}
+		lb.reply("persona turned off", meta)
+	case "list":
+		reply, err := lb.listPersonas(ctx, meta)
+		if err != nil {
+			slog.Error("Failed to list personas", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+			reply = "Something went wrong when listing personas"
+		}
+		lb.reply(reply, meta)
+	case "delete":
+		err := lb.DeletePersona(ctx, meta, name)
+		if errors.Is(err, storage.ErrNotFound) {
+			if _, ok := builtinPersonas[name]; ok {
+				lb.reply(fmt.Sprintf("%s is a built-in persona and cannot be deleted", name), meta)
+			} else {
+				lb.reply(fmt.Sprintf("no persona is called %s", name), meta)
+			}
+			return true
+		}
+		if err != nil {
+			slog.Error("Failed to delete persona", "user_id", meta.UserId, "group_id", meta.GroupId, "persona", name, "error", err)
+			lb.replyPersonaError(err, meta)
+			return true
+		}
+		lb.reply(fmt.Sprintf("persona %s deleted", name), meta)
+	default:
+		return false
+	}
+	return true
+}
+
+// listPersonas lists saved personas first, then the built-in ones not
+// shadowed by them.
+func (lb *LineBot) listPersonas(ctx context.Context, meta TextMessageMeta) (string, error) {
+	saved, err := lb.storage.ListPersonas(ctx, chatScope(meta))
+	if err != nil {
+		return "", err
+	}
+	_, active, err := lb.instruction(ctx, meta, false)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
+
+	var b strings.Builder
+	line := func(name, instruct, kind string) {
+		marker := ""
+		if name == active {
+			marker = " (in use)"
+		}
+		fmt.Fprintf(&b, "\n- %s%s [%s]: %s", name, marker, kind, preview(instruct, 60))
+	}
+	b.WriteString("personas:")
+	for _, persona := range saved {
+		line(persona.Name, persona.SystemInstruction, "saved")
+	}
+	for _, name := range slices.Sorted(maps.Keys(builtinPersonas)) {
+		if !slices.ContainsFunc(saved, func(p storage.Persona) bool { return p.Name == name }) {
+			line(name, builtinPersonas[name], "built-in")
+		}
+	}
+	return b.String(), nil
+}
+
+// preview shortens text to at most n runes.
+func preview(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func (lb *LineBot) replyPersonaError(err error, meta TextMessageMeta) {
+	reply := "Something went wrong, please try again"
+	if errors.Is(err, storage.ErrConflict) {
+		reply = "The persona or instruction was changed by someone else at the same time, please check it and try again"
+	}
+	lb.reply(reply, meta)
+}
@@ -0,0 +1,155 @@
+package linebot
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+func TestUsePersonaGroupFallback(t *testing.T) {
+	ctx := context.Background()
+	lb := &LineBot{storage: memstore.New()}
+	meta := TextMessageMeta{Type: GroupSource, GroupId: "Cgroup", UserId: "Uuser"}
+
+	if err := lb.SetInstruction(ctx, meta, "group default", true); err != nil {
+		t.Fatalf("Failed to set the group default: %v\n", err)
+	}
+	if err := lb.SavePersona(ctx, meta, "pirate", "talk like a pirate"); err != nil {
+		t.Fatalf("Failed to save persona: %v\n", err)
+	}
+	if err := lb.UsePersona(ctx, meta, "pirate"); err != nil {
+		t.Fatalf("Failed to use persona: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, true); err != nil || got != "talk like a pirate" {
+		t.Fatalf("Unexpected instruction with the persona: %q, %v\n", got, err)
+	}
+
+	// A deleted persona falls back to the group default.
+	if err := lb.DeletePersona(ctx, meta, "pirate"); err != nil {
+		t.Fatalf("Failed to delete persona: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, true); err != nil || got != "group default" {
+		t.Fatalf("Unexpected instruction after deleting the persona: %q, %v\n", got, err)
+	}
+
+	// Turning the persona off drops the row kept only for it.
+	if err := lb.UsePersona(ctx, meta, ""); err != nil {
+		t.Fatalf("Failed to turn persona off: %v\n", err)
+	}
+	if _, err := lb.storage.GetGroupUserSetting(ctx, meta.GroupId, meta.UserId); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected the setting to be deleted, got %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, true); err != nil || got != "group default" {
+		t.Fatalf("Unexpected instruction after turning the persona off: %q, %v\n", got, err)
+	}
+
+	// Turning it off again without a setting stores nothing.
+	if err := lb.UsePersona(ctx, meta, ""); err != nil {
+		t.Fatalf("Failed to turn persona off again: %v\n", err)
+	}
+	if _, err := lb.storage.GetGroupUserSetting(ctx, meta.GroupId, meta.UserId); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected no setting, got %v\n", err)
+	}
+}
+
+func TestUsePersonaKeepsOwnInstruction(t *testing.T) {
+	ctx := context.Background()
+	lb := &LineBot{storage: memstore.New()}
+	meta := TextMessageMeta{Type: GroupSource, GroupId: "Cgroup", UserId: "Uuser"}
+
+	if err := lb.SetInstruction(ctx, meta, "group default", true); err != nil {
+		t.Fatalf("Failed to set the group default: %v\n", err)
+	}
+	if err := lb.SetInstruction(ctx, meta, "my own", false); err != nil {
+		t.Fatalf("Failed to set the instruction: %v\n", err)
+	}
+	if err := lb.UsePersona(ctx, meta, "translator"); err != nil {
+		t.Fatalf("Failed to use persona: %v\n", err)
+	}
+	if err := lb.UsePersona(ctx, meta, ""); err != nil {
+		t.Fatalf("Failed to turn persona off: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, true); err != nil || got != "my own" {
+		t.Fatalf("Unexpected instruction: %q, %v\n", got, err)
+	}
+}
+
+func TestUsePersonaKeepsEmptyInstruction(t *testing.T) {
+	ctx := context.Background()
+	lb := &LineBot{storage: memstore.New()}
+	meta := TextMessageMeta{Type: GroupSource, GroupId: "Cgroup", UserId: "Uuser"}
+
+	if err := lb.SetInstruction(ctx, meta, "group default", true); err != nil {
+		t.Fatalf("Failed to set the group default: %v\n", err)
+	}
+	if err := lb.SetInstruction(ctx, meta, "", false); err != nil {
+		t.Fatalf("Failed to set an empty instruction: %v\n", err)
+	}
+	if err := lb.UsePersona(ctx, meta, "translator"); err != nil {
+		t.Fatalf("Failed to use persona: %v\n", err)
+	}
+	if err := lb.UsePersona(ctx, meta, ""); err != nil {
+		t.Fatalf("Failed to turn persona off: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, true); err != nil || got != "" {
+		t.Fatalf("Expected the empty instruction after turning the persona off, got %q, %v\n", got, err)
+	}
+
+	// A deleted persona falls back to the empty instruction, not the default.
+	if err := lb.SavePersona(ctx, meta, "poet", "answer in verse"); err != nil {
+		t.Fatalf("Failed to save persona: %v\n", err)
+	}
+	if err := lb.UsePersona(ctx, meta, "poet"); err != nil {
+		t.Fatalf("Failed to use persona: %v\n", err)
+	}
+	if err := lb.DeletePersona(ctx, meta, "poet"); err != nil {
+		t.Fatalf("Failed to delete persona: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, true); err != nil || got != "" {
+		t.Fatalf("Expected the empty instruction after deleting the persona, got %q, %v\n", got, err)
+	}
+}
+
+func TestInstructionPersona(t *testing.T) {
+	ctx := context.Background()
+	lb := &LineBot{storage: memstore.New()}
+	meta := TextMessageMeta{Type: UserSource, UserId: "Uuser"}
+
+	if err := lb.SetInstruction(ctx, meta, "my own", false); err != nil {
+		t.Fatalf("Failed to set the instruction: %v\n", err)
+	}
+	if err := lb.UsePersona(ctx, meta, "summarizer"); err != nil {
+		t.Fatalf("Failed to use persona: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, false); err != nil || got != builtinPersonas["summarizer"] {
+		t.Fatalf("Expected the built-in persona, got %q, %v\n", got, err)
+	}
+	if err := lb.UsePersona(ctx, meta, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for an unknown persona, got %v\n", err)
+	}
+
+	// Setting an instruction stops using the persona.
+	if err := lb.SetInstruction(ctx, meta, "new one", false); err != nil {
+		t.Fatalf("Failed to set the instruction: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, false); err != nil || got != "new one" {
+		t.Fatalf("Expected the new instruction, got %q, %v\n", got, err)
+	}
+
+	// A deleted persona falls back to the instruction.
+	if err := lb.SavePersona(ctx, meta, "poet", "answer in verse"); err != nil {
+		t.Fatalf("Failed to save persona: %v\n", err)
+	}
+	if err := lb.UsePersona(ctx, meta, "poet"); err != nil {
+		t.Fatalf("Failed to use persona: %v\n", err)
+	}
+	if err := lb.DeletePersona(ctx, meta, "poet"); err != nil {
+		t.Fatalf("Failed to delete persona: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, false); err != nil || got != "new one" {
+		t.Fatalf("Expected the instruction after deleting the persona, got %q, %v\n", got, err)
+	}
+}
@@ -0,0 +1,222 @@
+package linebot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// ownerClaimTTL is how long a member claiming an ownerless group keeps
+// others from claiming it too, long enough for the claim to be stored.
+const ownerClaimTTL = time.Minute
+
+// groupRole returns the role of a user in a group. Configured group owners
+// own every group and users without a stored role are members.
+func (lb *LineBot) groupRole(ctx context.Context, groupId, userId string) (string, error) {
+	if slices.Contains(lb.groupOwners, userId) {
+		return storage.RoleOwner, nil
+	}
+	role, err := lb.storage.GetGroupRole(ctx, groupId, userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		return storage.RoleMember, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return role.Role, nil
+}
+
+// authorize reports whether the sender of meta is an owner of the group, or
+// an admin unless ownerOnly. In a group without a stored owner the sender
+// becomes its owner, so that whoever sets the bot up first manages it, unless
+// group owners are configured: they already manage every group. Every chat is
+// authorized in a 1:1 chat.
+func (lb *LineBot) authorize(ctx context.Context, meta TextMessageMeta, ownerOnly bool) (bool, error) {
+	if meta.Type != GroupSource {
+		return true, nil
+	}
+	role, err := lb.groupRole(ctx, meta.GroupId, meta.UserId)
+	if err != nil {
+		return false, err
+	}
+	if role == storage.RoleOwner || (role == storage.RoleAdmin && !ownerOnly) {
+		return true, nil
+	}
+	if len(lb.groupOwners) > 0 {
+		return false, nil
+	}
+	roles, err := lb.storage.ListGroupRoles(ctx, meta.GroupId)
+	if err != nil {
+		return false, err
+	}
+	if slices.ContainsFunc(roles, func(r storage.GroupRole) bool { return r.Role == storage.RoleOwner }) {
+		return false, nil
+	}
+	// Members sending their first command at the same time would all find no
+	// owner, so only the first to mark the group claims it, once it has seen
+	// that no owner was stored in between.
+	first, err := lb.storage.MarkProcessed(ctx, "owner-claim:"+meta.GroupId, ownerClaimTTL)
+	if err != nil || !first {
+		return false, err
+	}
+	if roles, err = lb.storage.ListGroupRoles(ctx, meta.GroupId); err != nil {
+		return false, err
+	}
+	if slices.ContainsFunc(roles, func(r storage.GroupRole) bool { return r.Role == storage.RoleOwner }) {
+		return false, nil
+	}
+	// Version 0 keeps an admin promoted in between from being overwritten.
+	if err := lb.storage.UpsertGroupRole(ctx, storage.GroupRole{GroupId: meta.GroupId, UserId: meta.UserId, Role: storage.RoleOwner}); err != nil {
+		return false, err
+	}
+	slog.Info("Group owner claimed", "group_id", meta.GroupId, "user_id", meta.UserId)
+	lb.recordChange(ctx, chatScope(meta), meta.UserId, "claim owner", "", meta.UserId)
+	return true, nil
+}
+
+// allowGroupWide reports whether the sender may change a setting shared by
+// the group, and tells them when they may not.
+func (lb *LineBot) allowGroupWide(ctx context.Context, meta TextMessageMeta) bool {
+	return lb.allow(ctx, meta, false, "Only the owner and admins of this group can change this, send \"/admin list\" to see them")
+}
+
+func (lb *LineBot) allow(ctx context.Context, meta TextMessageMeta, ownerOnly bool, denied string) bool {
+	ok, err := lb.authorize(ctx, meta, ownerOnly)
+	if err != nil {
+		slog.Error("Failed to authorize", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+		lb.reply("Something went wrong when checking your permissions, please try again", meta)
+		return false
+	}
+	if !ok {
+		lb.reply(denied, meta)
+	}
+	return ok
+}
+
+// adminTargets returns the users an /admin command is about: those mentioned,
+// or the user ids given after the subcommand.
+func adminTargets(meta TextMessageMeta, args []string) []string {
+	if len(meta.Mentions) > 0 {
+		return meta.Mentions
+	}
+	var userIds []string
+	for _, arg := range args {
+		if storage.IsUserId(arg) {
+			userIds = append(userIds, arg)
+		}
+	}
+	return userIds
+}
+
+// handleAdmin handles /admin add|remove|list in groups.
+func (lb *LineBot) handleAdmin(ctx context.Context, meta TextMessageMeta) bool {
+	tokens := strings.Fields(strings.TrimPrefix(meta.Text, "/"))
+	if len(tokens) < 2 || tokens[0] != "admin" {
+		return false
+	}
+	if meta.Type != GroupSource {
+		lb.reply("/admin only works in groups", meta)
+		return true
+	}
+	switch tokens[1] {
+	case "add", "remove":
+		if !lb.allow(ctx, meta, true, "Only the owner of this group can manage admins") {
+			return true
+		}
+		targets := adminTargets(meta, tokens[2:])
+		if len(targets) == 0 {
+			lb.reply(fmt.Sprintf("Usage: /admin %s @member", tokens[1]), meta)
+			return true
+		}
+		var replies []string
+		for _, userId := range targets {
+			var reply string
+			var err error
+			if tokens[1] == "add" {
+				reply, err = lb.addAdmin(ctx, meta, userId)
+			} else {
+				reply, err = lb.removeAdmin(ctx, meta, userId)
+			}
+			if err != nil {
+				slog.Error("Failed to "+tokens[1]+" admin", "group_id", meta.GroupId, "user_id", meta.UserId, "target_user_id", userId, "error", err)
+				reply = "something went wrong"
+			}
+			replies = append(replies, lb.memberName(meta.GroupId, userId)+": "+reply)
+		}
+		lb.reply(strings.Join(replies, "\n"), meta)
+	case "list":
+		roles, err := lb.storage.ListGroupRoles(ctx, meta.GroupId)
+		if err != nil {
+			slog.Error("Failed to list group roles", "group_id", meta.GroupId, "error", err)
+			lb.reply("Something went wrong when listing admins", meta)
+			return true
+		}
+		if len(roles) == 0 && len(lb.groupOwners) > 0 {
+			lb.reply("this group is managed by the bot owners, and has no admins yet", meta)
+			return true
+		}
+		if len(roles) == 0 {
+			lb.reply("this group has no owner yet, the first member to change a group setting becomes its owner", meta)
+			return true
+		}
+		var b strings.Builder
+		b.WriteString("owner and admins:")
+		for _, role := range roles {
+			fmt.Fprintf(&b, "\n- %s (%s)", lb.memberName(meta.GroupId, role.UserId), role.Role)
+		}
+		lb.reply(b.String(), meta)
+	default:
+		return false
+	}
+	return true
+}
+
+func (lb *LineBot) addAdmin(ctx context.Context, meta TextMessageMeta, userId string) (string, error) {
+	role, err := lb.groupRole(ctx, meta.GroupId, userId)
+	if err != nil {
+		return "", err
+	}
+	if role != storage.RoleMember {
+		return "already " + role, nil
+	}
+	if err := lb.storage.UpsertGroupRole(ctx, storage.GroupRole{GroupId: meta.GroupId, UserId: userId, Role: storage.RoleAdmin}); err != nil {
+		return "", err
+	}
+	lb.recordChange(ctx, chatScope(meta), meta.UserId, "add admin", "", userId)
+	return "now admin", nil
+}
+
+func (lb *LineBot) removeAdmin(ctx context.Context, meta TextMessageMeta, userId string) (string, error) {
+	role, err := lb.storage.GetGroupRole(ctx, meta.GroupId, userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "not an admin", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if role.Role != storage.RoleAdmin {
+		return "the owner cannot be removed", nil
+	}
+	if err := lb.storage.DeleteGroupRole(ctx, *role); err != nil {
+		return "", err
+	}
+	lb.recordChange(ctx, chatScope(meta), meta.UserId, "remove admin", userId, "")
+	return "no longer admin", nil
+}
+
+// memberName returns the display name of a group member, or their id when it
+// cannot be looked up.
+func (lb *LineBot) memberName(groupId, userId string) string {
+	profile, err := lb.messagingAPI.GetGroupMemberProfile(groupId, userId)
+	if err != nil {
+		slog.Warn("Failed to get group member profile", "user_id", userId, "group_id", groupId, "error", err)
+		return userId
+	}
+	return sanitizeVar(profile.DisplayName)
+}
@@ -0,0 +1,87 @@
+package linebot
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+func TestAdminTargets(t *testing.T) {
+	alice, bob := fmt.Sprintf("U%032x", 1), fmt.Sprintf("U%032x", 2)
+	group := fmt.Sprintf("C%032x", 1)
+	for _, c := range []struct {
+		name     string
+		mentions []string
+		args     []string
+		want     []string
+	}{
+		{name: "mentions", mentions: []string{alice}, args: []string{bob}, want: []string{alice}},
+		{name: "ids", args: []string{alice, bob}, want: []string{alice, bob}},
+		{name: "invalid ids", args: []string{"@alice", group, "U123", alice}, want: []string{alice}},
+		{name: "nothing", want: nil},
+	} {
+		got := adminTargets(TextMessageMeta{Mentions: c.mentions}, c.args)
+		if !slices.Equal(got, c.want) {
+			t.Fatalf("%s: adminTargets = %v, expected %v\n", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAuthorizeClaimsOwnerOnce(t *testing.T) {
+	ctx := context.Background()
+	lb := &LineBot{storage: memstore.New()}
+	group := fmt.Sprintf("C%032x", 1)
+
+	var wg sync.WaitGroup
+	var claimed atomic.Int32
+	for i := range 10 {
+		wg.Go(func() {
+			meta := TextMessageMeta{Type: GroupSource, GroupId: group, UserId: fmt.Sprintf("U%032x", i)}
+			ok, err := lb.authorize(ctx, meta, true)
+			if err != nil {
+				t.Errorf("Failed to authorize: %v\n", err)
+			}
+			if ok {
+				claimed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	if claimed.Load() != 1 {
+		t.Fatalf("Expected a single member to claim the group, got %d\n", claimed.Load())
+	}
+	roles, err := lb.storage.ListGroupRoles(ctx, group)
+	if err != nil {
+		t.Fatalf("Failed to list roles: %v\n", err)
+	}
+	if len(roles) != 1 || roles[0].Role != storage.RoleOwner {
+		t.Fatalf("Expected a single owner, got %+v\n", roles)
+	}
+}
+
+func TestAuthorizeConfiguredOwners(t *testing.T) {
+	ctx := context.Background()
+	owner, member := fmt.Sprintf("U%032x", 1), fmt.Sprintf("U%032x", 2)
+	lb := &LineBot{storage: memstore.New(), groupOwners: []string{owner}}
+	group := fmt.Sprintf("C%032x", 1)
+
+	if ok, err := lb.authorize(ctx, TextMessageMeta{Type: GroupSource, GroupId: group, UserId: member}, true); err != nil || ok {
+		t.Fatalf("Expected a member not to claim a group with configured owners, got %v, %v\n", ok, err)
+	}
+	if ok, err := lb.authorize(ctx, TextMessageMeta{Type: GroupSource, GroupId: group, UserId: owner}, true); err != nil || !ok {
+		t.Fatalf("Expected a configured owner to be authorized, got %v, %v\n", ok, err)
+	}
+	roles, err := lb.storage.ListGroupRoles(ctx, group)
+	if err != nil {
+		t.Fatalf("Failed to list roles: %v\n", err)
+	}
+	if len(roles) != 0 {
+		t.Fatalf("Expected no stored role, got %+v\n", roles)
+	}
+}
@@ -0,0 +1,103 @@
+package linebot
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+const (
+	// closeTimeout bounds how long Close waits for events being handled.
+	closeTimeout = 20 * time.Second
+	// shutdownApology is pushed to chats still waiting for an answer when the
+	// bot stops, their reply token may be gone by the time it is sent.
+	shutdownApology = "Sorry, the bot restarted before it could answer, please send your message again"
+)
+
+// inflight tracks the events being handled, and the chats among them that
+// are waiting for an answer by reply token.
+type inflight struct {
+	events  sync.WaitGroup
+	mu      sync.Mutex
+	waiting map[string]TextMessageMeta
+}
+
+// expectAnswer marks the chat of meta as waiting for an answer until a reply
+// is sent with its reply token. The returned function stops waiting and
+// reports whether the chat was answered.
+func (lb *LineBot) expectAnswer(meta TextMessageMeta) func() bool {
+	f := &lb.inflight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.waiting == nil {
+		f.waiting = make(map[string]TextMessageMeta)
+	}
+	f.waiting[meta.ReplyToken] = meta
+	return func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		_, waiting := f.waiting[meta.ReplyToken]
+		delete(f.waiting, meta.ReplyToken)
+		return !waiting
+	}
+}
+
+// answered records that the chat waiting on replyToken got its answer.
+func (lb *LineBot) answered(replyToken string) {
+	f := &lb.inflight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.waiting, replyToken)
+}
+
+// Shutdown waits for the events being handled until ctx is done. Chats still
+// waiting for an answer then get an apology, and the LLM provider is closed.
+func (lb *LineBot) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.inflight.events.Wait()
+	}()
+	select {
+	case <-done:
+		slog.Info("Every event is handled")
+	case <-ctx.Done():
+		lb.apologize()
+	}
+	return lb.llmProvider.Close()
+}
+
+// Close is Shutdown with a deadline.
+func (lb *LineBot) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return lb.Shutdown(ctx)
+}
+
+// apologize pushes shutdownApology once to every chat waiting for an answer.
+func (lb *LineBot) apologize() {
+	f := &lb.inflight
+	f.mu.Lock()
+	chats := make(map[string]struct{})
+	for _, meta := range f.waiting {
+		to := meta.UserId
+		if meta.Type == GroupSource {
+			to = meta.GroupId
+		}
+		chats[to] = struct{}{}
+	}
+	f.mu.Unlock()
+	slog.Warn("Stopping with events still being handled", "chats", len(chats))
+	for to := range chats {
+		_, err := lb.messagingAPI.PushMessage(&messaging_api.PushMessageRequest{
+			To:       to,
+			Messages: []messaging_api.MessageInterface{messaging_api.TextMessage{Text: shutdownApology}},
+		}, "")
+		if err != nil {
+			slog.Error("Failed to push shutdown apology", "to", to, "error", err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package linebot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vgjm/linebot/internal/memstore"
+)
+
+func TestUnansweredEventIsRedelivered(t *testing.T) {
+	ctx := context.TODO()
+	lb := &LineBot{storage: memstore.New()}
+	answered := TextMessageMeta{Type: UserSource, UserId: "U1", ReplyToken: "answered"}
+	unanswered := TextMessageMeta{Type: UserSource, UserId: "U2", ReplyToken: "unanswered"}
+
+	stopAnswered, stopUnanswered := lb.expectAnswer(answered), lb.expectAnswer(unanswered)
+	lb.answered(answered.ReplyToken)
+	if !stopAnswered() {
+		t.Fatal("expect a replied chat to be answered")
+	}
+	if stopUnanswered() {
+		t.Fatal("expect a chat without reply to be unanswered")
+	}
+	if len(lb.inflight.waiting) != 0 {
+		t.Fatalf("expect no chat left waiting, got: %v\n", lb.inflight.waiting)
+	}
+
+	if !lb.firstDelivery(ctx, "event") || lb.firstDelivery(ctx, "event") {
+		t.Fatal("expect only the first delivery to be handled")
+	}
+	lb.forgetDelivery(ctx, "event")
+	if !lb.firstDelivery(ctx, "event") {
+		t.Fatal("expect a redelivery of a forgotten event to be handled")
+	}
+}
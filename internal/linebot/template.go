@@ -0,0 +1,216 @@
+package linebot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// templateVar matches {{name}} in an instruction. A leading backslash keeps it
+// literally.
+var templateVar = regexp.MustCompile(`\\?\{\{\s*([A-Za-z][A-Za-z0-9_.]*)\s*\}\}`)
+
+// errUnknownTimezone is returned by SetTimezone for a name that is not in the
+// IANA time zone database.
+var errUnknownTimezone = errors.New("unknown time zone")
+
+// maxVarLength bounds the length of a value taken from a profile or group.
+const maxVarLength = 100
+
+// Template variables. Unknown ones are left as they are.
+const (
+	varUserDisplayName = "user.displayName"
+	varUserLanguage    = "user.language"
+	varGroupName       = "group.name"
+	varDate            = "date"
+	varTime            = "time"
+	varWeekday         = "weekday"
+	varTz              = "tz"
+)
+
+// renderInstruction expands the template variables of instruct for meta.
+// Values are expanded once, so a display name that looks like a variable is
+// not expanded in turn. Variables that cannot be looked up expand to "".
+func (lb *LineBot) renderInstruction(ctx context.Context, meta TextMessageMeta, instruct string) string {
+	if !strings.Contains(instruct, "{{") {
+		return instruct
+	}
+	names := make(map[string]bool)
+	for _, m := range templateVar.FindAllStringSubmatch(instruct, -1) {
+		if !strings.HasPrefix(m[0], `\`) {
+			names[m[1]] = true
+		}
+	}
+	vars := lb.templateVars(ctx, meta, names)
+	return templateVar.ReplaceAllStringFunc(instruct, func(match string) string {
+		if strings.HasPrefix(match, `\`) {
+			return match[1:]
+		}
+		value, ok := vars[templateVar.FindStringSubmatch(match)[1]]
+		if !ok {
+			return match
+		}
+		return value
+	})
+}
+
+// templateVars looks up the variables in names, calling the LINE API only for
+// those used.
+func (lb *LineBot) templateVars(ctx context.Context, meta TextMessageMeta, names map[string]bool) map[string]string {
+	vars := make(map[string]string)
+	if names[varUserDisplayName] || names[varUserLanguage] {
+		vars[varUserDisplayName], vars[varUserLanguage] = "", ""
+		if meta.Type == GroupSource {
+			// Members who are not friends of the bot only have a group profile.
+			profile, err := lb.messagingAPI.GetGroupMemberProfile(meta.GroupId, meta.UserId)
+			if err != nil {
+				slog.Warn("Failed to get group member profile", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+			} else {
+				vars[varUserDisplayName] = sanitizeVar(profile.DisplayName)
+			}
+		}
+		if meta.Type == UserSource || names[varUserLanguage] {
+			profile, err := lb.messagingAPI.GetProfile(meta.UserId)
+			if err != nil {
+				slog.Warn("Failed to get profile", "user_id", meta.UserId, "error", err)
+			} else {
+				if meta.Type == UserSource {
+					vars[varUserDisplayName] = sanitizeVar(profile.DisplayName)
+				}
+				vars[varUserLanguage] = sanitizeVar(profile.Language)
+			}
+		}
+	}
+	if names[varGroupName] {
+		vars[varGroupName] = ""
+		if meta.Type == GroupSource {
+			summary, err := lb.messagingAPI.GetGroupSummary(meta.GroupId)
+			if err != nil {
+				slog.Warn("Failed to get group summary", "group_id", meta.GroupId, "error", err)
+			} else {
+				vars[varGroupName] = sanitizeVar(summary.GroupName)
+			}
+		}
+	}
+	if names[varDate] || names[varTime] || names[varWeekday] || names[varTz] {
+		loc := lb.userLocation(ctx, meta.UserId)
+		now := time.Now().In(loc)
+		vars[varDate] = now.Format(time.DateOnly)
+		vars[varTime] = now.Format("15:04")
+		vars[varWeekday] = now.Weekday().String()
+		vars[varTz] = loc.String()
+	}
+	return vars
+}
+
+// userLocation returns the time zone set by the user, or the bot default.
+func (lb *LineBot) userLocation(ctx context.Context, userId string) *time.Location {
+	setting, err := lb.storage.GetUserSetting(ctx, userId)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			slog.Warn("Failed to get user setting", "user_id", userId, "error", err)
+		}
+		return lb.location
+	}
+	if setting.Timezone == "" {
+		return lb.location
+	}
+	loc, err := time.LoadLocation(setting.Timezone)
+	if err != nil {
+		slog.Warn("Failed to load time zone", "user_id", userId, "timezone", setting.Timezone, "error", err)
+		return lb.location
+	}
+	return loc
+}
+
+// sanitizeVar keeps a value chosen by other users on one line, so that it
+// cannot pass for instructions of its own, and bounds its length.
+func sanitizeVar(value string) string {
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+	return preview(value, maxVarLength)
+}
+
+// SetTimezone sets the time zone of the user in every chat, or the bot default
+// when timezone is empty.
+func (lb *LineBot) SetTimezone(ctx context.Context, userId, timezone string) error {
+	if timezone != "" {
+		// Local is wherever the bot happens to run.
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+			return fmt.Errorf("%w: %q", errUnknownTimezone, timezone)
+		}
+	}
+	setting, err := lb.storage.GetUserSetting(ctx, userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		setting, err = &storage.UserSetting{UserId: userId}, nil
+	}
+	if err != nil {
+		return err
+	}
+	old := setting.Timezone
+	setting.Timezone = timezone
+	if err := lb.storage.UpsertUserSetting(ctx, *setting); err != nil {
+		return err
+	}
+	lb.recordChange(ctx, storage.UserScope(userId), userId, "set timezone", old, timezone)
+	return nil
+}
+
+// handleTemplate handles /preview instruction and the time zone commands,
+// with or without the slash in a 1:1 chat.
+func (lb *LineBot) handleTemplate(ctx context.Context, meta TextMessageMeta) bool {
+	tokens := strings.Fields(strings.TrimPrefix(meta.Text, "/"))
+	if len(tokens) < 2 {
+		return false
+	}
+	switch {
+	case tokens[0] == "preview" && tokens[1] == "instruction":
+		instruct, err := lb.GetInstruction(ctx, meta, true)
+		reply := preview(lb.renderInstruction(ctx, meta, instruct), maxTextLength)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			reply = "no instruction is set"
+		case err != nil:
+			slog.Error("Failed to get instruction", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+			reply = "Something went wrong when fetching your instruction"
+		case reply == "":
+			reply = "instruction is set to empty"
+		}
+		lb.reply(reply, meta)
+	case tokens[0] == "set" && tokens[1] == "timezone":
+		if len(tokens) < 3 {
+			lb.reply("Usage: set timezone <time zone>, e.g. set timezone Asia/Tokyo", meta)
+			return true
+		}
+		lb.setTimezone(ctx, meta, tokens[2], "timezone set to "+tokens[2])
+	case tokens[0] == "unset" && tokens[1] == "timezone":
+		lb.setTimezone(ctx, meta, "", "timezone set to the default "+lb.location.String())
+	case tokens[0] == "get" && tokens[1] == "timezone":
+		lb.reply("timezone is "+lb.userLocation(ctx, meta.UserId).String(), meta)
+	default:
+		return false
+	}
+	return true
+}
+
+func (lb *LineBot) setTimezone(ctx context.Context, meta TextMessageMeta, timezone, reply string) {
+	err := lb.SetTimezone(ctx, meta.UserId, timezone)
+	switch {
+	case errors.Is(err, storage.ErrConflict):
+		reply = "Your settings were changed at the same time, please try again"
+	case errors.Is(err, errUnknownTimezone):
+		reply = fmt.Sprintf("%s is not a known time zone, use a name like Asia/Tokyo", timezone)
+	case err != nil:
+		slog.Error("Failed to set timezone", "user_id", meta.UserId, "timezone", timezone, "error", err)
+		reply = "Something went wrong when setting your timezone"
+	}
+	lb.reply(reply, meta)
+}
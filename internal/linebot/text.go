@@ -2,12 +2,17 @@ package linebot
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
 	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/pkg/llm"
+	"github.com/vgjm/linebot/pkg/metrics"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type MessageSource int
@@ -28,63 +33,199 @@ type TextMessageMeta struct {
 	Text       string
 	ReplyToken string
 	QuoteToken string
+	// Mentions are the ids of the users mentioned in Text.
+	Mentions []string
 }
 
+// GetInstruction returns the instruction that applies to meta. In a group,
+// groupDefault falls back to the group default when the user never set one
+// (an instruction set to "" is kept). A persona in use takes precedence over
+// the instruction. It returns storage.ErrNotFound when no instruction applies.
 func (lb *LineBot) GetInstruction(ctx context.Context, meta TextMessageMeta, groupDefault bool) (string, error) {
-	var instruct string
+	instruct, persona, err := lb.instruction(ctx, meta, groupDefault)
+	if err != nil || persona == "" {
+		return instruct, err
+	}
+	resolved, err := lb.resolvePersona(ctx, chatScope(meta), persona)
+	if err == nil {
+		return resolved, nil
+	}
+	// The persona was deleted since; the user's own instruction still applies,
+	// or the group default when they only had the persona.
+	slog.Warn("Failed to resolve persona", "user_id", meta.UserId, "group_id", meta.GroupId, "persona", persona, "error", err)
+	if meta.Type == GroupSource && groupDefault && lb.personaOnly(ctx, meta) {
+		setting, err := lb.storage.GetGroupUserSetting(ctx, meta.GroupId, DefaultKey)
+		if err != nil {
+			return "", err
+		}
+		return setting.SystemInstruction, nil
+	}
+	return instruct, nil
+}
+
+// personaOnly reports whether the caller's group setting only exists for a
+// persona.
+func (lb *LineBot) personaOnly(ctx context.Context, meta TextMessageMeta) bool {
+	setting, err := lb.storage.GetGroupUserSetting(ctx, meta.GroupId, meta.UserId)
+	return err == nil && setting.PersonaOnly
+}
+
+// instruction returns the stored instruction and the name of the persona in
+// use, without resolving it.
+func (lb *LineBot) instruction(ctx context.Context, meta TextMessageMeta, groupDefault bool) (string, string, error) {
 	switch meta.Type {
 	case UserSource:
 		setting, err := lb.storage.GetUserSetting(ctx, meta.UserId)
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
-		instruct = setting.SystemInstruction
+		return setting.SystemInstruction, setting.Persona, nil
 	case GroupSource:
 		setting, err := lb.storage.GetGroupUserSetting(ctx, meta.GroupId, meta.UserId)
-		if err != nil {
-			return "", err
-		}
-		if groupDefault && setting.SystemInstruction == "" {
+		if groupDefault && errors.Is(err, storage.ErrNotFound) {
 			setting, err = lb.storage.GetGroupUserSetting(ctx, meta.GroupId, DefaultKey)
-			if err != nil {
-				return "", err
-			}
 		}
-		instruct = setting.SystemInstruction
+		if err != nil {
+			return "", "", err
+		}
+		return setting.SystemInstruction, setting.Persona, nil
 	}
-	return instruct, nil
+	return "", "", nil
 }
 
+// SetInstruction replaces the instruction at the version it is read at and
+// stops using any persona. It returns storage.ErrConflict when someone else
+// changed the setting in between.
 func (lb *LineBot) SetInstruction(ctx context.Context, meta TextMessageMeta, instruct string, groupDefault bool) error {
 	var err error
 	switch meta.Type {
 	case UserSource:
-		err = lb.storage.UpsertUserSetting(ctx, storage.UserSetting{
-			UserId:            meta.UserId,
-			SystemInstruction: instruct,
-		})
+		setting, getErr := lb.storage.GetUserSetting(ctx, meta.UserId)
+		if errors.Is(getErr, storage.ErrNotFound) {
+			setting, getErr = &storage.UserSetting{UserId: meta.UserId}, nil
+		}
+		if getErr != nil {
+			return getErr
+		}
+		old := setting.SystemInstruction
+		setting.SystemInstruction, setting.Persona = instruct, ""
+		if err = lb.storage.UpsertUserSetting(ctx, *setting); err == nil {
+			lb.recordChange(ctx, chatScope(meta), meta.UserId, "set instruction", old, instruct)
+		}
+	case GroupSource:
+		sourtKey := meta.UserId
+		if groupDefault {
+			sourtKey = DefaultKey
+		}
+		setting, getErr := lb.storage.GetGroupUserSetting(ctx, meta.GroupId, sourtKey)
+		if errors.Is(getErr, storage.ErrNotFound) {
+			setting, getErr = &storage.GroupUserSetting{GroupId: meta.GroupId, UserId: sourtKey}, nil
+		}
+		if getErr != nil {
+			return getErr
+		}
+		old := setting.SystemInstruction
+		setting.SystemInstruction, setting.Persona, setting.PersonaOnly = instruct, "", false
+		if err = lb.storage.UpsertGroupUserSetting(ctx, *setting); err == nil {
+			lb.recordChange(ctx, chatScope(meta), meta.UserId, instructionAction("set", groupDefault), old, instruct)
+		}
+	}
+	return err
+}
+
+// UnsetInstruction deletes the instruction so that, in a group, the group
+// default applies again. In a 1:1 chat a time zone set by the user is kept. It
+// returns storage.ErrNotFound when nothing was set.
+func (lb *LineBot) UnsetInstruction(ctx context.Context, meta TextMessageMeta, groupDefault bool) error {
+	var old string
+	var err error
+	switch meta.Type {
+	case UserSource:
+		setting, getErr := lb.storage.GetUserSetting(ctx, meta.UserId)
+		if getErr != nil {
+			return getErr
+		}
+		old = setting.SystemInstruction
+		if setting.Timezone != "" {
+			setting.SystemInstruction, setting.Persona = "", ""
+			err = lb.storage.UpsertUserSetting(ctx, *setting)
+		} else {
+			err = lb.storage.DeleteUserSetting(ctx, *setting)
+		}
 	case GroupSource:
 		sourtKey := meta.UserId
 		if groupDefault {
 			sourtKey = DefaultKey
 		}
-		err = lb.storage.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{
-			GroupId:           meta.GroupId,
-			UserId:            sourtKey,
-			SystemInstruction: instruct,
-		})
+		setting, getErr := lb.storage.GetGroupUserSetting(ctx, meta.GroupId, sourtKey)
+		if getErr != nil {
+			return getErr
+		}
+		old = setting.SystemInstruction
+		err = lb.storage.DeleteGroupUserSetting(ctx, *setting)
+	}
+	if err == nil {
+		lb.recordChange(ctx, chatScope(meta), meta.UserId, instructionAction("unset", groupDefault), old, "")
 	}
 	return err
 }
 
-func (lb *LineBot) handleTextMessage(ctx context.Context, meta TextMessageMeta) {
-	if !lb.handleInstruction(ctx, meta) {
-		lb.generateContent(ctx, meta)
+func instructionAction(verb string, groupDefault bool) string {
+	if groupDefault {
+		return verb + " default instruction"
 	}
+	return verb + " instruction"
+}
+
+// textHandler handles a command, and reports whether the message was one.
+type textHandler struct {
+	name   string
+	handle func(context.Context, TextMessageMeta) bool
+}
+
+// handleTextMessage handles a text message and reports whether it was
+// answered.
+func (lb *LineBot) handleTextMessage(ctx context.Context, meta TextMessageMeta) (answered bool) {
+	stopWaiting := lb.expectAnswer(meta)
+	defer func() { answered = stopWaiting() }()
+	ctx, span := tracer.Start(ctx, "linebot.handleTextMessage")
+	start, handler := time.Now(), "generate"
+	defer func() {
+		metrics.HandlerDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+		span.SetAttributes(attribute.String("linebot.handler", handler))
+		span.End()
+	}()
+	for _, h := range []textHandler{
+		{"operator", lb.handleOperator},
+		{"mydata", lb.handleMyData},
+		{"persona", lb.handlePersona},
+		{"admin", lb.handleAdmin},
+		{"template", lb.handleTemplate},
+		{"history", lb.handleHistory},
+		{"instruction", lb.handleInstruction},
+	} {
+		if h.handle(ctx, meta) {
+			handler = h.name
+			return
+		}
+	}
+	lb.generateContent(ctx, meta)
+	return
+}
+
+// parseInstruction returns the text after prefix. `""` stands for an empty
+// instruction, which unlike unset does not fall back to the group default.
+func parseInstruction(text, prefix string) string {
+	instruct := strings.TrimPrefix(strings.TrimPrefix(text, prefix), " ")
+	if instruct == `""` {
+		return ""
+	}
+	return instruct
 }
 
 func (lb *LineBot) handleInstruction(ctx context.Context, meta TextMessageMeta) bool {
 	if strings.HasPrefix(meta.Text, "set") ||
+		strings.HasPrefix(meta.Text, "unset") ||
 		strings.HasPrefix(meta.Text, "get") {
 		tokens := strings.Split(meta.Text, " ")
 		if len(tokens) >= 2 {
@@ -95,20 +236,26 @@ func (lb *LineBot) handleInstruction(ctx context.Context, meta TextMessageMeta)
 					if len(tokens) >= 3 {
 						switch tokens[2] {
 						case "instruction":
-							instruct := strings.Replace(meta.Text, "set default instruction ", "", 1)
+							if !lb.allowGroupWide(ctx, meta) {
+								return true
+							}
+							instruct := parseInstruction(meta.Text, "set default instruction")
 							if err := lb.SetInstruction(ctx, meta, instruct, true); err != nil {
-								slog.Error("Failed to set instruction", "user_id", meta.UserId, "group_id", meta.GroupId, "instruction", instruct)
+								slog.Error("Failed to set instruction", "user_id", meta.UserId, "group_id", meta.GroupId, "instruction", instruct, "error", err)
+								lb.replyConflict(err, meta)
 							} else {
 								if err := lb.replyMessage("default instruction updated", meta.ReplyToken, meta.QuoteToken); err != nil {
 									slog.Error("Failed to reply message", "error", err)
 								}
 							}
+							return true
 						}
 					}
 				case "instruction":
-					instruct := strings.Replace(meta.Text, "set instruction ", "", 1)
+					instruct := parseInstruction(meta.Text, "set instruction")
 					if err := lb.SetInstruction(ctx, meta, instruct, false); err != nil {
-						slog.Error("Failed to set instruction", "user_id", meta.UserId, "group_id", meta.GroupId, "instruction", instruct)
+						slog.Error("Failed to set instruction", "user_id", meta.UserId, "group_id", meta.GroupId, "instruction", instruct, "error", err)
+						lb.replyConflict(err, meta)
 					} else {
 						if err := lb.replyMessage("instruction updated", meta.ReplyToken, meta.QuoteToken); err != nil {
 							slog.Error("Failed to reply message", "error", err)
@@ -116,13 +263,46 @@ func (lb *LineBot) handleInstruction(ctx context.Context, meta TextMessageMeta)
 					}
 					return true
 				}
+			case "unset":
+				groupDefault := tokens[1] == "default" && len(tokens) >= 3 && tokens[2] == "instruction"
+				if !groupDefault && tokens[1] != "instruction" {
+					return false
+				}
+				if groupDefault && !lb.allowGroupWide(ctx, meta) {
+					return true
+				}
+				reply := "instruction removed"
+				if groupDefault {
+					reply = "default instruction removed"
+				}
+				if err := lb.UnsetInstruction(ctx, meta, groupDefault); errors.Is(err, storage.ErrNotFound) {
+					reply = "no instruction was set"
+				} else if err != nil {
+					slog.Error("Failed to unset instruction", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+					lb.replyConflict(err, meta)
+					return true
+				}
+				if err := lb.replyMessage(reply, meta.ReplyToken, meta.QuoteToken); err != nil {
+					slog.Error("Failed to reply message", "error", err)
+				}
+				return true
 			case "get":
 				switch tokens[1] {
 				case "instruction":
-					reply, err := lb.GetInstruction(ctx, meta, false)
-					if err != nil {
-						slog.Error("Failed to get instruction", "user_id", meta.UserId, "group_id", meta.GroupId)
+					reply, persona, err := lb.instruction(ctx, meta, false)
+					switch {
+					case err == nil && persona != "":
+						reply = "using persona " + persona
+					case errors.Is(err, storage.ErrNotFound):
+						reply = "no instruction is set"
+						if meta.Type == GroupSource {
+							reply = "no instruction is set, the group default is used"
+						}
+					case err != nil:
+						slog.Error("Failed to get instruction", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
 						reply = "Something went wrong when fetching your instruction"
+					case reply == "":
+						reply = "instruction is set to empty"
 					}
 					if err := lb.replyMessage(reply, meta.ReplyToken, meta.QuoteToken); err != nil {
 						slog.Error("Failed to reply message", "error", err)
@@ -136,18 +316,53 @@ func (lb *LineBot) handleInstruction(ctx context.Context, meta TextMessageMeta)
 	return false
 }
 
+// replyConflict tells the user their update lost a race instead of dropping it
+// silently.
+func (lb *LineBot) replyConflict(err error, meta TextMessageMeta) {
+	if !errors.Is(err, storage.ErrConflict) {
+		return
+	}
+	if err := lb.replyMessage("The instruction was changed by someone else at the same time, please check it and try again", meta.ReplyToken, meta.QuoteToken); err != nil {
+		slog.Error("Failed to reply message", "error", err)
+	}
+}
+
 func (lb *LineBot) generateContent(ctx context.Context, meta TextMessageMeta) {
+	if !lb.allowMessage(ctx, meta) {
+		if err := lb.replyMessage("Too many messages, please try again in a minute", meta.ReplyToken, meta.QuoteToken); err != nil {
+			slog.Error("Failed to reply message", "error", err)
+		}
+		return
+	}
+
+	lb.countStat(ctx, storage.StatMessages, 1)
+	if meta.Type == GroupSource {
+		lb.countStat(ctx, storage.StatGroupPrefix+meta.GroupId, 1)
+	}
+	ctx = llm.WithUsage(ctx, func(usage llm.Usage) {
+		lb.countStat(ctx, storage.StatInputTokensPrefix+usage.Model, usage.InputTokens)
+		lb.countStat(ctx, storage.StatOutputTokensPrefix+usage.Model, usage.OutputTokens)
+	})
+	if model := lb.botSetting(ctx, storage.ModelDefaultKey); model != "" {
+		ctx = llm.WithModel(ctx, model)
+	}
+
 	instruct, err := lb.GetInstruction(ctx, meta, true)
-	if err != nil {
-		slog.Error("Failed to get instruction", "user_id", meta.UserId, "group_id", meta.GroupId)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		slog.Error("Failed to get instruction", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
 	}
+	instruct = lb.renderInstruction(ctx, meta, instruct)
+	history := lb.getHistory(ctx, meta)
 
 	respChannel := make(chan string)
 	go func() {
-		resp, err := lb.llmProvider.GenerateContent(ctx, instruct, meta.Text)
+		resp, err := lb.llmProvider.GenerateContent(ctx, instruct, history, meta.Text)
 		if err != nil {
 			slog.Error("Failed to generate response", "error", err)
+			lb.countStat(ctx, storage.StatErrors, 1)
 			resp = "Something went wrong when generating response"
+		} else {
+			lb.appendHistory(ctx, meta, resp)
 		}
 		respChannel <- resp
 	}()
@@ -170,6 +385,13 @@ func (lb *LineBot) generateContent(ctx context.Context, meta TextMessageMeta) {
 	}
 }
 
+// reply answers meta with text, logging a failure.
+func (lb *LineBot) reply(text string, meta TextMessageMeta) {
+	if err := lb.replyMessage(text, meta.ReplyToken, meta.QuoteToken); err != nil {
+		slog.Error("Failed to reply message", "error", err)
+	}
+}
+
 func (lb *LineBot) replyMessage(text, replyToken, quoteToken string) error {
 	_, err := lb.messagingAPI.ReplyMessage(
 		&messaging_api.ReplyMessageRequest{
@@ -182,6 +404,86 @@ func (lb *LineBot) replyMessage(text, replyToken, quoteToken string) error {
 			},
 		},
 	)
+	if err != nil {
+		return err
+	}
+	lb.answered(replyToken)
+	return nil
+}
 
-	return err
+// allowMessage enforces the per-user rate limit, and in groups the quota of
+// the group if operators set one, over fixed one-minute windows.
+func (lb *LineBot) allowMessage(ctx context.Context, meta TextMessageMeta) bool {
+	limit, ok := lb.quota(ctx, meta.UserId)
+	if !ok {
+		limit, ok = lb.quota(ctx, storage.QuotaDefault)
+	}
+	if !ok {
+		limit = lb.rateLimit
+	}
+	if !lb.countMessage(ctx, meta.UserId, limit) {
+		return false
+	}
+	if meta.Type == GroupSource {
+		if limit, ok := lb.quota(ctx, meta.GroupId); ok {
+			return lb.countMessage(ctx, meta.GroupId, limit)
+		}
+	}
+	return true
+}
+
+// countMessage counts a message of a user or group and reports whether it is
+// within limit, 0 being unlimited.
+func (lb *LineBot) countMessage(ctx context.Context, id string, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	window := time.Now().Truncate(time.Minute).Unix()
+	count, err := lb.storage.IncrCounter(ctx, fmt.Sprintf("%s%d", rateLimitPrefix(id), window), 1, time.Minute)
+	if err != nil {
+		slog.Error("Failed to count message", "id", id, "error", err)
+		return true
+	}
+	return count <= int64(limit)
+}
+
+// historyKey starts with userHistoryPrefix in groups too, so that every
+// history of a user can be found for /mydata.
+func historyKey(meta TextMessageMeta) string {
+	if meta.Type == GroupSource {
+		return userHistoryPrefix(meta.UserId) + ":group:" + meta.GroupId
+	}
+	return userHistoryPrefix(meta.UserId)
+}
+
+func (lb *LineBot) getHistory(ctx context.Context, meta TextMessageMeta) []llm.Message {
+	if lb.historySize <= 0 {
+		return nil
+	}
+	stored, err := lb.storage.GetHistory(ctx, historyKey(meta))
+	if err != nil {
+		slog.Error("Failed to get history", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+		return nil
+	}
+	history := make([]llm.Message, 0, len(stored))
+	for _, m := range stored {
+		history = append(history, llm.Message{Role: m.Role, Text: m.Text})
+	}
+	return history
+}
+
+func (lb *LineBot) appendHistory(ctx context.Context, meta TextMessageMeta, resp string) {
+	if lb.historySize <= 0 {
+		return
+	}
+	key := historyKey(meta)
+	for _, m := range []storage.HistoryMessage{
+		{Role: storage.HistoryRoleUser, Text: meta.Text},
+		{Role: storage.HistoryRoleModel, Text: resp},
+	} {
+		if err := lb.storage.AppendHistory(ctx, key, m, lb.historySize, lb.historyTTL); err != nil {
+			slog.Error("Failed to append history", "user_id", meta.UserId, "group_id", meta.GroupId, "error", err)
+			return
+		}
+	}
 }
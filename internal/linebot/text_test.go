@@ -0,0 +1,72 @@
+package linebot
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+func TestInstructionFallback(t *testing.T) {
+	ctx := context.Background()
+	lb := &LineBot{storage: memstore.New()}
+	meta := TextMessageMeta{Type: GroupSource, GroupId: "Cgroup", UserId: "Uuser"}
+
+	if _, err := lb.GetInstruction(ctx, meta, true); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound without any instruction, got %v\n", err)
+	}
+	if err := lb.SetInstruction(ctx, meta, "group default", true); err != nil {
+		t.Fatalf("Failed to set the group default: %v\n", err)
+	}
+	for _, c := range []struct {
+		groupDefault bool
+		want         string
+		wantErr      error
+	}{
+		{groupDefault: true, want: "group default"},
+		{groupDefault: false, wantErr: storage.ErrNotFound},
+	} {
+		got, err := lb.GetInstruction(ctx, meta, c.groupDefault)
+		if got != c.want || !errors.Is(err, c.wantErr) {
+			t.Fatalf("Unexpected instruction with groupDefault %v: %q, %v\n", c.groupDefault, got, err)
+		}
+	}
+
+	// An empty instruction is kept rather than falling back.
+	if err := lb.SetInstruction(ctx, meta, "", false); err != nil {
+		t.Fatalf("Failed to set an empty instruction: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, true); err != nil || got != "" {
+		t.Fatalf("Expected the empty instruction, got %q, %v\n", got, err)
+	}
+
+	// Unsetting it brings the group default back.
+	if err := lb.UnsetInstruction(ctx, meta, false); err != nil {
+		t.Fatalf("Failed to unset the instruction: %v\n", err)
+	}
+	if got, err := lb.GetInstruction(ctx, meta, true); err != nil || got != "group default" {
+		t.Fatalf("Expected the group default, got %q, %v\n", got, err)
+	}
+	if err := lb.UnsetInstruction(ctx, meta, false); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound when nothing is set, got %v\n", err)
+	}
+}
+
+func TestParseInstruction(t *testing.T) {
+	for _, c := range []struct {
+		text, prefix, want string
+	}{
+		{"/instruction be brief", "/instruction", "be brief"},
+		{"/instruction  two spaces", "/instruction", " two spaces"},
+		{"/instruction line one\nline two", "/instruction", "line one\nline two"},
+		{`/instruction ""`, "/instruction", ""},
+		{`/instruction """"`, "/instruction", `""""`},
+		{"/instruction", "/instruction", ""},
+	} {
+		if got := parseInstruction(c.text, c.prefix); got != c.want {
+			t.Fatalf("parseInstruction(%q, %q) = %q, expected %q\n", c.text, c.prefix, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package memstore
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// Expired entries are dropped lazily when their key is touched again.
+
+type history struct {
+	messages  []storage.HistoryMessage
+	expiresAt time.Time
+}
+
+type counter struct {
+	value     int64
+	expiresAt time.Time
+}
+
+func (m *MemStore) AppendHistory(ctx context.Context, key string, message storage.HistoryMessage, maxLen int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	h := m.histories[key]
+	if !now.Before(h.expiresAt) {
+		h.messages = nil
+	}
+	h.messages = storage.AppendHistory(h.messages, message, maxLen)
+	h.expiresAt = now.Add(ttl)
+	m.histories[key] = h
+	return nil
+}
+
+func (m *MemStore) GetHistory(ctx context.Context, key string) ([]storage.HistoryMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	h, ok := m.histories[key]
+	if !ok || !time.Now().Before(h.expiresAt) {
+		return nil, nil
+	}
+	return slices.Clone(h.messages), nil
+}
+
+func (m *MemStore) ScanHistory(ctx context.Context, prefix string, fn func(key string, history []storage.HistoryMessage) error) error {
+	m.mu.RLock()
+	now := time.Now()
+	matched := make(map[string][]storage.HistoryMessage)
+	for key, h := range m.histories {
+		if strings.HasPrefix(key, prefix) && now.Before(h.expiresAt) {
+			matched[key] = slices.Clone(h.messages)
+		}
+	}
+	m.mu.RUnlock()
+	for key, messages := range matched {
+		if err := fn(key, messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) RewriteHistory(ctx context.Context, key string, fn func([]storage.HistoryMessage) ([]storage.HistoryMessage, error)) error {
+	old, err := m.GetHistory(ctx, key)
+	if err != nil || old == nil {
+		return err
+	}
+	history, err := fn(slices.Clone(old))
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.histories[key]
+	if !time.Now().Before(h.expiresAt) || !slices.Equal(h.messages, old) {
+		return storage.ErrConflict
+	}
+	h.messages = slices.Clone(history)
+	m.histories[key] = h
+	return nil
+}
+
+func (m *MemStore) DeleteHistory(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.histories, key)
+	return nil
+}
+
+func (m *MemStore) IncrCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	c, ok := m.counters[key]
+	if !ok || !now.Before(c.expiresAt) {
+		c = counter{expiresAt: now.Add(ttl)}
+	}
+	c.value += delta
+	m.counters[key] = c
+	return c.value, nil
+}
+
+func (m *MemStore) GetCounter(ctx context.Context, key string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.counters[key]
+	if !ok || !time.Now().Before(c.expiresAt) {
+		return 0, nil
+	}
+	return c.value, nil
+}
+
+func (m *MemStore) ScanCounters(ctx context.Context, prefix string, fn func(key string, value int64) error) error {
+	m.mu.RLock()
+	now := time.Now()
+	matched := make(map[string]int64)
+	for key, c := range m.counters {
+		if strings.HasPrefix(key, prefix) && now.Before(c.expiresAt) {
+			matched[key] = c.value
+		}
+	}
+	m.mu.RUnlock()
+	for key, value := range matched {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) DeleteCounter(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.counters, key)
+	return nil
+}
+
+func (m *MemStore) MarkProcessed(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if expiresAt, ok := m.processed[key]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+	m.processed[key] = now.Add(ttl)
+	return true, nil
+}
+
+func (m *MemStore) UnmarkProcessed(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.processed, key)
+	return nil
+}
@@ -0,0 +1,482 @@
+package memstore
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+var _ storage.Storage = (*MemStore)(nil)
+
+type groupUserKey struct {
+	groupId string
+	userId  string
+}
+
+type personaKey struct {
+	scope string
+	name  string
+}
+
+// MemStore keeps every setting in process memory. It is meant for tests and
+// local development; nothing survives a restart.
+type MemStore struct {
+	mu                sync.RWMutex
+	userSettings      map[string]storage.UserSetting
+	groupUserSettings map[groupUserKey]storage.GroupUserSetting
+	personas          map[personaKey]storage.Persona
+	groupRoles        map[groupUserKey]storage.GroupRole
+	botSettings       map[string]storage.BotSetting
+	blocks            map[string]storage.Block
+	audit             map[string][]storage.AuditEntry
+	histories         map[string]history
+	counters          map[string]counter
+	processed         map[string]time.Time
+}
+
+func New() *MemStore {
+	return &MemStore{
+		userSettings:      make(map[string]storage.UserSetting),
+		groupUserSettings: make(map[groupUserKey]storage.GroupUserSetting),
+		personas:          make(map[personaKey]storage.Persona),
+		groupRoles:        make(map[groupUserKey]storage.GroupRole),
+		botSettings:       make(map[string]storage.BotSetting),
+		blocks:            make(map[string]storage.Block),
+		audit:             make(map[string][]storage.AuditEntry),
+		histories:         make(map[string]history),
+		counters:          make(map[string]counter),
+		processed:         make(map[string]time.Time),
+	}
+}
+
+func (m *MemStore) UpsertGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := groupUserKey{setting.GroupId, setting.UserId}
+	if m.groupUserSettings[key].Version != setting.Version {
+		return storage.ErrConflict
+	}
+	setting.Version++
+	m.groupUserSettings[key] = setting
+	return nil
+}
+
+func (m *MemStore) GetGroupUserSetting(ctx context.Context, groupId, userId string) (*storage.GroupUserSetting, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	setting, ok := m.groupUserSettings[groupUserKey{groupId, userId}]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &setting, nil
+}
+
+func (m *MemStore) DeleteGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := groupUserKey{setting.GroupId, setting.UserId}
+	stored, ok := m.groupUserSettings[key]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if stored.Version != setting.Version {
+		return storage.ErrConflict
+	}
+	delete(m.groupUserSettings, key)
+	return nil
+}
+
+func (m *MemStore) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.userSettings[setting.UserId].Version != setting.Version {
+		return storage.ErrConflict
+	}
+	setting.Version++
+	m.userSettings[setting.UserId] = setting
+	return nil
+}
+
+func (m *MemStore) GetUserSetting(ctx context.Context, userId string) (*storage.UserSetting, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	setting, ok := m.userSettings[userId]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &setting, nil
+}
+
+func (m *MemStore) DeleteUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.userSettings[setting.UserId]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if stored.Version != setting.Version {
+		return storage.ErrConflict
+	}
+	delete(m.userSettings, setting.UserId)
+	return nil
+}
+
+func (m *MemStore) ScanGroupUserSettings(ctx context.Context, fn func(storage.GroupUserSetting) error) error {
+	m.mu.RLock()
+	settings := slices.Collect(maps.Values(m.groupUserSettings))
+	m.mu.RUnlock()
+	for _, setting := range settings {
+		if err := fn(setting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) ScanUserSettings(ctx context.Context, fn func(storage.UserSetting) error) error {
+	m.mu.RLock()
+	settings := slices.Collect(maps.Values(m.userSettings))
+	m.mu.RUnlock()
+	for _, setting := range settings {
+		if err := fn(setting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) ListGroupUserSettings(ctx context.Context, groupId, after string, limit int) ([]storage.GroupUserSetting, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var settings []storage.GroupUserSetting
+	for key, setting := range m.groupUserSettings {
+		if key.groupId == groupId && key.userId > after {
+			settings = append(settings, setting)
+		}
+	}
+	slices.SortFunc(settings, func(a, b storage.GroupUserSetting) int {
+		return strings.Compare(a.UserId, b.UserId)
+	})
+	return settings[:min(limit, len(settings))], nil
+}
+
+func (m *MemStore) ListGroupUserSettingsByUser(ctx context.Context, userId string) ([]storage.GroupUserSetting, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var settings []storage.GroupUserSetting
+	for key, setting := range m.groupUserSettings {
+		if key.userId == userId {
+			settings = append(settings, setting)
+		}
+	}
+	return settings, nil
+}
+
+func (m *MemStore) UpsertPersona(ctx context.Context, persona storage.Persona) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := personaKey{persona.Scope, persona.Name}
+	if m.personas[key].Version != persona.Version {
+		return storage.ErrConflict
+	}
+	persona.Version++
+	m.personas[key] = persona
+	return nil
+}
+
+func (m *MemStore) GetPersona(ctx context.Context, scope, name string) (*storage.Persona, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	persona, ok := m.personas[personaKey{scope, name}]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &persona, nil
+}
+
+func (m *MemStore) DeletePersona(ctx context.Context, persona storage.Persona) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := personaKey{persona.Scope, persona.Name}
+	stored, ok := m.personas[key]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if stored.Version != persona.Version {
+		return storage.ErrConflict
+	}
+	delete(m.personas, key)
+	return nil
+}
+
+func (m *MemStore) ListPersonas(ctx context.Context, scope string) ([]storage.Persona, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var personas []storage.Persona
+	for key, persona := range m.personas {
+		if key.scope == scope {
+			personas = append(personas, persona)
+		}
+	}
+	slices.SortFunc(personas, func(a, b storage.Persona) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return personas, nil
+}
+
+func (m *MemStore) ScanPersonas(ctx context.Context, fn func(storage.Persona) error) error {
+	m.mu.RLock()
+	personas := slices.Collect(maps.Values(m.personas))
+	m.mu.RUnlock()
+	for _, persona := range personas {
+		if err := fn(persona); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) UpsertGroupRole(ctx context.Context, role storage.GroupRole) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := groupUserKey{role.GroupId, role.UserId}
+	if m.groupRoles[key].Version != role.Version {
+		return storage.ErrConflict
+	}
+	role.Version++
+	m.groupRoles[key] = role
+	return nil
+}
+
+func (m *MemStore) GetGroupRole(ctx context.Context, groupId, userId string) (*storage.GroupRole, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	role, ok := m.groupRoles[groupUserKey{groupId, userId}]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &role, nil
+}
+
+func (m *MemStore) DeleteGroupRole(ctx context.Context, role storage.GroupRole) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := groupUserKey{role.GroupId, role.UserId}
+	stored, ok := m.groupRoles[key]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if stored.Version != role.Version {
+		return storage.ErrConflict
+	}
+	delete(m.groupRoles, key)
+	return nil
+}
+
+func (m *MemStore) ListGroupRoles(ctx context.Context, groupId string) ([]storage.GroupRole, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var roles []storage.GroupRole
+	for key, role := range m.groupRoles {
+		if key.groupId == groupId {
+			roles = append(roles, role)
+		}
+	}
+	slices.SortFunc(roles, func(a, b storage.GroupRole) int {
+		return strings.Compare(a.UserId, b.UserId)
+	})
+	return roles, nil
+}
+
+func (m *MemStore) ScanGroupRoles(ctx context.Context, fn func(storage.GroupRole) error) error {
+	m.mu.RLock()
+	roles := slices.Collect(maps.Values(m.groupRoles))
+	m.mu.RUnlock()
+	for _, role := range roles {
+		if err := fn(role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) UpsertBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.botSettings[setting.Key].Version != setting.Version {
+		return storage.ErrConflict
+	}
+	setting.Version++
+	m.botSettings[setting.Key] = setting
+	return nil
+}
+
+func (m *MemStore) GetBotSetting(ctx context.Context, key string) (*storage.BotSetting, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	setting, ok := m.botSettings[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &setting, nil
+}
+
+func (m *MemStore) DeleteBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.botSettings[setting.Key]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if stored.Version != setting.Version {
+		return storage.ErrConflict
+	}
+	delete(m.botSettings, setting.Key)
+	return nil
+}
+
+func (m *MemStore) ScanBotSettings(ctx context.Context, fn func(storage.BotSetting) error) error {
+	m.mu.RLock()
+	settings := slices.Collect(maps.Values(m.botSettings))
+	m.mu.RUnlock()
+	for _, setting := range settings {
+		if err := fn(setting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) UpsertBlock(ctx context.Context, block storage.Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.blocks[block.Id].Version != block.Version {
+		return storage.ErrConflict
+	}
+	block.Version++
+	m.blocks[block.Id] = block
+	return nil
+}
+
+func (m *MemStore) GetBlock(ctx context.Context, id string) (*storage.Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	block, ok := m.blocks[id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &block, nil
+}
+
+func (m *MemStore) DeleteBlock(ctx context.Context, block storage.Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.blocks[block.Id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if stored.Version != block.Version {
+		return storage.ErrConflict
+	}
+	delete(m.blocks, block.Id)
+	return nil
+}
+
+func (m *MemStore) ScanBlocks(ctx context.Context, fn func(storage.Block) error) error {
+	m.mu.RLock()
+	blocks := slices.Collect(maps.Values(m.blocks))
+	m.mu.RUnlock()
+	for _, block := range blocks {
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) AppendAudit(ctx context.Context, entry storage.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.audit[entry.Scope] = append(m.audit[entry.Scope], entry)
+	return nil
+}
+
+func (m *MemStore) ListAudit(ctx context.Context, scope string, before time.Time, limit int) ([]storage.AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var entries []storage.AuditEntry
+	for _, entry := range slices.Backward(m.audit[scope]) {
+		if len(entries) == limit {
+			break
+		}
+		if before.IsZero() || entry.Time.Before(before) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (m *MemStore) ScanAudit(ctx context.Context, fn func(scope string, entries []storage.AuditEntry) error) error {
+	m.mu.RLock()
+	audit := make(map[string][]storage.AuditEntry, len(m.audit))
+	for scope, entries := range m.audit {
+		audit[scope] = slices.Clone(entries)
+	}
+	m.mu.RUnlock()
+	for scope, entries := range audit {
+		if err := fn(scope, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) DeleteAudit(ctx context.Context, scope string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.audit, scope)
+	return nil
+}
+
+func (m *MemStore) RedactAudit(ctx context.Context, actor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entries := range m.audit {
+		for i := range entries {
+			if entries[i].Actor == actor {
+				entries[i].Actor, entries[i].OldHash, entries[i].NewValue = "", "", ""
+			}
+		}
+	}
+	return nil
+}
+
+// RewriteAudit calls fn without holding the lock, and replaces a value only
+// if its entry is still the one fn was called with.
+func (m *MemStore) RewriteAudit(ctx context.Context, fn func(storage.AuditEntry) (string, error)) error {
+	m.mu.RLock()
+	audit := make(map[string][]storage.AuditEntry, len(m.audit))
+	for scope, entries := range m.audit {
+		audit[scope] = slices.Clone(entries)
+	}
+	m.mu.RUnlock()
+	for scope, entries := range audit {
+		for i, entry := range entries {
+			value, err := fn(entry)
+			if err != nil {
+				return err
+			}
+			m.mu.Lock()
+			if stored := m.audit[scope]; i < len(stored) && stored[i] == entry {
+				stored[i].NewValue = value
+			}
+			m.mu.Unlock()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package memstore
+
+import (
+	"testing"
+
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/internal/storage/storagetest"
+)
+
+func TestMemStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return New()
+	})
+}
@@ -0,0 +1,327 @@
+// Package metricstore counts, times and traces the operations of a
+// storage.Storage.
+package metricstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ storage.Storage = (*MetricStore)(nil)
+
+var tracer = otel.Tracer("github.com/vgjm/linebot/internal/metricstore")
+
+// MetricStore wraps another storage.Storage. Operations are labelled and spans
+// named with the method name; the time of scans includes that of their
+// callbacks.
+type MetricStore struct {
+	storage.Storage
+}
+
+func New(backing storage.Storage) *MetricStore {
+	return &MetricStore{Storage: backing}
+}
+
+// observe starts an operation, returning the context to run it with and a
+// function to call with its error once it ended. Missing items and version
+// conflicts are outcomes of their own, not errors.
+func observe(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "storage."+operation, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, func(err *error) {
+		metrics.StorageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		outcome := metrics.OutcomeOK
+		switch {
+		case *err == nil:
+		case errors.Is(*err, storage.ErrNotFound):
+			outcome = metrics.OutcomeNotFound
+		case errors.Is(*err, storage.ErrConflict):
+			outcome = metrics.OutcomeConflict
+		default:
+			outcome = metrics.OutcomeError
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		metrics.StorageOperations.WithLabelValues(operation, outcome).Inc()
+		span.SetAttributes(attribute.String("linebot.storage.outcome", outcome))
+		span.End()
+	}
+}
+
+func (s *MetricStore) UpsertGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) (err error) {
+	ctx, done := observe(ctx, "UpsertGroupUserSetting")
+	defer done(&err)
+	return s.Storage.UpsertGroupUserSetting(ctx, setting)
+}
+
+func (s *MetricStore) GetGroupUserSetting(ctx context.Context, groupId, userId string) (setting *storage.GroupUserSetting, err error) {
+	ctx, done := observe(ctx, "GetGroupUserSetting")
+	defer done(&err)
+	return s.Storage.GetGroupUserSetting(ctx, groupId, userId)
+}
+
+func (s *MetricStore) DeleteGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) (err error) {
+	ctx, done := observe(ctx, "DeleteGroupUserSetting")
+	defer done(&err)
+	return s.Storage.DeleteGroupUserSetting(ctx, setting)
+}
+
+func (s *MetricStore) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) (err error) {
+	ctx, done := observe(ctx, "UpsertUserSetting")
+	defer done(&err)
+	return s.Storage.UpsertUserSetting(ctx, setting)
+}
+
+func (s *MetricStore) GetUserSetting(ctx context.Context, userId string) (setting *storage.UserSetting, err error) {
+	ctx, done := observe(ctx, "GetUserSetting")
+	defer done(&err)
+	return s.Storage.GetUserSetting(ctx, userId)
+}
+
+func (s *MetricStore) DeleteUserSetting(ctx context.Context, setting storage.UserSetting) (err error) {
+	ctx, done := observe(ctx, "DeleteUserSetting")
+	defer done(&err)
+	return s.Storage.DeleteUserSetting(ctx, setting)
+}
+
+func (s *MetricStore) ScanGroupUserSettings(ctx context.Context, fn func(storage.GroupUserSetting) error) (err error) {
+	ctx, done := observe(ctx, "ScanGroupUserSettings")
+	defer done(&err)
+	return s.Storage.ScanGroupUserSettings(ctx, fn)
+}
+
+func (s *MetricStore) ScanUserSettings(ctx context.Context, fn func(storage.UserSetting) error) (err error) {
+	ctx, done := observe(ctx, "ScanUserSettings")
+	defer done(&err)
+	return s.Storage.ScanUserSettings(ctx, fn)
+}
+
+func (s *MetricStore) ListGroupUserSettings(ctx context.Context, groupId, after string, limit int) (settings []storage.GroupUserSetting, err error) {
+	ctx, done := observe(ctx, "ListGroupUserSettings")
+	defer done(&err)
+	return s.Storage.ListGroupUserSettings(ctx, groupId, after, limit)
+}
+
+func (s *MetricStore) ListGroupUserSettingsByUser(ctx context.Context, userId string) (settings []storage.GroupUserSetting, err error) {
+	ctx, done := observe(ctx, "ListGroupUserSettingsByUser")
+	defer done(&err)
+	return s.Storage.ListGroupUserSettingsByUser(ctx, userId)
+}
+
+func (s *MetricStore) UpsertPersona(ctx context.Context, persona storage.Persona) (err error) {
+	ctx, done := observe(ctx, "UpsertPersona")
+	defer done(&err)
+	return s.Storage.UpsertPersona(ctx, persona)
+}
+
+func (s *MetricStore) GetPersona(ctx context.Context, scope, name string) (persona *storage.Persona, err error) {
+	ctx, done := observe(ctx, "GetPersona")
+	defer done(&err)
+	return s.Storage.GetPersona(ctx, scope, name)
+}
+
+func (s *MetricStore) DeletePersona(ctx context.Context, persona storage.Persona) (err error) {
+	ctx, done := observe(ctx, "DeletePersona")
+	defer done(&err)
+	return s.Storage.DeletePersona(ctx, persona)
+}
+
+func (s *MetricStore) ListPersonas(ctx context.Context, scope string) (personas []storage.Persona, err error) {
+	ctx, done := observe(ctx, "ListPersonas")
+	defer done(&err)
+	return s.Storage.ListPersonas(ctx, scope)
+}
+
+func (s *MetricStore) ScanPersonas(ctx context.Context, fn func(storage.Persona) error) (err error) {
+	ctx, done := observe(ctx, "ScanPersonas")
+	defer done(&err)
+	return s.Storage.ScanPersonas(ctx, fn)
+}
+
+func (s *MetricStore) UpsertGroupRole(ctx context.Context, role storage.GroupRole) (err error) {
+	ctx, done := observe(ctx, "UpsertGroupRole")
+	defer done(&err)
+	return s.Storage.UpsertGroupRole(ctx, role)
+}
+
+func (s *MetricStore) GetGroupRole(ctx context.Context, groupId, userId string) (role *storage.GroupRole, err error) {
+	ctx, done := observe(ctx, "GetGroupRole")
+	defer done(&err)
+	return s.Storage.GetGroupRole(ctx, groupId, userId)
+}
+
+func (s *MetricStore) DeleteGroupRole(ctx context.Context, role storage.GroupRole) (err error) {
+	ctx, done := observe(ctx, "DeleteGroupRole")
+	defer done(&err)
+	return s.Storage.DeleteGroupRole(ctx, role)
+}
+
+func (s *MetricStore) ListGroupRoles(ctx context.Context, groupId string) (roles []storage.GroupRole, err error) {
+	ctx, done := observe(ctx, "ListGroupRoles")
+	defer done(&err)
+	return s.Storage.ListGroupRoles(ctx, groupId)
+}
+
+func (s *MetricStore) ScanGroupRoles(ctx context.Context, fn func(storage.GroupRole) error) (err error) {
+	ctx, done := observe(ctx, "ScanGroupRoles")
+	defer done(&err)
+	return s.Storage.ScanGroupRoles(ctx, fn)
+}
+
+func (s *MetricStore) UpsertBotSetting(ctx context.Context, setting storage.BotSetting) (err error) {
+	ctx, done := observe(ctx, "UpsertBotSetting")
+	defer done(&err)
+	return s.Storage.UpsertBotSetting(ctx, setting)
+}
+
+func (s *MetricStore) GetBotSetting(ctx context.Context, key string) (setting *storage.BotSetting, err error) {
+	ctx, done := observe(ctx, "GetBotSetting")
+	defer done(&err)
+	return s.Storage.GetBotSetting(ctx, key)
+}
+
+func (s *MetricStore) DeleteBotSetting(ctx context.Context, setting storage.BotSetting) (err error) {
+	ctx, done := observe(ctx, "DeleteBotSetting")
+	defer done(&err)
+	return s.Storage.DeleteBotSetting(ctx, setting)
+}
+
+func (s *MetricStore) ScanBotSettings(ctx context.Context, fn func(storage.BotSetting) error) (err error) {
+	ctx, done := observe(ctx, "ScanBotSettings")
+	defer done(&err)
+	return s.Storage.ScanBotSettings(ctx, fn)
+}
+
+func (s *MetricStore) UpsertBlock(ctx context.Context, block storage.Block) (err error) {
+	ctx, done := observe(ctx, "UpsertBlock")
+	defer done(&err)
+	return s.Storage.UpsertBlock(ctx, block)
+}
+
+func (s *MetricStore) GetBlock(ctx context.Context, id string) (block *storage.Block, err error) {
+	ctx, done := observe(ctx, "GetBlock")
+	defer done(&err)
+	return s.Storage.GetBlock(ctx, id)
+}
+
+func (s *MetricStore) DeleteBlock(ctx context.Context, block storage.Block) (err error) {
+	ctx, done := observe(ctx, "DeleteBlock")
+	defer done(&err)
+	return s.Storage.DeleteBlock(ctx, block)
+}
+
+func (s *MetricStore) ScanBlocks(ctx context.Context, fn func(storage.Block) error) (err error) {
+	ctx, done := observe(ctx, "ScanBlocks")
+	defer done(&err)
+	return s.Storage.ScanBlocks(ctx, fn)
+}
+
+func (s *MetricStore) AppendAudit(ctx context.Context, entry storage.AuditEntry) (err error) {
+	ctx, done := observe(ctx, "AppendAudit")
+	defer done(&err)
+	return s.Storage.AppendAudit(ctx, entry)
+}
+
+func (s *MetricStore) ListAudit(ctx context.Context, scope string, before time.Time, limit int) (entries []storage.AuditEntry, err error) {
+	ctx, done := observe(ctx, "ListAudit")
+	defer done(&err)
+	return s.Storage.ListAudit(ctx, scope, before, limit)
+}
+
+func (s *MetricStore) ScanAudit(ctx context.Context, fn func(scope string, entries []storage.AuditEntry) error) (err error) {
+	ctx, done := observe(ctx, "ScanAudit")
+	defer done(&err)
+	return s.Storage.ScanAudit(ctx, fn)
+}
+
+func (s *MetricStore) DeleteAudit(ctx context.Context, scope string) (err error) {
+	ctx, done := observe(ctx, "DeleteAudit")
+	defer done(&err)
+	return s.Storage.DeleteAudit(ctx, scope)
+}
+
+func (s *MetricStore) RedactAudit(ctx context.Context, actor string) (err error) {
+	ctx, done := observe(ctx, "RedactAudit")
+	defer done(&err)
+	return s.Storage.RedactAudit(ctx, actor)
+}
+
+func (s *MetricStore) RewriteAudit(ctx context.Context, fn func(storage.AuditEntry) (string, error)) (err error) {
+	ctx, done := observe(ctx, "RewriteAudit")
+	defer done(&err)
+	return s.Storage.RewriteAudit(ctx, fn)
+}
+
+func (s *MetricStore) AppendHistory(ctx context.Context, key string, message storage.HistoryMessage, maxLen int, ttl time.Duration) (err error) {
+	ctx, done := observe(ctx, "AppendHistory")
+	defer done(&err)
+	return s.Storage.AppendHistory(ctx, key, message, maxLen, ttl)
+}
+
+func (s *MetricStore) GetHistory(ctx context.Context, key string) (history []storage.HistoryMessage, err error) {
+	ctx, done := observe(ctx, "GetHistory")
+	defer done(&err)
+	return s.Storage.GetHistory(ctx, key)
+}
+
+func (s *MetricStore) ScanHistory(ctx context.Context, prefix string, fn func(key string, history []storage.HistoryMessage) error) (err error) {
+	ctx, done := observe(ctx, "ScanHistory")
+	defer done(&err)
+	return s.Storage.ScanHistory(ctx, prefix, fn)
+}
+
+func (s *MetricStore) RewriteHistory(ctx context.Context, key string, fn func([]storage.HistoryMessage) ([]storage.HistoryMessage, error)) (err error) {
+	ctx, done := observe(ctx, "RewriteHistory")
+	defer done(&err)
+	return s.Storage.RewriteHistory(ctx, key, fn)
+}
+
+func (s *MetricStore) DeleteHistory(ctx context.Context, key string) (err error) {
+	ctx, done := observe(ctx, "DeleteHistory")
+	defer done(&err)
+	return s.Storage.DeleteHistory(ctx, key)
+}
+
+func (s *MetricStore) IncrCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (value int64, err error) {
+	ctx, done := observe(ctx, "IncrCounter")
+	defer done(&err)
+	return s.Storage.IncrCounter(ctx, key, delta, ttl)
+}
+
+func (s *MetricStore) GetCounter(ctx context.Context, key string) (value int64, err error) {
+	ctx, done := observe(ctx, "GetCounter")
+	defer done(&err)
+	return s.Storage.GetCounter(ctx, key)
+}
+
+func (s *MetricStore) ScanCounters(ctx context.Context, prefix string, fn func(key string, value int64) error) (err error) {
+	ctx, done := observe(ctx, "ScanCounters")
+	defer done(&err)
+	return s.Storage.ScanCounters(ctx, prefix, fn)
+}
+
+func (s *MetricStore) DeleteCounter(ctx context.Context, key string) (err error) {
+	ctx, done := observe(ctx, "DeleteCounter")
+	defer done(&err)
+	return s.Storage.DeleteCounter(ctx, key)
+}
+
+func (s *MetricStore) MarkProcessed(ctx context.Context, key string, ttl time.Duration) (first bool, err error) {
+	ctx, done := observe(ctx, "MarkProcessed")
+	defer done(&err)
+	return s.Storage.MarkProcessed(ctx, key, ttl)
+}
+
+func (s *MetricStore) UnmarkProcessed(ctx context.Context, key string) (err error) {
+	ctx, done := observe(ctx, "UnmarkProcessed")
+	defer done(&err)
+	return s.Storage.UnmarkProcessed(ctx, key)
+}
@@ -0,0 +1,38 @@
+package metricstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/pkg/metrics"
+)
+
+func TestOutcomes(t *testing.T) {
+	ctx := context.TODO()
+	s := New(memstore.New())
+	count := func(operation, outcome string) float64 {
+		return testutil.ToFloat64(metrics.StorageOperations.WithLabelValues(operation, outcome))
+	}
+
+	if _, err := s.GetUserSetting(ctx, "U1"); err == nil {
+		t.Fatal("expect a missing setting")
+	}
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{UserId: "U1"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{UserId: "U1"}); err == nil {
+		t.Fatal("expect a conflict on a stale version")
+	}
+	if got := count("GetUserSetting", metrics.OutcomeNotFound); got != 1 {
+		t.Fatalf("got %v missing reads, expect 1", got)
+	}
+	if got := count("UpsertUserSetting", metrics.OutcomeOK); got != 1 {
+		t.Fatalf("got %v successful writes, expect 1", got)
+	}
+	if got := count("UpsertUserSetting", metrics.OutcomeConflict); got != 1 {
+		t.Fatalf("got %v conflicts, expect 1", got)
+	}
+}
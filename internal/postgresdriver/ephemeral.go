@@ -0,0 +1,224 @@
+package postgresdriver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+// Expiry times are stored as unix milliseconds. Expired rows are ignored on
+// read and purged whenever a new event is marked as processed.
+
+func (d *PostgresDriver) AppendHistory(ctx context.Context, key string, message storage.HistoryMessage, maxLen int, ttl time.Duration) error {
+	now := time.Now()
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var raw string
+	var expiresAt int64
+	var history []storage.HistoryMessage
+	err = tx.QueryRowContext(ctx, `SELECT messages, expires_at FROM history WHERE key = $1 FOR UPDATE`, key).Scan(&raw, &expiresAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return err
+	case expiresAt > now.UnixMilli():
+		if err := json.Unmarshal([]byte(raw), &history); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(storage.AppendHistory(history, message, maxLen))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO history (key, messages, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET messages = excluded.messages, expires_at = excluded.expires_at`,
+		key, string(data), now.Add(ttl).UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *PostgresDriver) GetHistory(ctx context.Context, key string) ([]storage.HistoryMessage, error) {
+	var raw string
+	err := d.db.QueryRowContext(ctx, `
+		SELECT messages FROM history WHERE key = $1 AND expires_at > $2`,
+		key, time.Now().UnixMilli()).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var history []storage.HistoryMessage
+	if err := json.Unmarshal([]byte(raw), &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (d *PostgresDriver) ScanHistory(ctx context.Context, prefix string, fn func(key string, history []storage.HistoryMessage) error) error {
+	return d.scanEphemeral(ctx, `
+		SELECT key, messages FROM history
+		WHERE substr(key, 1, length($1)) = $1 AND expires_at > $2 AND key > $3
+		ORDER BY key LIMIT $4`,
+		prefix, func(key, raw string) error {
+			var history []storage.HistoryMessage
+			if err := json.Unmarshal([]byte(raw), &history); err != nil {
+				return err
+			}
+			return fn(key, history)
+		})
+}
+
+func (d *PostgresDriver) RewriteHistory(ctx context.Context, key string, fn func([]storage.HistoryMessage) ([]storage.HistoryMessage, error)) error {
+	var raw string
+	err := d.db.QueryRowContext(ctx, `
+		SELECT messages FROM history WHERE key = $1 AND expires_at > $2`,
+		key, time.Now().UnixMilli()).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var history []storage.HistoryMessage
+	if err := json.Unmarshal([]byte(raw), &history); err != nil {
+		return err
+	}
+	if history, err = fn(history); err != nil {
+		return err
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE history SET messages = $1
+		WHERE key = $2 AND messages = $3 AND expires_at > $4`,
+		string(data), key, raw, time.Now().UnixMilli()))
+}
+
+func (d *PostgresDriver) DeleteHistory(ctx context.Context, key string) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM history WHERE key = $1`, key)
+	return err
+}
+
+func (d *PostgresDriver) IncrCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	var value int64
+	err := d.db.QueryRowContext(ctx, `
+		INSERT INTO counter (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET
+			value = CASE WHEN counter.expires_at <= $4 THEN excluded.value ELSE counter.value + excluded.value END,
+			expires_at = CASE WHEN counter.expires_at <= $4 THEN excluded.expires_at ELSE counter.expires_at END
+		RETURNING value`,
+		key, delta, now.Add(ttl).UnixMilli(), now.UnixMilli()).Scan(&value)
+	return value, err
+}
+
+func (d *PostgresDriver) GetCounter(ctx context.Context, key string) (int64, error) {
+	var value int64
+	err := d.db.QueryRowContext(ctx, `
+		SELECT value FROM counter WHERE key = $1 AND expires_at > $2`,
+		key, time.Now().UnixMilli()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return value, err
+}
+
+func (d *PostgresDriver) ScanCounters(ctx context.Context, prefix string, fn func(key string, value int64) error) error {
+	return d.scanEphemeral(ctx, `
+		SELECT key, value FROM counter
+		WHERE substr(key, 1, length($1)) = $1 AND expires_at > $2 AND key > $3
+		ORDER BY key LIMIT $4`,
+		prefix, func(key, raw string) error {
+			value, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return err
+			}
+			return fn(key, value)
+		})
+}
+
+func (d *PostgresDriver) DeleteCounter(ctx context.Context, key string) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM counter WHERE key = $1`, key)
+	return err
+}
+
+// scanEphemeral pages through query, which selects a key and a value for a
+// key prefix, the current time, the last key seen and a page size, calling fn
+// with the value as text once the page is read.
+func (d *PostgresDriver) scanEphemeral(ctx context.Context, query, prefix string, fn func(key, value string) error) error {
+	type row struct{ key, value string }
+	after := ""
+	for {
+		rows, err := d.db.QueryContext(ctx, query, prefix, time.Now().UnixMilli(), after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.key, &r.value); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range page {
+			if err := fn(r.key, r.value); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1].key
+	}
+}
+
+func (d *PostgresDriver) MarkProcessed(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	if err := d.purgeExpired(ctx, now); err != nil {
+		return false, err
+	}
+	res, err := d.db.ExecContext(ctx, `
+		INSERT INTO processed (key, expires_at) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET expires_at = excluded.expires_at WHERE processed.expires_at <= $3`,
+		key, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (d *PostgresDriver) UnmarkProcessed(ctx context.Context, key string) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM processed WHERE key = $1`, key)
+	return err
+}
+
+func (d *PostgresDriver) purgeExpired(ctx context.Context, now time.Time) error {
+	for _, table := range []string{"history", "counter", "processed"} {
+		if _, err := d.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE expires_at <= $1`, now.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package postgresdriver
+
+// migrations are applied in order by sqlmigrate; never edit a released entry,
+// append a new one instead.
+var migrations = []string{
+	`CREATE TABLE user_setting (
+		user_id            TEXT PRIMARY KEY,
+		system_instruction TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE group_user_setting (
+		group_id           TEXT NOT NULL,
+		user_id            TEXT NOT NULL,
+		system_instruction TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (group_id, user_id)
+	);`,
+	`CREATE TABLE history (
+		key        TEXT PRIMARY KEY,
+		messages   TEXT NOT NULL,
+		expires_at BIGINT NOT NULL
+	);
+	CREATE INDEX history_expires_at ON history (expires_at);
+	CREATE TABLE counter (
+		key        TEXT PRIMARY KEY,
+		value      BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL
+	);
+	CREATE INDEX counter_expires_at ON counter (expires_at);
+	CREATE TABLE processed (
+		key        TEXT PRIMARY KEY,
+		expires_at BIGINT NOT NULL
+	);
+	CREATE INDEX processed_expires_at ON processed (expires_at);`,
+	`ALTER TABLE user_setting ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE group_user_setting ADD COLUMN version BIGINT NOT NULL DEFAULT 0;`,
+	`CREATE INDEX group_user_setting_user_id ON group_user_setting (user_id);`,
+	`ALTER TABLE user_setting ADD COLUMN persona TEXT NOT NULL DEFAULT '';
+	ALTER TABLE group_user_setting ADD COLUMN persona TEXT NOT NULL DEFAULT '';
+	CREATE TABLE persona (
+		scope              TEXT NOT NULL,
+		name               TEXT NOT NULL,
+		system_instruction TEXT NOT NULL DEFAULT '',
+		version            BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (scope, name)
+	);`,
+	`ALTER TABLE user_setting ADD COLUMN timezone TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE group_role (
+		group_id TEXT NOT NULL,
+		user_id  TEXT NOT NULL,
+		role     TEXT NOT NULL,
+		version  BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (group_id, user_id)
+	);`,
+	`CREATE TABLE bot_setting (
+		key     TEXT PRIMARY KEY,
+		value   TEXT NOT NULL,
+		version BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE TABLE block (
+		user_id    TEXT PRIMARY KEY,
+		reason     TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL DEFAULT 0,
+		version    BIGINT NOT NULL DEFAULT 0
+	);`,
+	`ALTER TABLE block RENAME COLUMN user_id TO id;
+	ALTER TABLE block ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;`,
+	`CREATE TABLE audit_entry (
+		id         BIGSERIAL PRIMARY KEY,
+		scope      TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		actor      TEXT NOT NULL DEFAULT '',
+		action     TEXT NOT NULL,
+		old_hash   TEXT NOT NULL DEFAULT '',
+		new_value  TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_entry_scope ON audit_entry (scope, created_at);`,
+	// Audit times are kept to the nanosecond, so that pages never split
+	// entries of the same millisecond.
+	`UPDATE audit_entry SET created_at = created_at * 1000000;`,
+	`ALTER TABLE group_user_setting ADD COLUMN persona_only BOOLEAN NOT NULL DEFAULT FALSE;`,
+}
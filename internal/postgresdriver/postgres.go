@@ -0,0 +1,795 @@
+package postgresdriver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/vgjm/linebot/internal/sqlmigrate"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+var _ storage.Storage = (*PostgresDriver)(nil)
+
+// migrationLockId is an arbitrary key for pg_advisory_lock so that replicas
+// starting together do not run the same migration twice.
+const migrationLockId = 7346178
+
+// scanPageSize rows are read at a time, so that scan callbacks do not run
+// while a query holds a pooled connection.
+const scanPageSize = 100
+
+type PostgresDriver struct {
+	db *sql.DB
+}
+
+type Config struct {
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+func New(ctx context.Context, pConfig Config) (*PostgresDriver, error) {
+	db, err := sql.Open("pgx", pConfig.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres database: %w", err)
+	}
+	db.SetMaxOpenConns(pConfig.MaxOpenConns)
+	db.SetMaxIdleConns(pConfig.MaxIdleConns)
+	db.SetConnMaxLifetime(pConfig.ConnMaxLifetime)
+
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresDriver{db}, nil
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockId); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationLockId)
+
+	// Migrate on the locked connection: the pool may have no other one to spare.
+	return sqlmigrate.Migrate(ctx, conn, migrations)
+}
+
+func (d *PostgresDriver) Close() error {
+	return d.db.Close()
+}
+
+func (d *PostgresDriver) UpsertGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	if setting.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO group_user_setting (group_id, user_id, system_instruction, persona, persona_only, version)
+			VALUES ($1, $2, $3, $4, $5, 1)
+			ON CONFLICT (group_id, user_id) DO UPDATE SET system_instruction = excluded.system_instruction, persona = excluded.persona, persona_only = excluded.persona_only, version = 1
+			WHERE group_user_setting.version = 0`,
+			setting.GroupId, setting.UserId, setting.SystemInstruction, setting.Persona, setting.PersonaOnly))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE group_user_setting SET system_instruction = $1, persona = $2, persona_only = $3, version = version + 1
+		WHERE group_id = $4 AND user_id = $5 AND version = $6`,
+		setting.SystemInstruction, setting.Persona, setting.PersonaOnly, setting.GroupId, setting.UserId, setting.Version))
+}
+
+func (d *PostgresDriver) GetGroupUserSetting(ctx context.Context, groupId, userId string) (*storage.GroupUserSetting, error) {
+	guSetting := storage.GroupUserSetting{GroupId: groupId, UserId: userId}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT system_instruction, persona, persona_only, version FROM group_user_setting WHERE group_id = $1 AND user_id = $2`,
+		groupId, userId).Scan(&guSetting.SystemInstruction, &guSetting.Persona, &guSetting.PersonaOnly, &guSetting.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &guSetting, nil
+}
+
+func (d *PostgresDriver) DeleteGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM group_user_setting WHERE group_id = $1 AND user_id = $2 AND version = $3`,
+		setting.GroupId, setting.UserId, setting.Version))
+	// No row matched: tell a missing setting apart from a changed one.
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetGroupUserSetting(ctx, setting.GroupId, setting.UserId); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *PostgresDriver) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	if setting.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO user_setting (user_id, system_instruction, persona, timezone, version)
+			VALUES ($1, $2, $3, $4, 1)
+			ON CONFLICT (user_id) DO UPDATE SET system_instruction = excluded.system_instruction, persona = excluded.persona, timezone = excluded.timezone, version = 1
+			WHERE user_setting.version = 0`,
+			setting.UserId, setting.SystemInstruction, setting.Persona, setting.Timezone))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE user_setting SET system_instruction = $1, persona = $2, timezone = $3, version = version + 1
+		WHERE user_id = $4 AND version = $5`,
+		setting.SystemInstruction, setting.Persona, setting.Timezone, setting.UserId, setting.Version))
+}
+
+func (d *PostgresDriver) GetUserSetting(ctx context.Context, userId string) (*storage.UserSetting, error) {
+	uSetting := storage.UserSetting{UserId: userId}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT system_instruction, persona, timezone, version FROM user_setting WHERE user_id = $1`,
+		userId).Scan(&uSetting.SystemInstruction, &uSetting.Persona, &uSetting.Timezone, &uSetting.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &uSetting, nil
+}
+
+func (d *PostgresDriver) DeleteUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM user_setting WHERE user_id = $1 AND version = $2`,
+		setting.UserId, setting.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetUserSetting(ctx, setting.UserId); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *PostgresDriver) ScanGroupUserSettings(ctx context.Context, fn func(storage.GroupUserSetting) error) error {
+	var after storage.GroupUserSetting
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT group_id, user_id, system_instruction, persona, persona_only, version FROM group_user_setting
+			WHERE (group_id, user_id) > ($1, $2)
+			ORDER BY group_id, user_id LIMIT $3`,
+			after.GroupId, after.UserId, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.GroupUserSetting
+		for rows.Next() {
+			var setting storage.GroupUserSetting
+			if err := rows.Scan(&setting.GroupId, &setting.UserId, &setting.SystemInstruction, &setting.Persona, &setting.PersonaOnly, &setting.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, setting)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, setting := range page {
+			if err := fn(setting); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+func (d *PostgresDriver) ScanUserSettings(ctx context.Context, fn func(storage.UserSetting) error) error {
+	var after string
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT user_id, system_instruction, persona, timezone, version FROM user_setting
+			WHERE user_id > $1
+			ORDER BY user_id LIMIT $2`,
+			after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.UserSetting
+		for rows.Next() {
+			var setting storage.UserSetting
+			if err := rows.Scan(&setting.UserId, &setting.SystemInstruction, &setting.Persona, &setting.Timezone, &setting.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, setting)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, setting := range page {
+			if err := fn(setting); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1].UserId
+	}
+}
+
+func (d *PostgresDriver) ListGroupUserSettings(ctx context.Context, groupId, after string, limit int) ([]storage.GroupUserSetting, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT group_id, user_id, system_instruction, persona, persona_only, version FROM group_user_setting
+		WHERE group_id = $1 AND user_id > $2
+		ORDER BY user_id LIMIT $3`,
+		groupId, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var settings []storage.GroupUserSetting
+	for rows.Next() {
+		var setting storage.GroupUserSetting
+		if err := rows.Scan(&setting.GroupId, &setting.UserId, &setting.SystemInstruction, &setting.Persona, &setting.PersonaOnly, &setting.Version); err != nil {
+			return nil, err
+		}
+		settings = append(settings, setting)
+	}
+	return settings, rows.Err()
+}
+
+func (d *PostgresDriver) ListGroupUserSettingsByUser(ctx context.Context, userId string) ([]storage.GroupUserSetting, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT group_id, user_id, system_instruction, persona, persona_only, version FROM group_user_setting WHERE user_id = $1`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var settings []storage.GroupUserSetting
+	for rows.Next() {
+		var setting storage.GroupUserSetting
+		if err := rows.Scan(&setting.GroupId, &setting.UserId, &setting.SystemInstruction, &setting.Persona, &setting.PersonaOnly, &setting.Version); err != nil {
+			return nil, err
+		}
+		settings = append(settings, setting)
+	}
+	return settings, rows.Err()
+}
+
+func (d *PostgresDriver) UpsertPersona(ctx context.Context, persona storage.Persona) error {
+	if persona.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO persona (scope, name, system_instruction, version)
+			VALUES ($1, $2, $3, 1)
+			ON CONFLICT (scope, name) DO UPDATE SET system_instruction = excluded.system_instruction, version = 1
+			WHERE persona.version = 0`,
+			persona.Scope, persona.Name, persona.SystemInstruction))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE persona SET system_instruction = $1, version = version + 1
+		WHERE scope = $2 AND name = $3 AND version = $4`,
+		persona.SystemInstruction, persona.Scope, persona.Name, persona.Version))
+}
+
+func (d *PostgresDriver) GetPersona(ctx context.Context, scope, name string) (*storage.Persona, error) {
+	persona := storage.Persona{Scope: scope, Name: name}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT system_instruction, version FROM persona WHERE scope = $1 AND name = $2`,
+		scope, name).Scan(&persona.SystemInstruction, &persona.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &persona, nil
+}
+
+func (d *PostgresDriver) DeletePersona(ctx context.Context, persona storage.Persona) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM persona WHERE scope = $1 AND name = $2 AND version = $3`,
+		persona.Scope, persona.Name, persona.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetPersona(ctx, persona.Scope, persona.Name); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *PostgresDriver) ListPersonas(ctx context.Context, scope string) ([]storage.Persona, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT scope, name, system_instruction, version FROM persona WHERE scope = $1 ORDER BY name`,
+		scope)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var personas []storage.Persona
+	for rows.Next() {
+		var persona storage.Persona
+		if err := rows.Scan(&persona.Scope, &persona.Name, &persona.SystemInstruction, &persona.Version); err != nil {
+			return nil, err
+		}
+		personas = append(personas, persona)
+	}
+	return personas, rows.Err()
+}
+
+func (d *PostgresDriver) ScanPersonas(ctx context.Context, fn func(storage.Persona) error) error {
+	var after storage.Persona
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT scope, name, system_instruction, version FROM persona
+			WHERE (scope, name) > ($1, $2)
+			ORDER BY scope, name LIMIT $3`,
+			after.Scope, after.Name, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.Persona
+		for rows.Next() {
+			var persona storage.Persona
+			if err := rows.Scan(&persona.Scope, &persona.Name, &persona.SystemInstruction, &persona.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, persona)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, persona := range page {
+			if err := fn(persona); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+func (d *PostgresDriver) UpsertGroupRole(ctx context.Context, role storage.GroupRole) error {
+	if role.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO group_role (group_id, user_id, role, version)
+			VALUES ($1, $2, $3, 1)
+			ON CONFLICT (group_id, user_id) DO UPDATE SET role = excluded.role, version = 1
+			WHERE group_role.version = 0`,
+			role.GroupId, role.UserId, role.Role))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE group_role SET role = $1, version = version + 1
+		WHERE group_id = $2 AND user_id = $3 AND version = $4`,
+		role.Role, role.GroupId, role.UserId, role.Version))
+}
+
+func (d *PostgresDriver) GetGroupRole(ctx context.Context, groupId, userId string) (*storage.GroupRole, error) {
+	role := storage.GroupRole{GroupId: groupId, UserId: userId}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT role, version FROM group_role WHERE group_id = $1 AND user_id = $2`,
+		groupId, userId).Scan(&role.Role, &role.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (d *PostgresDriver) DeleteGroupRole(ctx context.Context, role storage.GroupRole) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM group_role WHERE group_id = $1 AND user_id = $2 AND version = $3`,
+		role.GroupId, role.UserId, role.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetGroupRole(ctx, role.GroupId, role.UserId); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *PostgresDriver) ListGroupRoles(ctx context.Context, groupId string) ([]storage.GroupRole, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT group_id, user_id, role, version FROM group_role WHERE group_id = $1 ORDER BY user_id`,
+		groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []storage.GroupRole
+	for rows.Next() {
+		var role storage.GroupRole
+		if err := rows.Scan(&role.GroupId, &role.UserId, &role.Role, &role.Version); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (d *PostgresDriver) ScanGroupRoles(ctx context.Context, fn func(storage.GroupRole) error) error {
+	var after storage.GroupRole
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT group_id, user_id, role, version FROM group_role
+			WHERE (group_id, user_id) > ($1, $2)
+			ORDER BY group_id, user_id LIMIT $3`,
+			after.GroupId, after.UserId, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.GroupRole
+		for rows.Next() {
+			var role storage.GroupRole
+			if err := rows.Scan(&role.GroupId, &role.UserId, &role.Role, &role.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, role)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, role := range page {
+			if err := fn(role); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+func (d *PostgresDriver) UpsertBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	if setting.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO bot_setting (key, value, version)
+			VALUES ($1, $2, 1)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value, version = 1
+			WHERE bot_setting.version = 0`,
+			setting.Key, setting.Value))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE bot_setting SET value = $1, version = version + 1
+		WHERE key = $2 AND version = $3`,
+		setting.Value, setting.Key, setting.Version))
+}
+
+func (d *PostgresDriver) GetBotSetting(ctx context.Context, key string) (*storage.BotSetting, error) {
+	setting := storage.BotSetting{Key: key}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT value, version FROM bot_setting WHERE key = $1`,
+		key).Scan(&setting.Value, &setting.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+func (d *PostgresDriver) DeleteBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM bot_setting WHERE key = $1 AND version = $2`,
+		setting.Key, setting.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetBotSetting(ctx, setting.Key); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// ScanBotSettings reads every setting at once, there are only a handful.
+func (d *PostgresDriver) ScanBotSettings(ctx context.Context, fn func(storage.BotSetting) error) error {
+	rows, err := d.db.QueryContext(ctx, `SELECT key, value, version FROM bot_setting ORDER BY key`)
+	if err != nil {
+		return err
+	}
+	var settings []storage.BotSetting
+	for rows.Next() {
+		var setting storage.BotSetting
+		if err := rows.Scan(&setting.Key, &setting.Value, &setting.Version); err != nil {
+			rows.Close()
+			return err
+		}
+		settings = append(settings, setting)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, setting := range settings {
+		if err := fn(setting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *PostgresDriver) UpsertBlock(ctx context.Context, block storage.Block) error {
+	if block.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO block (id, reason, created_by, created_at, expires_at, version)
+			VALUES ($1, $2, $3, $4, $5, 1)
+			ON CONFLICT (id) DO UPDATE SET reason = excluded.reason, created_by = excluded.created_by, created_at = excluded.created_at, expires_at = excluded.expires_at, version = 1
+			WHERE block.version = 0`,
+			block.Id, block.Reason, block.CreatedBy, unixMilli(block.CreatedAt), unixMilli(block.ExpiresAt)))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE block SET reason = $1, created_by = $2, created_at = $3, expires_at = $4, version = version + 1
+		WHERE id = $5 AND version = $6`,
+		block.Reason, block.CreatedBy, unixMilli(block.CreatedAt), unixMilli(block.ExpiresAt), block.Id, block.Version))
+}
+
+func (d *PostgresDriver) GetBlock(ctx context.Context, id string) (*storage.Block, error) {
+	block := storage.Block{Id: id}
+	var createdAt, expiresAt int64
+	err := d.db.QueryRowContext(ctx, `
+		SELECT reason, created_by, created_at, expires_at, version FROM block WHERE id = $1`,
+		id).Scan(&block.Reason, &block.CreatedBy, &createdAt, &expiresAt, &block.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	block.CreatedAt, block.ExpiresAt = fromUnixMilli(createdAt), fromUnixMilli(expiresAt)
+	return &block, nil
+}
+
+func (d *PostgresDriver) DeleteBlock(ctx context.Context, block storage.Block) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM block WHERE id = $1 AND version = $2`,
+		block.Id, block.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetBlock(ctx, block.Id); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *PostgresDriver) ScanBlocks(ctx context.Context, fn func(storage.Block) error) error {
+	var after string
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT id, reason, created_by, created_at, expires_at, version FROM block
+			WHERE id > $1
+			ORDER BY id LIMIT $2`,
+			after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.Block
+		for rows.Next() {
+			var block storage.Block
+			var createdAt, expiresAt int64
+			if err := rows.Scan(&block.Id, &block.Reason, &block.CreatedBy, &createdAt, &expiresAt, &block.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			block.CreatedAt, block.ExpiresAt = fromUnixMilli(createdAt), fromUnixMilli(expiresAt)
+			page = append(page, block)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, block := range page {
+			if err := fn(block); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1].Id
+	}
+}
+
+func (d *PostgresDriver) AppendAudit(ctx context.Context, entry storage.AuditEntry) error {
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO audit_entry (scope, created_at, actor, action, old_hash, new_value)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		entry.Scope, unixNano(entry.Time), entry.Actor, entry.Action, entry.OldHash, entry.NewValue)
+	return err
+}
+
+func (d *PostgresDriver) ListAudit(ctx context.Context, scope string, before time.Time, limit int) ([]storage.AuditEntry, error) {
+	beforeNano := int64(math.MaxInt64)
+	if !before.IsZero() {
+		beforeNano = before.UnixNano()
+	}
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT created_at, actor, action, old_hash, new_value FROM audit_entry
+		WHERE scope = $1 AND created_at < $2
+		ORDER BY created_at DESC, id DESC LIMIT $3`,
+		scope, beforeNano, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []storage.AuditEntry
+	for rows.Next() {
+		entry := storage.AuditEntry{Scope: scope}
+		var createdAt int64
+		if err := rows.Scan(&createdAt, &entry.Actor, &entry.Action, &entry.OldHash, &entry.NewValue); err != nil {
+			return nil, err
+		}
+		entry.Time = fromUnixNano(createdAt)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// ScanAudit reads one scope at a time, so fn may use the database while the
+// scan is in progress.
+func (d *PostgresDriver) ScanAudit(ctx context.Context, fn func(scope string, entries []storage.AuditEntry) error) error {
+	var after string
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT DISTINCT scope FROM audit_entry
+			WHERE scope > $1
+			ORDER BY scope LIMIT $2`,
+			after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var scopes []string
+		for rows.Next() {
+			var scope string
+			if err := rows.Scan(&scope); err != nil {
+				rows.Close()
+				return err
+			}
+			scopes = append(scopes, scope)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, scope := range scopes {
+			entries, err := d.ListAudit(ctx, scope, time.Time{}, math.MaxInt32)
+			if err != nil {
+				return err
+			}
+			slices.Reverse(entries)
+			if err := fn(scope, entries); err != nil {
+				return err
+			}
+		}
+		if len(scopes) < scanPageSize {
+			return nil
+		}
+		after = scopes[len(scopes)-1]
+	}
+}
+
+func (d *PostgresDriver) DeleteAudit(ctx context.Context, scope string) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM audit_entry WHERE scope = $1`, scope)
+	return err
+}
+
+func (d *PostgresDriver) RedactAudit(ctx context.Context, actor string) error {
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE audit_entry SET actor = '', old_hash = '', new_value = ''
+		WHERE actor = $1`,
+		actor)
+	return err
+}
+
+// RewriteAudit reads scanPageSize entries at a time and only replaces a value
+// that was not redacted meanwhile.
+func (d *PostgresDriver) RewriteAudit(ctx context.Context, fn func(storage.AuditEntry) (string, error)) error {
+	var after int64
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT id, scope, created_at, actor, action, old_hash, new_value FROM audit_entry
+			WHERE id > $1
+			ORDER BY id LIMIT $2`,
+			after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		var entries []storage.AuditEntry
+		for rows.Next() {
+			var id, createdAt int64
+			var entry storage.AuditEntry
+			if err := rows.Scan(&id, &entry.Scope, &createdAt, &entry.Actor, &entry.Action, &entry.OldHash, &entry.NewValue); err != nil {
+				rows.Close()
+				return err
+			}
+			entry.Time = fromUnixNano(createdAt)
+			ids = append(ids, id)
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for i, entry := range entries {
+			value, err := fn(entry)
+			if err != nil {
+				return err
+			}
+			if _, err := d.db.ExecContext(ctx, `
+				UPDATE audit_entry SET new_value = $1
+				WHERE id = $2 AND actor = $3 AND new_value = $4`,
+				value, ids[i], entry.Actor, entry.NewValue); err != nil {
+				return err
+			}
+		}
+		if len(ids) < scanPageSize {
+			return nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+// unixMilli stores the zero time as 0 rather than a date in year 1.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms).UTC()
+}
+
+// unixNano and fromUnixNano are the audit log counterparts of unixMilli and
+// fromUnixMilli.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+// versioned turns a versioned write that matched no row into storage.ErrConflict.
+func versioned(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrConflict
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package redisdriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+func (d *RedisDriver) historyKey(key string) string {
+	return d.prefix + "history:" + key
+}
+
+func (d *RedisDriver) counterKey(key string) string {
+	return d.prefix + "counter:" + key
+}
+
+func (d *RedisDriver) processedKey(key string) string {
+	return d.prefix + "processed:" + key
+}
+
+func (d *RedisDriver) AppendHistory(ctx context.Context, key string, message storage.HistoryMessage, maxLen int, ttl time.Duration) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	k := d.historyKey(key)
+	_, err = d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, k, data)
+		pipe.LTrim(ctx, k, int64(-maxLen), -1)
+		pipe.PExpire(ctx, k, ttl)
+		return nil
+	})
+	return err
+}
+
+func (d *RedisDriver) GetHistory(ctx context.Context, key string) ([]storage.HistoryMessage, error) {
+	values, err := d.client.LRange(ctx, d.historyKey(key), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	history := make([]storage.HistoryMessage, 0, len(values))
+	for _, v := range values {
+		var message storage.HistoryMessage
+		if err := json.Unmarshal([]byte(v), &message); err != nil {
+			return nil, err
+		}
+		history = append(history, message)
+	}
+	return history, nil
+}
+
+func (d *RedisDriver) ScanHistory(ctx context.Context, prefix string, fn func(key string, history []storage.HistoryMessage) error) error {
+	return d.scanKeys(ctx, d.historyKey(prefix), func(k string) error {
+		key := strings.TrimPrefix(k, d.historyKey(""))
+		history, err := d.GetHistory(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(history) == 0 {
+			return nil
+		}
+		return fn(key, history)
+	})
+}
+
+// RewriteHistory watches the list, so that a message appended meanwhile makes
+// the rewrite fail rather than be lost.
+func (d *RedisDriver) RewriteHistory(ctx context.Context, key string, fn func([]storage.HistoryMessage) ([]storage.HistoryMessage, error)) error {
+	k := d.historyKey(key)
+	err := d.client.Watch(ctx, func(tx *redis.Tx) error {
+		history, err := d.GetHistory(ctx, key)
+		if err != nil || len(history) == 0 {
+			return err
+		}
+		ttl, err := tx.PTTL(ctx, k).Result()
+		if err != nil {
+			return err
+		}
+		if history, err = fn(history); err != nil {
+			return err
+		}
+		values := make([]any, len(history))
+		for i, message := range history {
+			if values[i], err = json.Marshal(message); err != nil {
+				return err
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, k)
+			if len(values) > 0 {
+				pipe.RPush(ctx, k, values...)
+			}
+			if ttl > 0 {
+				pipe.PExpire(ctx, k, ttl)
+			}
+			return nil
+		})
+		return err
+	}, k)
+	if errors.Is(err, redis.TxFailedErr) {
+		return storage.ErrConflict
+	}
+	return err
+}
+
+func (d *RedisDriver) DeleteHistory(ctx context.Context, key string) error {
+	return d.client.Del(ctx, d.historyKey(key)).Err()
+}
+
+func (d *RedisDriver) IncrCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	k := d.counterKey(key)
+	var incr *redis.IntCmd
+	_, err := d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		// SET NX only creates the counter, so the TTL of a running window is kept.
+		pipe.SetNX(ctx, k, 0, ttl)
+		incr = pipe.IncrBy(ctx, k, delta)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (d *RedisDriver) GetCounter(ctx context.Context, key string) (int64, error) {
+	value, err := d.client.Get(ctx, d.counterKey(key)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return value, err
+}
+
+func (d *RedisDriver) ScanCounters(ctx context.Context, prefix string, fn func(key string, value int64) error) error {
+	return d.scanKeys(ctx, d.counterKey(prefix), func(k string) error {
+		key := strings.TrimPrefix(k, d.counterKey(""))
+		value, err := d.client.Get(ctx, k).Int64()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(key, value)
+	})
+}
+
+func (d *RedisDriver) DeleteCounter(ctx context.Context, key string) error {
+	return d.client.Del(ctx, d.counterKey(key)).Err()
+}
+
+func (d *RedisDriver) MarkProcessed(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return d.client.SetNX(ctx, d.processedKey(key), 1, ttl).Result()
+}
+
+func (d *RedisDriver) UnmarkProcessed(ctx context.Context, key string) error {
+	return d.client.Del(ctx, d.processedKey(key)).Err()
+}
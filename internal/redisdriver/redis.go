@@ -0,0 +1,711 @@
+package redisdriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+var _ storage.Storage = (*RedisDriver)(nil)
+
+// scanCount is the SCAN batch size hint used when listing keys.
+const scanCount = 100
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// upsertSetting writes a settings hash only when its version still matches.
+// KEYS[1] is the hash, ARGV is the expected version, the version field and
+// then field/value pairs to set.
+var upsertSetting = redis.NewScript(`
+local version = tonumber(redis.call('HGET', KEYS[1], ARGV[2]) or '0')
+if version ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[2], version + 1, unpack(ARGV, 3))
+return 1
+`)
+
+// deleteSetting removes a settings hash only when its version still matches.
+// It returns -1 for a missing hash and 0 for a version mismatch.
+var deleteSetting = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+local version = tonumber(redis.call('HGET', KEYS[1], ARGV[2]) or '0')
+if version ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// replaceMember swaps a sorted set member for another of the given score, only
+// when the member is still in the set. KEYS[1] is the set, ARGV the old member,
+// the score and the new member.
+var replaceMember = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+return 1
+`)
+
+// RedisDriver stores settings as hashes and ephemeral data under native TTLs.
+// Every key starts with the configured prefix so several bots can share a database.
+type RedisDriver struct {
+	client *redis.Client
+	prefix string
+}
+
+type Config struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+}
+
+func New(ctx context.Context, rConfig Config) (*RedisDriver, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     rConfig.Addr,
+		Password: rConfig.Password,
+		DB:       rConfig.DB,
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return &RedisDriver{client: client, prefix: rConfig.Prefix}, nil
+}
+
+func (d *RedisDriver) Close() error {
+	return d.client.Close()
+}
+
+func (d *RedisDriver) userSettingKey(userId string) string {
+	return d.prefix + "user:" + userId
+}
+
+func (d *RedisDriver) groupUserSettingKey(groupId, userId string) string {
+	return d.prefix + "group:" + groupId + ":user:" + userId
+}
+
+func (d *RedisDriver) personaKey(scope, name string) string {
+	return d.personaPrefix(scope) + name
+}
+
+func (d *RedisDriver) personaPrefix(scope string) string {
+	return d.prefix + "persona:" + scope + ":"
+}
+
+func (d *RedisDriver) groupRoleKey(groupId, userId string) string {
+	return d.groupRolePrefix(groupId) + userId
+}
+
+func (d *RedisDriver) groupRolePrefix(groupId string) string {
+	return d.prefix + "role:" + groupId + ":"
+}
+
+func (d *RedisDriver) botSettingKey(key string) string {
+	return d.prefix + "botsetting:" + key
+}
+
+func (d *RedisDriver) blockKey(id string) string {
+	return d.prefix + "block:" + id
+}
+
+func (d *RedisDriver) auditKey(scope string) string {
+	return d.prefix + "audit:" + scope
+}
+
+func (d *RedisDriver) UpsertGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	return d.upsertSetting(ctx, d.groupUserSettingKey(setting.GroupId, setting.UserId), setting.Version,
+		storage.SystemInstruction, setting.SystemInstruction, storage.SettingPersona, setting.Persona,
+		storage.SettingPersonaOnly, setting.PersonaOnly)
+}
+
+func (d *RedisDriver) GetGroupUserSetting(ctx context.Context, groupId, userId string) (*storage.GroupUserSetting, error) {
+	guSetting := storage.GroupUserSetting{GroupId: groupId, UserId: userId}
+	fields, err := d.client.HGetAll(ctx, d.groupUserSettingKey(groupId, userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	guSetting.SystemInstruction = fields[storage.SystemInstruction]
+	guSetting.Persona = fields[storage.SettingPersona]
+	guSetting.PersonaOnly = fields[storage.SettingPersonaOnly] == "1"
+	if guSetting.Version, err = parseVersion(fields); err != nil {
+		return nil, err
+	}
+	return &guSetting, nil
+}
+
+func (d *RedisDriver) DeleteGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	return d.deleteSetting(ctx, d.groupUserSettingKey(setting.GroupId, setting.UserId), setting.Version)
+}
+
+func (d *RedisDriver) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	return d.upsertSetting(ctx, d.userSettingKey(setting.UserId), setting.Version,
+		storage.SystemInstruction, setting.SystemInstruction, storage.SettingPersona, setting.Persona,
+		storage.SettingTimezone, setting.Timezone)
+}
+
+func (d *RedisDriver) GetUserSetting(ctx context.Context, userId string) (*storage.UserSetting, error) {
+	uSetting := storage.UserSetting{UserId: userId}
+	fields, err := d.client.HGetAll(ctx, d.userSettingKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	uSetting.SystemInstruction = fields[storage.SystemInstruction]
+	uSetting.Persona = fields[storage.SettingPersona]
+	uSetting.Timezone = fields[storage.SettingTimezone]
+	if uSetting.Version, err = parseVersion(fields); err != nil {
+		return nil, err
+	}
+	return &uSetting, nil
+}
+
+func (d *RedisDriver) DeleteUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	return d.deleteSetting(ctx, d.userSettingKey(setting.UserId), setting.Version)
+}
+
+func (d *RedisDriver) ScanGroupUserSettings(ctx context.Context, fn func(storage.GroupUserSetting) error) error {
+	prefix := d.prefix + "group:"
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		groupId, userId, ok := strings.Cut(strings.TrimPrefix(key, prefix), ":user:")
+		if !ok {
+			return nil
+		}
+		setting, err := d.GetGroupUserSetting(ctx, groupId, userId)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(*setting)
+	})
+}
+
+// ListGroupUserSettings reads every setting of the group, which has no sorted
+// index in Redis, before ordering them.
+func (d *RedisDriver) ListGroupUserSettings(ctx context.Context, groupId, after string, limit int) ([]storage.GroupUserSetting, error) {
+	prefix := d.groupUserSettingKey(groupId, "")
+	var settings []storage.GroupUserSetting
+	err := d.scanKeys(ctx, prefix, func(key string) error {
+		userId := strings.TrimPrefix(key, prefix)
+		if userId <= after {
+			return nil
+		}
+		setting, err := d.GetGroupUserSetting(ctx, groupId, userId)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		settings = append(settings, *setting)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(settings, func(a, b storage.GroupUserSetting) int {
+		return strings.Compare(a.UserId, b.UserId)
+	})
+	return settings[:min(limit, len(settings))], nil
+}
+
+func (d *RedisDriver) ScanUserSettings(ctx context.Context, fn func(storage.UserSetting) error) error {
+	prefix := d.prefix + "user:"
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		setting, err := d.GetUserSetting(ctx, strings.TrimPrefix(key, prefix))
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(*setting)
+	})
+}
+
+func (d *RedisDriver) ListGroupUserSettingsByUser(ctx context.Context, userId string) ([]storage.GroupUserSetting, error) {
+	prefix := d.prefix + "group:"
+	pattern := globEscaper.Replace(prefix) + "*" + globEscaper.Replace(":user:"+userId)
+	var settings []storage.GroupUserSetting
+	err := d.scanMatch(ctx, pattern, func(key string) error {
+		groupId, uid, ok := strings.Cut(strings.TrimPrefix(key, prefix), ":user:")
+		if !ok || uid != userId {
+			return nil
+		}
+		setting, err := d.GetGroupUserSetting(ctx, groupId, userId)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		settings = append(settings, *setting)
+		return nil
+	})
+	return settings, err
+}
+
+func (d *RedisDriver) UpsertPersona(ctx context.Context, persona storage.Persona) error {
+	return d.upsertSetting(ctx, d.personaKey(persona.Scope, persona.Name), persona.Version,
+		storage.SystemInstruction, persona.SystemInstruction)
+}
+
+func (d *RedisDriver) GetPersona(ctx context.Context, scope, name string) (*storage.Persona, error) {
+	persona := storage.Persona{Scope: scope, Name: name}
+	fields, err := d.client.HGetAll(ctx, d.personaKey(scope, name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	persona.SystemInstruction = fields[storage.SystemInstruction]
+	if persona.Version, err = parseVersion(fields); err != nil {
+		return nil, err
+	}
+	return &persona, nil
+}
+
+func (d *RedisDriver) DeletePersona(ctx context.Context, persona storage.Persona) error {
+	return d.deleteSetting(ctx, d.personaKey(persona.Scope, persona.Name), persona.Version)
+}
+
+func (d *RedisDriver) ListPersonas(ctx context.Context, scope string) ([]storage.Persona, error) {
+	prefix := d.personaPrefix(scope)
+	var personas []storage.Persona
+	err := d.scanKeys(ctx, prefix, func(key string) error {
+		persona, err := d.GetPersona(ctx, scope, strings.TrimPrefix(key, prefix))
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		personas = append(personas, *persona)
+		return nil
+	})
+	slices.SortFunc(personas, func(a, b storage.Persona) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return personas, err
+}
+
+// ScanPersonas relies on scopes being "<kind>:<id>" without further colons.
+func (d *RedisDriver) ScanPersonas(ctx context.Context, fn func(storage.Persona) error) error {
+	prefix := d.prefix + "persona:"
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		kind, rest, _ := strings.Cut(strings.TrimPrefix(key, prefix), ":")
+		id, name, ok := strings.Cut(rest, ":")
+		if !ok {
+			return nil
+		}
+		persona, err := d.GetPersona(ctx, kind+":"+id, name)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(*persona)
+	})
+}
+
+func (d *RedisDriver) UpsertGroupRole(ctx context.Context, role storage.GroupRole) error {
+	return d.upsertSetting(ctx, d.groupRoleKey(role.GroupId, role.UserId), role.Version,
+		storage.GroupRoleRole, role.Role)
+}
+
+func (d *RedisDriver) GetGroupRole(ctx context.Context, groupId, userId string) (*storage.GroupRole, error) {
+	role := storage.GroupRole{GroupId: groupId, UserId: userId}
+	fields, err := d.client.HGetAll(ctx, d.groupRoleKey(groupId, userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	role.Role = fields[storage.GroupRoleRole]
+	if role.Version, err = parseVersion(fields); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (d *RedisDriver) DeleteGroupRole(ctx context.Context, role storage.GroupRole) error {
+	return d.deleteSetting(ctx, d.groupRoleKey(role.GroupId, role.UserId), role.Version)
+}
+
+func (d *RedisDriver) ListGroupRoles(ctx context.Context, groupId string) ([]storage.GroupRole, error) {
+	prefix := d.groupRolePrefix(groupId)
+	var roles []storage.GroupRole
+	err := d.scanKeys(ctx, prefix, func(key string) error {
+		role, err := d.GetGroupRole(ctx, groupId, strings.TrimPrefix(key, prefix))
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		roles = append(roles, *role)
+		return nil
+	})
+	slices.SortFunc(roles, func(a, b storage.GroupRole) int {
+		return strings.Compare(a.UserId, b.UserId)
+	})
+	return roles, err
+}
+
+func (d *RedisDriver) ScanGroupRoles(ctx context.Context, fn func(storage.GroupRole) error) error {
+	prefix := d.prefix + "role:"
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		groupId, userId, ok := strings.Cut(strings.TrimPrefix(key, prefix), ":")
+		if !ok {
+			return nil
+		}
+		role, err := d.GetGroupRole(ctx, groupId, userId)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(*role)
+	})
+}
+
+func (d *RedisDriver) UpsertBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	return d.upsertSetting(ctx, d.botSettingKey(setting.Key), setting.Version,
+		storage.BotSettingValue, setting.Value)
+}
+
+func (d *RedisDriver) GetBotSetting(ctx context.Context, key string) (*storage.BotSetting, error) {
+	setting := storage.BotSetting{Key: key}
+	fields, err := d.client.HGetAll(ctx, d.botSettingKey(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	setting.Value = fields[storage.BotSettingValue]
+	if setting.Version, err = parseVersion(fields); err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+func (d *RedisDriver) DeleteBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	return d.deleteSetting(ctx, d.botSettingKey(setting.Key), setting.Version)
+}
+
+func (d *RedisDriver) ScanBotSettings(ctx context.Context, fn func(storage.BotSetting) error) error {
+	prefix := d.botSettingKey("")
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		setting, err := d.GetBotSetting(ctx, strings.TrimPrefix(key, prefix))
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(*setting)
+	})
+}
+
+func (d *RedisDriver) UpsertBlock(ctx context.Context, block storage.Block) error {
+	return d.upsertSetting(ctx, d.blockKey(block.Id), block.Version,
+		storage.BlockReason, block.Reason, storage.BlockCreatedBy, block.CreatedBy,
+		storage.BlockCreatedAt, unixMilli(block.CreatedAt), storage.BlockExpiresAt, unixMilli(block.ExpiresAt))
+}
+
+func (d *RedisDriver) GetBlock(ctx context.Context, id string) (*storage.Block, error) {
+	block := storage.Block{Id: id}
+	fields, err := d.client.HGetAll(ctx, d.blockKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	block.Reason = fields[storage.BlockReason]
+	block.CreatedBy = fields[storage.BlockCreatedBy]
+	if block.CreatedAt, err = parseUnixMilli(fields, storage.BlockCreatedAt); err != nil {
+		return nil, err
+	}
+	if block.ExpiresAt, err = parseUnixMilli(fields, storage.BlockExpiresAt); err != nil {
+		return nil, err
+	}
+	if block.Version, err = parseVersion(fields); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+func (d *RedisDriver) DeleteBlock(ctx context.Context, block storage.Block) error {
+	return d.deleteSetting(ctx, d.blockKey(block.Id), block.Version)
+}
+
+func (d *RedisDriver) ScanBlocks(ctx context.Context, fn func(storage.Block) error) error {
+	prefix := d.blockKey("")
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		block, err := d.GetBlock(ctx, strings.TrimPrefix(key, prefix))
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(*block)
+	})
+}
+
+// AppendAudit keeps the entries of a scope in a sorted set scored by time in
+// milliseconds. The member is the whole entry, whose nanosecond time keeps it
+// unique.
+func (d *RedisDriver) AppendAudit(ctx context.Context, entry storage.AuditEntry) error {
+	member, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return d.client.ZAdd(ctx, d.auditKey(entry.Scope), redis.Z{Score: float64(entry.Time.UnixMilli()), Member: member}).Err()
+}
+
+// ListAudit reads the entries scored up to the millisecond of before and
+// compares their exact times, so that entries written in the same millisecond
+// as before are not skipped. Members of equal score are not in time order, so
+// every member of the score of the last entry kept is read before sorting.
+func (d *RedisDriver) ListAudit(ctx context.Context, scope string, before time.Time, limit int) ([]storage.AuditEntry, error) {
+	maxScore := "+inf"
+	if !before.IsZero() {
+		maxScore = strconv.FormatInt(before.UnixMilli(), 10)
+	}
+	var entries []storage.AuditEntry
+	var lastScore float64
+	count := int64(max(limit, 1))
+	for offset := int64(0); ; offset += count {
+		members, err := d.client.ZRevRangeByScoreWithScores(ctx, d.auditKey(scope), &redis.ZRangeBy{
+			Min: "-inf", Max: maxScore, Offset: offset, Count: count,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, z := range members {
+			if len(entries) >= limit && z.Score != lastScore {
+				return sortAudit(entries, limit), nil
+			}
+			member, _ := z.Member.(string)
+			var entry storage.AuditEntry
+			if err := json.Unmarshal([]byte(member), &entry); err != nil {
+				return nil, fmt.Errorf("invalid audit entry in %v: %w", scope, err)
+			}
+			if !before.IsZero() && !entry.Time.Before(before) {
+				continue
+			}
+			entries = append(entries, entry)
+			lastScore = z.Score
+		}
+		if int64(len(members)) < count {
+			return sortAudit(entries, limit), nil
+		}
+	}
+}
+
+// sortAudit puts entries newest first and keeps the first limit.
+func sortAudit(entries []storage.AuditEntry, limit int) []storage.AuditEntry {
+	slices.SortStableFunc(entries, func(a, b storage.AuditEntry) int { return b.Time.Compare(a.Time) })
+	return entries[:min(len(entries), limit)]
+}
+
+func (d *RedisDriver) ScanAudit(ctx context.Context, fn func(scope string, entries []storage.AuditEntry) error) error {
+	prefix := d.auditKey("")
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		scope := strings.TrimPrefix(key, prefix)
+		members, err := d.client.ZRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		entries := make([]storage.AuditEntry, 0, len(members))
+		for _, member := range members {
+			var entry storage.AuditEntry
+			if err := json.Unmarshal([]byte(member), &entry); err != nil {
+				return fmt.Errorf("invalid audit entry in %v: %w", scope, err)
+			}
+			entries = append(entries, entry)
+		}
+		return fn(scope, entries)
+	})
+}
+
+func (d *RedisDriver) DeleteAudit(ctx context.Context, scope string) error {
+	return d.client.Del(ctx, d.auditKey(scope)).Err()
+}
+
+// RedactAudit replaces the members made by actor, which are the whole entries,
+// keeping their score.
+func (d *RedisDriver) RedactAudit(ctx context.Context, actor string) error {
+	prefix := d.auditKey("")
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		members, err := d.client.ZRangeWithScores(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		_, err = d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, z := range members {
+				member, _ := z.Member.(string)
+				var entry storage.AuditEntry
+				if err := json.Unmarshal([]byte(member), &entry); err != nil {
+					return fmt.Errorf("invalid audit entry in %v: %w", strings.TrimPrefix(key, prefix), err)
+				}
+				if entry.Actor != actor {
+					continue
+				}
+				entry.Actor, entry.OldHash, entry.NewValue = "", "", ""
+				redacted, err := json.Marshal(entry)
+				if err != nil {
+					return err
+				}
+				pipe.ZRem(ctx, key, member)
+				pipe.ZAdd(ctx, key, redis.Z{Score: z.Score, Member: redacted})
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// RewriteAudit replaces members one at a time, leaving those redacted
+// meanwhile.
+func (d *RedisDriver) RewriteAudit(ctx context.Context, fn func(storage.AuditEntry) (string, error)) error {
+	prefix := d.auditKey("")
+	return d.scanKeys(ctx, prefix, func(key string) error {
+		members, err := d.client.ZRangeWithScores(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, z := range members {
+			member, _ := z.Member.(string)
+			var entry storage.AuditEntry
+			if err := json.Unmarshal([]byte(member), &entry); err != nil {
+				return fmt.Errorf("invalid audit entry in %v: %w", strings.TrimPrefix(key, prefix), err)
+			}
+			if entry.NewValue, err = fn(entry); err != nil {
+				return err
+			}
+			rewritten, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := replaceMember.Run(ctx, d.client, []string{key}, member, z.Score, rewritten).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// unixMilli stores the zero time as 0 rather than a date in year 1.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// parseUnixMilli reads a time stored by unixMilli. A missing field is the zero
+// time.
+func parseUnixMilli(fields map[string]string, name string) (time.Time, error) {
+	if fields[name] == "" {
+		return time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(fields[name], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q: %w", name, fields[name], err)
+	}
+	if ms == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(ms).UTC(), nil
+}
+
+// scanKeys calls fn for every key starting with prefix.
+func (d *RedisDriver) scanKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return d.scanMatch(ctx, globEscaper.Replace(prefix)+"*", fn)
+}
+
+// scanMatch calls fn once for every key matching pattern. SCAN may return a
+// key deleted since, so callers read each key again.
+func (d *RedisDriver) scanMatch(ctx context.Context, pattern string, fn func(key string) error) error {
+	seen := make(map[string]struct{})
+	iter := d.client.Scan(ctx, 0, pattern, scanCount).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (d *RedisDriver) upsertSetting(ctx context.Context, key string, version int64, fieldValues ...any) error {
+	args := append([]any{version, storage.SettingVersion}, fieldValues...)
+	ok, err := upsertSetting.Run(ctx, d.client, []string{key}, args...).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return storage.ErrConflict
+	}
+	return nil
+}
+
+func (d *RedisDriver) deleteSetting(ctx context.Context, key string, version int64) error {
+	result, err := deleteSetting.Run(ctx, d.client, []string{key}, version, storage.SettingVersion).Int()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case -1:
+		return storage.ErrNotFound
+	case 0:
+		return storage.ErrConflict
+	}
+	return nil
+}
+
+func parseVersion(fields map[string]string) (int64, error) {
+	v, ok := fields[storage.SettingVersion]
+	if !ok {
+		return 0, nil
+	}
+	version, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid setting version %q: %w", v, err)
+	}
+	return version, nil
+}
@@ -0,0 +1,23 @@
+package redisdriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/internal/storage/storagetest"
+)
+
+func TestRedisDriver(t *testing.T) {
+	server := miniredis.RunT(t)
+	driver, err := New(context.TODO(), Config{Addr: server.Addr(), Prefix: "linebot:"})
+	if err != nil {
+		t.Fatalf("failed to initialize redis driver: %v\n", err)
+	}
+	defer driver.Close()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return driver
+	}, storagetest.WithAdvance(server.FastForward))
+}
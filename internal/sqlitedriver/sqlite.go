@@ -0,0 +1,773 @@
+package sqlitedriver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/vgjm/linebot/internal/sqlmigrate"
+	"github.com/vgjm/linebot/internal/storage"
+	_ "modernc.org/sqlite"
+)
+
+var _ storage.Storage = (*SQLiteDriver)(nil)
+
+// scanPageSize rows are read at a time, so that scan callbacks do not run
+// while a query holds the only connection SQLite has.
+const scanPageSize = 100
+
+type SQLiteDriver struct {
+	db *sql.DB
+}
+
+type Config struct {
+	Path string
+}
+
+func New(ctx context.Context, sConfig Config) (*SQLiteDriver, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", sConfig.Path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY between
+	// our own goroutines and keeps in-memory databases shared.
+	db.SetMaxOpenConns(1)
+
+	if err := sqlmigrate.Migrate(ctx, db, migrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteDriver{db}, nil
+}
+
+func (d *SQLiteDriver) Close() error {
+	return d.db.Close()
+}
+
+func (d *SQLiteDriver) UpsertGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	if setting.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO group_user_setting (group_id, user_id, system_instruction, persona, persona_only, version)
+			VALUES (?, ?, ?, ?, ?, 1)
+			ON CONFLICT (group_id, user_id) DO UPDATE SET system_instruction = excluded.system_instruction, persona = excluded.persona, persona_only = excluded.persona_only, version = 1
+			WHERE group_user_setting.version = 0`,
+			setting.GroupId, setting.UserId, setting.SystemInstruction, setting.Persona, setting.PersonaOnly))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE group_user_setting SET system_instruction = ?, persona = ?, persona_only = ?, version = version + 1
+		WHERE group_id = ? AND user_id = ? AND version = ?`,
+		setting.SystemInstruction, setting.Persona, setting.PersonaOnly, setting.GroupId, setting.UserId, setting.Version))
+}
+
+func (d *SQLiteDriver) GetGroupUserSetting(ctx context.Context, groupId, userId string) (*storage.GroupUserSetting, error) {
+	guSetting := storage.GroupUserSetting{GroupId: groupId, UserId: userId}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT system_instruction, persona, persona_only, version FROM group_user_setting WHERE group_id = ? AND user_id = ?`,
+		groupId, userId).Scan(&guSetting.SystemInstruction, &guSetting.Persona, &guSetting.PersonaOnly, &guSetting.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &guSetting, nil
+}
+
+func (d *SQLiteDriver) DeleteGroupUserSetting(ctx context.Context, setting storage.GroupUserSetting) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM group_user_setting WHERE group_id = ? AND user_id = ? AND version = ?`,
+		setting.GroupId, setting.UserId, setting.Version))
+	// No row matched: tell a missing setting apart from a changed one.
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetGroupUserSetting(ctx, setting.GroupId, setting.UserId); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *SQLiteDriver) UpsertUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	if setting.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO user_setting (user_id, system_instruction, persona, timezone, version)
+			VALUES (?, ?, ?, ?, 1)
+			ON CONFLICT (user_id) DO UPDATE SET system_instruction = excluded.system_instruction, persona = excluded.persona, timezone = excluded.timezone, version = 1
+			WHERE user_setting.version = 0`,
+			setting.UserId, setting.SystemInstruction, setting.Persona, setting.Timezone))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE user_setting SET system_instruction = ?, persona = ?, timezone = ?, version = version + 1
+		WHERE user_id = ? AND version = ?`,
+		setting.SystemInstruction, setting.Persona, setting.Timezone, setting.UserId, setting.Version))
+}
+
+func (d *SQLiteDriver) GetUserSetting(ctx context.Context, userId string) (*storage.UserSetting, error) {
+	uSetting := storage.UserSetting{UserId: userId}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT system_instruction, persona, timezone, version FROM user_setting WHERE user_id = ?`,
+		userId).Scan(&uSetting.SystemInstruction, &uSetting.Persona, &uSetting.Timezone, &uSetting.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &uSetting, nil
+}
+
+func (d *SQLiteDriver) DeleteUserSetting(ctx context.Context, setting storage.UserSetting) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM user_setting WHERE user_id = ? AND version = ?`,
+		setting.UserId, setting.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetUserSetting(ctx, setting.UserId); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *SQLiteDriver) ScanGroupUserSettings(ctx context.Context, fn func(storage.GroupUserSetting) error) error {
+	var after storage.GroupUserSetting
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT group_id, user_id, system_instruction, persona, persona_only, version FROM group_user_setting
+			WHERE (group_id, user_id) > (?, ?)
+			ORDER BY group_id, user_id LIMIT ?`,
+			after.GroupId, after.UserId, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.GroupUserSetting
+		for rows.Next() {
+			var setting storage.GroupUserSetting
+			if err := rows.Scan(&setting.GroupId, &setting.UserId, &setting.SystemInstruction, &setting.Persona, &setting.PersonaOnly, &setting.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, setting)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, setting := range page {
+			if err := fn(setting); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+func (d *SQLiteDriver) ScanUserSettings(ctx context.Context, fn func(storage.UserSetting) error) error {
+	var after string
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT user_id, system_instruction, persona, timezone, version FROM user_setting
+			WHERE user_id > ?
+			ORDER BY user_id LIMIT ?`,
+			after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.UserSetting
+		for rows.Next() {
+			var setting storage.UserSetting
+			if err := rows.Scan(&setting.UserId, &setting.SystemInstruction, &setting.Persona, &setting.Timezone, &setting.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, setting)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, setting := range page {
+			if err := fn(setting); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1].UserId
+	}
+}
+
+func (d *SQLiteDriver) ListGroupUserSettings(ctx context.Context, groupId, after string, limit int) ([]storage.GroupUserSetting, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT group_id, user_id, system_instruction, persona, persona_only, version FROM group_user_setting
+		WHERE group_id = ? AND user_id > ?
+		ORDER BY user_id LIMIT ?`,
+		groupId, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var settings []storage.GroupUserSetting
+	for rows.Next() {
+		var setting storage.GroupUserSetting
+		if err := rows.Scan(&setting.GroupId, &setting.UserId, &setting.SystemInstruction, &setting.Persona, &setting.PersonaOnly, &setting.Version); err != nil {
+			return nil, err
+		}
+		settings = append(settings, setting)
+	}
+	return settings, rows.Err()
+}
+
+func (d *SQLiteDriver) ListGroupUserSettingsByUser(ctx context.Context, userId string) ([]storage.GroupUserSetting, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT group_id, user_id, system_instruction, persona, persona_only, version FROM group_user_setting WHERE user_id = ?1`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var settings []storage.GroupUserSetting
+	for rows.Next() {
+		var setting storage.GroupUserSetting
+		if err := rows.Scan(&setting.GroupId, &setting.UserId, &setting.SystemInstruction, &setting.Persona, &setting.PersonaOnly, &setting.Version); err != nil {
+			return nil, err
+		}
+		settings = append(settings, setting)
+	}
+	return settings, rows.Err()
+}
+
+func (d *SQLiteDriver) UpsertPersona(ctx context.Context, persona storage.Persona) error {
+	if persona.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO persona (scope, name, system_instruction, version)
+			VALUES (?, ?, ?, 1)
+			ON CONFLICT (scope, name) DO UPDATE SET system_instruction = excluded.system_instruction, version = 1
+			WHERE persona.version = 0`,
+			persona.Scope, persona.Name, persona.SystemInstruction))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE persona SET system_instruction = ?, version = version + 1
+		WHERE scope = ? AND name = ? AND version = ?`,
+		persona.SystemInstruction, persona.Scope, persona.Name, persona.Version))
+}
+
+func (d *SQLiteDriver) GetPersona(ctx context.Context, scope, name string) (*storage.Persona, error) {
+	persona := storage.Persona{Scope: scope, Name: name}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT system_instruction, version FROM persona WHERE scope = ? AND name = ?`,
+		scope, name).Scan(&persona.SystemInstruction, &persona.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &persona, nil
+}
+
+func (d *SQLiteDriver) DeletePersona(ctx context.Context, persona storage.Persona) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM persona WHERE scope = ? AND name = ? AND version = ?`,
+		persona.Scope, persona.Name, persona.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetPersona(ctx, persona.Scope, persona.Name); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *SQLiteDriver) ListPersonas(ctx context.Context, scope string) ([]storage.Persona, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT scope, name, system_instruction, version FROM persona WHERE scope = ? ORDER BY name`,
+		scope)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var personas []storage.Persona
+	for rows.Next() {
+		var persona storage.Persona
+		if err := rows.Scan(&persona.Scope, &persona.Name, &persona.SystemInstruction, &persona.Version); err != nil {
+			return nil, err
+		}
+		personas = append(personas, persona)
+	}
+	return personas, rows.Err()
+}
+
+func (d *SQLiteDriver) ScanPersonas(ctx context.Context, fn func(storage.Persona) error) error {
+	var after storage.Persona
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT scope, name, system_instruction, version FROM persona
+			WHERE (scope, name) > (?, ?)
+			ORDER BY scope, name LIMIT ?`,
+			after.Scope, after.Name, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.Persona
+		for rows.Next() {
+			var persona storage.Persona
+			if err := rows.Scan(&persona.Scope, &persona.Name, &persona.SystemInstruction, &persona.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, persona)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, persona := range page {
+			if err := fn(persona); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+func (d *SQLiteDriver) UpsertGroupRole(ctx context.Context, role storage.GroupRole) error {
+	if role.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO group_role (group_id, user_id, role, version)
+			VALUES (?, ?, ?, 1)
+			ON CONFLICT (group_id, user_id) DO UPDATE SET role = excluded.role, version = 1
+			WHERE group_role.version = 0`,
+			role.GroupId, role.UserId, role.Role))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE group_role SET role = ?, version = version + 1
+		WHERE group_id = ? AND user_id = ? AND version = ?`,
+		role.Role, role.GroupId, role.UserId, role.Version))
+}
+
+func (d *SQLiteDriver) GetGroupRole(ctx context.Context, groupId, userId string) (*storage.GroupRole, error) {
+	role := storage.GroupRole{GroupId: groupId, UserId: userId}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT role, version FROM group_role WHERE group_id = ? AND user_id = ?`,
+		groupId, userId).Scan(&role.Role, &role.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (d *SQLiteDriver) DeleteGroupRole(ctx context.Context, role storage.GroupRole) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM group_role WHERE group_id = ? AND user_id = ? AND version = ?`,
+		role.GroupId, role.UserId, role.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetGroupRole(ctx, role.GroupId, role.UserId); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *SQLiteDriver) ListGroupRoles(ctx context.Context, groupId string) ([]storage.GroupRole, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT group_id, user_id, role, version FROM group_role WHERE group_id = ? ORDER BY user_id`,
+		groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []storage.GroupRole
+	for rows.Next() {
+		var role storage.GroupRole
+		if err := rows.Scan(&role.GroupId, &role.UserId, &role.Role, &role.Version); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (d *SQLiteDriver) ScanGroupRoles(ctx context.Context, fn func(storage.GroupRole) error) error {
+	var after storage.GroupRole
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT group_id, user_id, role, version FROM group_role
+			WHERE (group_id, user_id) > (?, ?)
+			ORDER BY group_id, user_id LIMIT ?`,
+			after.GroupId, after.UserId, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.GroupRole
+		for rows.Next() {
+			var role storage.GroupRole
+			if err := rows.Scan(&role.GroupId, &role.UserId, &role.Role, &role.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, role)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, role := range page {
+			if err := fn(role); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+func (d *SQLiteDriver) UpsertBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	if setting.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO bot_setting (key, value, version)
+			VALUES (?, ?, 1)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value, version = 1
+			WHERE bot_setting.version = 0`,
+			setting.Key, setting.Value))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE bot_setting SET value = ?, version = version + 1
+		WHERE key = ? AND version = ?`,
+		setting.Value, setting.Key, setting.Version))
+}
+
+func (d *SQLiteDriver) GetBotSetting(ctx context.Context, key string) (*storage.BotSetting, error) {
+	setting := storage.BotSetting{Key: key}
+	err := d.db.QueryRowContext(ctx, `
+		SELECT value, version FROM bot_setting WHERE key = ?`,
+		key).Scan(&setting.Value, &setting.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+func (d *SQLiteDriver) DeleteBotSetting(ctx context.Context, setting storage.BotSetting) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM bot_setting WHERE key = ? AND version = ?`,
+		setting.Key, setting.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetBotSetting(ctx, setting.Key); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// ScanBotSettings reads every setting at once, there are only a handful.
+func (d *SQLiteDriver) ScanBotSettings(ctx context.Context, fn func(storage.BotSetting) error) error {
+	rows, err := d.db.QueryContext(ctx, `SELECT key, value, version FROM bot_setting ORDER BY key`)
+	if err != nil {
+		return err
+	}
+	var settings []storage.BotSetting
+	for rows.Next() {
+		var setting storage.BotSetting
+		if err := rows.Scan(&setting.Key, &setting.Value, &setting.Version); err != nil {
+			rows.Close()
+			return err
+		}
+		settings = append(settings, setting)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, setting := range settings {
+		if err := fn(setting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *SQLiteDriver) UpsertBlock(ctx context.Context, block storage.Block) error {
+	if block.Version == 0 {
+		return versioned(d.db.ExecContext(ctx, `
+			INSERT INTO block (id, reason, created_by, created_at, expires_at, version)
+			VALUES (?, ?, ?, ?, ?, 1)
+			ON CONFLICT (id) DO UPDATE SET reason = excluded.reason, created_by = excluded.created_by, created_at = excluded.created_at, expires_at = excluded.expires_at, version = 1
+			WHERE block.version = 0`,
+			block.Id, block.Reason, block.CreatedBy, unixMilli(block.CreatedAt), unixMilli(block.ExpiresAt)))
+	}
+	return versioned(d.db.ExecContext(ctx, `
+		UPDATE block SET reason = ?, created_by = ?, created_at = ?, expires_at = ?, version = version + 1
+		WHERE id = ? AND version = ?`,
+		block.Reason, block.CreatedBy, unixMilli(block.CreatedAt), unixMilli(block.ExpiresAt), block.Id, block.Version))
+}
+
+func (d *SQLiteDriver) GetBlock(ctx context.Context, id string) (*storage.Block, error) {
+	block := storage.Block{Id: id}
+	var createdAt, expiresAt int64
+	err := d.db.QueryRowContext(ctx, `
+		SELECT reason, created_by, created_at, expires_at, version FROM block WHERE id = ?`,
+		id).Scan(&block.Reason, &block.CreatedBy, &createdAt, &expiresAt, &block.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	block.CreatedAt, block.ExpiresAt = fromUnixMilli(createdAt), fromUnixMilli(expiresAt)
+	return &block, nil
+}
+
+func (d *SQLiteDriver) DeleteBlock(ctx context.Context, block storage.Block) error {
+	err := versioned(d.db.ExecContext(ctx, `
+		DELETE FROM block WHERE id = ? AND version = ?`,
+		block.Id, block.Version))
+	if errors.Is(err, storage.ErrConflict) {
+		if _, err := d.GetBlock(ctx, block.Id); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *SQLiteDriver) ScanBlocks(ctx context.Context, fn func(storage.Block) error) error {
+	var after string
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT id, reason, created_by, created_at, expires_at, version FROM block
+			WHERE id > ?
+			ORDER BY id LIMIT ?`,
+			after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var page []storage.Block
+		for rows.Next() {
+			var block storage.Block
+			var createdAt, expiresAt int64
+			if err := rows.Scan(&block.Id, &block.Reason, &block.CreatedBy, &createdAt, &expiresAt, &block.Version); err != nil {
+				rows.Close()
+				return err
+			}
+			block.CreatedAt, block.ExpiresAt = fromUnixMilli(createdAt), fromUnixMilli(expiresAt)
+			page = append(page, block)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, block := range page {
+			if err := fn(block); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1].Id
+	}
+}
+
+func (d *SQLiteDriver) AppendAudit(ctx context.Context, entry storage.AuditEntry) error {
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO audit_entry (scope, created_at, actor, action, old_hash, new_value)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		entry.Scope, unixNano(entry.Time), entry.Actor, entry.Action, entry.OldHash, entry.NewValue)
+	return err
+}
+
+func (d *SQLiteDriver) ListAudit(ctx context.Context, scope string, before time.Time, limit int) ([]storage.AuditEntry, error) {
+	beforeNano := int64(math.MaxInt64)
+	if !before.IsZero() {
+		beforeNano = before.UnixNano()
+	}
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT created_at, actor, action, old_hash, new_value FROM audit_entry
+		WHERE scope = ? AND created_at < ?
+		ORDER BY created_at DESC, id DESC LIMIT ?`,
+		scope, beforeNano, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []storage.AuditEntry
+	for rows.Next() {
+		entry := storage.AuditEntry{Scope: scope}
+		var createdAt int64
+		if err := rows.Scan(&createdAt, &entry.Actor, &entry.Action, &entry.OldHash, &entry.NewValue); err != nil {
+			return nil, err
+		}
+		entry.Time = fromUnixNano(createdAt)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// ScanAudit reads one scope at a time, so fn may use the database while the
+// scan is in progress.
+func (d *SQLiteDriver) ScanAudit(ctx context.Context, fn func(scope string, entries []storage.AuditEntry) error) error {
+	var after string
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT DISTINCT scope FROM audit_entry
+			WHERE scope > ?
+			ORDER BY scope LIMIT ?`,
+			after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var scopes []string
+		for rows.Next() {
+			var scope string
+			if err := rows.Scan(&scope); err != nil {
+				rows.Close()
+				return err
+			}
+			scopes = append(scopes, scope)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, scope := range scopes {
+			entries, err := d.ListAudit(ctx, scope, time.Time{}, math.MaxInt32)
+			if err != nil {
+				return err
+			}
+			slices.Reverse(entries)
+			if err := fn(scope, entries); err != nil {
+				return err
+			}
+		}
+		if len(scopes) < scanPageSize {
+			return nil
+		}
+		after = scopes[len(scopes)-1]
+	}
+}
+
+func (d *SQLiteDriver) DeleteAudit(ctx context.Context, scope string) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM audit_entry WHERE scope = ?`, scope)
+	return err
+}
+
+func (d *SQLiteDriver) RedactAudit(ctx context.Context, actor string) error {
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE audit_entry SET actor = '', old_hash = '', new_value = ''
+		WHERE actor = ?`,
+		actor)
+	return err
+}
+
+// RewriteAudit reads scanPageSize entries at a time and only replaces a value
+// that was not redacted meanwhile.
+func (d *SQLiteDriver) RewriteAudit(ctx context.Context, fn func(storage.AuditEntry) (string, error)) error {
+	var after int64
+	for {
+		rows, err := d.db.QueryContext(ctx, `
+			SELECT id, scope, created_at, actor, action, old_hash, new_value FROM audit_entry
+			WHERE id > ?
+			ORDER BY id LIMIT ?`,
+			after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		var entries []storage.AuditEntry
+		for rows.Next() {
+			var id, createdAt int64
+			var entry storage.AuditEntry
+			if err := rows.Scan(&id, &entry.Scope, &createdAt, &entry.Actor, &entry.Action, &entry.OldHash, &entry.NewValue); err != nil {
+				rows.Close()
+				return err
+			}
+			entry.Time = fromUnixNano(createdAt)
+			ids = append(ids, id)
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for i, entry := range entries {
+			value, err := fn(entry)
+			if err != nil {
+				return err
+			}
+			if _, err := d.db.ExecContext(ctx, `
+				UPDATE audit_entry SET new_value = ?
+				WHERE id = ? AND actor = ? AND new_value = ?`,
+				value, ids[i], entry.Actor, entry.NewValue); err != nil {
+				return err
+			}
+		}
+		if len(ids) < scanPageSize {
+			return nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+// unixMilli stores the zero time as 0 rather than a date in year 1.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms).UTC()
+}
+
+// unixNano and fromUnixNano are the audit log counterparts of unixMilli and
+// fromUnixMilli.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+// versioned turns a versioned write that matched no row into storage.ErrConflict.
+func versioned(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrConflict
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package sqlitedriver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/internal/storage/storagetest"
+)
+
+func TestSQLiteDriver(t *testing.T) {
+	driver, err := New(context.TODO(), Config{Path: filepath.Join(t.TempDir(), "linebot.db")})
+	if err != nil {
+		t.Fatalf("failed to initialize sqlite driver: %v\n", err)
+	}
+	defer driver.Close()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return driver
+	})
+}
+
+func TestSQLiteDriverReopen(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "linebot.db")
+	driver, err := New(ctx, Config{Path: path})
+	if err != nil {
+		t.Fatalf("failed to initialize sqlite driver: %v\n", err)
+	}
+	if err := driver.UpsertUserSetting(ctx, storage.UserSetting{UserId: "test", SystemInstruction: "kept"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	driver.Close()
+
+	driver, err = New(ctx, Config{Path: path})
+	if err != nil {
+		t.Fatalf("failed to reopen sqlite driver: %v\n", err)
+	}
+	defer driver.Close()
+	setting, err := driver.GetUserSetting(ctx, "test")
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "kept" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, "kept")
+	}
+}
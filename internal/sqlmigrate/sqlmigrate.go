@@ -0,0 +1,62 @@
+// Package sqlmigrate applies versioned schema migrations to database/sql backends.
+package sqlmigrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+const createVersionTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY
+)`
+
+// DB is the part of *sql.DB and *sql.Conn used by Migrate, so migrations can
+// run on a connection holding a lock.
+type DB interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Migrate applies migrations[i] as schema version i+1, skipping versions that are
+// already recorded. Each migration runs in its own transaction, so a failed step
+// leaves the schema at the previous version.
+func Migrate(ctx context.Context, db DB, migrations []string) error {
+	if _, err := db.ExecContext(ctx, createVersionTable); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if err := apply(ctx, db, version, migrations[i]); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+		slog.Info("schema migrated", "version", version)
+	}
+	return nil
+}
+
+func apply(ctx context.Context, db DB, version int, migration string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migration); err != nil {
+		return err
+	}
+	// The version is an integer we control, so it is safe to inline and keeps the
+	// statement independent of the driver's placeholder syntax.
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO schema_migrations (version) VALUES (%d)`, version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// BotScope is the scope of audit entries of changes made by operators.
+const BotScope = "bot"
+
+// AuditEntry records a change of a setting. Entries are only ever appended,
+// and removed with the whole log of their scope.
+type AuditEntry struct {
+	// Scope is UserScope, GroupScope or BotScope.
+	Scope string    `dynamodbav:"Scope" json:"scope"`
+	Time  time.Time `dynamodbav:"Time" json:"time"`
+	// Actor is the user id of who made the change.
+	Actor  string `dynamodbav:"Actor" json:"actor"`
+	Action string `dynamodbav:"Action" json:"action"`
+	// OldHash is HashValue of the value before the change, empty when there
+	// was none.
+	OldHash  string `dynamodbav:"OldHash" json:"old_hash"`
+	NewValue string `dynamodbav:"NewValue" json:"new_value"`
+}
+
+// HashValue identifies an old value without keeping it: the first 16 hex
+// digits of its SHA-256, or "" for an empty value.
+func HashValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	userIdPattern  = regexp.MustCompile(`^U[0-9a-f]{32}$`)
+	groupIdPattern = regexp.MustCompile(`^C[0-9a-f]{32}$`)
+)
+
+var (
+	ErrInvalidBlockId = errors.New("storage: not a user or group id")
+	ErrBlockOperator  = errors.New("storage: operators cannot be blocked")
+)
+
+// IsUserId and IsGroupId report whether id has the form of a LINE user or
+// group id.
+func IsUserId(id string) bool  { return userIdPattern.MatchString(id) }
+func IsGroupId(id string) bool { return groupIdPattern.MatchString(id) }
+
+// Block stops the bot from answering a user, or anyone in a group.
+type Block struct {
+	// Id is the user or group id, told apart by LINE's U and C prefixes.
+	Id     string `dynamodbav:"Id" json:"id"`
+	Reason string `dynamodbav:"Reason" json:"reason"`
+	// CreatedBy is the operator who added the block.
+	CreatedBy string    `dynamodbav:"CreatedBy" json:"created_by"`
+	CreatedAt time.Time `dynamodbav:"CreatedAt" json:"created_at"`
+	// ExpiresAt is when the block is lifted, zero for never. Expired blocks
+	// stay stored until they are deleted.
+	ExpiresAt time.Time `dynamodbav:"ExpiresAt" json:"expires_at"`
+	// Version is the version this block was read at, see Storage.
+	Version int64 `dynamodbav:"Version" json:"version"`
+}
+
+func (block Block) GetKey() map[string]types.AttributeValue {
+	id, err := attributevalue.Marshal(block.Id)
+	if err != nil {
+		panic(err)
+	}
+	return map[string]types.AttributeValue{"Id": id}
+}
+
+// Expired reports whether the block was lifted by now.
+func (block Block) Expired(now time.Time) bool {
+	return !block.ExpiresAt.IsZero() && !now.Before(block.ExpiresAt)
+}
+
+// PutBlock stops the bot from answering a user or group until expiresAt, or
+// for good when it is zero, and replaces any earlier block of id. It returns
+// the block at its new version, ErrInvalidBlockId for an id that is neither a
+// user nor a group id and ErrBlockOperator for one of operators. Leaving a
+// blocked group is up to the caller.
+func PutBlock(ctx context.Context, s Storage, operators []string, id, reason, createdBy string, expiresAt time.Time) (*Block, error) {
+	if !IsUserId(id) && !IsGroupId(id) {
+		return nil, ErrInvalidBlockId
+	}
+	if slices.Contains(operators, id) {
+		return nil, ErrBlockOperator
+	}
+	block, err := s.GetBlock(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		block, err = &Block{Id: id}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block.Reason, block.CreatedBy, block.CreatedAt, block.ExpiresAt = reason, createdBy, time.Now().UTC(), expiresAt.UTC()
+	if expiresAt.IsZero() {
+		block.ExpiresAt = time.Time{}
+	}
+	if err := s.UpsertBlock(ctx, *block); err != nil {
+		return nil, err
+	}
+	block.Version++
+	return block, nil
+}
+
+// RemoveBlock lifts the block of id. It returns ErrNotFound when id is not
+// blocked.
+func RemoveBlock(ctx context.Context, s Storage, id string) error {
+	block, err := s.GetBlock(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.DeleteBlock(ctx, *block)
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// BotSetting is a setting of the whole bot changed by operators at runtime,
+// such as the default model.
+type BotSetting struct {
+	Key   string `dynamodbav:"Key" json:"key"`
+	Value string `dynamodbav:"Value" json:"value"`
+	// Version is the version this setting was read at, see Storage.
+	Version int64 `dynamodbav:"Version" json:"version"`
+}
+
+// Keys of bot settings. A quota is stored under QuotaPrefix followed by a user
+// id, a group id or QuotaDefault, and holds messages per minute.
+const (
+	ModelDefaultKey = "model:default"
+	QuotaPrefix     = "quota:"
+	QuotaDefault    = "default"
+)
+
+func (setting BotSetting) GetKey() map[string]types.AttributeValue {
+	key, err := attributevalue.Marshal(setting.Key)
+	if err != nil {
+		panic(err)
+	}
+	return map[string]types.AttributeValue{"Key": key}
+}
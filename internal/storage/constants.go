@@ -3,5 +3,21 @@ package storage
 const (
 	GroupUserSettingTableName = "LineBotGroupUserSetting"
 	UserSettingTableName      = "LineBotUserSetting"
+	EphemeralTableName        = "LineBotEphemeral"
+	PersonaTableName          = "LineBotPersona"
+	GroupRoleTableName        = "LineBotGroupRole"
+	BotSettingTableName       = "LineBotBotSetting"
+	BlockTableName            = "LineBotBlock"
+	AuditTableName            = "LineBotAudit"
 	SystemInstruction         = "SystemInstruction"
+	SettingVersion            = "Version"
+	SettingPersona            = "Persona"
+	SettingPersonaOnly        = "PersonaOnly"
+	SettingTimezone           = "Timezone"
+	GroupRoleRole             = "Role"
+	BotSettingValue           = "Value"
+	BlockReason               = "Reason"
+	BlockCreatedBy            = "CreatedBy"
+	BlockCreatedAt            = "CreatedAt"
+	BlockExpiresAt            = "ExpiresAt"
 )
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	HistoryRoleUser  = "user"
+	HistoryRoleModel = "model"
+)
+
+// HistoryMessage is one turn of a conversation kept for context. Histories,
+// counters and processed markers are ephemeral: drivers drop them once their
+// TTL has passed.
+type HistoryMessage struct {
+	Role string `dynamodbav:"Role" json:"role"`
+	Text string `dynamodbav:"Text" json:"text"`
+}
+
+// EphemeralItem is the DynamoDB representation shared by all ephemeral data.
+type EphemeralItem struct {
+	Id        string           `dynamodbav:"Id"`
+	ExpiresAt int64            `dynamodbav:"ExpiresAt"`
+	Messages  []HistoryMessage `dynamodbav:"Messages,omitempty"`
+	Value     int64            `dynamodbav:"Value,omitempty"`
+}
+
+func (item EphemeralItem) GetKey() map[string]types.AttributeValue {
+	id, err := attributevalue.Marshal(item.Id)
+	if err != nil {
+		panic(err)
+	}
+	return map[string]types.AttributeValue{"Id": id}
+}
+
+// AppendHistory appends message and drops the oldest messages beyond maxLen.
+func AppendHistory(history []HistoryMessage, message HistoryMessage, maxLen int) []HistoryMessage {
+	history = append(history, message)
+	if len(history) > maxLen {
+		history = slices.Clone(history[len(history)-maxLen:])
+	}
+	return history
+}
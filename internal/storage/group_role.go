@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Roles of a group member. Members have no GroupRole stored.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// GroupRole is the role of a user in a group, which decides who may change
+// the settings shared by the group.
+type GroupRole struct {
+	GroupId string `dynamodbav:"GroupId" json:"group_id"`
+	UserId  string `dynamodbav:"UserId" json:"user_id"`
+	Role    string `dynamodbav:"Role" json:"role"`
+	// Version is the version this role was read at, see Storage.
+	Version int64 `dynamodbav:"Version" json:"version"`
+}
+
+func (role GroupRole) GetKey() map[string]types.AttributeValue {
+	gid, err := attributevalue.Marshal(role.GroupId)
+	if err != nil {
+		panic(err)
+	}
+	uid, err := attributevalue.Marshal(role.UserId)
+	if err != nil {
+		panic(err)
+	}
+	return map[string]types.AttributeValue{"GroupId": gid, "UserId": uid}
+}
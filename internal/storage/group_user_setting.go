@@ -6,9 +6,17 @@ import (
 )
 
 type GroupUserSetting struct {
-	GroupId           string `dynamodbav:"GroupId"`
-	UserId            string `dynamodbav:"UserId"`
-	SystemInstruction string `dynamodbav:"SystemInstruction"`
+	GroupId           string `dynamodbav:"GroupId" json:"group_id"`
+	UserId            string `dynamodbav:"UserId" json:"user_id"`
+	SystemInstruction string `dynamodbav:"SystemInstruction" json:"system_instruction"`
+	// Persona names the persona in use, which takes precedence over
+	// SystemInstruction. Empty when none is.
+	Persona string `dynamodbav:"Persona,omitempty" json:"persona,omitempty"`
+	// PersonaOnly reports that the setting was created to use a persona, the
+	// user never set an instruction of their own in the group.
+	PersonaOnly bool `dynamodbav:"PersonaOnly,omitempty" json:"persona_only,omitempty"`
+	// Version is the version this setting was read at, see Storage.
+	Version int64 `dynamodbav:"Version" json:"version"`
 }
 
 func (setting GroupUserSetting) GetKey() map[string]types.AttributeValue {
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Persona is a named instruction saved for reuse within a scope, see
+// UserScope and GroupScope.
+type Persona struct {
+	Scope             string `dynamodbav:"Scope" json:"scope"`
+	Name              string `dynamodbav:"Name" json:"name"`
+	SystemInstruction string `dynamodbav:"SystemInstruction" json:"system_instruction"`
+	// Version is the version this persona was read at, see Storage.
+	Version int64 `dynamodbav:"Version" json:"version"`
+}
+
+// UserScope is the scope of personas saved in a 1:1 chat.
+func UserScope(userId string) string {
+	return "user:" + userId
+}
+
+// GroupScope is the scope of personas shared by the members of a group.
+func GroupScope(groupId string) string {
+	return "group:" + groupId
+}
+
+func (persona Persona) GetKey() map[string]types.AttributeValue {
+	scope, err := attributevalue.Marshal(persona.Scope)
+	if err != nil {
+		panic(err)
+	}
+	name, err := attributevalue.Marshal(persona.Name)
+	if err != nil {
+		panic(err)
+	}
+	return map[string]types.AttributeValue{"Scope": scope, "Name": name}
+}
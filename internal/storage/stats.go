@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// Daily counters are stored under StatsKey of their name and day, and kept for
+// StatsDays days.
+const (
+	StatsPrefix = "stats:"
+	StatsDays   = 7
+
+	StatMessages = "messages"
+	StatErrors   = "errors"
+	// StatGroupPrefix followed by a group id counts the messages of a group.
+	StatGroupPrefix = "group:"
+	// StatInputTokensPrefix and StatOutputTokensPrefix followed by a model
+	// count the tokens used with it.
+	StatInputTokensPrefix  = "tokens:input:"
+	StatOutputTokensPrefix = "tokens:output:"
+)
+
+// StatsKey returns the counter key of the stat name on the UTC day of day.
+func StatsKey(name string, day time.Time) string {
+	return StatsPrefix + name + ":" + day.UTC().Format(time.DateOnly)
+}
+
+// ParseStatsKey splits a key made by StatsKey into the stat name and day.
+func ParseStatsKey(key string) (string, time.Time, bool) {
+	rest, ok := strings.CutPrefix(key, StatsPrefix)
+	i := strings.LastIndex(rest, ":")
+	if !ok || i < 0 {
+		return "", time.Time{}, false
+	}
+	day, err := time.Parse(time.DateOnly, rest[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return rest[:i], day, true
+}
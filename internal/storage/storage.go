@@ -1,10 +1,125 @@
 package storage
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a setting, persona, role or block was never
+	// set or was deleted.
+	ErrNotFound = errors.New("storage: setting not found")
+	// ErrConflict is returned when a setting was changed since it was read.
+	ErrConflict = errors.New("storage: setting was modified concurrently")
+)
 
 type Storage interface {
+	// UpsertGroupUserSetting stores setting if the stored version still equals
+	// setting.Version (0 for a missing setting) and bumps the version by one.
+	// Otherwise it returns ErrConflict and leaves the setting untouched.
 	UpsertGroupUserSetting(ctx context.Context, setting GroupUserSetting) error
+	// GetGroupUserSetting returns ErrNotFound when the setting is missing. A
+	// setting stored with an empty instruction is found.
 	GetGroupUserSetting(ctx context.Context, groupId, userId string) (*GroupUserSetting, error)
+	// DeleteGroupUserSetting removes the setting if the stored version still
+	// equals setting.Version. It returns ErrNotFound when the setting is missing
+	// and ErrConflict when it changed.
+	DeleteGroupUserSetting(ctx context.Context, setting GroupUserSetting) error
+	// UpsertUserSetting, GetUserSetting and DeleteUserSetting behave like their
+	// group user counterparts.
 	UpsertUserSetting(ctx context.Context, setting UserSetting) error
 	GetUserSetting(ctx context.Context, userId string) (*UserSetting, error)
+	DeleteUserSetting(ctx context.Context, setting UserSetting) error
+	// ScanGroupUserSettings calls fn for every stored group user setting, in no
+	// particular order, and stops at the first error fn returns. fn may write to
+	// the store.
+	ScanGroupUserSettings(ctx context.Context, fn func(GroupUserSetting) error) error
+	ScanUserSettings(ctx context.Context, fn func(UserSetting) error) error
+	// ListGroupUserSettings returns up to limit settings of groupId whose user
+	// id sorts after after, ordered by user id. An empty after starts from the
+	// first one.
+	ListGroupUserSettings(ctx context.Context, groupId, after string, limit int) ([]GroupUserSetting, error)
+	// ListGroupUserSettingsByUser returns the settings of userId in every group.
+	// Drivers backed by an eventually consistent index may miss a setting
+	// written moments ago.
+	ListGroupUserSettingsByUser(ctx context.Context, userId string) ([]GroupUserSetting, error)
+
+	// UpsertPersona, GetPersona and DeletePersona behave like their setting
+	// counterparts.
+	UpsertPersona(ctx context.Context, persona Persona) error
+	GetPersona(ctx context.Context, scope, name string) (*Persona, error)
+	DeletePersona(ctx context.Context, persona Persona) error
+	// ListPersonas returns the personas saved in scope, ordered by name.
+	ListPersonas(ctx context.Context, scope string) ([]Persona, error)
+	ScanPersonas(ctx context.Context, fn func(Persona) error) error
+
+	// UpsertGroupRole, GetGroupRole and DeleteGroupRole behave like their
+	// setting counterparts.
+	UpsertGroupRole(ctx context.Context, role GroupRole) error
+	GetGroupRole(ctx context.Context, groupId, userId string) (*GroupRole, error)
+	DeleteGroupRole(ctx context.Context, role GroupRole) error
+	// ListGroupRoles returns the roles in a group, ordered by user id.
+	ListGroupRoles(ctx context.Context, groupId string) ([]GroupRole, error)
+	ScanGroupRoles(ctx context.Context, fn func(GroupRole) error) error
+
+	// UpsertBotSetting, GetBotSetting and DeleteBotSetting behave like their
+	// user setting counterparts.
+	UpsertBotSetting(ctx context.Context, setting BotSetting) error
+	GetBotSetting(ctx context.Context, key string) (*BotSetting, error)
+	DeleteBotSetting(ctx context.Context, setting BotSetting) error
+	ScanBotSettings(ctx context.Context, fn func(BotSetting) error) error
+
+	// UpsertBlock, GetBlock and DeleteBlock behave like their user setting
+	// counterparts.
+	UpsertBlock(ctx context.Context, block Block) error
+	GetBlock(ctx context.Context, id string) (*Block, error)
+	DeleteBlock(ctx context.Context, block Block) error
+	ScanBlocks(ctx context.Context, fn func(Block) error) error
+
+	// AppendAudit adds an entry to the audit log of entry.Scope.
+	AppendAudit(ctx context.Context, entry AuditEntry) error
+	// ListAudit returns up to limit entries of scope older than before, the
+	// newest first. A zero before starts from the newest entry.
+	ListAudit(ctx context.Context, scope string, before time.Time, limit int) ([]AuditEntry, error)
+	// ScanAudit calls fn with the whole audit log of every scope, the oldest
+	// entry first, and stops at the first error fn returns.
+	ScanAudit(ctx context.Context, fn func(scope string, entries []AuditEntry) error) error
+	// DeleteAudit removes the audit log of scope, if any. It is the only way
+	// entries are removed, when restoring a backup or erasing a user's data.
+	DeleteAudit(ctx context.Context, scope string) error
+	// RedactAudit blanks the Actor, OldHash and NewValue of every entry made
+	// by actor, in any scope, keeping the time and action of the change.
+	RedactAudit(ctx context.Context, actor string) error
+	// RewriteAudit replaces the NewValue of every entry, in any scope, with
+	// the value fn returns for it. Entries changed meanwhile are left as they
+	// are.
+	RewriteAudit(ctx context.Context, fn func(AuditEntry) (string, error)) error
+
+	// AppendHistory adds a message to the history under key, keeps at most the
+	// last maxLen messages and restarts the TTL.
+	AppendHistory(ctx context.Context, key string, message HistoryMessage, maxLen int, ttl time.Duration) error
+	// GetHistory returns an empty history when key is missing or expired.
+	GetHistory(ctx context.Context, key string) ([]HistoryMessage, error)
+	// ScanHistory calls fn for every unexpired history whose key starts with
+	// prefix and stops at the first error fn returns.
+	ScanHistory(ctx context.Context, prefix string, fn func(key string, history []HistoryMessage) error) error
+	// RewriteHistory replaces the history under key with the one fn returns
+	// for it, keeping its expiry. fn is not called when key is missing or
+	// expired, and ErrConflict is returned when the history changed meanwhile.
+	RewriteHistory(ctx context.Context, key string, fn func([]HistoryMessage) ([]HistoryMessage, error)) error
+	// DeleteHistory removes the history under key, if any.
+	DeleteHistory(ctx context.Context, key string) error
+	// IncrCounter adds delta to the counter under key and returns the new value.
+	// The TTL is only set when the counter is created, giving a fixed window.
+	IncrCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	GetCounter(ctx context.Context, key string) (int64, error)
+	// ScanCounters and DeleteCounter are the counter counterparts of
+	// ScanHistory and DeleteHistory.
+	ScanCounters(ctx context.Context, prefix string, fn func(key string, value int64) error) error
+	DeleteCounter(ctx context.Context, key string) error
+	// MarkProcessed records key for ttl and reports whether it was not marked yet.
+	MarkProcessed(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// UnmarkProcessed removes the mark of key, if any.
+	UnmarkProcessed(ctx context.Context, key string) error
 }
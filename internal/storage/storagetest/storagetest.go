@@ -0,0 +1,1354 @@
+// Package storagetest holds the behavior every storage.Storage implementation
+// must provide. Drivers call Run from their own tests.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vgjm/linebot/internal/storage"
+)
+
+type options struct {
+	advance func(d time.Duration)
+}
+
+type Option func(*options)
+
+// WithAdvance replaces the real sleep used to let TTLs pass, for drivers
+// backed by a fake clock.
+func WithAdvance(advance func(d time.Duration)) Option {
+	return func(o *options) {
+		o.advance = advance
+	}
+}
+
+// Run executes the conformance suite. newStorage is called once per subtest and
+// may return the same shared instance; every subtest uses its own ids.
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage, opts ...Option) {
+	o := options{advance: time.Sleep}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storage, o options)
+	}{
+		{"UserSettingRoundTrip", testUserSettingRoundTrip},
+		{"UserSettingMissing", testUserSettingMissing},
+		{"UserSettingOverwrite", testUserSettingOverwrite},
+		{"UserSettingEmptyInstruction", testUserSettingEmptyInstruction},
+		{"UserSettingDelete", testUserSettingDelete},
+		{"GroupUserSettingRoundTrip", testGroupUserSettingRoundTrip},
+		{"GroupUserSettingMissing", testGroupUserSettingMissing},
+		{"GroupUserSettingDelete", testGroupUserSettingDelete},
+		{"GroupUserSettingIsolation", testGroupUserSettingIsolation},
+		{"ConcurrentUpserts", testConcurrentUpserts},
+		{"UserSettingConflict", testUserSettingConflict},
+		{"GroupUserSettingConflict", testGroupUserSettingConflict},
+		{"ConcurrentConflicts", testConcurrentConflicts},
+		{"ScanSettings", testScanSettings},
+		{"ListGroupUserSettings", testListGroupUserSettings},
+		{"ListGroupUserSettingsByUser", testListGroupUserSettingsByUser},
+		{"SettingPersona", testSettingPersona},
+		{"UserSettingTimezone", testUserSettingTimezone},
+		{"PersonaRoundTrip", testPersonaRoundTrip},
+		{"PersonaConflict", testPersonaConflict},
+		{"ListAndScanPersonas", testListAndScanPersonas},
+		{"GroupRoleRoundTrip", testGroupRoleRoundTrip},
+		{"ListAndScanGroupRoles", testListAndScanGroupRoles},
+		{"BotSettingRoundTrip", testBotSettingRoundTrip},
+		{"BlockRoundTrip", testBlockRoundTrip},
+		{"AuditLog", testAuditLog},
+		{"RewriteAudit", testRewriteAudit},
+		{"HistoryAppendAndTrim", testHistoryAppendAndTrim},
+		{"HistoryExpires", testHistoryExpires},
+		{"ScanAndDeleteHistory", testScanAndDeleteHistory},
+		{"RewriteHistory", testRewriteHistory},
+		{"Counter", testCounter},
+		{"CounterExpires", testCounterExpires},
+		{"ScanAndDeleteCounters", testScanAndDeleteCounters},
+		{"MarkProcessed", testMarkProcessed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t), o)
+		})
+	}
+}
+
+// uniqueId keeps subtests independent when the backing store outlives the test run.
+func uniqueId(t *testing.T, prefix string) string {
+	return fmt.Sprintf("%s-%s-%d", prefix, t.Name(), time.Now().UnixNano())
+}
+
+func testUserSettingRoundTrip(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	userId := uniqueId(t, "user")
+	instruct := "some instruct"
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{
+		UserId:            userId,
+		SystemInstruction: instruct,
+	}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	setting, err := s.GetUserSetting(ctx, userId)
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.UserId != userId {
+		t.Fatalf("got different user id, got: %v, expect: %v\n", setting.UserId, userId)
+	}
+	if setting.SystemInstruction != instruct {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, instruct)
+	}
+}
+
+func testUserSettingMissing(t *testing.T, s storage.Storage, o options) {
+	userId := uniqueId(t, "user")
+	if _, err := s.GetUserSetting(context.TODO(), userId); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound for a missing user, got: %v\n", err)
+	}
+}
+
+func testUserSettingEmptyInstruction(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	userId := uniqueId(t, "user")
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{UserId: userId}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	setting, err := s.GetUserSetting(ctx, userId)
+	if err != nil {
+		t.Fatalf("expect a setting with an empty instruction to be found, got: %v\n", err)
+	}
+	if setting.SystemInstruction != "" || setting.Version != 1 {
+		t.Fatalf("got different setting: %+v\n", setting)
+	}
+}
+
+func testUserSettingDelete(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	userId := uniqueId(t, "user")
+	if err := s.DeleteUserSetting(ctx, storage.UserSetting{UserId: userId}); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound when deleting a missing user, got: %v\n", err)
+	}
+	for i, instruct := range []string{"first", "second"} {
+		if err := s.UpsertUserSetting(ctx, storage.UserSetting{
+			UserId:            userId,
+			SystemInstruction: instruct,
+			Version:           int64(i),
+		}); err != nil {
+			t.Fatalf("failed to update user setting: %v\n", err)
+		}
+	}
+	if err := s.DeleteUserSetting(ctx, storage.UserSetting{UserId: userId, Version: 1}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect a conflict when deleting a stale version, got: %v\n", err)
+	}
+	if err := s.DeleteUserSetting(ctx, storage.UserSetting{UserId: userId, Version: 2}); err != nil {
+		t.Fatalf("failed to delete user setting: %v\n", err)
+	}
+	if _, err := s.GetUserSetting(ctx, userId); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound after delete, got: %v\n", err)
+	}
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{UserId: userId, SystemInstruction: "again"}); err != nil {
+		t.Fatalf("failed to recreate user setting: %v\n", err)
+	}
+}
+
+func testUserSettingOverwrite(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	userId := uniqueId(t, "user")
+	for i, instruct := range []string{"first", "second"} {
+		if err := s.UpsertUserSetting(ctx, storage.UserSetting{
+			UserId:            userId,
+			SystemInstruction: instruct,
+			Version:           int64(i),
+		}); err != nil {
+			t.Fatalf("failed to update user setting: %v\n", err)
+		}
+	}
+	setting, err := s.GetUserSetting(ctx, userId)
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "second" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, "second")
+	}
+	if setting.Version != 2 {
+		t.Fatalf("got different version, got: %v, expect: %v\n", setting.Version, 2)
+	}
+}
+
+func testGroupUserSettingRoundTrip(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	userId := uniqueId(t, "user")
+	instruct := "some instruct"
+	if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{
+		GroupId:           groupId,
+		UserId:            userId,
+		SystemInstruction: instruct,
+	}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	setting, err := s.GetGroupUserSetting(ctx, groupId, userId)
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if setting.GroupId != groupId || setting.UserId != userId {
+		t.Fatalf("got different keys, got: %v/%v, expect: %v/%v\n", setting.GroupId, setting.UserId, groupId, userId)
+	}
+	if setting.SystemInstruction != instruct {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, instruct)
+	}
+}
+
+func testGroupUserSettingMissing(t *testing.T, s storage.Storage, o options) {
+	groupId := uniqueId(t, "group")
+	userId := uniqueId(t, "user")
+	if _, err := s.GetGroupUserSetting(context.TODO(), groupId, userId); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound for a missing group user, got: %v\n", err)
+	}
+}
+
+func testGroupUserSettingDelete(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	userId := uniqueId(t, "user")
+	setting := storage.GroupUserSetting{GroupId: groupId, UserId: userId}
+	if err := s.DeleteGroupUserSetting(ctx, setting); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound when deleting a missing group user, got: %v\n", err)
+	}
+	if err := s.UpsertGroupUserSetting(ctx, setting); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	if err := s.DeleteGroupUserSetting(ctx, setting); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect a conflict when deleting a stale version, got: %v\n", err)
+	}
+	setting.Version = 1
+	if err := s.DeleteGroupUserSetting(ctx, setting); err != nil {
+		t.Fatalf("failed to delete group user setting: %v\n", err)
+	}
+	if _, err := s.GetGroupUserSetting(ctx, groupId, userId); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound after delete, got: %v\n", err)
+	}
+}
+
+func testGroupUserSettingIsolation(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupA := uniqueId(t, "groupA")
+	groupB := uniqueId(t, "groupB")
+	userId := uniqueId(t, "user")
+	if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{
+		GroupId:           groupA,
+		UserId:            userId,
+		SystemInstruction: "in group a",
+	}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{
+		UserId:            userId,
+		SystemInstruction: "in user chat",
+	}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+
+	if setting, err := s.GetGroupUserSetting(ctx, groupB, userId); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("setting leaked across groups: %+v, error: %v\n", setting, err)
+	}
+	setting, err := s.GetGroupUserSetting(ctx, groupA, userId)
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "in group a" {
+		t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, "in group a")
+	}
+}
+
+func testConcurrentUpserts(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	const workers = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			userId := fmt.Sprintf("%s-user-%d", groupId, i)
+			if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{
+				GroupId:           groupId,
+				UserId:            userId,
+				SystemInstruction: userId,
+			}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := s.GetGroupUserSetting(ctx, groupId, userId); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent access failed: %v\n", err)
+	}
+
+	for i := range workers {
+		userId := fmt.Sprintf("%s-user-%d", groupId, i)
+		setting, err := s.GetGroupUserSetting(ctx, groupId, userId)
+		if err != nil {
+			t.Fatalf("failed to get group user setting: %v\n", err)
+		}
+		if setting.SystemInstruction != userId {
+			t.Fatalf("got different system instruction, got: %v, expect: %v\n", setting.SystemInstruction, userId)
+		}
+	}
+}
+
+func testUserSettingConflict(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	userId := uniqueId(t, "user")
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{
+		UserId:            userId,
+		SystemInstruction: "first",
+		Version:           3,
+	}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect a conflict for a missing setting read at a later version, got: %v\n", err)
+	}
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{
+		UserId:            userId,
+		SystemInstruction: "first",
+	}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{
+		UserId:            userId,
+		SystemInstruction: "stale",
+	}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect a conflict for a stale version, got: %v\n", err)
+	}
+	setting, err := s.GetUserSetting(ctx, userId)
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "first" || setting.Version != 1 {
+		t.Fatalf("a conflicting write changed the setting: %+v\n", setting)
+	}
+}
+
+func testGroupUserSettingConflict(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	userId := uniqueId(t, "user")
+	if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{
+		GroupId:           groupId,
+		UserId:            userId,
+		SystemInstruction: "first",
+	}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	setting, err := s.GetGroupUserSetting(ctx, groupId, userId)
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if setting.Version != 1 {
+		t.Fatalf("got different version, got: %v, expect: %v\n", setting.Version, 1)
+	}
+
+	stale := *setting
+	setting.SystemInstruction = "second"
+	if err := s.UpsertGroupUserSetting(ctx, *setting); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	stale.SystemInstruction = "lost"
+	if err := s.UpsertGroupUserSetting(ctx, stale); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect a conflict for a stale version, got: %v\n", err)
+	}
+	setting, err = s.GetGroupUserSetting(ctx, groupId, userId)
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if setting.SystemInstruction != "second" || setting.Version != 2 {
+		t.Fatalf("a conflicting write changed the setting: %+v\n", setting)
+	}
+}
+
+func testConcurrentConflicts(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	const workers = 8
+
+	var wg sync.WaitGroup
+	results := make(chan error, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{
+				GroupId:           groupId,
+				UserId:            "default",
+				SystemInstruction: fmt.Sprintf("writer %d", i),
+			})
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, storage.ErrConflict):
+			t.Fatalf("concurrent upsert failed: %v\n", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expect exactly one writer to win, got: %v\n", succeeded)
+	}
+}
+
+func testScanSettings(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	userIds := []string{uniqueId(t, "user-a"), uniqueId(t, "user-b")}
+	for _, userId := range userIds {
+		if err := s.UpsertUserSetting(ctx, storage.UserSetting{UserId: userId, SystemInstruction: userId}); err != nil {
+			t.Fatalf("failed to update user setting: %v\n", err)
+		}
+		if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: groupId, UserId: userId, SystemInstruction: userId}); err != nil {
+			t.Fatalf("failed to update group user setting: %v\n", err)
+		}
+	}
+
+	users := make(map[string]storage.UserSetting)
+	if err := s.ScanUserSettings(ctx, func(setting storage.UserSetting) error {
+		users[setting.UserId] = setting
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan user settings: %v\n", err)
+	}
+	groupUsers := make(map[string]storage.GroupUserSetting)
+	if err := s.ScanGroupUserSettings(ctx, func(setting storage.GroupUserSetting) error {
+		if setting.GroupId == groupId {
+			groupUsers[setting.UserId] = setting
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan group user settings: %v\n", err)
+	}
+	for _, userId := range userIds {
+		if users[userId].SystemInstruction != userId || users[userId].Version != 1 {
+			t.Fatalf("scan returned a different user setting: %+v\n", users[userId])
+		}
+		if groupUsers[userId].SystemInstruction != userId || groupUsers[userId].Version != 1 {
+			t.Fatalf("scan returned a different group user setting: %+v\n", groupUsers[userId])
+		}
+	}
+	if len(groupUsers) != len(userIds) {
+		t.Fatalf("got %v group user settings, expect: %v\n", len(groupUsers), len(userIds))
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	if err := s.ScanUserSettings(ctx, func(setting storage.UserSetting) error {
+		calls++
+		return stop
+	}); !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("expect the scan to stop at the first error, got: %v after %v calls\n", err, calls)
+	}
+}
+
+func testListGroupUserSettings(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	userIds := []string{uniqueId(t, "user-a"), uniqueId(t, "user-b"), uniqueId(t, "user-c")}
+	for _, userId := range userIds {
+		if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: groupId, UserId: userId, SystemInstruction: userId}); err != nil {
+			t.Fatalf("failed to update group user setting: %v\n", err)
+		}
+	}
+	// Neither another group nor a group whose id extends this one's may be
+	// listed.
+	for _, other := range []string{uniqueId(t, "other"), groupId + "-suffix"} {
+		if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: other, UserId: userIds[0], SystemInstruction: other}); err != nil {
+			t.Fatalf("failed to update group user setting: %v\n", err)
+		}
+	}
+
+	var listed []string
+	after := ""
+	for range len(userIds) + 1 {
+		settings, err := s.ListGroupUserSettings(ctx, groupId, after, 2)
+		if err != nil {
+			t.Fatalf("failed to list group user settings: %v\n", err)
+		}
+		if len(settings) == 0 {
+			break
+		}
+		for _, setting := range settings {
+			if setting.GroupId != groupId || setting.SystemInstruction != setting.UserId {
+				t.Fatalf("list returned a different group user setting: %+v\n", setting)
+			}
+			listed = append(listed, setting.UserId)
+		}
+		after = listed[len(listed)-1]
+	}
+	if !slices.Equal(listed, userIds) {
+		t.Fatalf("got users %v, expect every user once in order: %v\n", listed, userIds)
+	}
+}
+
+func testListGroupUserSettingsByUser(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	userId := uniqueId(t, "user")
+	groupIds := []string{uniqueId(t, "group-a"), uniqueId(t, "group-b")}
+	for _, groupId := range groupIds {
+		if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: groupId, UserId: userId, SystemInstruction: groupId}); err != nil {
+			t.Fatalf("failed to update group user setting: %v\n", err)
+		}
+	}
+	// Neither another user in the same group nor a user whose id extends this
+	// one's may be listed.
+	for _, other := range []string{uniqueId(t, "other"), userId + "-suffix"} {
+		if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: groupIds[0], UserId: other, SystemInstruction: other}); err != nil {
+			t.Fatalf("failed to update group user setting: %v\n", err)
+		}
+	}
+
+	settings, err := s.ListGroupUserSettingsByUser(ctx, userId)
+	if err != nil {
+		t.Fatalf("failed to list group user settings: %v\n", err)
+	}
+	found := make(map[string]storage.GroupUserSetting)
+	for _, setting := range settings {
+		if setting.UserId != userId {
+			t.Fatalf("listed a setting of another user: %+v\n", setting)
+		}
+		found[setting.GroupId] = setting
+	}
+	if len(found) != len(groupIds) || len(settings) != len(groupIds) {
+		t.Fatalf("got %v group user settings, expect: %v\n", len(settings), len(groupIds))
+	}
+	for _, groupId := range groupIds {
+		if found[groupId].SystemInstruction != groupId || found[groupId].Version != 1 {
+			t.Fatalf("list returned a different group user setting: %+v\n", found[groupId])
+		}
+	}
+
+	settings, err = s.ListGroupUserSettingsByUser(ctx, uniqueId(t, "nobody"))
+	if err != nil {
+		t.Fatalf("failed to list group user settings: %v\n", err)
+	}
+	if len(settings) != 0 {
+		t.Fatalf("expect no settings for an unknown user, got: %+v\n", settings)
+	}
+}
+
+func testSettingPersona(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	userId := uniqueId(t, "user")
+	groupId := uniqueId(t, "group")
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{UserId: userId, SystemInstruction: "instruction", Persona: "translator"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	if err := s.UpsertGroupUserSetting(ctx, storage.GroupUserSetting{GroupId: groupId, UserId: userId, Persona: "summarizer", PersonaOnly: true}); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	setting, err := s.GetUserSetting(ctx, userId)
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.Persona != "translator" || setting.SystemInstruction != "instruction" {
+		t.Fatalf("got different user setting: %+v\n", setting)
+	}
+	guSetting, err := s.GetGroupUserSetting(ctx, groupId, userId)
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if guSetting.Persona != "summarizer" || !guSetting.PersonaOnly {
+		t.Fatalf("got different group user setting: %+v\n", guSetting)
+	}
+
+	// Clearing the persona must be stored too.
+	setting.Persona = ""
+	if err := s.UpsertUserSetting(ctx, *setting); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	setting, err = s.GetUserSetting(ctx, userId)
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.Persona != "" {
+		t.Fatalf("expect the persona to be cleared, got: %v\n", setting.Persona)
+	}
+	guSetting.Persona, guSetting.PersonaOnly = "", false
+	if err := s.UpsertGroupUserSetting(ctx, *guSetting); err != nil {
+		t.Fatalf("failed to update group user setting: %v\n", err)
+	}
+	guSetting, err = s.GetGroupUserSetting(ctx, groupId, userId)
+	if err != nil {
+		t.Fatalf("failed to get group user setting: %v\n", err)
+	}
+	if guSetting.Persona != "" || guSetting.PersonaOnly {
+		t.Fatalf("expect the persona to be cleared, got: %+v\n", guSetting)
+	}
+}
+
+func testUserSettingTimezone(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	userId := uniqueId(t, "user")
+	if err := s.UpsertUserSetting(ctx, storage.UserSetting{UserId: userId, Timezone: "Asia/Tokyo"}); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	setting, err := s.GetUserSetting(ctx, userId)
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.Timezone != "Asia/Tokyo" {
+		t.Fatalf("got different timezone, got: %v, expect: %v\n", setting.Timezone, "Asia/Tokyo")
+	}
+
+	var scanned string
+	err = s.ScanUserSettings(ctx, func(setting storage.UserSetting) error {
+		if setting.UserId == userId {
+			scanned = setting.Timezone
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to scan user settings: %v\n", err)
+	}
+	if scanned != "Asia/Tokyo" {
+		t.Fatalf("got different scanned timezone, got: %v, expect: %v\n", scanned, "Asia/Tokyo")
+	}
+
+	setting.Timezone = ""
+	if err := s.UpsertUserSetting(ctx, *setting); err != nil {
+		t.Fatalf("failed to update user setting: %v\n", err)
+	}
+	setting, err = s.GetUserSetting(ctx, userId)
+	if err != nil {
+		t.Fatalf("failed to get user setting: %v\n", err)
+	}
+	if setting.Timezone != "" {
+		t.Fatalf("expect the timezone to be cleared, got: %v\n", setting.Timezone)
+	}
+}
+
+func testPersonaRoundTrip(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	scope := storage.UserScope(uniqueId(t, "user"))
+	if _, err := s.GetPersona(ctx, scope, "poet"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound for a missing persona, got: %v\n", err)
+	}
+	if err := s.UpsertPersona(ctx, storage.Persona{Scope: scope, Name: "poet", SystemInstruction: "answer in verse"}); err != nil {
+		t.Fatalf("failed to update persona: %v\n", err)
+	}
+	persona, err := s.GetPersona(ctx, scope, "poet")
+	if err != nil {
+		t.Fatalf("failed to get persona: %v\n", err)
+	}
+	if persona.Scope != scope || persona.Name != "poet" || persona.SystemInstruction != "answer in verse" || persona.Version != 1 {
+		t.Fatalf("got different persona: %+v\n", persona)
+	}
+	if _, err := s.GetPersona(ctx, storage.GroupScope(uniqueId(t, "group")), "poet"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect personas to be scoped, got: %v\n", err)
+	}
+
+	if err := s.DeletePersona(ctx, *persona); err != nil {
+		t.Fatalf("failed to delete persona: %v\n", err)
+	}
+	if _, err := s.GetPersona(ctx, scope, "poet"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound after delete, got: %v\n", err)
+	}
+	if err := s.DeletePersona(ctx, *persona); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound when deleting a missing persona, got: %v\n", err)
+	}
+}
+
+func testPersonaConflict(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	scope := storage.GroupScope(uniqueId(t, "group"))
+	if err := s.UpsertPersona(ctx, storage.Persona{Scope: scope, Name: "poet", SystemInstruction: "first"}); err != nil {
+		t.Fatalf("failed to update persona: %v\n", err)
+	}
+	if err := s.UpsertPersona(ctx, storage.Persona{Scope: scope, Name: "poet", SystemInstruction: "second"}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect ErrConflict when saving over a persona at version 0, got: %v\n", err)
+	}
+	stale := storage.Persona{Scope: scope, Name: "poet", Version: 1}
+	if err := s.UpsertPersona(ctx, storage.Persona{Scope: scope, Name: "poet", SystemInstruction: "third", Version: 1}); err != nil {
+		t.Fatalf("failed to update persona: %v\n", err)
+	}
+	if err := s.DeletePersona(ctx, stale); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect ErrConflict when deleting a changed persona, got: %v\n", err)
+	}
+	persona, err := s.GetPersona(ctx, scope, "poet")
+	if err != nil {
+		t.Fatalf("failed to get persona: %v\n", err)
+	}
+	if persona.SystemInstruction != "third" || persona.Version != 2 {
+		t.Fatalf("got different persona: %+v\n", persona)
+	}
+}
+
+func testListAndScanPersonas(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	scope := storage.UserScope(uniqueId(t, "user"))
+	other := storage.UserScope(uniqueId(t, "other"))
+	names := []string{"alpha", "beta", "gamma"}
+	for _, name := range []string{"gamma", "alpha", "beta"} {
+		if err := s.UpsertPersona(ctx, storage.Persona{Scope: scope, Name: name, SystemInstruction: name}); err != nil {
+			t.Fatalf("failed to update persona: %v\n", err)
+		}
+	}
+	if err := s.UpsertPersona(ctx, storage.Persona{Scope: other, Name: "delta"}); err != nil {
+		t.Fatalf("failed to update persona: %v\n", err)
+	}
+
+	personas, err := s.ListPersonas(ctx, scope)
+	if err != nil {
+		t.Fatalf("failed to list personas: %v\n", err)
+	}
+	if len(personas) != len(names) {
+		t.Fatalf("got %v personas, expect: %v\n", len(personas), len(names))
+	}
+	for i, persona := range personas {
+		if persona.Name != names[i] || persona.SystemInstruction != names[i] || persona.Scope != scope {
+			t.Fatalf("expect personas ordered by name, got: %+v\n", personas)
+		}
+	}
+
+	found := make(map[string]storage.Persona)
+	if err := s.ScanPersonas(ctx, func(persona storage.Persona) error {
+		if persona.Scope == scope || persona.Scope == other {
+			found[persona.Scope+"/"+persona.Name] = persona
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan personas: %v\n", err)
+	}
+	if len(found) != len(names)+1 {
+		t.Fatalf("got %v personas from the scan, expect: %v\n", len(found), len(names)+1)
+	}
+	if found[other+"/delta"].Version != 1 {
+		t.Fatalf("scan returned a different persona: %+v\n", found[other+"/delta"])
+	}
+}
+
+func testGroupRoleRoundTrip(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	userId := uniqueId(t, "user")
+	if _, err := s.GetGroupRole(ctx, groupId, userId); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound for a missing role, got: %v\n", err)
+	}
+	if err := s.UpsertGroupRole(ctx, storage.GroupRole{GroupId: groupId, UserId: userId, Role: storage.RoleAdmin}); err != nil {
+		t.Fatalf("failed to update group role: %v\n", err)
+	}
+	if err := s.UpsertGroupRole(ctx, storage.GroupRole{GroupId: groupId, UserId: userId, Role: storage.RoleOwner}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect ErrConflict when saving over a role at version 0, got: %v\n", err)
+	}
+	role, err := s.GetGroupRole(ctx, groupId, userId)
+	if err != nil {
+		t.Fatalf("failed to get group role: %v\n", err)
+	}
+	if role.Role != storage.RoleAdmin || role.Version != 1 {
+		t.Fatalf("got different group role: %+v\n", role)
+	}
+
+	role.Role = storage.RoleOwner
+	if err := s.UpsertGroupRole(ctx, *role); err != nil {
+		t.Fatalf("failed to update group role: %v\n", err)
+	}
+	if err := s.DeleteGroupRole(ctx, *role); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect ErrConflict when deleting a changed role, got: %v\n", err)
+	}
+	role.Version++
+	if err := s.DeleteGroupRole(ctx, *role); err != nil {
+		t.Fatalf("failed to delete group role: %v\n", err)
+	}
+	if err := s.DeleteGroupRole(ctx, *role); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound when deleting a missing role, got: %v\n", err)
+	}
+}
+
+func testListAndScanGroupRoles(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	groupId := uniqueId(t, "group")
+	other := uniqueId(t, "other")
+	userIds := []string{groupId + "-a", groupId + "-b", groupId + "-c"}
+	for _, userId := range []string{userIds[2], userIds[0], userIds[1]} {
+		if err := s.UpsertGroupRole(ctx, storage.GroupRole{GroupId: groupId, UserId: userId, Role: storage.RoleAdmin}); err != nil {
+			t.Fatalf("failed to update group role: %v\n", err)
+		}
+	}
+	if err := s.UpsertGroupRole(ctx, storage.GroupRole{GroupId: other, UserId: userIds[0], Role: storage.RoleOwner}); err != nil {
+		t.Fatalf("failed to update group role: %v\n", err)
+	}
+
+	roles, err := s.ListGroupRoles(ctx, groupId)
+	if err != nil {
+		t.Fatalf("failed to list group roles: %v\n", err)
+	}
+	if len(roles) != len(userIds) {
+		t.Fatalf("got %v roles, expect: %v\n", len(roles), len(userIds))
+	}
+	for i, role := range roles {
+		if role.UserId != userIds[i] || role.GroupId != groupId || role.Role != storage.RoleAdmin {
+			t.Fatalf("expect roles ordered by user id, got: %+v\n", roles)
+		}
+	}
+
+	found := make(map[string]storage.GroupRole)
+	if err := s.ScanGroupRoles(ctx, func(role storage.GroupRole) error {
+		if role.GroupId == groupId || role.GroupId == other {
+			found[role.GroupId+"/"+role.UserId] = role
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan group roles: %v\n", err)
+	}
+	if len(found) != len(userIds)+1 {
+		t.Fatalf("got %v roles from the scan, expect: %v\n", len(found), len(userIds)+1)
+	}
+	if found[other+"/"+userIds[0]].Role != storage.RoleOwner {
+		t.Fatalf("scan returned a different role: %+v\n", found[other+"/"+userIds[0]])
+	}
+}
+
+func testBotSettingRoundTrip(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	key := uniqueId(t, "setting")
+	if _, err := s.GetBotSetting(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound for a missing bot setting, got: %v\n", err)
+	}
+	if err := s.UpsertBotSetting(ctx, storage.BotSetting{Key: key, Value: "one"}); err != nil {
+		t.Fatalf("failed to update bot setting: %v\n", err)
+	}
+	if err := s.UpsertBotSetting(ctx, storage.BotSetting{Key: key, Value: "two"}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect ErrConflict when saving over a bot setting at version 0, got: %v\n", err)
+	}
+	setting, err := s.GetBotSetting(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get bot setting: %v\n", err)
+	}
+	if setting.Value != "one" || setting.Version != 1 {
+		t.Fatalf("got different bot setting: %+v\n", setting)
+	}
+
+	var scanned *storage.BotSetting
+	if err := s.ScanBotSettings(ctx, func(setting storage.BotSetting) error {
+		if setting.Key == key {
+			scanned = &setting
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan bot settings: %v\n", err)
+	}
+	if scanned == nil || scanned.Value != "one" {
+		t.Fatalf("scan returned a different bot setting: %+v\n", scanned)
+	}
+
+	if err := s.DeleteBotSetting(ctx, *setting); err != nil {
+		t.Fatalf("failed to delete bot setting: %v\n", err)
+	}
+	if err := s.DeleteBotSetting(ctx, *setting); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound when deleting a missing bot setting, got: %v\n", err)
+	}
+}
+
+func testBlockRoundTrip(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	id := uniqueId(t, "group")
+	createdAt := time.Now().UTC().Truncate(time.Millisecond)
+	if _, err := s.GetBlock(ctx, id); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound for a missing block, got: %v\n", err)
+	}
+	if err := s.UpsertBlock(ctx, storage.Block{Id: id, Reason: "spam", CreatedBy: "operator", CreatedAt: createdAt}); err != nil {
+		t.Fatalf("failed to update block: %v\n", err)
+	}
+	block, err := s.GetBlock(ctx, id)
+	if err != nil {
+		t.Fatalf("failed to get block: %v\n", err)
+	}
+	if block.Reason != "spam" || block.CreatedBy != "operator" || !block.CreatedAt.Equal(createdAt) || !block.ExpiresAt.IsZero() || block.Version != 1 {
+		t.Fatalf("got different block: %+v\n", block)
+	}
+
+	// An expiry is added to an existing block and read back.
+	expiresAt := createdAt.Add(time.Hour)
+	block.Reason, block.ExpiresAt = "abuse", expiresAt
+	if err := s.UpsertBlock(ctx, *block); err != nil {
+		t.Fatalf("failed to update block: %v\n", err)
+	}
+	var scanned *storage.Block
+	if err := s.ScanBlocks(ctx, func(block storage.Block) error {
+		if block.Id == id {
+			scanned = &block
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan blocks: %v\n", err)
+	}
+	if scanned == nil || scanned.Reason != "abuse" || !scanned.ExpiresAt.Equal(expiresAt) || scanned.Version != 2 {
+		t.Fatalf("scan returned a different block: %+v\n", scanned)
+	}
+
+	if err := s.DeleteBlock(ctx, *block); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect ErrConflict when deleting a changed block, got: %v\n", err)
+	}
+	if err := s.DeleteBlock(ctx, *scanned); err != nil {
+		t.Fatalf("failed to delete block: %v\n", err)
+	}
+	if _, err := s.GetBlock(ctx, id); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expect ErrNotFound for a deleted block, got: %v\n", err)
+	}
+}
+
+func testAuditLog(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	scope := storage.GroupScope(uniqueId(t, "group"))
+	start := time.Now().UTC().Truncate(time.Millisecond)
+	for i, value := range []string{"one", "two", "three"} {
+		entry := storage.AuditEntry{
+			Scope:    scope,
+			Time:     start.Add(time.Duration(i) * time.Second),
+			Actor:    "user",
+			Action:   "set default instruction",
+			OldHash:  storage.HashValue("previous"),
+			NewValue: value,
+		}
+		if err := s.AppendAudit(ctx, entry); err != nil {
+			t.Fatalf("failed to append audit entry: %v\n", err)
+		}
+	}
+	// Another scope is not listed.
+	if err := s.AppendAudit(ctx, storage.AuditEntry{Scope: scope + "-other", Time: start, Action: "set instruction"}); err != nil {
+		t.Fatalf("failed to append audit entry: %v\n", err)
+	}
+
+	entries, err := s.ListAudit(ctx, scope, time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v\n", err)
+	}
+	if len(entries) != 2 || entries[0].NewValue != "three" || entries[1].NewValue != "two" {
+		t.Fatalf("expect the two newest entries first, got: %+v\n", entries)
+	}
+	if entries[0].Actor != "user" || entries[0].Action != "set default instruction" || entries[0].OldHash != storage.HashValue("previous") ||
+		!entries[0].Time.Equal(start.Add(2*time.Second)) {
+		t.Fatalf("got different audit entry: %+v\n", entries[0])
+	}
+	entries, err = s.ListAudit(ctx, scope, entries[1].Time, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v\n", err)
+	}
+	if len(entries) != 1 || entries[0].NewValue != "one" {
+		t.Fatalf("expect the entry before the second newest, got: %+v\n", entries)
+	}
+
+	// Entries of the same millisecond are paged without being skipped.
+	tied := storage.GroupScope(uniqueId(t, "tied"))
+	for i, value := range []string{"one", "two", "three"} {
+		if err := s.AppendAudit(ctx, storage.AuditEntry{Scope: tied, Time: start.Add(time.Duration(i) * time.Microsecond), Action: "set instruction", NewValue: value}); err != nil {
+			t.Fatalf("failed to append audit entry: %v\n", err)
+		}
+	}
+	var paged []string
+	for before := (time.Time{}); len(paged) <= 3; {
+		entries, err := s.ListAudit(ctx, tied, before, 1)
+		if err != nil {
+			t.Fatalf("failed to list audit entries: %v\n", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		paged = append(paged, entries[0].NewValue)
+		before = entries[0].Time
+	}
+	if !slices.Equal(paged, []string{"three", "two", "one"}) {
+		t.Fatalf("expect every entry of the same millisecond newest first, got: %v\n", paged)
+	}
+
+	var scanned []storage.AuditEntry
+	if err := s.ScanAudit(ctx, func(entryScope string, entries []storage.AuditEntry) error {
+		if entryScope == scope {
+			scanned = entries
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan audit entries: %v\n", err)
+	}
+	if len(scanned) != 3 || scanned[0].NewValue != "one" || scanned[2].NewValue != "three" || scanned[2].Scope != scope {
+		t.Fatalf("expect the three entries oldest first, got: %+v\n", scanned)
+	}
+
+	actor := uniqueId(t, "actor")
+	if err := s.AppendAudit(ctx, storage.AuditEntry{Scope: scope, Time: start.Add(3 * time.Second), Actor: actor, Action: "set instruction", OldHash: storage.HashValue("one"), NewValue: "secret"}); err != nil {
+		t.Fatalf("failed to append audit entry: %v\n", err)
+	}
+	if err := s.RedactAudit(ctx, actor); err != nil {
+		t.Fatalf("failed to redact audit entries: %v\n", err)
+	}
+	entries, err = s.ListAudit(ctx, scope, time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v\n", err)
+	}
+	if len(entries) != 2 || entries[0].Actor != "" || entries[0].OldHash != "" || entries[0].NewValue != "" ||
+		entries[0].Action != "set instruction" || !entries[0].Time.Equal(start.Add(3*time.Second)) || entries[1].NewValue != "three" {
+		t.Fatalf("expect only the entry of the actor to be redacted, got: %+v\n", entries)
+	}
+
+	if err := s.DeleteAudit(ctx, scope); err != nil {
+		t.Fatalf("failed to delete audit entries: %v\n", err)
+	}
+	if entries, err := s.ListAudit(ctx, scope, time.Time{}, 10); err != nil || len(entries) != 0 {
+		t.Fatalf("expect no entries after deleting the scope, got: %+v, %v\n", entries, err)
+	}
+	if entries, err := s.ListAudit(ctx, scope+"-other", time.Time{}, 10); err != nil || len(entries) != 1 {
+		t.Fatalf("expect the other scope to be kept, got: %+v, %v\n", entries, err)
+	}
+}
+
+func testRewriteAudit(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	scope := storage.UserScope(uniqueId(t, "audit"))
+	actor := uniqueId(t, "actor")
+	start := time.Now().UTC().Truncate(time.Millisecond)
+	for i, value := range []string{"one", "two"} {
+		if err := s.AppendAudit(ctx, storage.AuditEntry{Scope: scope, Time: start.Add(time.Duration(i) * time.Second), Actor: actor, Action: "set instruction", OldHash: storage.HashValue("old"), NewValue: value}); err != nil {
+			t.Fatalf("failed to append audit entry: %v\n", err)
+		}
+	}
+
+	// Entries of other tests are rewritten too, so only those of scope change.
+	if err := s.RewriteAudit(ctx, func(entry storage.AuditEntry) (string, error) {
+		if entry.Scope != scope {
+			return entry.NewValue, nil
+		}
+		return "new " + entry.NewValue, nil
+	}); err != nil {
+		t.Fatalf("failed to rewrite audit entries: %v\n", err)
+	}
+	entries, err := s.ListAudit(ctx, scope, time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v\n", err)
+	}
+	if len(entries) != 2 || entries[0].NewValue != "new two" || entries[1].NewValue != "new one" {
+		t.Fatalf("expect both values rewritten newest first, got: %+v\n", entries)
+	}
+	if entries[0].Actor != actor || entries[0].Action != "set instruction" || entries[0].OldHash != storage.HashValue("old") ||
+		!entries[0].Time.Equal(start.Add(time.Second)) {
+		t.Fatalf("expect the rest of the entry to be kept, got: %+v\n", entries[0])
+	}
+
+	// An entry redacted while being rewritten stays redacted.
+	if err := s.RewriteAudit(ctx, func(entry storage.AuditEntry) (string, error) {
+		if entry.Scope != scope {
+			return entry.NewValue, nil
+		}
+		if err := s.RedactAudit(ctx, actor); err != nil {
+			return "", err
+		}
+		return "leaked", nil
+	}); err != nil {
+		t.Fatalf("failed to rewrite audit entries: %v\n", err)
+	}
+	entries, err = s.ListAudit(ctx, scope, time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v\n", err)
+	}
+	for _, entry := range entries {
+		if entry.Actor != "" || entry.NewValue != "" {
+			t.Fatalf("expect redacted entries to stay redacted, got: %+v\n", entries)
+		}
+	}
+}
+
+func testHistoryAppendAndTrim(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	key := uniqueId(t, "history")
+	history, err := s.GetHistory(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get history: %v\n", err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("expect an empty history for a missing key, got: %+v\n", history)
+	}
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err := s.AppendHistory(ctx, key, storage.HistoryMessage{
+			Role: storage.HistoryRoleUser,
+			Text: text,
+		}, 2, time.Minute); err != nil {
+			t.Fatalf("failed to append history: %v\n", err)
+		}
+	}
+	history, err = s.GetHistory(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get history: %v\n", err)
+	}
+	if len(history) != 2 || history[0].Text != "two" || history[1].Text != "three" {
+		t.Fatalf("expect the last two messages in order, got: %+v\n", history)
+	}
+	if history[0].Role != storage.HistoryRoleUser {
+		t.Fatalf("got different role, got: %v, expect: %v\n", history[0].Role, storage.HistoryRoleUser)
+	}
+}
+
+func testHistoryExpires(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	key := uniqueId(t, "history")
+	if err := s.AppendHistory(ctx, key, storage.HistoryMessage{
+		Role: storage.HistoryRoleUser,
+		Text: "soon gone",
+	}, 10, time.Second); err != nil {
+		t.Fatalf("failed to append history: %v\n", err)
+	}
+	o.advance(2 * time.Second)
+	history, err := s.GetHistory(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get history: %v\n", err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("expect history to expire, got: %+v\n", history)
+	}
+}
+
+func testScanAndDeleteHistory(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	prefix := uniqueId(t, "history") + ":"
+	keys := []string{prefix + "a", prefix + "b*[x]"}
+	for _, key := range append(keys, uniqueId(t, "other")) {
+		if err := s.AppendHistory(ctx, key, storage.HistoryMessage{Role: storage.HistoryRoleUser, Text: key}, 10, time.Minute); err != nil {
+			t.Fatalf("failed to append history: %v\n", err)
+		}
+	}
+	if _, err := s.IncrCounter(ctx, prefix+"counter", 1, time.Minute); err != nil {
+		t.Fatalf("failed to increase counter: %v\n", err)
+	}
+
+	found := make(map[string][]storage.HistoryMessage)
+	if err := s.ScanHistory(ctx, prefix, func(key string, history []storage.HistoryMessage) error {
+		found[key] = history
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan history: %v\n", err)
+	}
+	if len(found) != len(keys) {
+		t.Fatalf("got %v histories, expect: %v\n", len(found), len(keys))
+	}
+	for _, key := range keys {
+		if len(found[key]) != 1 || found[key][0].Text != key {
+			t.Fatalf("scan returned a different history for %v: %+v\n", key, found[key])
+		}
+	}
+
+	if err := s.DeleteHistory(ctx, keys[0]); err != nil {
+		t.Fatalf("failed to delete history: %v\n", err)
+	}
+	history, err := s.GetHistory(ctx, keys[0])
+	if err != nil {
+		t.Fatalf("failed to get history: %v\n", err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("expect a deleted history to be empty, got: %+v\n", history)
+	}
+	if err := s.DeleteHistory(ctx, keys[0]); err != nil {
+		t.Fatalf("expect deleting a missing history to succeed, got: %v\n", err)
+	}
+}
+
+func testRewriteHistory(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	key := uniqueId(t, "history")
+	if err := s.RewriteHistory(ctx, key, func(history []storage.HistoryMessage) ([]storage.HistoryMessage, error) {
+		t.Fatal("expect no rewrite of a missing history")
+		return history, nil
+	}); err != nil {
+		t.Fatalf("failed to rewrite history: %v\n", err)
+	}
+
+	for _, text := range []string{"one", "two"} {
+		if err := s.AppendHistory(ctx, key, storage.HistoryMessage{Role: storage.HistoryRoleUser, Text: text}, 10, 2*time.Second); err != nil {
+			t.Fatalf("failed to append history: %v\n", err)
+		}
+	}
+	if err := s.RewriteHistory(ctx, key, func(history []storage.HistoryMessage) ([]storage.HistoryMessage, error) {
+		for i := range history {
+			history[i].Text = "new " + history[i].Text
+		}
+		return history, nil
+	}); err != nil {
+		t.Fatalf("failed to rewrite history: %v\n", err)
+	}
+	history, err := s.GetHistory(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get history: %v\n", err)
+	}
+	if len(history) != 2 || history[0].Text != "new one" || history[1].Text != "new two" || history[0].Role != storage.HistoryRoleUser {
+		t.Fatalf("expect both messages rewritten in order, got: %+v\n", history)
+	}
+
+	err = s.RewriteHistory(ctx, key, func(history []storage.HistoryMessage) ([]storage.HistoryMessage, error) {
+		if err := s.AppendHistory(ctx, key, storage.HistoryMessage{Role: storage.HistoryRoleModel, Text: "three"}, 10, 2*time.Second); err != nil {
+			return nil, err
+		}
+		return history, nil
+	})
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("expect a conflict when a message was appended meanwhile, got: %v\n", err)
+	}
+	if history, err := s.GetHistory(ctx, key); err != nil || len(history) != 3 {
+		t.Fatalf("expect the appended message to be kept, got: %+v, %v\n", history, err)
+	}
+
+	// A rewrite keeps the expiry rather than restarting it.
+	o.advance(time.Second)
+	if err := s.RewriteHistory(ctx, key, func(history []storage.HistoryMessage) ([]storage.HistoryMessage, error) {
+		return history, nil
+	}); err != nil {
+		t.Fatalf("failed to rewrite history: %v\n", err)
+	}
+	o.advance(2 * time.Second)
+	if history, err := s.GetHistory(ctx, key); err != nil || len(history) != 0 {
+		t.Fatalf("expect the rewritten history to expire, got: %+v, %v\n", history, err)
+	}
+}
+
+func testCounter(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	key := uniqueId(t, "counter")
+	value, err := s.GetCounter(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get counter: %v\n", err)
+	}
+	if value != 0 {
+		t.Fatalf("expect a missing counter to be 0, got: %v\n", value)
+	}
+	for i, delta := range []int64{1, 2} {
+		value, err = s.IncrCounter(ctx, key, delta, time.Minute)
+		if err != nil {
+			t.Fatalf("failed to increase counter: %v\n", err)
+		}
+		if expect := []int64{1, 3}[i]; value != expect {
+			t.Fatalf("got different counter value, got: %v, expect: %v\n", value, expect)
+		}
+	}
+	value, err = s.GetCounter(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get counter: %v\n", err)
+	}
+	if value != 3 {
+		t.Fatalf("got different counter value, got: %v, expect: %v\n", value, 3)
+	}
+}
+
+func testCounterExpires(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	key := uniqueId(t, "counter")
+	if _, err := s.IncrCounter(ctx, key, 5, time.Second); err != nil {
+		t.Fatalf("failed to increase counter: %v\n", err)
+	}
+	o.advance(2 * time.Second)
+	value, err := s.GetCounter(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get counter: %v\n", err)
+	}
+	if value != 0 {
+		t.Fatalf("expect counter to expire, got: %v\n", value)
+	}
+	value, err = s.IncrCounter(ctx, key, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to increase counter: %v\n", err)
+	}
+	if value != 1 {
+		t.Fatalf("expect a new window to start from 0, got: %v\n", value)
+	}
+}
+
+func testScanAndDeleteCounters(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	prefix := uniqueId(t, "counter") + ":"
+	counters := map[string]int64{prefix + "a": 1, prefix + "b": 2}
+	for key, value := range counters {
+		if _, err := s.IncrCounter(ctx, key, value, time.Minute); err != nil {
+			t.Fatalf("failed to increase counter: %v\n", err)
+		}
+	}
+	if _, err := s.IncrCounter(ctx, uniqueId(t, "other"), 1, time.Minute); err != nil {
+		t.Fatalf("failed to increase counter: %v\n", err)
+	}
+	if err := s.AppendHistory(ctx, prefix+"history", storage.HistoryMessage{Role: storage.HistoryRoleUser, Text: "text"}, 10, time.Minute); err != nil {
+		t.Fatalf("failed to append history: %v\n", err)
+	}
+
+	found := make(map[string]int64)
+	if err := s.ScanCounters(ctx, prefix, func(key string, value int64) error {
+		found[key] = value
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to scan counters: %v\n", err)
+	}
+	if len(found) != len(counters) {
+		t.Fatalf("got %v counters, expect: %v\n", len(found), len(counters))
+	}
+	for key, value := range counters {
+		if found[key] != value {
+			t.Fatalf("got different counter value for %v, got: %v, expect: %v\n", key, found[key], value)
+		}
+	}
+
+	if err := s.DeleteCounter(ctx, prefix+"a"); err != nil {
+		t.Fatalf("failed to delete counter: %v\n", err)
+	}
+	value, err := s.GetCounter(ctx, prefix+"a")
+	if err != nil {
+		t.Fatalf("failed to get counter: %v\n", err)
+	}
+	if value != 0 {
+		t.Fatalf("expect a deleted counter to be 0, got: %v\n", value)
+	}
+}
+
+func testMarkProcessed(t *testing.T, s storage.Storage, o options) {
+	ctx := context.TODO()
+	key := uniqueId(t, "event")
+	for i, expect := range []bool{true, false} {
+		first, err := s.MarkProcessed(ctx, key, time.Second)
+		if err != nil {
+			t.Fatalf("failed to mark processed: %v\n", err)
+		}
+		if first != expect {
+			t.Fatalf("got different result on call %d, got: %v, expect: %v\n", i+1, first, expect)
+		}
+	}
+	o.advance(2 * time.Second)
+	first, err := s.MarkProcessed(ctx, key, time.Second)
+	if err != nil {
+		t.Fatalf("failed to mark processed: %v\n", err)
+	}
+	if !first {
+		t.Fatal("expect the mark to expire")
+	}
+
+	if err := s.UnmarkProcessed(ctx, key); err != nil {
+		t.Fatalf("failed to unmark processed: %v\n", err)
+	}
+	first, err = s.MarkProcessed(ctx, key, time.Second)
+	if err != nil {
+		t.Fatalf("failed to mark processed: %v\n", err)
+	}
+	if !first {
+		t.Fatal("expect an unmarked key to be marked again")
+	}
+}
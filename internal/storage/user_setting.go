@@ -6,8 +6,16 @@ import (
 )
 
 type UserSetting struct {
-	UserId            string `dynamodbav:"UserId"`
-	SystemInstruction string `dynamodbav:"SystemInstruction"`
+	UserId            string `dynamodbav:"UserId" json:"user_id"`
+	SystemInstruction string `dynamodbav:"SystemInstruction" json:"system_instruction"`
+	// Persona names the persona in use, which takes precedence over
+	// SystemInstruction. Empty when none is.
+	Persona string `dynamodbav:"Persona,omitempty" json:"persona,omitempty"`
+	// Timezone is the IANA time zone of the user, used by instruction
+	// templates. Empty means the bot default.
+	Timezone string `dynamodbav:"Timezone,omitempty" json:"timezone,omitempty"`
+	// Version is the version this setting was read at, see Storage.
+	Version int64 `dynamodbav:"Version" json:"version"`
 }
 
 func (setting UserSetting) GetKey() map[string]types.AttributeValue {
@@ -0,0 +1,114 @@
+// Package storagedriver opens the storage.Storage implementation selected by
+// configuration, shared by every entrypoint.
+package storagedriver
+
+import (
+	"context"
+	"fmt"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/vgjm/linebot/internal/cachestore"
+	"github.com/vgjm/linebot/internal/config"
+	"github.com/vgjm/linebot/internal/dynamodriver"
+	"github.com/vgjm/linebot/internal/encstore"
+	"github.com/vgjm/linebot/internal/memstore"
+	"github.com/vgjm/linebot/internal/postgresdriver"
+	"github.com/vgjm/linebot/internal/redisdriver"
+	"github.com/vgjm/linebot/internal/sqlitedriver"
+	"github.com/vgjm/linebot/internal/storage"
+	"github.com/vgjm/linebot/pkg/metrics"
+)
+
+// Open returns the configured driver. Drivers holding connections also
+// implement io.Closer.
+func Open(ctx context.Context, cfg config.StorageConfig) (storage.Storage, error) {
+	switch cfg.Driver {
+	case config.StorageDynamoDB:
+		return OpenDynamoDB(ctx, cfg)
+	case config.StorageSQLite:
+		return sqlitedriver.New(ctx, sqlitedriver.Config{
+			Path: cfg.SQLite.Path,
+		})
+	case config.StoragePostgres:
+		return postgresdriver.New(ctx, postgresdriver.Config{
+			DSN:             cfg.Postgres.DSN,
+			MaxOpenConns:    cfg.Postgres.MaxOpenConns,
+			MaxIdleConns:    cfg.Postgres.MaxIdleConns,
+			ConnMaxLifetime: cfg.Postgres.ConnMaxLifetime,
+		})
+	case config.StorageRedis:
+		return redisdriver.New(ctx, redisdriver.Config{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+			Prefix:   cfg.Redis.Prefix,
+		})
+	case config.StorageMemory:
+		return memstore.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported storage driver %q", cfg.Driver)
+}
+
+func OpenDynamoDB(ctx context.Context, cfg config.StorageConfig) (*dynamodriver.DynamoDriver, error) {
+	return dynamodriver.New(ctx, dynamodriver.Config{
+		EndPoint:          cfg.DynamoDB.EndPoint,
+		TablePrefix:       cfg.DynamoDB.TablePrefix,
+		OnDemand:          cfg.DynamoDB.BillingMode == config.BillingOnDemand,
+		ReadCapacity:      int64(cfg.DynamoDB.ReadCapacity),
+		WriteCapacity:     int64(cfg.DynamoDB.WriteCapacity),
+		SkipTableCreation: cfg.DynamoDB.SkipTableCreation,
+		EnableTTL:         cfg.DynamoDB.EnableTTL,
+	})
+}
+
+// OpenKeyProvider returns the configured key provider, or nil when encryption
+// is disabled.
+func OpenKeyProvider(ctx context.Context, cfg config.EncryptionConfig) (encstore.KeyProvider, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case config.EncryptionLocal:
+		return encstore.NewLocalKeyProvider(cfg.KeyFile)
+	case config.EncryptionKMS:
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return encstore.NewKMSProvider(kms.NewFromConfig(awsCfg), cfg.KMSKeyId), nil
+	}
+	return nil, fmt.Errorf("unsupported key provider %q", cfg.Provider)
+}
+
+// Encrypt wraps s with encstore when encryption is configured.
+func Encrypt(ctx context.Context, s storage.Storage, cfg config.EncryptionConfig) (storage.Storage, error) {
+	keys, err := OpenKeyProvider(ctx, cfg)
+	if err != nil || keys == nil {
+		return s, err
+	}
+	return encstore.New(s, keys), nil
+}
+
+// Cache wraps s in the settings cache unless both TTLs are zero, exporting
+// its hits and misses as metrics.
+func Cache(s storage.Storage, cfg config.CacheConfig) storage.Storage {
+	if cfg.TTL <= 0 && cfg.NegativeTTL <= 0 {
+		return s
+	}
+	cache := cachestore.New(s, cachestore.Config{
+		TTL:         cfg.TTL,
+		NegativeTTL: cfg.NegativeTTL,
+	})
+	metrics.RegisterCache(func() (uint64, uint64) {
+		stats := cache.Stats()
+		return stats.Hits, stats.Misses
+	})
+	return cache
+}
+
+// Ping checks that s can be read, for readiness probes. Reading a counter that
+// does not exist is the cheapest request every driver serves.
+func Ping(ctx context.Context, s storage.Storage) error {
+	_, err := s.GetCounter(ctx, "health:ping")
+	return err
+}
@@ -3,19 +3,33 @@ package gemini
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"slices"
+	"time"
 
 	"github.com/vgjm/linebot/pkg/llm"
+	"github.com/vgjm/linebot/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/genai"
 )
 
 var _ llm.LLM = (*Gemini)(nil)
 
+// provider labels the metrics and spans of Gemini calls.
+const provider = "gemini"
+
+var tracer = otel.Tracer("github.com/vgjm/linebot/pkg/gemini")
+
 var DefaultModels = []string{"gemini-2.5-flash", "gemini-2.5-flash-lite", "gemini-2.0-flash-lite"}
 
 type Gemini struct {
-	ctx    context.Context
-	client *genai.Client
-	models []string
+	ctx       context.Context
+	client    *genai.Client
+	transport *http.Transport
+	models    []string
 }
 
 func New(ctx context.Context, apiKey string, model string) (*Gemini, error) {
@@ -23,21 +37,26 @@ func New(ctx context.Context, apiKey string, model string) (*Gemini, error) {
 	if model != "" {
 		models = append([]string{model}, models...)
 	}
+	// The client gets a transport of its own, so that Close can drop its
+	// connections without touching those of other clients.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
 	client, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey: apiKey,
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Transport: transport},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gemini client: %w", err)
 	}
 
 	return &Gemini{
-		ctx:    ctx,
-		client: client,
-		models: models,
+		ctx:       ctx,
+		client:    client,
+		transport: transport,
+		models:    models,
 	}, nil
 }
 
-func (g *Gemini) GenerateContent(ctx context.Context, instruction, question string) (string, error) {
+func (g *Gemini) GenerateContent(ctx context.Context, instruction string, history []llm.Message, question string) (string, error) {
 	config := &genai.GenerateContentConfig{
 		// Set all harm block to none
 		// https://ai.google.dev/docs/safety_setting_gemini?hl=zh-cn#safety-settings
@@ -69,13 +88,41 @@ func (g *Gemini) GenerateContent(ctx context.Context, instruction, question stri
 		}
 	}
 
+	contents := make([]*genai.Content, 0, len(history)+1)
+	for _, m := range history {
+		role := genai.Role(genai.RoleUser)
+		if m.Role == llm.RoleModel {
+			role = genai.RoleModel
+		}
+		contents = append(contents, genai.NewContentFromText(m.Text, role))
+	}
+	contents = append(contents, genai.NewContentFromText(question, genai.RoleUser))
+
+	models := g.models
+	if model := llm.ModelFromContext(ctx); model != "" {
+		models = append([]string{model}, slices.DeleteFunc(slices.Clone(models), func(m string) bool { return m == model })...)
+	}
+
 	var resp *genai.GenerateContentResponse
 	var err error
-	for _, m := range g.models {
-		resp, err = g.client.Models.GenerateContent(ctx, m, genai.Text(question), config)
+	for i, m := range models {
+		// Each attempt gets a span of its own, in the order models are tried.
+		attemptCtx, span := tracer.Start(ctx, "gemini.GenerateContent", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			attribute.String("gen_ai.system", provider),
+			attribute.String("gen_ai.request.model", m),
+			attribute.Int("linebot.llm.attempt", i),
+		))
+		start := time.Now()
+		resp, err = g.client.Models.GenerateContent(attemptCtx, m, contents, config)
+		metrics.LLMDuration.WithLabelValues(provider, m).Observe(time.Since(start).Seconds())
 		if err != nil {
+			metrics.LLMRequests.WithLabelValues(provider, m, metrics.OutcomeError).Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
 			continue
 		}
+		metrics.LLMRequests.WithLabelValues(provider, m, metrics.OutcomeOK).Inc()
 
 		var text string
 		for _, cand := range resp.Candidates {
@@ -85,6 +132,20 @@ func (g *Gemini) GenerateContent(ctx context.Context, instruction, question stri
 				}
 			}
 		}
+		if resp.UsageMetadata != nil {
+			metrics.LLMTokens.WithLabelValues(provider, m, "input").Add(float64(resp.UsageMetadata.PromptTokenCount))
+			metrics.LLMTokens.WithLabelValues(provider, m, "output").Add(float64(resp.UsageMetadata.CandidatesTokenCount))
+			llm.ReportUsage(ctx, llm.Usage{
+				Model:        m,
+				InputTokens:  int64(resp.UsageMetadata.PromptTokenCount),
+				OutputTokens: int64(resp.UsageMetadata.CandidatesTokenCount),
+			})
+			span.SetAttributes(
+				attribute.Int("gen_ai.usage.input_tokens", int(resp.UsageMetadata.PromptTokenCount)),
+				attribute.Int("gen_ai.usage.output_tokens", int(resp.UsageMetadata.CandidatesTokenCount)),
+			)
+		}
+		span.End()
 
 		return text, nil
 	}
@@ -92,6 +153,18 @@ func (g *Gemini) GenerateContent(ctx context.Context, instruction, question stri
 	return "", err
 }
 
+// Ping looks up the first model, which needs a valid API key but costs no
+// tokens.
+func (g *Gemini) Ping(ctx context.Context) error {
+	if _, err := g.client.Models.Get(ctx, g.models[0], nil); err != nil {
+		return fmt.Errorf("failed to get gemini model: %w", err)
+	}
+	return nil
+}
+
+// Close closes the idle connections to the Gemini API. Calls in progress are
+// left to finish.
 func (g *Gemini) Close() error {
+	g.transport.CloseIdleConnections()
 	return nil
 }
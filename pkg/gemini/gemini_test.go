@@ -15,7 +15,7 @@ func TestGenerateContent(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to create client: %v", err)
 	}
-	if _, err := g.GenerateContent(ctx, "You are an assistant", "Hello"); err != nil {
+	if _, err := g.GenerateContent(ctx, "You are an assistant", nil, "Hello"); err != nil {
 		t.Errorf("failed to generate response: %v", err)
 	}
 }
@@ -0,0 +1,172 @@
+// Package health serves the probes of container orchestrators: /healthz tells
+// the process is alive, /readyz that its dependencies are reachable and
+// /version what build is running.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheTTL = 10 * time.Second
+	DefaultTimeout  = 5 * time.Second
+)
+
+// Check returns an error when a dependency cannot be used.
+type Check func(ctx context.Context) error
+
+type Config struct {
+	// Checks are run by /readyz, by name.
+	Checks map[string]Check
+	// CacheTTL is how long the results of the checks are reused, so that
+	// frequent probes do not load the dependencies. DefaultCacheTTL when zero.
+	CacheTTL time.Duration
+	// Timeout bounds each check, DefaultTimeout when zero.
+	Timeout time.Duration
+}
+
+type Health struct {
+	checks   map[string]Check
+	cacheTTL time.Duration
+	timeout  time.Duration
+
+	mu        sync.Mutex
+	results   map[string]string
+	ready     bool
+	checkedAt time.Time
+}
+
+// readiness is the body of /readyz. Checks holds "ok" or "unavailable" for
+// each check; errors are only logged, as probes may come from anywhere.
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Version is the body of /version.
+type Version struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func New(cfg *Config) *Health {
+	h := &Health{
+		checks:   cfg.Checks,
+		cacheTTL: cfg.CacheTTL,
+		timeout:  cfg.Timeout,
+	}
+	if h.cacheTTL == 0 {
+		h.cacheTTL = DefaultCacheTTL
+	}
+	if h.timeout == 0 {
+		h.timeout = DefaultTimeout
+	}
+	return h
+}
+
+// Register serves /healthz, /readyz and /version on mux.
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", h.Healthz)
+	mux.HandleFunc("GET /readyz", h.Readyz)
+	mux.HandleFunc("GET /version", h.Version)
+}
+
+// Healthz answers as long as the process serves requests.
+func (h *Health) Healthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz answers 200 when every check passes and 503 otherwise.
+func (h *Health) Readyz(w http.ResponseWriter, req *http.Request) {
+	results, ready := h.run(req.Context())
+	body := readiness{Status: "ok", Checks: results}
+	status := http.StatusOK
+	if !ready {
+		body.Status, status = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, body)
+}
+
+// run runs the checks concurrently, or returns the results of the last run
+// while they are fresh. Probes arriving during a run wait for its results.
+func (h *Health) run(ctx context.Context) (map[string]string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.results != nil && time.Since(h.checkedAt) < h.cacheTTL {
+		return h.results, h.ready
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.timeout)
+	defer cancel()
+	results := make(map[string]string, len(h.checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range h.checks {
+		wg.Go(func() {
+			result := "ok"
+			if err := check(ctx); err != nil {
+				slog.Warn("Readiness check failed", "check", name, "error", err)
+				result = "unavailable"
+			}
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	h.results, h.checkedAt = results, time.Now()
+	h.ready = !slices.Contains(slices.Collect(maps.Values(results)), "unavailable")
+	return h.results, h.ready
+}
+
+// Version answers with the build info of the binary.
+func (h *Health) Version(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, BuildVersion())
+}
+
+// BuildVersion reads the build info embedded by the go command. The
+// revision is only known for binaries built inside a checkout.
+func BuildVersion() Version {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return Version{Version: "unknown"}
+	}
+	v := Version{
+		Module:    info.Main.Path,
+		Version:   info.Main.Version,
+		GoVersion: info.GoVersion,
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			v.Revision = setting.Value
+		case "vcs.time":
+			v.Time = setting.Value
+		case "vcs.modified":
+			v.Modified = setting.Value == "true"
+		}
+	}
+	return v
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write health response", "error", err)
+	}
+}
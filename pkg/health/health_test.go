@@ -0,0 +1,67 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, mux *http.ServeMux, path string) (int, map[string]any) {
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode %s: %v\n", path, err)
+	}
+	return w.Code, body
+}
+
+func TestReadyz(t *testing.T) {
+	var calls atomic.Int32
+	var failing atomic.Bool
+	mux := http.NewServeMux()
+	New(&Config{
+		Checks: map[string]Check{
+			"storage": func(ctx context.Context) error {
+				calls.Add(1)
+				if failing.Load() {
+					return errors.New("connection refused")
+				}
+				return nil
+			},
+			"llm": func(ctx context.Context) error { return nil },
+		},
+		CacheTTL: 50 * time.Millisecond,
+	}).Register(mux)
+
+	if status, body := get(t, mux, "/readyz"); status != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("got %d %v, expect ready", status, body)
+	}
+	failing.Store(true)
+	if status, _ := get(t, mux, "/readyz"); status != http.StatusOK || calls.Load() != 1 {
+		t.Fatalf("got %d after %d checks, expect the cached result", status, calls.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	status, body := get(t, mux, "/readyz")
+	checks, _ := body["checks"].(map[string]any)
+	if status != http.StatusServiceUnavailable || checks["storage"] != "unavailable" || checks["llm"] != "ok" {
+		t.Fatalf("got %d %v, expect storage to be unavailable", status, body)
+	}
+}
+
+func TestHealthzAndVersion(t *testing.T) {
+	mux := http.NewServeMux()
+	New(&Config{}).Register(mux)
+	if status, body := get(t, mux, "/healthz"); status != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("got %d %v, expect ok", status, body)
+	}
+	if status, body := get(t, mux, "/version"); status != http.StatusOK || body["go_version"] == "" {
+		t.Fatalf("got %d %v, expect the go version", status, body)
+	}
+}
@@ -2,7 +2,58 @@ package llm
 
 import "context"
 
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+// Message is a previous turn of the conversation, oldest first.
+type Message struct {
+	Role string
+	Text string
+}
+
+type modelKey struct{}
+
+// WithModel asks the LLM to try model first for calls made with the returned
+// context, before the models it was configured with.
+func WithModel(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, modelKey{}, model)
+}
+
+// ModelFromContext returns the model set by WithModel, if any.
+func ModelFromContext(ctx context.Context) string {
+	model, _ := ctx.Value(modelKey{}).(string)
+	return model
+}
+
 type LLM interface {
-	GenerateContent(ctx context.Context, instruction string, question string) (string, error)
+	GenerateContent(ctx context.Context, instruction string, history []Message, question string) (string, error)
+	// Ping checks that the provider can be reached, without generating
+	// anything.
+	Ping(ctx context.Context) error
 	Close() error
 }
+
+// Usage is the number of tokens a call used with a model.
+type Usage struct {
+	Model        string
+	InputTokens  int64
+	OutputTokens int64
+}
+
+type usageKey struct{}
+
+// WithUsage makes the LLM pass the tokens used by calls made with the
+// returned context to fn, once per successful call.
+func WithUsage(ctx context.Context, fn func(Usage)) context.Context {
+	return context.WithValue(ctx, usageKey{}, fn)
+}
+
+// ReportUsage passes usage to the function set by WithUsage, if any. It is
+// called by LLM implementations.
+func ReportUsage(ctx context.Context, usage Usage) {
+	if fn, ok := ctx.Value(usageKey{}).(func(Usage)); ok {
+		fn(usage)
+	}
+}
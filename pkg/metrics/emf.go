@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// EMFNamespace is the CloudWatch namespace of the metrics written by EMF.
+const EMFNamespace = "LineBot"
+
+// EMF writes the bot's metrics as CloudWatch embedded metric format log
+// lines, which CloudWatch turns into metrics when they reach its logs. Each
+// Flush writes what was counted since the previous one, one line per series.
+type EMF struct {
+	w  io.Writer
+	mu sync.Mutex
+	// last holds the counter values and histogram bucket counts at the
+	// previous flush, by series.
+	last map[string][]float64
+}
+
+func NewEMF(w io.Writer) *EMF {
+	return &EMF{w: w, last: make(map[string][]float64)}
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// emfDistribution is a histogram in EMF, each value observed count times.
+type emfDistribution struct {
+	Values []float64 `json:"Values"`
+	Counts []float64 `json:"Counts"`
+}
+
+// Flush writes the bot's counters and histograms that changed since the
+// previous flush. Histograms are written as their bucket upper bounds, with
+// observations above the last bound counted in the last bucket.
+func (e *EMF) Flush() error {
+	families, err := Registry.Gather()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now().UnixMilli()
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, namespace+"_") {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			var value any
+			var unit string
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				delta := e.delta(name, m, []float64{m.GetCounter().GetValue()})
+				if delta == nil {
+					continue
+				}
+				value, unit = delta[0], "Count"
+			case dto.MetricType_HISTOGRAM:
+				d := e.distribution(name, m)
+				if d == nil {
+					continue
+				}
+				value, unit = d, "Seconds"
+			default:
+				continue
+			}
+			if err := e.write(now, name, unit, m.GetLabel(), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// delta returns how much each of values grew since the previous flush, nil
+// when none did.
+func (e *EMF) delta(name string, m *dto.Metric, values []float64) []float64 {
+	key := name
+	for _, label := range m.GetLabel() {
+		key += "\x00" + label.GetName() + "=" + label.GetValue()
+	}
+	last := e.last[key]
+	e.last[key] = values
+	var changed bool
+	deltas := make([]float64, len(values))
+	for i, v := range values {
+		if i < len(last) {
+			deltas[i] = v - last[i]
+		} else {
+			deltas[i] = v
+		}
+		changed = changed || deltas[i] != 0
+	}
+	if !changed {
+		return nil
+	}
+	return deltas
+}
+
+func (e *EMF) distribution(name string, m *dto.Metric) *emfDistribution {
+	h := m.GetHistogram()
+	buckets := h.GetBucket()
+	if len(buckets) == 0 {
+		return nil
+	}
+	// Cumulative counts are turned into counts per bucket.
+	counts := make([]float64, len(buckets))
+	var previous uint64
+	for i, b := range buckets {
+		counts[i] = float64(b.GetCumulativeCount() - previous)
+		previous = b.GetCumulativeCount()
+	}
+	counts[len(counts)-1] += float64(h.GetSampleCount() - previous)
+	deltas := e.delta(name, m, counts)
+	if deltas == nil {
+		return nil
+	}
+	d := &emfDistribution{}
+	for i, count := range deltas {
+		if count > 0 && !math.IsInf(buckets[i].GetUpperBound(), 1) {
+			d.Values = append(d.Values, buckets[i].GetUpperBound())
+			d.Counts = append(d.Counts, count)
+		}
+	}
+	return d
+}
+
+func (e *EMF) write(timestamp int64, name, unit string, labels []*dto.LabelPair, value any) error {
+	dimensions := []string{}
+	line := map[string]any{name: value}
+	for _, label := range labels {
+		dimensions = append(dimensions, label.GetName())
+		line[label.GetName()] = label.GetValue()
+	}
+	line["_aws"] = emfMetadata{
+		Timestamp: timestamp,
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  EMFNamespace,
+			Dimensions: [][]string{dimensions},
+			Metrics:    []emfMetric{{Name: name, Unit: unit}},
+		}},
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
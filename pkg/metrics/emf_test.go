@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func flush(t *testing.T, emf *EMF, buf *bytes.Buffer) map[string]map[string]any {
+	buf.Reset()
+	if err := emf.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v\n", err)
+	}
+	lines := make(map[string]map[string]any)
+	for line := range strings.Lines(buf.String()) {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("failed to decode %q: %v\n", line, err)
+		}
+		if m["model"] == "emf-test" {
+			for name := range m {
+				if strings.HasPrefix(name, namespace+"_") {
+					lines[name] = m
+				}
+			}
+		}
+	}
+	return lines
+}
+
+func TestEMF(t *testing.T) {
+	var buf bytes.Buffer
+	emf := NewEMF(&buf)
+	LLMRequests.WithLabelValues("test", "emf-test", OutcomeOK).Add(2)
+	LLMDuration.WithLabelValues("test", "emf-test").Observe(0.3)
+	LLMDuration.WithLabelValues("test", "emf-test").Observe(0.4)
+	LLMDuration.WithLabelValues("test", "emf-test").Observe(120)
+
+	lines := flush(t, emf, &buf)
+	requests := lines["linebot_llm_requests_total"]
+	if requests == nil || requests["linebot_llm_requests_total"] != 2.0 || requests["outcome"] != OutcomeOK {
+		t.Fatalf("got %v, expect 2 requests", requests)
+	}
+	directive := requests["_aws"].(map[string]any)["CloudWatchMetrics"].([]any)[0].(map[string]any)
+	if directive["Namespace"] != EMFNamespace || len(directive["Dimensions"].([]any)[0].([]any)) != 3 {
+		t.Fatalf("got directive %v, expect the namespace and three dimensions", directive)
+	}
+	duration, _ := lines["linebot_llm_request_duration_seconds"]["linebot_llm_request_duration_seconds"].(map[string]any)
+	if values, counts := duration["Values"].([]any), duration["Counts"].([]any); len(values) != 2 || values[0] != 0.5 || counts[0] != 2.0 || values[1] != 60.0 || counts[1] != 1.0 {
+		t.Fatalf("got duration %v, expect 2 in the 0.5s bucket and 1 in the last", duration)
+	}
+
+	if lines := flush(t, emf, &buf); len(lines) != 0 {
+		t.Fatalf("got %v, expect nothing without new observations", lines)
+	}
+	LLMRequests.WithLabelValues("test", "emf-test", OutcomeOK).Inc()
+	if lines := flush(t, emf, &buf); lines["linebot_llm_requests_total"]["linebot_llm_requests_total"] != 1.0 || len(lines) != 1 {
+		t.Fatalf("got %v, expect only the new request", lines)
+	}
+}
@@ -0,0 +1,86 @@
+// Package metrics defines the metrics of the bot. They are served in the
+// Prometheus text format by Handler, or written as CloudWatch embedded metric
+// format log lines by EMF where nothing scrapes the process.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "linebot"
+
+// Outcomes of the operations counted below.
+const (
+	OutcomeOK       = "ok"
+	OutcomeError    = "error"
+	OutcomeNotFound = "not_found"
+	OutcomeConflict = "conflict"
+)
+
+// slowBuckets fit requests that wait for an LLM, which may take a minute.
+var slowBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60}
+
+// Registry holds every metric of the bot and the Go runtime metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	CallbackRequests = newCounterVec("callback_requests_total", "Webhook requests, by status code.", "code")
+	CallbackDuration = newHistogramVec("callback_duration_seconds", "Time to handle a webhook request.", slowBuckets)
+
+	Events        = newCounterVec("events_total", "Webhook events, by type.", "type")
+	EventDuration = newHistogramVec("event_duration_seconds", "Time to handle a webhook event, by type.", slowBuckets, "type")
+	// HandlerDuration is labelled with the handler that answered a text
+	// message, generate when it went to the LLM.
+	HandlerDuration = newHistogramVec("handler_duration_seconds", "Time to answer a text message, by handler.", slowBuckets, "handler")
+
+	// LLMRequests counts every model tried, so fallbacks show as errors of
+	// one model followed by a request to the next.
+	LLMRequests = newCounterVec("llm_requests_total", "Requests to LLM models, by provider, model and outcome.", "provider", "model", "outcome")
+	LLMDuration = newHistogramVec("llm_request_duration_seconds", "Time of requests to LLM models, by provider and model.", slowBuckets, "provider", "model")
+	LLMTokens   = newCounterVec("llm_tokens_total", "Tokens used, by provider, model and direction (input or output).", "provider", "model", "direction")
+
+	StorageOperations = newCounterVec("storage_operations_total", "Storage operations, by operation and outcome.", "operation", "outcome")
+	StorageDuration   = newHistogramVec("storage_operation_duration_seconds", "Time of storage operations, by operation.", prometheus.DefBuckets, "operation")
+
+	LineAPIRequests = newCounterVec("line_api_requests_total", "Requests to the LINE API, by endpoint and status code.", "endpoint", "code")
+	LineAPIDuration = newHistogramVec("line_api_request_duration_seconds", "Time of requests to the LINE API, by endpoint.", prometheus.DefBuckets, "endpoint")
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: help}, labels)
+	Registry.MustRegister(c)
+	return c
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: namespace, Name: name, Help: help, Buckets: buckets}, labels)
+	Registry.MustRegister(h)
+	return h
+}
+
+// RegisterCache exports the hits and misses of the storage cache, read from
+// stats whenever the metrics are gathered.
+func RegisterCache(stats func() (hits, misses uint64)) {
+	Registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: namespace, Name: "cache_hits_total", Help: "Setting reads answered by the storage cache."},
+			func() float64 { hits, _ := stats(); return float64(hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: namespace, Name: "cache_misses_total", Help: "Setting reads the storage cache passed to the backing store."},
+			func() float64 { _, misses := stats(); return float64(misses) }),
+	)
+}
+
+// Handler serves Registry in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,74 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are exported with OTLP
+// over HTTP, configured with the standard OTEL_EXPORTER_OTLP_* variables, or
+// written to stdout for local debugging.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// Exporters.
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// Provider flushes and stops what Setup started.
+type Provider interface {
+	// ForceFlush exports the spans ended so far, as a Lambda function has to
+	// before it is frozen.
+	ForceFlush(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+}
+
+type noopProvider struct{}
+
+func (noopProvider) ForceFlush(context.Context) error { return nil }
+func (noopProvider) Shutdown(context.Context) error   { return nil }
+
+// Setup makes the global tracer provider export spans with exporter, and
+// leaves tracing disabled when it is empty. The service name is serviceName
+// unless OTEL_SERVICE_NAME is set, and sampling follows OTEL_TRACES_SAMPLER.
+func Setup(ctx context.Context, exporter, serviceName string) (Provider, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "":
+		return noopProvider{}, nil
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp, nil
+}
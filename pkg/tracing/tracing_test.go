@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup(t *testing.T) {
+	ctx := context.TODO()
+	if _, err := Setup(ctx, "jaeger", "test"); err == nil {
+		t.Fatal("expect an error for an unknown exporter")
+	}
+	p, err := Setup(ctx, "", "test")
+	if err != nil {
+		t.Fatalf("failed to set up disabled tracing: %v\n", err)
+	}
+	if _, span := otel.Tracer("test").Start(ctx, "disabled"); span.SpanContext().IsValid() {
+		t.Fatal("expect no span to be recorded when tracing is disabled")
+	}
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down disabled tracing: %v\n", err)
+	}
+
+	p, err = Setup(ctx, ExporterStdout, "test")
+	if err != nil {
+		t.Fatalf("failed to set up tracing: %v\n", err)
+	}
+	_, span := otel.Tracer("test").Start(ctx, "enabled")
+	if !span.SpanContext().IsValid() {
+		t.Fatal("expect spans to be recorded")
+	}
+	span.End()
+	if err := p.ForceFlush(ctx); err != nil {
+		t.Fatalf("failed to flush spans: %v\n", err)
+	}
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down tracing: %v\n", err)
+	}
+}